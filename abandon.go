@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// Abandonment. The UI fires POST /api/bookings/{id}/abandon (navigator.sendBeacon from
+// beforeunload, or the back button) when the user walks away from the payment page, and the
+// hold is released straight away instead of after the payment timeout.
+
+type AbandonRequest struct {
+	UserID int `json:"user_id"`
+}
+
+type AbandonResponse struct {
+	BookingID     string `json:"booking_id"`
+	Status        string `json:"status"`
+	ReleasedSeats []int  `json:"released_seats"`
+}
+
+// handleAbandonBooking serves POST /api/bookings/{id}/abandon. The caller must name the user
+// that holds the booking, so a guessed booking id isn't enough to release someone's seats.
+func handleAbandonBooking(w http.ResponseWriter, r *http.Request) {
+	bookingID := r.PathValue("id")
+
+	var req AbandonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Abandon requested", "component", "api", "booking_id", bookingID, "user_id", req.UserID, "ip", r.RemoteAddr)
+
+	released, err := releaseBookingHold(r.Context(), bookingID, req.UserID)
+	if errors.Is(err, errCheckoutNotClosed) {
+		slog.WarnContext(r.Context(), "Gateway refused to close checkout", "component", "api", "booking_id", bookingID, "provider", paymentProvider.Name(), "error", err)
+		http.Error(w, "The checkout couldn't be closed at the payment gateway; it may have been paid", http.StatusBadGateway)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to abandon booking", "component", "api", "booking_id", bookingID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(released) == 0 {
+		http.Error(w, "No pending seats found", http.StatusNotFound)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Booking abandoned", "component", "api", "booking_id", bookingID, "user_id", req.UserID, "seats", released)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AbandonResponse{
+		BookingID:     bookingID,
+		Status:        "ABANDONED",
+		ReleasedSeats: released,
+	})
+}
+
+// releaseBookingHold closes the booking's checkout at the gateway, returns its PENDING seats to
+// inventory the same way the reaper does, then drops its Redis locks. A checkout the gateway
+// won't close (it may have been paid) fails with errCheckoutNotClosed and the hold is kept. A
+// webhook that is processing the booking right now holds the rows, so we wait for it and find
+// nothing left to release.
+func releaseBookingHold(ctx context.Context, bookingID string, userID int) ([]int, error) {
+	return releaseBookingHoldFor(ctx, bookingID, userID, "hold released")
+}
+
+// releaseBookingHoldFor is releaseBookingHold cancelling the booking for reason.
+func releaseBookingHoldFor(ctx context.Context, bookingID string, userID int, reason string) ([]int, error) {
+	if err := closeBookingCheckout(ctx, bookingID, userID); err != nil {
+		return nil, err
+	}
+
+	var seatIDs []int
+	var lockKeys []string
+	err := runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT id, show_id FROM seats
+			WHERE payment_session_id = ? AND user_id = ? AND payment_status = 'PENDING' AND is_reserved = 1
+			FOR UPDATE
+		`, bookingID, userID)
+		if err != nil {
+			return fmt.Errorf("failed to query held seats: %w", err)
+		}
+		defer rows.Close()
+
+		seatIDs, lockKeys = nil, nil
+		for rows.Next() {
+			var seatID, showID int
+			if err := rows.Scan(&seatID, &showID); err != nil {
+				return fmt.Errorf("failed to scan seat: %w", err)
+			}
+			seatIDs = append(seatIDs, seatID)
+			lockKeys = append(lockKeys, seatLockKey(showID, seatID))
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating held seats: %w", err)
+		}
+		if len(seatIDs) == 0 {
+			return nil
+		}
+
+		if err := releaseSeatRows(ctx, tx, seatIDs, HoldReleased); err != nil {
+			return fmt.Errorf("failed to release seats: %w", err)
+		}
+		return transitionBooking(ctx, tx, bookingID, BookingCancelled, reason)
+	})
+	if err != nil || len(seatIDs) == 0 {
+		return nil, err
+	}
+
+	lockProvider.Release(ctx, lockKeys, seatLockOwner(int64(userID)))
+	redlock.Unlock(ctx, redlockSeatKeys(seatIDs), bookingID)
+
+	return seatIDs, nil
+}
+
+// releaseSeatRows returns seats to inventory, clearing the holder the way the reaper does, and
+// records it in the event store as event.
+func releaseSeatRows(ctx context.Context, tx *sql.Tx, seatIDs []int, event string) error {
+	if err := appendSeatEvents(ctx, tx, event, seatIDs); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		UPDATE seats
+		SET is_reserved = 0,
+		    payment_status = 'FAILED',
+		    user_id = NULL,
+		    reserved_until = NULL,
+		    payment_timeout = NULL,
+		    payment_session_id = NULL
+		WHERE id IN (%s)
+	`, generatePlaceholders(len(seatIDs))), sliceToInterface(seatIDs)...)
+	return err
+}
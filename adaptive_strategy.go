@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// The "auto" method picks a strategy per request from the show's recent conflict rate:
+// optimistic while conflicts are rare, pessimistic row locks once they are common, and the
+// Redis lock when the show is hot enough that even row lock waits pile up. Thresholds and
+// half-life are in strategyConfig.Auto.
+
+type showContention struct {
+	rate    float64 // decayed fraction of attempts that hit contention
+	updated time.Time
+}
+
+// ContentionTracker keeps an exponentially decaying conflict rate per show, fed by every
+// booking attempt regardless of strategy.
+type ContentionTracker struct {
+	mu    sync.Mutex
+	shows map[int]*showContention
+	alpha float64
+}
+
+func NewContentionTracker() *ContentionTracker {
+	return &ContentionTracker{shows: make(map[int]*showContention), alpha: 0.1}
+}
+
+var contentionTracker = NewContentionTracker()
+
+// decayed returns the show's rate faded towards zero for the time since its last update, so
+// a show that was hot an hour ago starts out optimistic again.
+func (c *ContentionTracker) decayed(s *showContention, now time.Time) float64 {
+	elapsed := now.Sub(s.updated)
+	return s.rate * math.Pow(0.5, float64(elapsed)/float64(strategyConfig.Auto.HalfLife))
+}
+
+func (c *ContentionTracker) Record(showID int, conflict bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	s, ok := c.shows[showID]
+	if !ok {
+		s = &showContention{updated: now}
+		c.shows[showID] = s
+	}
+
+	sample := 0.0
+	if conflict {
+		sample = 1.0
+	}
+	s.rate = c.decayed(s, now)*(1-c.alpha) + sample*c.alpha
+	s.updated = now
+}
+
+func (c *ContentionTracker) Rate(showID int) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.shows[showID]
+	if !ok {
+		return 0
+	}
+	return c.decayed(s, time.Now())
+}
+
+func (c *ContentionTracker) ChooseMethod(showID int) string {
+	rate := c.Rate(showID)
+	method := "current"
+	switch {
+	case rate < strategyConfig.Auto.OptimisticMaxConflictRate:
+		method = "optimistic"
+	case rate < strategyConfig.Auto.PessimisticMaxConflictRate:
+		method = "pessimistic"
+	}
+	slog.Info("Chose strategy", "component", "auto", "show_id", showID, "conflict_rate", rate, "method", method)
+	return method
+}
+
+// isContentionError separates "another booking got in the way" from plain unavailability
+// or infrastructure errors.
+func isContentionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, ErrSeatsLocked) ||
+		errors.Is(err, ErrOptimisticConflict) ||
+		isLockNotAvailable(err) ||
+		isLockContention(err)
+}
@@ -1,7 +0,0 @@
--- Add version column to seats table
--- ALTER TABLE seats ADD COLUMN version INT NOT NULL DEFAULT 1;
-
--- Add version column to any other tables that might exist
--- ALTER TABLE shows ADD COLUMN version INT NOT NULL DEFAULT 1;
--- ALTER TABLE users ADD COLUMN version INT NOT NULL DEFAULT 1;
--- ALTER TABLE bookings ADD COLUMN version INT NOT NULL DEFAULT 1; 
\ No newline at end of file
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// requireAdmin guards admin endpoints with the bearer token in ADMIN_TOKEN. When the variable
+// is unset the admin endpoints are disabled entirely.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			http.Error(w, "Admin API disabled", http.StatusNotFound)
+			return
+		}
+
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			slog.WarnContext(r.Context(), "Unauthorized request", "component", "admin", "path", r.URL.Path, "ip", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+type SeatDebugRow struct {
+	ID             int        `json:"id"`
+	ShowID         int        `json:"show_id"`
+	SeatNumber     string     `json:"seat_number"`
+	IsReserved     bool       `json:"is_reserved"`
+	UserID         *int64     `json:"user_id"`
+	PaymentStatus  string     `json:"payment_status"`
+	PaymentTimeout *time.Time `json:"payment_timeout"`
+	Version        int        `json:"version"`
+	AllocationID   *int64     `json:"allocation_id"`
+	FenceToken     int64      `json:"fence_token"`
+}
+
+type LockDebugState struct {
+	Node          string `json:"node"`
+	Key           string `json:"key"`
+	Value         string `json:"value"`
+	TTLMillis     int64  `json:"ttl_ms"`
+	OwnedByBooker bool   `json:"owned_by_booking"`
+}
+
+type BookingTransitionEntry struct {
+	ID        int64     `json:"id"`
+	FromState string    `json:"from_state"`
+	ToState   string    `json:"to_state"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type PaymentEventEntry struct {
+	ID          int64     `json:"id"`
+	Status      string    `json:"status"`
+	EventID     string    `json:"event_id,omitempty"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+type OutboxEventEntry struct {
+	ID          int64           `json:"id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload"`
+	CreatedAt   time.Time       `json:"created_at"`
+	PublishedAt *time.Time      `json:"published_at"`
+}
+
+// BookingDebugBundle is everything recorded about a booking. Audit holds the seat audit
+// entries of its seats, reaper releases among them (source "reaper"); PaymentEvents the
+// webhook deliveries applied to it; OutboxEvents the lifecycle events it emitted.
+type BookingDebugBundle struct {
+	BookingID         string                   `json:"booking_id"`
+	State             BookingState             `json:"state"`
+	Status            string                   `json:"status"`
+	RedirectURL       *string                  `json:"payment_redirect_url"`
+	ProviderSessionID *string                  `json:"provider_session_id"`
+	Seats             []SeatDebugRow           `json:"seats"`
+	Locks             []LockDebugState         `json:"locks"`
+	Transitions       []BookingTransitionEntry `json:"transitions"`
+	Audit             []SeatAuditEntry         `json:"audit"`
+	PaymentEvents     []PaymentEventEntry      `json:"payment_events"`
+	OutboxEvents      []OutboxEventEntry       `json:"outbox_events"`
+	GeneratedAt       time.Time                `json:"generated_at"`
+}
+
+// debugBundleLimit caps each history in a debug bundle.
+const debugBundleLimit = 500
+
+// handleBookingDebug serves GET /admin/bookings/{id}/debug.
+func handleBookingDebug(w http.ResponseWriter, r *http.Request) {
+	bookingID := r.PathValue("id")
+	slog.InfoContext(r.Context(), "Debug bundle requested", "component", "admin", "booking_id", bookingID, "ip", r.RemoteAddr)
+
+	bundle, err := buildBookingDebugBundle(bookingID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to build debug bundle", "component", "admin", "booking_id", bookingID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if bundle.State == "" {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(bundle)
+}
+
+func buildBookingDebugBundle(bookingID string) (*BookingDebugBundle, error) {
+	bundle := &BookingDebugBundle{
+		BookingID:   bookingID,
+		Status:      "NOT_FOUND",
+		Seats:       []SeatDebugRow{},
+		Locks:       []LockDebugState{},
+		GeneratedAt: time.Now(),
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, show_id, seat_number, is_reserved, user_id, payment_status,
+		       payment_timeout, version, allocation_id, fence_token
+		FROM seats
+		WHERE payment_session_id = ?
+		ORDER BY id
+	`, bookingID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load seats: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var seat SeatDebugRow
+		var userID sql.NullInt64
+		var paymentTimeout sql.NullTime
+		var allocationID sql.NullInt64
+		if err := rows.Scan(&seat.ID, &seat.ShowID, &seat.SeatNumber, &seat.IsReserved, &userID, &seat.PaymentStatus,
+			&paymentTimeout, &seat.Version, &allocationID, &seat.FenceToken); err != nil {
+			return nil, fmt.Errorf("failed to scan seat: %w", err)
+		}
+		if userID.Valid {
+			seat.UserID = &userID.Int64
+		}
+		if paymentTimeout.Valid {
+			seat.PaymentTimeout = &paymentTimeout.Time
+		}
+		if allocationID.Valid {
+			seat.AllocationID = &allocationID.Int64
+		}
+		bundle.Seats = append(bundle.Seats, seat)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating seat rows: %w", err)
+	}
+
+	// Same status as the public status endpoint.
+	bundle.State, bundle.Status, err = bookingStatus(ctx, db, bookingID)
+	if err != nil {
+		return nil, err
+	}
+	checkout, err := loadBookingCheckout(ctx, db, bookingID)
+	if err != nil {
+		return nil, err
+	}
+	if checkout.RedirectURL.Valid {
+		bundle.RedirectURL = &checkout.RedirectURL.String
+	}
+	if checkout.ProviderSessionID.Valid {
+		bundle.ProviderSessionID = &checkout.ProviderSessionID.String
+	}
+
+	for _, seat := range bundle.Seats {
+		ownerValue := ""
+		if seat.UserID != nil {
+			ownerValue = seatLockOwner(*seat.UserID)
+		}
+		key := seatLockKey(seat.ShowID, seat.ID)
+		if state, held, err := lockProvider.Inspect(ctx, key); err != nil {
+			slog.Error("Failed to read lock", "component", "admin", "node", lockProvider.Name(), "key", key, "error", err)
+		} else if held {
+			bundle.Locks = append(bundle.Locks, LockDebugState{
+				Node:          lockProvider.Name(),
+				Key:           key,
+				Value:         state.Owner,
+				TTLMillis:     state.TTL.Milliseconds(),
+				OwnedByBooker: state.Owner == ownerValue,
+			})
+		}
+		for i, client := range redlock.clients {
+			node := fmt.Sprintf("redlock-%d", i)
+			if lock, ok := inspectLock(client, node, redlockSeatKeys([]int{seat.ID})[0], bookingID); ok {
+				bundle.Locks = append(bundle.Locks, lock)
+			}
+		}
+	}
+
+	if bundle.Transitions, err = bookingTransitionLog(bookingID); err != nil {
+		return nil, err
+	}
+	bundle.Audit, err = querySeatAudit(ctx, `
+		SELECT id, seat_id, show_id, user_id, booking_id, old_status, new_status, source, strategy,
+		       request_id, changed_at
+		FROM seat_audit
+		WHERE booking_id = ?
+		ORDER BY id
+		LIMIT ?
+	`, bookingID, debugBundleLimit)
+	if err != nil {
+		return nil, err
+	}
+	if bundle.PaymentEvents, err = bookingPaymentEvents(bookingID); err != nil {
+		return nil, err
+	}
+	if bundle.OutboxEvents, err = bookingOutboxEvents(bookingID); err != nil {
+		return nil, err
+	}
+
+	return bundle, nil
+}
+
+func bookingTransitionLog(bookingID string) ([]BookingTransitionEntry, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, from_state, to_state, reason, created_at FROM booking_transitions
+		WHERE booking_id = ?
+		ORDER BY id
+		LIMIT ?
+	`, bookingID, debugBundleLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load transitions: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []BookingTransitionEntry{}
+	for rows.Next() {
+		var e BookingTransitionEntry
+		if err := rows.Scan(&e.ID, &e.FromState, &e.ToState, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan transition: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func bookingPaymentEvents(bookingID string) ([]PaymentEventEntry, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, status, event_id, processed_at FROM payment_webhook_events
+		WHERE session_id = ?
+		ORDER BY id
+		LIMIT ?
+	`, bookingID, debugBundleLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load payment events: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []PaymentEventEntry{}
+	for rows.Next() {
+		var e PaymentEventEntry
+		if err := rows.Scan(&e.ID, &e.Status, &e.EventID, &e.ProcessedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan payment event: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func bookingOutboxEvents(bookingID string) ([]OutboxEventEntry, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, type, payload, created_at, published_at FROM outbox_events
+		WHERE booking_id = ?
+		ORDER BY id
+		LIMIT ?
+	`, bookingID, debugBundleLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load outbox events: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []OutboxEventEntry{}
+	for rows.Next() {
+		var e OutboxEventEntry
+		var payload string
+		var publishedAt sql.NullTime
+		if err := rows.Scan(&e.ID, &e.Type, &payload, &e.CreatedAt, &publishedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan outbox event: %w", err)
+		}
+		e.Payload = json.RawMessage(payload)
+		if publishedAt.Valid {
+			e.PublishedAt = &publishedAt.Time
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func inspectLock(client redis.UniversalClient, node, key, ownerValue string) (LockDebugState, bool) {
+	value, err := client.Get(ctx, key).Result()
+	if err != nil {
+		if err != redis.Nil {
+			slog.Error("Failed to read lock", "component", "admin", "node", node, "key", key, "error", err)
+		}
+		return LockDebugState{}, false
+	}
+	ttl, _ := client.PTTL(ctx, key).Result()
+	return LockDebugState{
+		Node:          node,
+		Key:           key,
+		Value:         value,
+		TTLMillis:     ttl.Milliseconds(),
+		OwnedByBooker: value == ownerValue,
+	}, true
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Lock overview. GET /admin/locks lists the seat_lock keys in Redis right now, with owner and
+// TTL, next to what the database says about each seat, so operators can see contention and
+// wedged seats without redis-cli. Each lock is classified:
+//   - held: the seat is held (PENDING, REVIEW or REFUND_PENDING) by the lock's owner
+//   - hold_expired: the same, but the hold's payment_timeout has passed and the reaper hasn't
+//     got to it yet
+//   - other_owner: the seat is held by someone other than the lock's owner
+//   - stale: the seat is free, paid, blocked or gone; the lock reconciler would delete it
+// holds_without_lock lists live holds with no lock at all. ?show_id= narrows it to one show;
+// with hash tagged keys (lock_striping.go) only that show's keys are scanned, otherwise every
+// key is and the rest filtered out. Only the redis lock provider can be listed.
+
+const (
+	defaultAdminLocksLimit = 500
+	maxAdminLocksLimit     = 5000
+)
+
+const (
+	LockHeld        = "held"
+	LockHoldExpired = "hold_expired"
+	LockOtherOwner  = "other_owner"
+	LockStale       = "stale"
+)
+
+type AdminLock struct {
+	Key       string `json:"key"`
+	SeatID    int    `json:"seat_id"`
+	ShowID    int    `json:"show_id,omitempty"`
+	Owner     string `json:"owner"`
+	TTLMillis int64  `json:"ttl_ms"`
+	Status    string `json:"status"`
+	// The seat as the database has it, missing when the seat is gone.
+	Seat *AdminLockSeat `json:"seat,omitempty"`
+}
+
+type AdminLockSeat struct {
+	PaymentStatus  string       `json:"payment_status"`
+	IsReserved     bool         `json:"is_reserved"`
+	UserID         *int64       `json:"user_id,omitempty"`
+	BookingID      string       `json:"booking_id,omitempty"`
+	BookingState   BookingState `json:"booking_state,omitempty"`
+	PaymentTimeout *time.Time   `json:"payment_timeout,omitempty"`
+}
+
+type AdminLocksResponse struct {
+	ShowID           int            `json:"show_id,omitempty"`
+	Total            int            `json:"total"`
+	ByStatus         map[string]int `json:"by_status"`
+	ByShow           map[int]int    `json:"by_show"`
+	Locks            []AdminLock    `json:"locks"`
+	Truncated        bool           `json:"truncated"`
+	HoldsWithoutLock []int          `json:"holds_without_lock"`
+}
+
+// handleAdminLocks serves GET /admin/locks (?show_id=, ?status=, ?limit=).
+func handleAdminLocks(w http.ResponseWriter, r *http.Request) {
+	if lockProvider.Name() != "redis" {
+		http.Error(w, "Seat locks are kept by "+lockProvider.Name()+", which can't be listed", http.StatusNotImplemented)
+		return
+	}
+
+	query := r.URL.Query()
+	showID := 0
+	if v := query.Get("show_id"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid show_id", http.StatusBadRequest)
+			return
+		}
+		showID = n
+	}
+	status := query.Get("status")
+	switch status {
+	case "", LockHeld, LockHoldExpired, LockOtherOwner, LockStale:
+	default:
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	limit := defaultAdminLocksLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxAdminLocksLimit)
+	}
+
+	resp, err := listAdminLocks(r.Context(), showID, status, limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list locks", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func listAdminLocks(ctx context.Context, showID int, status string, limit int) (*AdminLocksResponse, error) {
+	locks, err := scanSeatLocks(ctx, seatLockPattern(showID))
+	if err != nil {
+		return nil, err
+	}
+	seatIDs := make([]int, len(locks))
+	for i, lock := range locks {
+		seatIDs[i] = lock.seatID
+	}
+	seats, shows, err := adminLockSeats(ctx, seatIDs)
+	if err != nil {
+		return nil, err
+	}
+	ttls, err := lockTTLs(ctx, locks)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &AdminLocksResponse{
+		ShowID:   showID,
+		ByStatus: make(map[string]int),
+		ByShow:   make(map[int]int),
+		Locks:    []AdminLock{},
+	}
+	now := time.Now()
+	for i, entry := range locks {
+		lock := AdminLock{Key: entry.key, SeatID: entry.seatID, Owner: entry.owner, TTLMillis: ttls[i], Seat: seats[entry.seatID]}
+		lock.ShowID = shows[entry.seatID]
+		if showID != 0 && lock.ShowID != showID {
+			continue
+		}
+		lock.Status = classifyAdminLock(lock, now)
+
+		resp.Total++
+		resp.ByStatus[lock.Status]++
+		if lock.ShowID != 0 {
+			resp.ByShow[lock.ShowID]++
+		}
+		if status == "" || lock.Status == status {
+			resp.Locks = append(resp.Locks, lock)
+		}
+	}
+	sort.Slice(resp.Locks, func(i, j int) bool {
+		if resp.Locks[i].ShowID != resp.Locks[j].ShowID {
+			return resp.Locks[i].ShowID < resp.Locks[j].ShowID
+		}
+		return resp.Locks[i].SeatID < resp.Locks[j].SeatID
+	})
+	if len(resp.Locks) > limit {
+		resp.Locks = resp.Locks[:limit]
+		resp.Truncated = true
+	}
+
+	noLock, err := holdsWithoutLock(ctx, showID)
+	if err != nil {
+		return nil, err
+	}
+	resp.HoldsWithoutLock = noLock[:min(len(noLock), maxReportedSeats)]
+	if resp.HoldsWithoutLock == nil {
+		resp.HoldsWithoutLock = []int{}
+	}
+	return resp, nil
+}
+
+// seatLockPattern is the SCAN pattern for the seat locks of a show, or of all shows with
+// showID 0. Without hash tags a key doesn't say its show and all of them are scanned.
+func seatLockPattern(showID int) string {
+	switch {
+	case showID == 0:
+		return "seat_lock:*"
+	case strategyConfig.Redis.StripeBucket > 0:
+		return fmt.Sprintf("seat_lock:{%d:*", showID)
+	case redisCluster():
+		return fmt.Sprintf("seat_lock:{%d}:*", showID)
+	default:
+		return "seat_lock:*"
+	}
+}
+
+func classifyAdminLock(lock AdminLock, now time.Time) string {
+	seat := lock.Seat
+	if seat == nil || !seat.IsReserved || seat.PaymentStatus == "FAILED" || seat.PaymentStatus == "COMPLETED" || seat.PaymentStatus == "BLOCKED" {
+		return LockStale
+	}
+	if seat.UserID == nil || seatLockOwner(*seat.UserID) != lock.Owner {
+		return LockOtherOwner
+	}
+	if seat.PaymentStatus == "PENDING" && seat.PaymentTimeout != nil && seat.PaymentTimeout.Before(now) {
+		return LockHoldExpired
+	}
+	return LockHeld
+}
+
+// adminLockSeats reads the seats and their bookings' states, 500 at a time.
+func adminLockSeats(ctx context.Context, seatIDs []int) (map[int]*AdminLockSeat, map[int]int, error) {
+	seats := make(map[int]*AdminLockSeat, len(seatIDs))
+	shows := make(map[int]int, len(seatIDs))
+	for start := 0; start < len(seatIDs); start += 500 {
+		chunk := seatIDs[start:min(start+500, len(seatIDs))]
+		rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+			SELECT s.id, s.show_id, s.payment_status, s.is_reserved, s.user_id, s.payment_session_id, b.state, s.payment_timeout
+			FROM seats s LEFT JOIN bookings b ON b.id = s.payment_session_id
+			WHERE s.id IN (%s)
+		`, generatePlaceholders(len(chunk))), sliceToInterface(chunk)...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read locked seats: %w", err)
+		}
+		for rows.Next() {
+			var seatID, showID int
+			var seat AdminLockSeat
+			var userID sql.NullInt64
+			var bookingID, state sql.NullString
+			var timeout sql.NullTime
+			if err := rows.Scan(&seatID, &showID, &seat.PaymentStatus, &seat.IsReserved, &userID, &bookingID, &state, &timeout); err != nil {
+				rows.Close()
+				return nil, nil, fmt.Errorf("failed to scan locked seat: %w", err)
+			}
+			if userID.Valid {
+				seat.UserID = &userID.Int64
+			}
+			if timeout.Valid {
+				seat.PaymentTimeout = &timeout.Time
+			}
+			seat.BookingID = bookingID.String
+			seat.BookingState = BookingState(state.String)
+			seats[seatID] = &seat
+			shows[seatID] = showID
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, fmt.Errorf("failed to read locked seats: %w", err)
+		}
+	}
+	return seats, shows, nil
+}
+
+// lockTTLs reads the locks' remaining TTLs in milliseconds in one pipeline, 0 for those gone
+// in the meantime.
+func lockTTLs(ctx context.Context, locks []seatLockEntry) ([]int64, error) {
+	cmds, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, lock := range locks {
+			pipe.PTTL(ctx, lock.key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to read lock TTLs: %w", err)
+	}
+	ttls := make([]int64, len(locks))
+	for i, cmd := range cmds {
+		ttls[i] = cmd.(*redis.DurationCmd).Val().Milliseconds()
+	}
+	return ttls, nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Asynchronous booking. With async_booking.enabled, /api/book doesn't book: it appends the
+// request to the Redis stream async_booking.stream and answers 202 ACCEPTED with the booking
+// id straight away. async_booking.workers workers per instance in the primary region read the
+// stream through one consumer group and run BookSeats for each request. Until the booking has
+// a row, /api/booking-status answers from a Redis key the workers keep: ACCEPTED while
+// queued, PROCESSING, then FAILED or TRY_AGAIN when it didn't get its seats. A booking that
+// did is looked up as usual.
+//
+// A request a worker took but didn't acknowledge, because its instance died, is claimed by
+// another worker once it has been pending for twice server.request_timeout. If the booking
+// got its hold before the worker died, it isn't booked again.
+//
+// A booking that fails for a transient reason (the database or Redis unreachable, a deadlock,
+// a busy show) is tried again up to async_booking.max_attempts times, async_booking.retry_backoff
+// apart and doubling. One that still fails, whose job can't be read, that panics, or that has
+// been claimed more than async_booking.max_deliveries times goes to the dead-letter stream,
+// see async_booking_dead_letters.go.
+
+const (
+	asyncBookingGroup     = "booking_workers"
+	asyncBookingReadBlock = 5 * time.Second
+	// asyncBookingRetryPause keeps a worker from spinning while Redis is unreachable.
+	asyncBookingRetryPause = 1 * time.Second
+)
+
+// Statuses of a booking that has no row yet.
+const (
+	AsyncBookingAccepted   = "ACCEPTED"
+	AsyncBookingProcessing = "PROCESSING"
+)
+
+// AsyncBookingConfig switches /api/book to queued bookings, see async_booking.go.
+type AsyncBookingConfig struct {
+	Enabled       bool     `json:"enabled"`        // ASYNC_BOOKING_ENABLED
+	Stream        string   `json:"stream"`         // ASYNC_BOOKING_STREAM, the Redis stream requests are queued on
+	Workers       int      `json:"workers"`        // ASYNC_BOOKING_WORKERS, bookings run at once per instance
+	ResultTTL     Duration `json:"result_ttl"`     // ASYNC_BOOKING_RESULT_TTL, how long the status of a booking without a row is kept
+	MaxAttempts   int      `json:"max_attempts"`   // ASYNC_BOOKING_MAX_ATTEMPTS, tries of a booking failing for a transient reason
+	RetryBackoff  Duration `json:"retry_backoff"`  // ASYNC_BOOKING_RETRY_BACKOFF, before the second try, doubling after
+	MaxDeliveries int      `json:"max_deliveries"` // ASYNC_BOOKING_MAX_DELIVERIES, workers a job may be taken by before it is dead-lettered
+}
+
+type asyncBookingJob struct {
+	Request   BookingRequest `json:"request"`
+	RequestID string         `json:"request_id"`
+	Quota     *bookingQuota  `json:"quota,omitempty"` // the partner quota the request was charged against
+}
+
+func asyncBookingEnabled() bool {
+	return strategyConfig.AsyncBooking.Enabled
+}
+
+func asyncBookingStatusKey(bookingID string) string {
+	return "async_booking:" + bookingID
+}
+
+// enqueueBooking queues req for the workers as bookingID.
+func enqueueBooking(ctx context.Context, bookingID string, req BookingRequest) error {
+	quota, _ := bookingQuotaFromContext(ctx)
+	job, err := json.Marshal(asyncBookingJob{Request: req, RequestID: requestIDFromContext(ctx), Quota: quota})
+	if err != nil {
+		return fmt.Errorf("failed to encode booking request: %w", err)
+	}
+	// The status first: a worker may pick the request up before XADD returns.
+	if err := setAsyncBookingStatus(ctx, bookingID, AsyncBookingAccepted); err != nil {
+		return err
+	}
+	err = rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: strategyConfig.AsyncBooking.Stream,
+		Values: map[string]interface{}{"booking_id": bookingID, "job": string(job)},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to queue booking: %w", err)
+	}
+	return nil
+}
+
+func setAsyncBookingStatus(ctx context.Context, bookingID, status string) error {
+	ttl := time.Duration(strategyConfig.AsyncBooking.ResultTTL)
+	if err := rdb.Set(ctx, asyncBookingStatusKey(bookingID), status, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to record booking status: %w", err)
+	}
+	return nil
+}
+
+// asyncBookingStatus returns the status of a queued booking without a row, "" when there is
+// none.
+func asyncBookingStatus(ctx context.Context, bookingID string) (string, error) {
+	status, err := rdb.Get(ctx, asyncBookingStatusKey(bookingID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load booking status: %w", err)
+	}
+	return status, nil
+}
+
+// bookingFailureStatus is the status a booking that failed with err is reported with.
+func bookingFailureStatus(err error) string {
+	if errors.Is(err, ErrDatabaseUnavailable) || errors.Is(err, ErrShowBusy) {
+		return "TRY_AGAIN"
+	}
+	if errors.Is(err, ErrSeatLimitExceeded) {
+		return "SEAT_LIMIT_EXCEEDED"
+	}
+	return "FAILED"
+}
+
+func runAsyncBookingWorkers() error {
+	cfg := strategyConfig.AsyncBooking
+	err := rdb.XGroupCreateMkStream(ctx, cfg.Stream, asyncBookingGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create booking worker group: %w", err)
+	}
+
+	slog.Info("Starting booking workers", "component", "async_booking", "stream", cfg.Stream, "workers", cfg.Workers)
+	errCh := make(chan error, cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		consumer := fmt.Sprintf("%s:%d", leader.id, i)
+		go func() {
+			errCh <- runAsyncBookingWorker(consumer)
+		}()
+	}
+	return <-errCh
+}
+
+func runAsyncBookingWorker(consumer string) error {
+	stream := strategyConfig.AsyncBooking.Stream
+	claimAfter := 2 * time.Duration(strategyConfig.Server.RequestTimeout)
+
+	for {
+		// Other regions don't book, their requests are waiting for the primary.
+		if !isPrimaryRegion() {
+			time.Sleep(asyncBookingReadBlock)
+			continue
+		}
+
+		messages, _, err := rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    asyncBookingGroup,
+			Consumer: consumer,
+			MinIdle:  claimAfter,
+			Start:    "0-0",
+			Count:    1,
+		}).Result()
+		claimed := len(messages) > 0
+		if err == nil && !claimed {
+			var streams []redis.XStream
+			streams, err = rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    asyncBookingGroup,
+				Consumer: consumer,
+				Streams:  []string{stream, ">"},
+				Count:    1,
+				Block:    asyncBookingReadBlock,
+			}).Result()
+			for _, s := range streams {
+				messages = append(messages, s.Messages...)
+			}
+		}
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to read booking requests", "component", "async_booking", "consumer", consumer, "error", err)
+			time.Sleep(asyncBookingRetryPause)
+			continue
+		}
+
+		for _, message := range messages {
+			deliveries := int64(1)
+			if claimed {
+				deliveries = asyncBookingDeliveries(stream, message.ID)
+			}
+			if !processAsyncBooking(message, deliveries) {
+				continue
+			}
+			if err := rdb.XAck(ctx, stream, asyncBookingGroup, message.ID).Err(); err != nil {
+				slog.Error("Failed to acknowledge booking request", "component", "async_booking", "message_id", message.ID, "error", err)
+			}
+		}
+	}
+}
+
+// asyncBookingDeliveries is how many times the message has been taken by a worker. Unknown
+// counts as the first time.
+func asyncBookingDeliveries(stream, messageID string) int64 {
+	pending, err := rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  asyncBookingGroup,
+		Start:  messageID,
+		End:    messageID,
+		Count:  1,
+	}).Result()
+	if err != nil || len(pending) == 0 {
+		return 1
+	}
+	return pending[0].RetryCount
+}
+
+// processAsyncBooking books one queued request, retrying transient failures, and records how
+// it went. deliveries counts the workers that have taken it, this one included. It reports
+// whether the request is done with; one that isn't stays pending for another worker.
+func processAsyncBooking(message redis.XMessage, deliveries int64) (done bool) {
+	cfg := strategyConfig.AsyncBooking
+	bookingID, _ := message.Values["booking_id"].(string)
+	payload, _ := message.Values["job"].(string)
+	var job asyncBookingJob
+	if err := json.Unmarshal([]byte(payload), &job); err != nil || bookingID == "" {
+		return deadLetterBooking(ctx, message, fmt.Sprintf("invalid booking job: %v", err), deliveries)
+	}
+
+	reqCtx := withSeatAudit(serverCtx, "api")
+	if job.RequestID != "" {
+		reqCtx = context.WithValue(reqCtx, requestIDContextKey{}, job.RequestID)
+		reqCtx = withLogFields(reqCtx, "request_id", job.RequestID)
+	}
+	reqCtx = withLogFields(reqCtx, "booking_id", bookingID, "user_id", job.Request.UserID)
+	reqCtx = withBookingCallback(reqCtx, job.Request.CallbackURL)
+	if job.Quota != nil {
+		reqCtx = context.WithValue(reqCtx, bookingQuotaContextKey{}, job.Quota)
+	}
+
+	// A job that panics would take every worker that picks it up down with it.
+	defer func() {
+		if reportPanic(reqCtx, "async_booking", recover()) {
+			done = failAsyncBooking(reqCtx, message, bookingID, "FAILED", "panicked while booking", deliveries)
+		}
+	}()
+	if deliveries > int64(cfg.MaxDeliveries) {
+		reason := fmt.Sprintf("taken by %d workers without finishing", deliveries-1)
+		return failAsyncBooking(reqCtx, message, bookingID, "FAILED", reason, deliveries)
+	}
+
+	backoff := time.Duration(cfg.RetryBackoff)
+	for attempt := 1; ; attempt++ {
+		err := runAsyncBooking(reqCtx, bookingID, job, message.ID)
+		if err == nil {
+			return true
+		}
+		status := bookingFailureStatus(err)
+		if !isTransientBookingError(err) {
+			slog.ErrorContext(reqCtx, "Failed queued booking", "component", "async_booking", "status", status, "error", err)
+			endAsyncBooking(context.WithoutCancel(reqCtx), bookingID, status)
+			return true
+		}
+		if attempt >= cfg.MaxAttempts {
+			return failAsyncBooking(reqCtx, message, bookingID, status, err.Error(), deliveries)
+		}
+
+		slog.WarnContext(reqCtx, "Queued booking failed, retrying", "component", "async_booking", "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-reqCtx.Done():
+			// Shutting down: another worker takes it from here.
+			return false
+		}
+		backoff *= 2
+	}
+}
+
+// runAsyncBooking makes one attempt at a queued booking.
+func runAsyncBooking(ctx context.Context, bookingID string, job asyncBookingJob, messageID string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(strategyConfig.Server.RequestTimeout))
+	defer cancel()
+
+	// Claimed from a worker that died, or retried: if it got the hold, the booking's row has
+	// the status.
+	state, err := bookingState(ctx, db, bookingID)
+	if err != nil {
+		return fmt.Errorf("failed to check queued booking: %w", err)
+	}
+	if state != "" {
+		slog.InfoContext(ctx, "Queued booking already has its hold", "component", "async_booking", "state", state)
+		return nil
+	}
+
+	if err := setAsyncBookingStatus(ctx, bookingID, AsyncBookingProcessing); err != nil {
+		slog.WarnContext(ctx, "Failed to record booking status", "component", "async_booking", "error", err)
+	}
+	slog.InfoContext(ctx, "Starting queued booking", "component", "async_booking", "queued_for", queuedFor(messageID))
+	if _, err := BookSeats(ctx, job.Request, bookingID); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Successfully initiated queued booking", "component", "async_booking")
+	return nil
+}
+
+// failAsyncBooking gives up on a queued booking: it is reported with status and its job goes
+// to the dead-letter stream.
+func failAsyncBooking(ctx context.Context, message redis.XMessage, bookingID, status, reason string, deliveries int64) bool {
+	ctx = context.WithoutCancel(ctx)
+	endAsyncBooking(ctx, bookingID, status)
+	return deadLetterBooking(ctx, message, reason, deliveries)
+}
+
+// endAsyncBooking reports a queued booking that failed with status. Unless it got as far as
+// a row, it gives its seats back to the partner quota and sends its callback; the row's move
+// to CANCELLED sent that one.
+func endAsyncBooking(ctx context.Context, bookingID, status string) {
+	if err := setAsyncBookingStatus(ctx, bookingID, status); err != nil {
+		slog.ErrorContext(ctx, "Failed to record booking status", "component", "async_booking", "error", err)
+	}
+	state, err := bookingState(ctx, db, bookingID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to check queued booking", "component", "async_booking", "error", err)
+		return
+	}
+	if state != "" {
+		return
+	}
+	giveBackBookingQuota(ctx)
+	callbackURL := bookingCallbackFromContext(ctx)
+	if callbackURL == "" {
+		return
+	}
+	err = insertBookingCallback(ctx, db, callbackURL, BookingCallback{
+		BookingID: bookingID, Status: "FAILED", Reason: strings.ToLower(status), OccurredAt: time.Now().UTC(),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to queue booking callback", "component", "async_booking", "error", err)
+	}
+}
+
+// isTransientBookingError reports whether a booking that failed with err may well succeed if
+// it is simply run again: the database or Redis blipped, it lost a deadlock, or its show was
+// momentarily too busy. Seats taken by someone else are not transient.
+func isTransientBookingError(err error) bool {
+	return errors.Is(err, ErrDatabaseUnavailable) ||
+		errors.Is(err, ErrShowBusy) ||
+		isLockContention(err) ||
+		isDatabaseUnavailable(err)
+}
+
+// queuedFor is how long ago a stream message was added.
+func queuedFor(messageID string) time.Duration {
+	return time.Since(streamIDTime(messageID)).Round(time.Millisecond)
+}
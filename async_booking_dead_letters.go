@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Dead-letter stream of the async booking workers, <async_booking.stream>:dead. A booking job
+// the workers gave up on is added there, with the reason and how many workers had taken it,
+// before it is acknowledged on the main stream, so a job is always on one of the two.
+// GET /admin/booking-jobs/dead lists them, newest first, and
+// POST /admin/booking-jobs/dead/{id}/requeue queues one again as it was: its booking goes
+// back to ACCEPTED and the workers take it like a new request.
+
+const (
+	maxDeadBookingJobsLimit = 1000
+	// deadBookingJobsMaxLen roughly caps the dead-letter stream.
+	deadBookingJobsMaxLen = 100000
+)
+
+type DeadBookingJob struct {
+	ID         string    `json:"id"`
+	BookingID  string    `json:"booking_id"`
+	Job        string    `json:"job"`
+	Reason     string    `json:"reason"`
+	Deliveries int64     `json:"deliveries"`
+	QueuedAt   time.Time `json:"queued_at"`
+	FailedAt   time.Time `json:"failed_at"`
+}
+
+func deadBookingJobsStream() string {
+	return strategyConfig.AsyncBooking.Stream + ":dead"
+}
+
+// deadLetterBooking moves message to the dead-letter stream. It reports whether it did, a job
+// that couldn't be moved is left pending on the main stream.
+func deadLetterBooking(ctx context.Context, message redis.XMessage, reason string, deliveries int64) bool {
+	bookingID, _ := message.Values["booking_id"].(string)
+	job, _ := message.Values["job"].(string)
+	err := rdb.XAdd(context.WithoutCancel(ctx), &redis.XAddArgs{
+		Stream: deadBookingJobsStream(),
+		MaxLen: deadBookingJobsMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"booking_id":  bookingID,
+			"job":         job,
+			"reason":      reason,
+			"deliveries":  deliveries,
+			"original_id": message.ID,
+		},
+	}).Err()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to dead-letter booking job", "component", "async_booking", "message_id", message.ID, "reason", reason, "error", err)
+		return false
+	}
+	slog.WarnContext(ctx, "Dead-lettered booking job", "component", "async_booking", "message_id", message.ID, "booking_id", bookingID, "reason", reason, "deliveries", deliveries)
+	return true
+}
+
+func deadBookingJob(message redis.XMessage) DeadBookingJob {
+	entry := DeadBookingJob{ID: message.ID, FailedAt: streamIDTime(message.ID)}
+	entry.BookingID, _ = message.Values["booking_id"].(string)
+	entry.Job, _ = message.Values["job"].(string)
+	entry.Reason, _ = message.Values["reason"].(string)
+	deliveries, _ := message.Values["deliveries"].(string)
+	entry.Deliveries, _ = strconv.ParseInt(deliveries, 10, 64)
+	originalID, _ := message.Values["original_id"].(string)
+	entry.QueuedAt = streamIDTime(originalID)
+	return entry
+}
+
+// streamIDTime is when a stream entry was added, from its id.
+func streamIDTime(id string) time.Time {
+	var ms int64
+	if _, err := fmt.Sscanf(id, "%d-", &ms); err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms).UTC()
+}
+
+// handleDeadBookingJobs lists dead-lettered booking jobs, newest first, up to limit.
+func handleDeadBookingJobs(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxDeadBookingJobsLimit)
+	}
+
+	messages, err := rdb.XRevRangeN(r.Context(), deadBookingJobsStream(), "+", "-", int64(limit)).Result()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list dead booking jobs", "component", "admin", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	jobs := make([]DeadBookingJob, len(messages))
+	for i, message := range messages {
+		jobs[i] = deadBookingJob(message)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count": len(jobs),
+		"jobs":  jobs,
+	})
+}
+
+// handleRequeueDeadBookingJob puts a dead-lettered job back on the main stream.
+func handleRequeueDeadBookingJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	messages, err := rdb.XRange(r.Context(), deadBookingJobsStream(), id, id).Result()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load dead booking job", "component", "admin", "id", id, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(messages) == 0 {
+		http.Error(w, "Dead booking job not found", http.StatusNotFound)
+		return
+	}
+	entry := deadBookingJob(messages[0])
+
+	if err := setAsyncBookingStatus(r.Context(), entry.BookingID, AsyncBookingAccepted); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to requeue dead booking job", "component", "admin", "id", id, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// Added before it is deleted: a failure in between leaves it on both, never on neither.
+	requeuedID, err := rdb.XAdd(r.Context(), &redis.XAddArgs{
+		Stream: strategyConfig.AsyncBooking.Stream,
+		Values: map[string]interface{}{"booking_id": entry.BookingID, "job": entry.Job},
+	}).Result()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to requeue dead booking job", "component", "admin", "id", id, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := rdb.XDel(r.Context(), deadBookingJobsStream(), id).Err(); err != nil {
+		slog.WarnContext(r.Context(), "Requeued dead booking job but failed to remove it", "component", "admin", "id", id, "error", err)
+	}
+
+	slog.InfoContext(r.Context(), "Requeued dead booking job", "component", "admin", "id", id, "booking_id", entry.BookingID, "message_id", requeuedID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"booking_id": entry.BookingID,
+		"message_id": requeuedID,
+		"status":     AsyncBookingAccepted,
+	})
+}
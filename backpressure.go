@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Load shedding for /api/book. At most Backpressure.MaxInFlight bookings execute at once; up
+// to Backpressure.MaxQueue more wait for a slot, each for at most Backpressure.QueueTimeout.
+// Anything beyond that is answered 429 with Retry-After straight away, so a burst turns into
+// fast rejections the client can retry instead of a pile of requests all waiting on the
+// database connection pool.
+
+type BookingLimiter struct {
+	slots   chan struct{}
+	waiting atomic.Int64
+}
+
+var bookingLimiter *BookingLimiter
+
+func newBookingLimiter(cfg BackpressureConfig) *BookingLimiter {
+	if cfg.MaxInFlight <= 0 {
+		return &BookingLimiter{}
+	}
+	return &BookingLimiter{slots: make(chan struct{}, cfg.MaxInFlight)}
+}
+
+// Acquire waits for a slot and returns the func that frees it, or false when the queue is
+// full or the wait timed out.
+func (l *BookingLimiter) Acquire(timeout time.Duration, maxQueue int) (func(), bool) {
+	if l.slots == nil {
+		return func() {}, true
+	}
+	release := func() { <-l.slots }
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, true
+	default:
+	}
+
+	if l.waiting.Add(1) > int64(maxQueue) {
+		l.waiting.Add(-1)
+		return nil, false
+	}
+	defer l.waiting.Add(-1)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		return nil, false
+	}
+}
+
+func (l *BookingLimiter) InFlight() int {
+	return len(l.slots)
+}
+
+func (l *BookingLimiter) Waiting() int64 {
+	return l.waiting.Load()
+}
+
+// limitBookings sheds /api/book requests the limiter has no room for.
+func limitBookings(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := strategyConfig.Backpressure
+		release, ok := bookingLimiter.Acquire(time.Duration(cfg.QueueTimeout), cfg.MaxQueue)
+		if !ok {
+			slog.InfoContext(r.Context(), "Booking pipeline saturated, shedding request", "component", "api", "ip", r.RemoteAddr, "in_flight", bookingLimiter.InFlight(), "waiting", bookingLimiter.Waiting())
+			if attempt, ok := bookingAttemptFromContext(r.Context()); ok {
+				attempt.Outcome = "rejected_overload"
+			}
+			retryAfter := int(math.Ceil(time.Duration(cfg.QueueTimeout).Seconds()))
+			w.Header().Set("Retry-After", fmt.Sprint(max(retryAfter, 1)))
+			http.Error(w, "Too many bookings in progress, try again", http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+		next(w, r)
+	}
+}
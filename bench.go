@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Booking benchmark. `bench` runs -requests bookings, -concurrency at a time, through BookSeats
+// in this process, against the same database, locks and config as the service, and reports
+// how they went. Each booking takes -seats random seats of -show for a random user
+// (skip_locked asks for -seats of any). With -release (default) every hold is released as soon
+// as it is made, so the show stays bookable and the numbers measure contention rather than a
+// show running out; without it the seats stay held until the reaper or the payment webhook.
+
+type BenchConfig struct {
+	Method          string
+	ShowID          int
+	Requests        int
+	Concurrency     int
+	SeatsPerBooking int
+	Release         bool
+}
+
+type benchResults struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	outcomes  map[string]int
+	firstErr  map[string]error
+}
+
+func (r *benchResults) record(outcome string, took time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies = append(r.latencies, took)
+	r.outcomes[outcome]++
+	if err != nil && r.firstErr[outcome] == nil {
+		r.firstErr[outcome] = err
+	}
+}
+
+// benchOutcome buckets a booking error the way /api/book answers it.
+func benchOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "booked"
+	case errors.Is(err, ErrShowBusy):
+		return "busy"
+	case isContentionError(err):
+		return "conflict"
+	default:
+		return "error"
+	}
+}
+
+func runBench(cfg BenchConfig, seatIDs, userIDs []int) *benchResults {
+	results := &benchResults{outcomes: make(map[string]int), firstErr: make(map[string]error)}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < cfg.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(w)))
+			for n := range jobs {
+				req := BookingRequest{
+					UserID: userIDs[rng.Intn(len(userIDs))],
+					ShowID: cfg.ShowID,
+					Method: cfg.Method,
+				}
+				if cfg.Method == "skip_locked" {
+					req.Quantity = cfg.SeatsPerBooking
+				} else {
+					for _, i := range rng.Perm(len(seatIDs))[:cfg.SeatsPerBooking] {
+						req.SeatIDs = append(req.SeatIDs, seatIDs[i])
+					}
+				}
+				bookingID := fmt.Sprintf("bench_%d_%d_%d", req.UserID, time.Now().UnixNano(), n)
+
+				started := time.Now()
+				_, err := BookSeats(ctx, req, bookingID)
+				results.record(benchOutcome(err), time.Since(started), err)
+
+				if err == nil && cfg.Release {
+					releaseBenchHold(bookingID, req.UserID)
+				}
+			}
+		}()
+	}
+
+	for n := 0; n < cfg.Requests; n++ {
+		jobs <- n
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+func releaseBenchHold(bookingID string, userID int) {
+	if dbDriver == "memory" {
+		memoryStore.CompletePayment(bookingID, "FAILED")
+		return
+	}
+	if _, err := releaseBookingHold(ctx, bookingID, userID); err != nil {
+		slog.Error("Failed to release hold", "component", "bench", "booking_id", bookingID, "error", err)
+	}
+}
+
+// benchInventory returns the show's seats and the users to book them with.
+func benchInventory(showID int) ([]int, []int, error) {
+	if dbDriver == "memory" {
+		cfg := strategyConfig.Memory
+		if showID < 1 || showID > cfg.Shows {
+			return nil, nil, fmt.Errorf("the in-memory store has shows 1..%d", cfg.Shows)
+		}
+		seatIDs := make([]int, cfg.SeatsPerShow)
+		for n := range seatIDs {
+			seatIDs[n] = (showID-1)*cfg.SeatsPerShow + n + 1
+		}
+		userIDs := make([]int, 100)
+		for n := range userIDs {
+			userIDs[n] = n + 1
+		}
+		return seatIDs, userIDs, nil
+	}
+
+	seatIDs, err := queryIDs(`SELECT id FROM seats WHERE show_id = ? ORDER BY id`, showID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load seats: %w", err)
+	}
+	userIDs, err := queryIDs(`SELECT id FROM users ORDER BY id LIMIT 1000`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load users: %w", err)
+	}
+	return seatIDs, userIDs, nil
+}
+
+func queryIDs(query string, args ...interface{}) ([]int, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (r *benchResults) report(cfg BenchConfig, elapsed time.Duration) {
+	slices.Sort(r.latencies)
+	percentile := func(p float64) time.Duration {
+		if len(r.latencies) == 0 {
+			return 0
+		}
+		return r.latencies[int(float64(len(r.latencies)-1)*p)]
+	}
+
+	slog.Info("Done", "component", "bench", "method", cfg.Method, "show_id", cfg.ShowID, "requests", cfg.Requests, "concurrency", cfg.Concurrency, "seats_per_booking", cfg.SeatsPerBooking, "elapsed", elapsed, "throughput", fmt.Sprintf("%.1f req/s", float64(cfg.Requests)/elapsed.Seconds()))
+	slog.Info("Outcomes", "component", "bench", "booked", r.outcomes["booked"], "conflict", r.outcomes["conflict"], "busy", r.outcomes["busy"], "error", r.outcomes["error"])
+	slog.Info("Latency", "component", "bench", "p50", percentile(0.50), "p95", percentile(0.95), "p99", percentile(0.99), "max", percentile(1))
+	for outcome, err := range r.firstErr {
+		slog.Info("First error", "component", "bench", "outcome", outcome, "error", err)
+	}
+}
+
+// runBenchCommand is `bench [flags]`.
+func runBenchCommand(args []string) {
+	cfg := BenchConfig{}
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	flags.StringVar(&cfg.Method, "method", "optimistic", "booking method, as in /api/book")
+	flags.IntVar(&cfg.ShowID, "show", 1, "show to book")
+	flags.IntVar(&cfg.Requests, "requests", 1000, "bookings to run")
+	flags.IntVar(&cfg.Concurrency, "concurrency", 50, "bookings running at once")
+	flags.IntVar(&cfg.SeatsPerBooking, "seats", 2, "seats per booking")
+	flags.BoolVar(&cfg.Release, "release", true, "release every hold right after it is made")
+	configFile := configFlag(flags)
+	flags.Parse(args)
+
+	if cfg.Requests <= 0 || cfg.Concurrency <= 0 || cfg.SeatsPerBooking <= 0 {
+		log.Fatalf("Invalid bench config: -requests, -concurrency and -seats must be > 0")
+	}
+
+	loadConfig(*configFile)
+	if connectDatabase() {
+		defer db.Close()
+		connectServices()
+		if paymentProvider.Name() != "mock" {
+			log.Fatalf("Every booking opens a checkout, run bench with PAYMENT_PROVIDER=mock")
+		}
+	}
+
+	seatIDs, userIDs, err := benchInventory(cfg.ShowID)
+	if err != nil {
+		log.Fatalf("Bench setup failed: %v", err)
+	}
+	if len(seatIDs) < cfg.SeatsPerBooking {
+		log.Fatalf("Show %d has %d seats, fewer than -seats %d", cfg.ShowID, len(seatIDs), cfg.SeatsPerBooking)
+	}
+	if len(userIDs) == 0 {
+		log.Fatalf("No users to book with, run seed first")
+	}
+
+	slog.Info("Starting", "component", "bench", "method", cfg.Method, "show_id", cfg.ShowID, "seats", len(seatIDs), "users", len(userIDs), "requests", cfg.Requests, "concurrency", cfg.Concurrency)
+	started := time.Now()
+	results := runBench(cfg, seatIDs, userIDs)
+	results.report(cfg, time.Since(started))
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+)
+
+// Best-available booking. POST /api/book-best-available takes a show, a quantity and
+// preferences instead of seat ids, and the server picks the seats, so clients don't race each
+// other for seats they chose from a seat map that was already stale. Seats are picked by the
+// adjacency rules:
+//   - with contiguous (the default), the seats are side by side in one row;
+//   - a block that would leave a single seat free next to it, which hardly anyone books, is
+//     only taken when there is no other;
+//   - then front rows go first, and in a row the block nearest the middle.
+//
+// Without contiguous the best block is still tried first, then the best seats wherever they
+// are. A section narrows the seats to that section of the show's venue (venues.go).
+//
+// The booking itself is the skip_locked strategy (SkipLockedBooking, concurrency_control.go),
+// which /api/book's skip_locked requests go through too, without preferences. The blocks are
+// chosen on a read that takes no locks; the chosen block is then locked with SKIP LOCKED, and
+// when another booking got to any of its seats first the next block without those seats is
+// tried, up to maxBestAvailableAttempts. The best seats wherever they are are locked in one
+// statement that skips the rows others have locked, so those never wait or conflict. The
+// request goes through everything /api/book does in front of the booking (sold out, sale
+// window, waiting room, presale).
+
+const (
+	maxBestAvailableQuantity = 10
+	maxBestAvailableAttempts = 5
+)
+
+var ErrNotEnoughSeats = errors.New("not enough seats available")
+
+// errBlockTaken is a block another booking took some seats of first.
+var errBlockTaken = errors.New("seats taken")
+
+type SeatPreferences struct {
+	Section    string `json:"section"`
+	Contiguous bool   `json:"contiguous"`
+}
+
+// freeSeat is a seat on sale, with where it is.
+type freeSeat struct {
+	id     int
+	row    string
+	column int
+	// rowIndex orders rows front to back, width is the row's last column.
+	rowIndex int
+	width    int
+}
+
+// seatBlock is a choice of seats, with how good it is by the adjacency rules.
+type seatBlock struct {
+	seatIDs  []int
+	orphan   bool
+	rowIndex int
+	// offCentre is twice the distance of the block's middle from the row's.
+	offCentre int
+}
+
+// bestAvailableSeatsFrom is the free seats of a show, s, joined to w, the widths of their rows
+// (the last column), with a section filter when section is given. Its arguments are the show
+// id twice and the section.
+func bestAvailableSeatsFrom(section string) string {
+	from := `
+		FROM seats s
+		LEFT JOIN (
+			SELECT seat_row, MAX(seat_column) AS width FROM seats WHERE show_id = ? GROUP BY seat_row
+		) w ON w.seat_row = s.seat_row
+		WHERE s.show_id = ?
+		AND (s.is_reserved = 0 OR (s.is_reserved = 1 AND s.payment_status = 'FAILED'))`
+	if section != "" {
+		from += `
+		AND s.seat_row IN (
+			SELECT vr.label FROM venue_rows vr
+			JOIN venue_sections vs ON vs.id = vr.section_id
+			JOIN shows sh ON sh.venue_id = vs.venue_id
+			WHERE sh.id = s.show_id AND vs.name = ?
+		)`
+	}
+	return from
+}
+
+func bestAvailableSeatsArgs(showID int, section string) []interface{} {
+	if section == "" {
+		return []interface{}{showID, showID}
+	}
+	return []interface{}{showID, showID, section}
+}
+
+// freeSeatsForBestAvailable returns the show's seats on sale, in the section when one is given,
+// front row first and by column.
+func freeSeatsForBestAvailable(ctx context.Context, showID int, section string) ([]freeSeat, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT s.id, s.seat_row, s.seat_column, w.width`+bestAvailableSeatsFrom(section)+`
+		ORDER BY LENGTH(s.seat_row), s.seat_row, s.seat_column, s.id
+	`, bestAvailableSeatsArgs(showID, section)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read free seats: %w", err)
+	}
+	defer rows.Close()
+
+	var seats []freeSeat
+	rowIndex := -1
+	lastRow := ""
+	for rows.Next() {
+		var seat freeSeat
+		var row sql.NullString
+		var column, width sql.NullInt64
+		if err := rows.Scan(&seat.id, &row, &column, &width); err != nil {
+			return nil, fmt.Errorf("failed to scan seat: %w", err)
+		}
+		seat.row, seat.column, seat.width = row.String, int(column.Int64), int(width.Int64)
+		if rowIndex < 0 || seat.row != lastRow {
+			rowIndex++
+			lastRow = seat.row
+		}
+		seat.rowIndex = rowIndex
+		seats = append(seats, seat)
+	}
+	return seats, rows.Err()
+}
+
+// bestAvailableBlocks lists the blocks of quantity free seats side by side in a row, best
+// first. seats are ordered as freeSeatsForBestAvailable returns them.
+func bestAvailableBlocks(seats []freeSeat, quantity int) []seatBlock {
+	var blocks []seatBlock
+	// Runs of free seats side by side, split where the row or the columns break.
+	for start := 0; start < len(seats); {
+		end := start + 1
+		for end < len(seats) && seats[end].row == seats[start].row && seats[end].column == seats[end-1].column+1 {
+			end++
+		}
+		run := seats[start:end]
+		start = end
+		if run[0].row == "" || run[0].column == 0 {
+			// Seats without a place in a row can't be side by side.
+			continue
+		}
+		for i := 0; i+quantity <= len(run); i++ {
+			block := seatBlock{rowIndex: run[i].rowIndex}
+			for _, seat := range run[i : i+quantity] {
+				block.seatIDs = append(block.seatIDs, seat.id)
+			}
+			block.orphan = i == 1 || len(run)-(i+quantity) == 1
+			block.offCentre = abs(run[i].column + run[i+quantity-1].column - (run[i].width + 1))
+			blocks = append(blocks, block)
+		}
+	}
+	sort.SliceStable(blocks, func(i, j int) bool {
+		a, b := blocks[i], blocks[j]
+		if a.orphan != b.orphan {
+			return !a.orphan
+		}
+		if a.rowIndex != b.rowIndex {
+			return a.rowIndex < b.rowIndex
+		}
+		return a.offCentre < b.offCentre
+	})
+	return blocks
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// lockSeatBlock locks those of seatIDs that are still free, skipping rows another booking
+// has locked, and returns them.
+func lockSeatBlock(ctx context.Context, tx *sql.Tx, seatIDs []int) (map[int]bool, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+		SELECT id FROM seats
+		WHERE id IN (%s)
+		AND (is_reserved = 0 OR (is_reserved = 1 AND payment_status = 'FAILED'))
+		FOR UPDATE SKIP LOCKED`, generatePlaceholders(len(seatIDs))), sliceToInterface(seatIDs)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock seats: %w", err)
+	}
+	defer rows.Close()
+	locked := make(map[int]bool)
+	for rows.Next() {
+		var seatID int
+		if err := rows.Scan(&seatID); err != nil {
+			return nil, fmt.Errorf("failed to scan seat: %w", err)
+		}
+		locked[seatID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating locked seats: %w", err)
+	}
+	return locked, nil
+}
+
+// lockBestFreeSeats locks up to quantity of the show's best free seats wherever they are, front
+// row first and nearest the middle, skipping rows another booking has locked.
+func lockBestFreeSeats(ctx context.Context, tx *sql.Tx, showID, quantity int, section string) ([]int, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT s.id`+bestAvailableSeatsFrom(section)+`
+		ORDER BY LENGTH(s.seat_row), s.seat_row, ABS(2 * s.seat_column - (w.width + 1)), s.id
+		LIMIT ?
+		FOR UPDATE OF s SKIP LOCKED
+	`, append(bestAvailableSeatsArgs(showID, section), quantity)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select free seats: %w", err)
+	}
+	defer rows.Close()
+
+	var seatIDs []int
+	for rows.Next() {
+		var seatID int
+		if err := rows.Scan(&seatID); err != nil {
+			return nil, fmt.Errorf("failed to scan seat: %w", err)
+		}
+		seatIDs = append(seatIDs, seatID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating free seat rows: %w", err)
+	}
+	return seatIDs, nil
+}
+
+func blockTaken(block seatBlock, taken map[int]bool) bool {
+	for _, seatID := range block.seatIDs {
+		if taken[seatID] {
+			return true
+		}
+	}
+	return false
+}
+
+// handleBestAvailableBooking serves POST /api/book-best-available: /api/book with seats the
+// server picks, {"user_id": 7, "show_id": 1, "quantity": 2, "preferences": {"section":
+// "Balcony", "contiguous": true}}.
+func handleBestAvailableBooking(w http.ResponseWriter, r *http.Request) {
+	req := BookingRequest{Preferences: SeatPreferences{Contiguous: true}}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.WarnContext(r.Context(), "Invalid request body", "component", "api", "ip", r.RemoteAddr, "error", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Quantity <= 0 || req.Quantity > maxBestAvailableQuantity {
+		http.Error(w, fmt.Sprintf("quantity must be between 1 and %d", maxBestAvailableQuantity), http.StatusBadRequest)
+		return
+	}
+	req.Method = "best_available"
+	req.SeatIDs = nil
+	req.Hold = false
+	if attempt, ok := bookingAttemptFromContext(r.Context()); ok {
+		attempt.Strategy = req.Method
+	}
+	serveBooking(w, r, req)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// freeRow is the free seats of a row as freeSeatsForBestAvailable returns them, each seat's id
+// being rowIndex*100 plus its column.
+func freeRow(rowIndex int, row string, width int, columns ...int) []freeSeat {
+	seats := make([]freeSeat, 0, len(columns))
+	for _, column := range columns {
+		seats = append(seats, freeSeat{id: rowIndex*100 + column, row: row, column: column, rowIndex: rowIndex, width: width})
+	}
+	return seats
+}
+
+func blockSeatIDs(blocks []seatBlock) [][]int {
+	ids := make([][]int, 0, len(blocks))
+	for _, block := range blocks {
+		ids = append(ids, block.seatIDs)
+	}
+	return ids
+}
+
+func TestBestAvailableBlocks(t *testing.T) {
+	tests := []struct {
+		name     string
+		seats    []freeSeat
+		quantity int
+		want     [][]int
+	}{
+		{
+			name:     "middle of the row first",
+			seats:    freeRow(0, "A", 6, 1, 2, 3, 4, 5, 6),
+			quantity: 2,
+			// 3-4 is centred; 1-2 and 5-6 are as far off as 2-3 and 4-5, which leave a single
+			// seat free and go last.
+			want: [][]int{{3, 4}, {1, 2}, {5, 6}, {2, 3}, {4, 5}},
+		},
+		{
+			name:     "blocks leaving a single seat go last",
+			seats:    freeRow(0, "A", 10, 1, 2, 3, 4),
+			quantity: 2,
+			want:     [][]int{{3, 4}, {1, 2}, {2, 3}},
+		},
+		{
+			name:     "front rows first",
+			seats:    append(freeRow(0, "A", 10, 1, 2), freeRow(1, "B", 10, 5, 6)...),
+			quantity: 2,
+			want:     [][]int{{1, 2}, {105, 106}},
+		},
+		{
+			name:     "a row further back beats leaving a single seat",
+			seats:    append(freeRow(0, "A", 10, 1, 2, 3), freeRow(1, "B", 10, 5, 6)...),
+			quantity: 2,
+			want:     [][]int{{105, 106}, {2, 3}, {1, 2}},
+		},
+		{
+			name:     "taken seats break a run",
+			seats:    freeRow(0, "A", 10, 1, 2, 4, 5),
+			quantity: 3,
+			want:     [][]int{},
+		},
+		{
+			name:     "runs don't carry over into the next row",
+			seats:    append(freeRow(0, "A", 2, 1, 2), freeRow(1, "B", 2, 3)...),
+			quantity: 3,
+			want:     [][]int{},
+		},
+		{
+			name:     "seats without a place in a row are left out",
+			seats:    []freeSeat{{id: 1}, {id: 2}},
+			quantity: 2,
+			want:     [][]int{},
+		},
+		{
+			name:     "more seats than the row has",
+			seats:    freeRow(0, "A", 3, 1, 2, 3),
+			quantity: 4,
+			want:     [][]int{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := blockSeatIDs(bestAvailableBlocks(tt.seats, tt.quantity))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bestAvailableBlocks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBestAvailableBlocksFlagsOrphans(t *testing.T) {
+	blocks := bestAvailableBlocks(freeRow(0, "A", 5, 1, 2, 3, 4, 5), 3)
+	orphans := make(map[int]bool)
+	for _, block := range blocks {
+		orphans[block.seatIDs[0]] = block.orphan
+	}
+	want := map[int]bool{1: false, 2: true, 3: false}
+	if !reflect.DeepEqual(orphans, want) {
+		t.Errorf("orphan flags by first seat = %v, want %v", orphans, want)
+	}
+}
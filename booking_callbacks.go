@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Client callbacks. A booking request may carry a callback_url; the booking keeps it, and when
+// the booking ends, CONFIRMED, EXPIRED or cancelled (FAILED), a notification for it is queued in
+// booking_callbacks in the same transaction. A queued booking that fails before it has a row
+// (async_booking.go) gets a FAILED one too, and a waitlist entry offered seats
+// (waitlist.go) a WAITLIST_OFFERED one. The dispatcher on the maintenance leader POSTs
+// them, signed like the payment webhooks we receive: X-Webhook-Timestamp is the unix time and
+// X-Webhook-Signature "sha256=" and the hex HMAC-SHA256 of "<timestamp>.<body>" with
+// BOOKING_CALLBACK_SECRET. A delivery that doesn't get a 2xx is tried again after
+// callbacks.backoff, doubling up to maxCallbackBackoff, until callbacks.max_attempts. A
+// booking is notified at least once, clients dedupe on booking_id. The memory store makes no
+// callbacks.
+
+const (
+	bookingCallbackInterval  = 1 * time.Second
+	bookingCallbackBatchSize = 100
+	// bookingCallbackConcurrency bounds the deliveries in flight, so one slow client doesn't
+	// hold up the rest.
+	bookingCallbackConcurrency = 10
+	maxCallbackBackoff         = 1 * time.Hour
+	maxCallbackURLLength       = 2048
+	callbackRetention          = 7 * 24 * time.Hour
+	callbackPruneInterval      = 1 * time.Hour
+)
+
+// BookingCallbackConfig tunes callback delivery, see booking_callbacks.go.
+type BookingCallbackConfig struct {
+	MaxAttempts int      `json:"max_attempts"` // BOOKING_CALLBACK_MAX_ATTEMPTS
+	Backoff     Duration `json:"backoff"`      // BOOKING_CALLBACK_BACKOFF, before the second attempt, doubling after
+	Timeout     Duration `json:"timeout"`      // BOOKING_CALLBACK_TIMEOUT, for one delivery
+}
+
+type BookingCallback struct {
+	BookingID string       `json:"booking_id"`
+	Status    string       `json:"status"` // CONFIRMED, EXPIRED or FAILED, or WAITLIST_OFFERED
+	State     BookingState `json:"state,omitempty"`
+	Reason    string       `json:"reason,omitempty"`
+	// A WAITLIST_OFFERED callback says which entry the offer is for and how to take it.
+	WaitlistID  int64      `json:"waitlist_id,omitempty"`
+	SeatIDs     []int      `json:"seat_ids,omitempty"`
+	RedirectURL string     `json:"redirect_url,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	OccurredAt  time.Time  `json:"occurred_at"`
+}
+
+// callbackStatuses are the booking states that end it, with the status clients are told.
+var callbackStatuses = map[BookingState]string{
+	BookingConfirmed: "CONFIRMED",
+	BookingExpired:   "EXPIRED",
+	BookingCancelled: "FAILED",
+}
+
+var ErrCallbacksNotConfigured = errors.New("booking callbacks are not configured")
+
+var callbackHTTPClient = &http.Client{}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type bookingCallbackContextKey struct{}
+
+// withBookingCallback makes the booking made under ctx keep callbackURL.
+func withBookingCallback(ctx context.Context, callbackURL string) context.Context {
+	if callbackURL == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, bookingCallbackContextKey{}, callbackURL)
+}
+
+func bookingCallbackFromContext(ctx context.Context) string {
+	callbackURL, _ := ctx.Value(bookingCallbackContextKey{}).(string)
+	return callbackURL
+}
+
+// checkCallbackURL accepts an absolute http(s) URL, or none. In production a callback needs
+// BOOKING_CALLBACK_SECRET, an unsigned one could be forged by anyone.
+func checkCallbackURL(callbackURL string) error {
+	if callbackURL == "" {
+		return nil
+	}
+	if isProduction() && os.Getenv("BOOKING_CALLBACK_SECRET") == "" {
+		return ErrCallbacksNotConfigured
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(callbackURL) > maxCallbackURLLength {
+		return errors.New("callback_url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// queueBookingCallback queues the notification for the booking's move to `to` within tx,
+// when that ends it and the booking has a callback URL.
+func queueBookingCallback(ctx context.Context, tx *sql.Tx, bookingID string, to BookingState, reason string) error {
+	status, ok := callbackStatuses[to]
+	if !ok {
+		return nil
+	}
+	var callbackURL sql.NullString
+	err := tx.QueryRowContext(ctx, `SELECT callback_url FROM bookings WHERE id = ?`, bookingID).Scan(&callbackURL)
+	if err != nil {
+		return fmt.Errorf("failed to load booking callback: %w", err)
+	}
+	if !callbackURL.Valid {
+		return nil
+	}
+	return insertBookingCallback(ctx, tx, callbackURL.String, BookingCallback{
+		BookingID: bookingID, Status: status, State: to, Reason: reason, OccurredAt: time.Now().UTC(),
+	})
+}
+
+func insertBookingCallback(ctx context.Context, exec execer, callbackURL string, callback BookingCallback) error {
+	payload, err := json.Marshal(callback)
+	if err != nil {
+		return fmt.Errorf("failed to encode booking callback: %w", err)
+	}
+	_, err = exec.ExecContext(ctx, `
+		INSERT INTO booking_callbacks (booking_id, url, payload) VALUES (?, ?, ?)
+	`, callback.BookingID, callbackURL, string(payload))
+	if err != nil {
+		return fmt.Errorf("failed to queue booking callback: %w", err)
+	}
+	return nil
+}
+
+func runBookingCallbackDispatcher() error {
+	ticker := time.NewTicker(bookingCallbackInterval)
+	defer ticker.Stop()
+	var lastPrune time.Time
+
+	for range ticker.C {
+		if !runsMaintenance() {
+			continue
+		}
+		dispatchBookingCallbacks()
+		if time.Since(lastPrune) >= callbackPruneInterval {
+			pruneBookingCallbacks()
+			lastPrune = time.Now()
+		}
+	}
+	return errors.New("ending booking callback dispatcher")
+}
+
+type pendingCallback struct {
+	id       int64
+	url      string
+	payload  string
+	attempts int
+}
+
+// dispatchBookingCallbacks delivers the callbacks that are due.
+func dispatchBookingCallbacks() {
+	defer func() { reportPanic(ctx, "callbacks", recover()) }()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, url, payload, attempts FROM booking_callbacks
+		WHERE delivered_at IS NULL AND next_attempt_at <= ? AND attempts < ?
+		ORDER BY next_attempt_at
+		LIMIT ?
+	`, time.Now(), strategyConfig.Callbacks.MaxAttempts, bookingCallbackBatchSize)
+	if err != nil {
+		slog.Error("Failed to load due callbacks", "component", "callbacks", "error", err)
+		return
+	}
+	var due []pendingCallback
+	for rows.Next() {
+		var c pendingCallback
+		if err := rows.Scan(&c.id, &c.url, &c.payload, &c.attempts); err != nil {
+			slog.Error("Failed to scan callback", "component", "callbacks", "error", err)
+			continue
+		}
+		due = append(due, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		slog.Error("Failed to load due callbacks", "component", "callbacks", "error", err)
+		return
+	}
+
+	sem := make(chan struct{}, bookingCallbackConcurrency)
+	var wg sync.WaitGroup
+	for _, c := range due {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			deliverBookingCallback(c)
+		}()
+	}
+	wg.Wait()
+}
+
+func deliverBookingCallback(c pendingCallback) {
+	defer func() { reportPanic(ctx, "callbacks", recover()) }()
+
+	err := postBookingCallback(c.url, []byte(c.payload))
+	if err == nil {
+		if _, err := db.ExecContext(ctx, `UPDATE booking_callbacks SET delivered_at = ?, attempts = attempts + 1 WHERE id = ?`, time.Now(), c.id); err != nil {
+			slog.Error("Failed to mark callback delivered", "component", "callbacks", "callback_id", c.id, "error", err)
+		}
+		slog.Info("Delivered booking callback", "component", "callbacks", "callback_id", c.id, "attempt", c.attempts+1)
+		return
+	}
+
+	attempts := c.attempts + 1
+	backoff := min(time.Duration(strategyConfig.Callbacks.Backoff)<<(attempts-1), maxCallbackBackoff)
+	if backoff <= 0 {
+		// Shifted past the int64 range.
+		backoff = maxCallbackBackoff
+	}
+	_, dbErr := db.ExecContext(ctx, `
+		UPDATE booking_callbacks SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?
+	`, attempts, time.Now().Add(backoff), truncate(err.Error(), 255), c.id)
+	if dbErr != nil {
+		slog.Error("Failed to record callback attempt", "component", "callbacks", "callback_id", c.id, "error", dbErr)
+	}
+	if attempts >= strategyConfig.Callbacks.MaxAttempts {
+		slog.Error("Giving up on booking callback", "component", "callbacks", "callback_id", c.id, "attempts", attempts, "error", err)
+		return
+	}
+	slog.Warn("Booking callback failed, retrying", "component", "callbacks", "callback_id", c.id, "attempt", attempts, "backoff", backoff, "error", err)
+}
+
+func postBookingCallback(callbackURL string, body []byte) error {
+	reqCtx, cancel := context.WithTimeout(ctx, time.Duration(strategyConfig.Callbacks.Timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := os.Getenv("BOOKING_CALLBACK_SECRET"); secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, signWebhookPayload(secret, timestamp, body))
+	}
+
+	resp, err := callbackHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback responded %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// pruneBookingCallbacks deletes callbacks queued longer than callbackRetention ago, delivered
+// or given up on long before.
+func pruneBookingCallbacks() {
+	cutoff := time.Now().Add(-callbackRetention)
+	result, err := db.ExecContext(ctx, "DELETE FROM booking_callbacks WHERE created_at < ?", cutoff)
+	if err != nil {
+		slog.Error("Failed to prune booking callbacks", "component", "callbacks", "cutoff", cutoff, "error", err)
+		return
+	}
+	if pruned, _ := result.RowsAffected(); pruned > 0 {
+		slog.Info("Pruned booking callbacks", "component", "callbacks", "cutoff", cutoff, "rows", pruned)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Booking attempt journal. Every request that reaches /api/book is appended to
+// booking_attempts with who sent it, what it asked for and how it ended, including requests
+// rejected for quota, lock conflicts or bad input. Rows are never updated; the only delete is
+// the retention prune. Writes go through a buffered channel so a burst of scalper traffic
+// doesn't add a database round trip to every request; if the buffer is full the entry is
+// dropped and logged.
+
+const (
+	journalBufferSize       = 1000
+	journalPruneInterval    = 1 * time.Hour
+	defaultJournalRetention = 90 * 24 * time.Hour
+	maxJournalQueryLimit    = 1000
+)
+
+type BookingAttempt struct {
+	ID           int64     `json:"id"`
+	BookingID    string    `json:"booking_id,omitempty"`
+	UserID       int       `json:"user_id"`
+	ShowID       int       `json:"show_id"`
+	SeatIDs      []int     `json:"seat_ids"`
+	Strategy     string    `json:"strategy"`
+	ClientIP     string    `json:"client_ip"`
+	ForwardedFor string    `json:"forwarded_for,omitempty"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+	PartnerID    *int      `json:"partner_id,omitempty"`
+	Outcome      string    `json:"outcome"`
+	HTTPStatus   int       `json:"http_status"`
+	Error        string    `json:"error,omitempty"`
+	DurationMs   int64     `json:"duration_ms"`
+	AttemptedAt  time.Time `json:"attempted_at"`
+}
+
+var bookingJournal = make(chan *BookingAttempt, journalBufferSize)
+
+type bookingAttemptContextKey struct{}
+
+// bookingAttemptFromContext lets the handlers further down fill in what only they know
+// (partner, booking id, the seats actually reserved, the error).
+func bookingAttemptFromContext(ctx context.Context) (*BookingAttempt, bool) {
+	attempt, ok := ctx.Value(bookingAttemptContextKey{}).(*BookingAttempt)
+	return attempt, ok
+}
+
+func attemptOutcome(status int) string {
+	switch {
+	case status < 300:
+		return "accepted"
+	case status == http.StatusBadRequest:
+		return "invalid_request"
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "rejected_auth"
+	case status == http.StatusConflict:
+		return "rejected_conflict"
+	case status == http.StatusTooManyRequests:
+		return "rejected_quota"
+	case status == http.StatusServiceUnavailable:
+		return "rejected_unavailable"
+	case status < 500:
+		return "rejected"
+	default:
+		return "failed"
+	}
+}
+
+// journalBookingAttempts wraps the booking endpoint and appends one journal entry per request.
+func journalBookingAttempts(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		attempt := &BookingAttempt{
+			ClientIP:     r.RemoteAddr,
+			ForwardedFor: truncate(r.Header.Get("X-Forwarded-For"), 255),
+			UserAgent:    truncate(r.UserAgent(), 255),
+			AttemptedAt:  start,
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			attempt.ClientIP = host
+		}
+
+		// Decode what we can up front so rejected requests still say who and what.
+		if body, err := io.ReadAll(r.Body); err == nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			var req BookingRequest
+			if json.Unmarshal(body, &req) == nil {
+				attempt.UserID = req.UserID
+				attempt.ShowID = req.ShowID
+				attempt.SeatIDs = req.SeatIDs
+				attempt.Strategy = req.Method
+			}
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), bookingAttemptContextKey{}, attempt))
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+
+		attempt.HTTPStatus = recorder.status
+		if attempt.Outcome == "" {
+			attempt.Outcome = attemptOutcome(recorder.status)
+		}
+		attempt.DurationMs = time.Since(start).Milliseconds()
+
+		select {
+		case bookingJournal <- attempt:
+		default:
+			slog.InfoContext(r.Context(), "Buffer full, dropping attempt", "component", "journal", "user_id", attempt.UserID, "ip", attempt.ClientIP, "outcome", attempt.Outcome)
+		}
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+func journalRetention() time.Duration {
+	if days, err := strconv.Atoi(os.Getenv("BOOKING_JOURNAL_RETENTION_DAYS")); err == nil && days > 0 {
+		return time.Duration(days) * 24 * time.Hour
+	}
+	return defaultJournalRetention
+}
+
+// runBookingJournal drains the journal buffer into booking_attempts and prunes entries older
+// than BOOKING_JOURNAL_RETENTION_DAYS (default 90).
+func runBookingJournal() error {
+	ticker := time.NewTicker(journalPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case attempt := <-bookingJournal:
+			if err := insertBookingAttempt(attempt); err != nil {
+				slog.Error("Failed to write attempt", "component", "journal", "user_id", attempt.UserID, "ip", attempt.ClientIP, "error", err)
+			}
+		case <-ticker.C:
+			if !runsMaintenance() {
+				continue
+			}
+			cutoff := time.Now().Add(-journalRetention())
+			result, err := db.ExecContext(ctx, "DELETE FROM booking_attempts WHERE attempted_at < ?", cutoff)
+			if err != nil {
+				slog.Error("Failed to prune attempts", "component", "journal", "cutoff", cutoff, "error", err)
+				continue
+			}
+			if pruned, _ := result.RowsAffected(); pruned > 0 {
+				slog.Info("Pruned attempts", "component", "journal", "cutoff", cutoff, "rows", pruned)
+			}
+		}
+	}
+}
+
+func insertBookingAttempt(a *BookingAttempt) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO booking_attempts (booking_id, user_id, show_id, seat_ids, strategy, client_ip,
+		                              forwarded_for, user_agent, partner_id, outcome, http_status,
+		                              error, duration_ms, attempted_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, a.BookingID, a.UserID, a.ShowID, joinInts(a.SeatIDs), a.Strategy, a.ClientIP,
+		a.ForwardedFor, a.UserAgent, a.PartnerID, a.Outcome, a.HTTPStatus,
+		truncate(a.Error, 1000), a.DurationMs, a.AttemptedAt)
+	return err
+}
+
+// handleBookingAttempts serves GET /admin/booking-attempts. Filters: user_id, show_id, ip,
+// outcome, since and until (RFC 3339), limit. Newest first.
+func handleBookingAttempts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var where []string
+	var args []interface{}
+
+	for _, filter := range []struct{ param, column string }{
+		{"user_id", "user_id"},
+		{"show_id", "show_id"},
+		{"partner_id", "partner_id"},
+	} {
+		if v := query.Get(filter.param); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "Invalid "+filter.param, http.StatusBadRequest)
+				return
+			}
+			where = append(where, filter.column+" = ?")
+			args = append(args, id)
+		}
+	}
+	if ip := query.Get("ip"); ip != "" {
+		where = append(where, "client_ip = ?")
+		args = append(args, ip)
+	}
+	if outcome := query.Get("outcome"); outcome != "" {
+		where = append(where, "outcome = ?")
+		args = append(args, outcome)
+	}
+	for _, bound := range []struct{ param, op string }{{"since", ">="}, {"until", "<"}} {
+		if v := query.Get(bound.param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "Invalid "+bound.param+", expected RFC 3339", http.StatusBadRequest)
+				return
+			}
+			where = append(where, "attempted_at "+bound.op+" ?")
+			args = append(args, t)
+		}
+	}
+
+	limit := 100
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxJournalQueryLimit)
+	}
+
+	sqlQuery := `
+		SELECT id, booking_id, user_id, show_id, seat_ids, strategy, client_ip, forwarded_for,
+		       user_agent, partner_id, outcome, http_status, error, duration_ms, attempted_at
+		FROM booking_attempts`
+	if len(where) > 0 {
+		sqlQuery += " WHERE " + strings.Join(where, " AND ")
+	}
+	sqlQuery += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	attempts, err := queryBookingAttempts(sqlQuery, args...)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to query booking attempts", "component", "admin", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":    len(attempts),
+		"attempts": attempts,
+	})
+}
+
+func queryBookingAttempts(query string, args ...interface{}) ([]BookingAttempt, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attempts: %w", err)
+	}
+	defer rows.Close()
+
+	attempts := []BookingAttempt{}
+	for rows.Next() {
+		var a BookingAttempt
+		var seatIDs string
+		var partnerID *int
+		if err := rows.Scan(&a.ID, &a.BookingID, &a.UserID, &a.ShowID, &seatIDs, &a.Strategy, &a.ClientIP,
+			&a.ForwardedFor, &a.UserAgent, &partnerID, &a.Outcome, &a.HTTPStatus, &a.Error,
+			&a.DurationMs, &a.AttemptedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan attempt: %w", err)
+		}
+		a.PartnerID = partnerID
+		a.SeatIDs = splitInts(seatIDs)
+		attempts = append(attempts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating attempt rows: %w", err)
+	}
+	return attempts, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// Booking lifecycle. A booking is HELD once a strategy has reserved its seats and
+// PENDING_PAYMENT once its checkout is open. The payment result CONFIRMS it or CANCELS it, the
+// reaper EXPIRES a hold that ran out, abandoning CANCELS it, and a refund of all its seats
+// makes it REFUNDED. Every move goes through transitionBooking, in the same transaction as
+// the seat writes it describes: it locks the booking's row, checks the move, updates
+// bookings.state and records it in booking_transitions, with the event the outbox publishes
+// for it (outbox.go) and, for a move that ends it, the client's callback (booking_callbacks.go).
+// Seat-level states (REVIEW, REFUND_PENDING) don't move the booking.
+
+type BookingState string
+
+const (
+	BookingHeld           BookingState = "HELD"
+	BookingPendingPayment BookingState = "PENDING_PAYMENT"
+	BookingConfirmed      BookingState = "CONFIRMED"
+	BookingExpired        BookingState = "EXPIRED"
+	BookingCancelled      BookingState = "CANCELLED"
+	BookingRefunded       BookingState = "REFUNDED"
+)
+
+var ErrIllegalBookingTransition = errors.New("illegal booking state transition")
+
+// bookingTransitions lists where each state can go. HELD goes straight to CONFIRMED when there
+// is nothing to pay, like a seat upgrade to cheaper seats.
+var bookingTransitions = map[BookingState][]BookingState{
+	BookingHeld:           {BookingPendingPayment, BookingConfirmed, BookingExpired, BookingCancelled},
+	BookingPendingPayment: {BookingConfirmed, BookingExpired, BookingCancelled},
+	BookingConfirmed:      {BookingRefunded},
+}
+
+func (s BookingState) CanTransitionTo(to BookingState) bool {
+	return slices.Contains(bookingTransitions[s], to)
+}
+
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// bookingState returns the booking's current state, or "" when there is no such booking.
+func bookingState(ctx context.Context, q rowQueryer, bookingID string) (BookingState, error) {
+	return readBookingState(ctx, q, bookingID, "")
+}
+
+// lockBookingState is bookingState that also locks the booking's row for the transaction.
+func lockBookingState(ctx context.Context, tx *sql.Tx, bookingID string) (BookingState, error) {
+	return readBookingState(ctx, tx, bookingID, "FOR UPDATE")
+}
+
+func readBookingState(ctx context.Context, q rowQueryer, bookingID, lock string) (BookingState, error) {
+	var state BookingState
+	err := q.QueryRowContext(ctx, `SELECT state FROM bookings WHERE id = ? `+lock, bookingID).Scan(&state)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load booking state: %w", err)
+	}
+	return state, nil
+}
+
+// recordBookingTransition appends the move to the booking's audit trail.
+func recordBookingTransition(ctx context.Context, tx *sql.Tx, bookingID string, from, to BookingState, reason string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO booking_transitions (booking_id, from_state, to_state, reason)
+		VALUES (?, ?, ?, ?)
+	`, bookingID, string(from), string(to), reason)
+	if err != nil {
+		return fmt.Errorf("failed to record booking transition: %w", err)
+	}
+	if err := writeOutboxEvent(ctx, tx, bookingID, to, reason); err != nil {
+		return err
+	}
+	if err := queueBookingCallback(ctx, tx, bookingID, to, reason); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "State transition", "component", "booking", "booking_id", bookingID, "from", from, "to", to, "reason", reason)
+	return nil
+}
+
+// transitionBooking moves the booking to state `to` within tx, failing with
+// ErrIllegalBookingTransition if its current state can't go there. Moving to the state it is
+// already in is a no-op, so callers that touch a booking in several steps (reaper batches)
+// can call it every time. Bookings start out HELD through recordBookingHold.
+func transitionBooking(ctx context.Context, tx *sql.Tx, bookingID string, to BookingState, reason string) error {
+	from, err := lockBookingState(ctx, tx, bookingID)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+	if from == "" {
+		return fmt.Errorf("%w: booking %s doesn't exist", ErrIllegalBookingTransition, bookingID)
+	}
+	if !from.CanTransitionTo(to) {
+		slog.WarnContext(ctx, "Illegal state transition refused", "component", "booking", "booking_id", bookingID, "from", from, "to", to, "reason", reason)
+		return fmt.Errorf("%w: booking %s is %s, can't become %s", ErrIllegalBookingTransition, bookingID, from, to)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE bookings SET state = ?, updated_at = ? WHERE id = ?`, string(to), time.Now(), bookingID)
+	if err != nil {
+		return fmt.Errorf("failed to update booking state: %w", err)
+	}
+	return recordBookingTransition(ctx, tx, bookingID, from, to, reason)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Long-polling /api/booking-status. With ?wait=30s the request is held until the booking is no
+// longer PENDING (or, queued, ACCEPTED or PROCESSING), or the wait is over, and then answered
+// as usual, so a client waiting on a payment asks once per wait instead of once a second.
+//
+// A held booking only leaves PENDING by moving its seats, confirmed, released or flagged, so
+// the request listens on the seat feed of the booking's show (seat_status_feed.go), which every
+// instance gets from the relay, and re-reads the booking when one of its seats changes. Queued
+// bookings and anything the feed misses are caught by re-reading every bookingWaitRecheck.
+
+const (
+	maxBookingStatusWait = 60 * time.Second
+	bookingWaitRecheck   = 2 * time.Second
+	// bookingWaitMargin is left of the request's deadline to answer in.
+	bookingWaitMargin = 1 * time.Second
+)
+
+// parseBookingStatusWait reads the wait parameter, 0 when there is none.
+func parseBookingStatusWait(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(v)
+	if err != nil || wait < 0 {
+		return 0, errors.New("wait must be a duration like 30s")
+	}
+	return min(wait, maxBookingStatusWait), nil
+}
+
+// bookingStillPending reports whether a booking reported with status may yet move on its own.
+func bookingStillPending(status string) bool {
+	return status == "PENDING" || status == AsyncBookingAccepted || status == AsyncBookingProcessing
+}
+
+// currentBookingStatus is the status /api/booking-status reports for the booking, "" when
+// there is no such booking.
+func currentBookingStatus(ctx context.Context, bookingID string) (string, error) {
+	state, status, err := bookingStatus(ctx, db, bookingID)
+	if err != nil {
+		return "", err
+	}
+	if state == "" && asyncBookingEnabled() {
+		return asyncBookingStatus(ctx, bookingID)
+	}
+	return status, nil
+}
+
+// awaitBookingStatus returns once the booking is no longer pending, when wait is over or the
+// request's deadline is close, whichever is first. The caller reads the status afterwards.
+func awaitBookingStatus(ctx context.Context, bookingID string, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	if d, ok := ctx.Deadline(); ok && d.Add(-bookingWaitMargin).Before(deadline) {
+		deadline = d.Add(-bookingWaitMargin)
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	recheck := time.NewTicker(bookingWaitRecheck)
+	defer recheck.Stop()
+
+	var sub *seatFeedSubscriber
+	var showID int
+	var seatIDs []int
+	defer func() {
+		if sub != nil {
+			seatFeed.unsubscribe(showID, sub)
+		}
+	}()
+
+	for {
+		status, err := currentBookingStatus(ctx, bookingID)
+		if err != nil {
+			return err
+		}
+		if !bookingStillPending(status) {
+			return nil
+		}
+		if sub == nil && status == "PENDING" {
+			// Subscribed, then read again, so no move of its seats falls between the two.
+			if showID, seatIDs, err = bookingShowSeats(ctx, bookingID); err != nil {
+				return err
+			}
+			sub = seatFeed.subscribe(showID)
+			continue
+		}
+
+		if !waitForBookingChange(ctx, sub, seatIDs, timer.C, recheck.C) {
+			return nil
+		}
+	}
+}
+
+// waitForBookingChange blocks until one of seatIDs changes on sub, if there is one, or the
+// recheck ticks. It returns false when the wait is over.
+func waitForBookingChange(ctx context.Context, sub *seatFeedSubscriber, seatIDs []int, expired, recheck <-chan time.Time) bool {
+	var messages <-chan interface{}
+	var dropped <-chan struct{}
+	if sub != nil {
+		messages, dropped = sub.messages, sub.dropped
+	}
+	for {
+		select {
+		case message := <-messages:
+			if change, ok := message.(SeatStatusChange); ok && slices.Contains(seatIDs, change.SeatID) {
+				return true
+			}
+		case <-recheck:
+			return true
+		case <-dropped:
+			// The feed gave up on us or is shutting down: answer with what there is.
+			return false
+		case <-expired:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// bookingShowSeats returns the show and the seats of a booking.
+func bookingShowSeats(ctx context.Context, bookingID string) (int, []int, error) {
+	var showID int
+	if err := db.QueryRowContext(ctx, `SELECT show_id FROM bookings WHERE id = ?`, bookingID).Scan(&showID); err != nil {
+		return 0, nil, fmt.Errorf("failed to load booking show: %w", err)
+	}
+	seatIDs, err := bookingSeatIDs(ctx, db, bookingID)
+	if err != nil {
+		return 0, nil, err
+	}
+	return showID, seatIDs, nil
+}
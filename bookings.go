@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Bookings. A booking is its own row in bookings, keyed by the booking id the strategies hold
+// seats under (seats.payment_session_id), with the seats it took in booking_seats. The
+// booking carries its state and everything about its checkout; seats only carry the hold
+// itself (is_reserved, user_id, payment_status, payment_timeout). booking_seats outlives
+// the hold, so a booking that expired or was refunded still knows which seats it had.
+
+// bookingCheckout is the gateway checkout stored on a booking.
+type bookingCheckout struct {
+	RedirectURL       sql.NullString
+	ProviderSessionID sql.NullString
+	AmountCents       sql.NullInt64
+	Currency          sql.NullString
+}
+
+// recordBookingHold creates the booking for seats a strategy just reserved, HELD, or adds the
+// seats to it when the booking is already being held in several steps (bulk chunks). It fails
+// with ErrSeatLimitExceeded when the seats take the user over the seat limit (seat_limit.go).
+func recordBookingHold(ctx context.Context, tx *sql.Tx, bookingID string, userID int, seatIDs []int, redirectURL string) error {
+	state, err := lockBookingState(ctx, tx, bookingID)
+	if err != nil {
+		return err
+	}
+	var showID int
+	if err := tx.QueryRowContext(ctx, `SELECT show_id FROM seats WHERE id = ?`, seatIDs[0]).Scan(&showID); err != nil {
+		return fmt.Errorf("failed to load booking show: %w", err)
+	}
+	if err := checkSeatLimit(ctx, tx, userID, showID); err != nil {
+		return err
+	}
+	switch state {
+	case "":
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO bookings (id, user_id, show_id, state, payment_redirect_url, callback_url)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, bookingID, userID, showID, string(BookingHeld), redirectURL, nullString(bookingCallbackFromContext(ctx)))
+		if err != nil {
+			return fmt.Errorf("failed to create booking: %w", err)
+		}
+		if err := recordBookingTransition(ctx, tx, bookingID, "", BookingHeld, "seats reserved"); err != nil {
+			return err
+		}
+	case BookingHeld:
+	default:
+		return fmt.Errorf("%w: booking %s is %s, can't hold more seats", ErrIllegalBookingTransition, bookingID, state)
+	}
+	return addBookingSeats(ctx, tx, bookingID, seatIDs)
+}
+
+func addBookingSeats(ctx context.Context, tx *sql.Tx, bookingID string, seatIDs []int) error {
+	values := make([]interface{}, 0, 2*len(seatIDs))
+	placeholders := ""
+	for i, seatID := range seatIDs {
+		if i > 0 {
+			placeholders += ", "
+		}
+		placeholders += "(?, ?)"
+		values = append(values, bookingID, seatID)
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO booking_seats (booking_id, seat_id) VALUES `+placeholders, values...)
+	if err != nil {
+		return fmt.Errorf("failed to record booking seats: %w", err)
+	}
+	return nil
+}
+
+// moveBookingSeats replaces seats `from` of the booking with seats `to`, for seat upgrades and
+// seat changes; either may be empty.
+func moveBookingSeats(ctx context.Context, tx *sql.Tx, bookingID string, from, to []int) error {
+	if len(from) > 0 {
+		if err := dropBookingSeats(ctx, tx, bookingID, from); err != nil {
+			return err
+		}
+	}
+	if len(to) == 0 {
+		return nil
+	}
+	return addBookingSeats(ctx, tx, bookingID, to)
+}
+
+func dropBookingSeats(ctx context.Context, tx *sql.Tx, bookingID string, seatIDs []int) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		DELETE FROM booking_seats WHERE booking_id = ? AND seat_id IN (%s)
+	`, generatePlaceholders(len(seatIDs))), append([]interface{}{bookingID}, sliceToInterface(seatIDs)...)...)
+	if err != nil {
+		return fmt.Errorf("failed to drop booking seats: %w", err)
+	}
+	return nil
+}
+
+// bookingSeatIDs returns the seats the booking holds or held.
+func bookingSeatIDs(ctx context.Context, q queryer, bookingID string) ([]int, error) {
+	rows, err := q.QueryContext(ctx, `SELECT seat_id FROM booking_seats WHERE booking_id = ? ORDER BY seat_id`, bookingID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load booking seats: %w", err)
+	}
+	defer rows.Close()
+
+	var seatIDs []int
+	for rows.Next() {
+		var seatID int
+		if err := rows.Scan(&seatID); err != nil {
+			return nil, fmt.Errorf("failed to scan booking seat: %w", err)
+		}
+		seatIDs = append(seatIDs, seatID)
+	}
+	return seatIDs, rows.Err()
+}
+
+// setBookingCheckout stores the checkout opened for the booking and what it has to be paid.
+func setBookingCheckout(ctx context.Context, tx *sql.Tx, bookingID string, session PaymentSession, amountCents int64, currency string) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE bookings
+		SET provider_session_id = ?, payment_redirect_url = ?, provider_session_opened_at = ?,
+		    payment_amount_cents = ?, payment_currency = ?, updated_at = ?
+		WHERE id = ?
+	`, session.ID, session.RedirectURL, time.Now(), amountCents, currency, time.Now(), bookingID)
+	if err != nil {
+		return fmt.Errorf("failed to store checkout: %w", err)
+	}
+	return nil
+}
+
+// loadBookingCheckout returns the booking's checkout; all fields are null when there is no
+// such booking or no checkout was opened for it.
+func loadBookingCheckout(ctx context.Context, q rowQueryer, bookingID string) (bookingCheckout, error) {
+	var checkout bookingCheckout
+	err := q.QueryRowContext(ctx, `
+		SELECT payment_redirect_url, provider_session_id, payment_amount_cents, payment_currency
+		FROM bookings WHERE id = ?
+	`, bookingID).Scan(&checkout.RedirectURL, &checkout.ProviderSessionID, &checkout.AmountCents, &checkout.Currency)
+	if err != nil && err != sql.ErrNoRows {
+		return checkout, fmt.Errorf("failed to load checkout: %w", err)
+	}
+	return checkout, nil
+}
+
+// bookingPaymentStatus is the payment status /api/booking-status has always reported, for a
+// booking state.
+func bookingPaymentStatus(state BookingState) string {
+	switch state {
+	case BookingHeld, BookingPendingPayment:
+		return "PENDING"
+	case BookingConfirmed:
+		return "COMPLETED"
+	case BookingExpired, BookingCancelled:
+		return "FAILED"
+	default:
+		return string(state)
+	}
+}
+
+// bookingStatus returns the booking's state and the payment status /api/booking-status
+// reports for it, or "" for both when there is no such booking. A booking's seats can be
+// flagged on their own, REVIEW for a payment that didn't match or REFUND_PENDING while a
+// refund is out, and that is what gets reported then.
+func bookingStatus(ctx context.Context, q rowQueryer, bookingID string) (BookingState, string, error) {
+	state, err := bookingState(ctx, q, bookingID)
+	if err != nil || state == "" {
+		return state, "", err
+	}
+
+	var flagged sql.NullString
+	err = q.QueryRowContext(ctx, `
+		SELECT MAX(payment_status) FROM seats
+		WHERE payment_session_id = ? AND payment_status IN ('REVIEW', 'REFUND_PENDING')
+	`, bookingID).Scan(&flagged)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load seat statuses: %w", err)
+	}
+	if flagged.Valid {
+		return state, flagged.String, nil
+	}
+	return state, bookingPaymentStatus(state), nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// Bulk booking. Requests above strategyConfig.Bulk.MaxSeatsPerRequest (school groups, corporate
+// blocks) don't go through the requested strategy: one FOR UPDATE over 80 rows holds locks on
+// a large part of the show for the whole transaction and everyone else queues behind it.
+// Instead the seats are sorted and reserved in chunks, each in its own short transaction, so
+// other bookings interleave between chunks. Sorting gives every bulk booking the same lock
+// order, so two of them can't deadlock. The coordinator is all-or-nothing: if a chunk fails,
+// the chunks already committed are released again. The hold is longer than the usual minute
+// because a group payment takes longer.
+
+// BulkBooking reserves seatIDs chunk by chunk under one payment session.
+func BulkBooking(ctx context.Context, db *sql.DB, userID int, seatIDs []int, bookingId string) (err error) {
+	cfg := strategyConfig.Bulk
+	slog.InfoContext(ctx, "Starting bulk booking", "component", "booking", "user_id", userID, "seats", len(seatIDs), "chunk_size", cfg.ChunkSize)
+
+	ordered := append([]int(nil), seatIDs...)
+	sort.Ints(ordered)
+
+	sessionID := bookingId
+	redirectURL := mockPaymentRedirectURL(sessionID)
+	holdUntil := time.Now().Add(time.Duration(cfg.HoldTimeout))
+
+	reserved := 0
+	defer func() {
+		if err != nil && reserved > 0 {
+			slog.InfoContext(ctx, "Rolling back bulk booking", "component", "booking", "user_id", userID, "session_id", sessionID, "reserved", reserved)
+			// The request may be what failed, the release still has to happen.
+			if _, releaseErr := releaseBookingHold(context.WithoutCancel(ctx), bookingId, userID); releaseErr != nil {
+				slog.ErrorContext(ctx, "Failed to roll back bulk booking", "component", "booking", "session_id", sessionID, "error", releaseErr)
+			}
+		}
+	}()
+
+	for start := 0; start < len(ordered); start += cfg.ChunkSize {
+		chunk := ordered[start:min(start+cfg.ChunkSize, len(ordered))]
+		setBookingPhase(ctx, fmt.Sprintf("chunk_%d", start/cfg.ChunkSize+1))
+		if err := reserveBulkChunk(ctx, db, userID, chunk, sessionID, redirectURL, holdUntil); err != nil {
+			slog.ErrorContext(ctx, "Bulk chunk failed", "component", "booking", "user_id", userID, "chunk", chunk, "error", err)
+			return err
+		}
+		reserved += len(chunk)
+	}
+
+	slog.InfoContext(ctx, "Successfully completed bulk booking", "component", "booking", "user_id", userID, "session_id", sessionID, "seats", reserved, "hold_until", holdUntil)
+	return nil
+}
+
+func reserveBulkChunk(ctx context.Context, db *sql.DB, userID int, chunk []int, sessionID, redirectURL string, holdUntil time.Time) error {
+	return runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		var seats map[int]SeatAvailability
+		err := withLockWaitTimeout(ctx, tx, time.Duration(strategyConfig.Pessimistic.LockWaitTimeout), func() (err error) {
+			seats, err = readSeatAvailability(ctx, tx, chunk, seatLockForUpdate)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to lock seats: %w", err)
+		}
+		if unavailable := unavailableSeats(chunk, seats); len(unavailable) > 0 {
+			return fmt.Errorf("seats %v are not available", unavailable)
+		}
+
+		if err := markSeatsReserved(ctx, tx, userID, chunk, sessionID, redirectURL); err != nil {
+			return fmt.Errorf("failed to mark seats as reserved: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+			UPDATE seats SET payment_timeout = ? WHERE id IN (%s)
+		`, generatePlaceholders(len(chunk))), append([]interface{}{holdUntil}, sliceToInterface(chunk)...)...)
+		if err != nil {
+			return fmt.Errorf("failed to extend hold: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// Cancellation. DELETE /api/bookings/{id} lets the user holding a booking that isn't paid yet
+// (HELD or PENDING_PAYMENT) call it off: its checkout is closed at the gateway first, so it
+// can't be paid any more, then its seats are released and its Redis locks dropped as on
+// abandon (abandon.go), and the booking becomes CANCELLED. When the gateway won't close the
+// checkout, because it was paid meanwhile or can't be reached, nothing is released; a paid
+// booking is cancelled with a refund (refunds.go).
+
+type CancelBookingRequest struct {
+	UserID int `json:"user_id"`
+}
+
+type CancelBookingResponse struct {
+	BookingID     string       `json:"booking_id"`
+	State         BookingState `json:"state"`
+	ReleasedSeats []int        `json:"released_seats"`
+}
+
+// handleCancelBooking serves DELETE /api/bookings/{id}. Like abandon, the caller must name the
+// user that holds the booking.
+func handleCancelBooking(w http.ResponseWriter, r *http.Request) {
+	bookingID := r.PathValue("id")
+
+	var req CancelBookingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Cancellation requested", "component", "api", "booking_id", bookingID, "user_id", req.UserID, "ip", r.RemoteAddr)
+
+	var userID int
+	var state BookingState
+	err := db.QueryRowContext(r.Context(), `
+		SELECT user_id, state FROM bookings WHERE id = ?
+	`, bookingID).Scan(&userID, &state)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && userID != req.UserID) {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load booking", "component", "api", "booking_id", bookingID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := CancelBookingResponse{BookingID: bookingID, State: state, ReleasedSeats: []int{}}
+	switch state {
+	case BookingHeld, BookingPendingPayment:
+	case BookingCancelled:
+		// Already cancelled: a retry gets the same answer.
+		writeCancelBooking(w, resp)
+		return
+	default:
+		http.Error(w, "Booking is "+string(state)+" and can't be cancelled", http.StatusConflict)
+		return
+	}
+
+	released, err := releaseBookingHold(r.Context(), bookingID, req.UserID)
+	if errors.Is(err, errCheckoutNotClosed) {
+		slog.WarnContext(r.Context(), "Gateway refused to close checkout", "component", "api", "booking_id", bookingID, "provider", paymentProvider.Name(), "error", err)
+		http.Error(w, "The checkout couldn't be closed at the payment gateway; it may have been paid", http.StatusBadGateway)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to cancel booking", "component", "api", "booking_id", bookingID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(released) == 0 {
+		// The hold ended or was paid while the checkout was being closed.
+		state, err := bookingState(r.Context(), db, bookingID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to load booking state", "component", "api", "booking_id", bookingID, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if state != BookingCancelled {
+			http.Error(w, "Booking is "+string(state)+" and can't be cancelled", http.StatusConflict)
+			return
+		}
+		resp.State = state
+		writeCancelBooking(w, resp)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Booking cancelled", "component", "api", "booking_id", bookingID, "user_id", req.UserID, "seats", released)
+	resp.State = BookingCancelled
+	resp.ReleasedSeats = released
+	writeCancelBooking(w, resp)
+}
+
+func writeCancelBooking(w http.ResponseWriter, resp CancelBookingResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
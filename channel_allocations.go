@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Seats handed to a partner channel are marked reserved with payment_status PENDING and an
+// allocation_id, but no payment_timeout, so the payment reclaimer never touches them. Only
+// releaseExpiredAllocations returns them to general inventory. Every endpoint needs a partner
+// key with channels:write (partner_keys.go), which acts for the channel named like its
+// partner: it allocates for that channel only, and other channels' allocations are not found.
+
+type AllocationRequest struct {
+	Channel     string `json:"channel"`
+	ShowID      int    `json:"show_id"`
+	Quantity    int    `json:"quantity"`
+	HoldMinutes int    `json:"hold_minutes"`
+}
+
+type AllocationResponse struct {
+	AllocationID int       `json:"allocation_id"`
+	Channel      string    `json:"channel"`
+	ShowID       int       `json:"show_id"`
+	Status       string    `json:"status"`
+	HoldUntil    time.Time `json:"hold_until"`
+	HeldSeatIDs  []int     `json:"held_seat_ids"`
+	ClaimedSeats int       `json:"claimed_seats"`
+}
+
+type ClaimRequest struct {
+	AllocationID int   `json:"allocation_id"`
+	SeatIDs      []int `json:"seat_ids"`
+}
+
+var errAllocationRejected = errors.New("allocation rejected")
+
+func handleChannelAllocate(w http.ResponseWriter, r *http.Request) {
+	slog.DebugContext(r.Context(), "Allocation request", "component", "channel", "ip", r.RemoteAddr)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AllocationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Channel == "" || req.Quantity <= 0 {
+		slog.WarnContext(r.Context(), "Invalid allocation request", "component", "channel", "ip", r.RemoteAddr, "error", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	partner, _ := partnerFromContext(r.Context())
+	if req.Channel != partner.PartnerName || !partner.canAccessShow(req.ShowID) {
+		slog.WarnContext(r.Context(), "Allocation for another channel or show", "component", "channel", "partner", partner.PartnerName, "channel", req.Channel, "show_id", req.ShowID)
+		http.Error(w, "API key not valid for this channel or show", http.StatusForbidden)
+		return
+	}
+
+	resp, err := allocateChannelSeats(r.Context(), req)
+	if errors.Is(err, errAllocationRejected) {
+		slog.WarnContext(r.Context(), "Allocation rejected", "component", "channel", "channel", req.Channel, "show_id", req.ShowID, "error", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Allocation failed", "component", "channel", "channel", req.Channel, "show_id", req.ShowID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Allocated seats", "component", "channel", "channel", req.Channel, "allocation_id", resp.AllocationID, "seat_ids", resp.HeldSeatIDs, "hold_until", resp.HoldUntil)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func allocateChannelSeats(ctx context.Context, req AllocationRequest) (*AllocationResponse, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := tagSeatAudit(ctx, tx, seatAuditFromContext(ctx)); err != nil {
+		return nil, err
+	}
+
+	// Locking the channel row serializes quota checks for concurrent allocations.
+	var channelID, seatQuota, maxHoldMinutes int
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, seat_quota, max_hold_minutes FROM sales_channels WHERE name = ? FOR UPDATE
+	`, req.Channel).Scan(&channelID, &seatQuota, &maxHoldMinutes)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: unknown channel %s", errAllocationRejected, req.Channel)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load channel: %w", err)
+	}
+
+	holdMinutes := req.HoldMinutes
+	if holdMinutes <= 0 {
+		holdMinutes = maxHoldMinutes
+	}
+	if holdMinutes > maxHoldMinutes {
+		return nil, fmt.Errorf("%w: hold of %d minutes exceeds channel maximum of %d", errAllocationRejected, holdMinutes, maxHoldMinutes)
+	}
+
+	var outstanding int
+	err = tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM seats s
+		JOIN channel_allocations a ON s.allocation_id = a.id
+		WHERE a.channel_id = ? AND a.show_id = ? AND a.status = 'ACTIVE' AND s.payment_status = 'PENDING'
+	`, channelID, req.ShowID).Scan(&outstanding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count outstanding allocations: %w", err)
+	}
+	if outstanding+req.Quantity > seatQuota {
+		return nil, fmt.Errorf("%w: quota exceeded (%d held, %d requested, quota %d)", errAllocationRejected, outstanding, req.Quantity, seatQuota)
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id FROM seats
+		WHERE show_id = ? AND (is_reserved = 0 OR (is_reserved = 1 AND payment_status = 'FAILED'))
+		ORDER BY id
+		LIMIT ?
+		FOR UPDATE
+	`, req.ShowID, req.Quantity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select seats: %w", err)
+	}
+	var seatIDs []int
+	for rows.Next() {
+		var seatID int
+		if err := rows.Scan(&seatID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan seat: %w", err)
+		}
+		seatIDs = append(seatIDs, seatID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating seat rows: %w", err)
+	}
+	if len(seatIDs) != req.Quantity {
+		return nil, fmt.Errorf("%w: only %d of %d seats available", errAllocationRejected, len(seatIDs), req.Quantity)
+	}
+
+	holdUntil := time.Now().Add(time.Duration(holdMinutes) * time.Minute)
+	allocationID, err := insertReturningID(ctx, tx, `
+		INSERT INTO channel_allocations (channel_id, show_id, hold_until) VALUES (?, ?, ?)
+	`, channelID, req.ShowID, holdUntil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create allocation: %w", err)
+	}
+
+	updateQuery := fmt.Sprintf(`
+		UPDATE seats
+		SET is_reserved = 1,
+		    payment_status = 'PENDING',
+		    allocation_id = ?,
+		    user_id = NULL,
+		    payment_timeout = NULL,
+		    payment_session_id = NULL
+		WHERE id IN (%s)`, generatePlaceholders(len(seatIDs)))
+	updateArgs := append([]interface{}{allocationID}, sliceToInterface(seatIDs)...)
+	if _, err := tx.ExecContext(ctx, updateQuery, updateArgs...); err != nil {
+		return nil, fmt.Errorf("failed to allocate seats: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &AllocationResponse{
+		AllocationID: allocationID,
+		Channel:      req.Channel,
+		ShowID:       req.ShowID,
+		Status:       "ACTIVE",
+		HoldUntil:    holdUntil,
+		HeldSeatIDs:  seatIDs,
+	}, nil
+}
+
+// handleChannelClaim confirms seats the partner has sold out of an active allocation.
+func handleChannelClaim(w http.ResponseWriter, r *http.Request) {
+	slog.DebugContext(r.Context(), "Claim request", "component", "channel", "ip", r.RemoteAddr)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ClaimRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.SeatIDs) == 0 {
+		slog.WarnContext(r.Context(), "Invalid claim request", "component", "channel", "ip", r.RemoteAddr, "error", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	partner, _ := partnerFromContext(ctx)
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to begin transaction", "component", "channel", "allocation_id", req.AllocationID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if err := tagSeatAudit(ctx, tx, seatAuditFromContext(ctx)); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to begin transaction", "component", "channel", "allocation_id", req.AllocationID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var status string
+	var holdUntil time.Time
+	err = tx.QueryRowContext(ctx, `
+		SELECT status, hold_until FROM channel_allocations
+		WHERE id = ? AND channel_id = (SELECT id FROM sales_channels WHERE name = ?)
+		FOR UPDATE
+	`, req.AllocationID, partner.PartnerName).Scan(&status, &holdUntil)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Allocation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load allocation", "component", "channel", "allocation_id", req.AllocationID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if status != "ACTIVE" || time.Now().After(holdUntil) {
+		slog.InfoContext(r.Context(), "Claim on inactive allocation", "component", "channel", "allocation_id", req.AllocationID, "status", status)
+		http.Error(w, "Allocation is no longer active", http.StatusConflict)
+		return
+	}
+
+	claimQuery := fmt.Sprintf(`
+		UPDATE seats
+		SET payment_status = 'COMPLETED'
+		WHERE allocation_id = ? AND payment_status = 'PENDING' AND id IN (%s)`, generatePlaceholders(len(req.SeatIDs)))
+	claimArgs := append([]interface{}{req.AllocationID}, sliceToInterface(req.SeatIDs)...)
+	result, err := tx.ExecContext(ctx, claimQuery, claimArgs...)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to claim seats", "component", "channel", "allocation_id", req.AllocationID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if int(rowsAffected) != len(req.SeatIDs) {
+		slog.InfoContext(r.Context(), "Seats not held by allocation", "component", "channel", "allocation_id", req.AllocationID, "seat_ids", req.SeatIDs)
+		http.Error(w, "Some seats are not held by this allocation", http.StatusConflict)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to commit claim", "component", "channel", "allocation_id", req.AllocationID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Claimed seats", "component", "channel", "allocation_id", req.AllocationID, "seat_ids", req.SeatIDs)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+func handleChannelAllocationStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	allocationID, err := strconv.Atoi(r.URL.Query().Get("allocation_id"))
+	if err != nil {
+		http.Error(w, "Allocation ID is required", http.StatusBadRequest)
+		return
+	}
+
+	partner, _ := partnerFromContext(r.Context())
+	resp := AllocationResponse{AllocationID: allocationID, HeldSeatIDs: []int{}}
+	err = db.QueryRowContext(r.Context(), `
+		SELECT c.name, a.show_id, a.status, a.hold_until
+		FROM channel_allocations a JOIN sales_channels c ON a.channel_id = c.id
+		WHERE a.id = ? AND c.name = ?
+	`, allocationID, partner.PartnerName).Scan(&resp.Channel, &resp.ShowID, &resp.Status, &resp.HoldUntil)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Allocation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load allocation", "component", "channel", "allocation_id", allocationID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT id, payment_status FROM seats WHERE allocation_id = ?`, allocationID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load allocation seats", "component", "channel", "allocation_id", allocationID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var seatID int
+		var paymentStatus string
+		if err := rows.Scan(&seatID, &paymentStatus); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if paymentStatus == "COMPLETED" {
+			resp.ClaimedSeats++
+		} else {
+			resp.HeldSeatIDs = append(resp.HeldSeatIDs, seatID)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// releaseExpiredAllocations returns unclaimed allocation seats to general inventory once the
+// allocation's hold deadline passes.
+func releaseExpiredAllocations() error {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !runsMaintenance() {
+			continue
+		}
+
+		tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+		if err != nil {
+			slog.Error("Error starting transaction", "component", "channel", "error", err)
+			continue
+		}
+		if err := tagSeatAudit(ctx, tx, SeatAudit{Source: SeatAuditAllocations}); err != nil {
+			tx.Rollback()
+			slog.Error("Error starting transaction", "component", "channel", "error", err)
+			continue
+		}
+
+		rows, err := tx.QueryContext(ctx, `
+			SELECT id FROM channel_allocations
+			WHERE status = 'ACTIVE' AND hold_until < NOW()
+			FOR UPDATE
+		`)
+		if err != nil {
+			tx.Rollback()
+			slog.Error("Error querying expired allocations", "component", "channel", "error", err)
+			continue
+		}
+
+		var expired []int
+		for rows.Next() {
+			var allocationID int
+			if err := rows.Scan(&allocationID); err != nil {
+				slog.Error("Error scanning allocation", "component", "channel", "error", err)
+				continue
+			}
+			expired = append(expired, allocationID)
+		}
+		rows.Close()
+
+		for _, allocationID := range expired {
+			result, err := tx.ExecContext(ctx, `
+				UPDATE seats
+				SET is_reserved = 0,
+				    allocation_id = NULL
+				WHERE allocation_id = ? AND payment_status = 'PENDING'
+			`, allocationID)
+			if err != nil {
+				slog.Error("Error releasing seats for allocation", "component", "channel", "allocation_id", allocationID, "error", err)
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE channel_allocations SET status = 'RELEASED' WHERE id = ?`, allocationID); err != nil {
+				slog.Error("Error marking allocation released", "component", "channel", "allocation_id", allocationID, "error", err)
+				continue
+			}
+			released, _ := result.RowsAffected()
+			slog.Warn("Released expired allocation", "component", "channel", "allocation_id", allocationID, "seats", released)
+		}
+
+		if err := tx.Commit(); err != nil {
+			slog.Error("Error committing transaction", "component", "channel", "error", err)
+		}
+	}
+
+	return errors.New("ending allocation release function")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Subcommands. They all load the same config (see strategy_config.go), so operational jobs
+// can run next to the service without starting the HTTP server. With no subcommand the
+// binary serves, as `go run .` always has.
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string)
+}
+
+var commands = []command{
+	{"serve", "run the booking API and its background jobs (default)", runServeCommand},
+	{"migrate", "apply the schema migrations the database is missing", runMigrateCommand},
+	{"seed", "generate shows, seats and users", runSeedCommand},
+	{"bench", "run concurrent bookings in-process and report throughput and latency", runBenchCommand},
+	{"reconcile", "settle pending payments the gateway has already settled, once", runReconcileCommand},
+	{"replay-events", "fold a show's seat events back into seat states and compare them with the seats table", runReplayEventsCommand},
+	{"reconcile-locks", "delete seat locks whose seats are free or paid, report holds without a lock", runReconcileLocksCommand},
+}
+
+func runCommand(args []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "-help" {
+		runServeCommand(args)
+		return
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			c.run(args[1:])
+			return
+		}
+	}
+
+	printUsage()
+	if args[0] == "help" || args[0] == "-h" || args[0] == "-help" {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\nunknown command %q\n", args[0])
+	os.Exit(2)
+}
+
+// configFlag adds -config, the YAML config file, to a subcommand's flags.
+func configFlag(flags *flag.FlagSet) *string {
+	return flags.String("config", os.Getenv("CONFIG_FILE"), "YAML config file (default $CONFIG_FILE), see config.example.yaml")
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun %s <command> -h for its flags.\n", os.Args[0])
+}
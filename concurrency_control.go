@@ -3,13 +3,15 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
 
 	"fmt"
-	"log"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/go-redis/redis/v8"
 )
 
 func generatePlaceholders(count int) string {
@@ -27,291 +29,539 @@ func sliceToInterface(ids []int) []interface{} {
 	return args
 }
 
-// PessimisticLocking: First come, first serve approach for seat booking
-func PessimisticLocking(ctx context.Context, db *sql.DB, userID int, seatIDs []int, bookingId string) error {
-	log.Printf("[Booking] Starting pessimistic locking - UserID: %d, Seats: %v", userID, seatIDs)
-
-	if len(seatIDs) == 0 {
-		log.Printf("[Booking] No seat IDs provided - UserID: %d", userID)
-		return fmt.Errorf("no seat IDs provided")
+// joinInts and splitInts store seat id lists in a VARCHAR column.
+func joinInts(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id)
 	}
+	return strings.Join(parts, ",")
+}
 
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{
-		Isolation: sql.LevelSerializable,
-	})
-	if err != nil {
-		log.Printf("[Booking] Failed to begin transaction - UserID: %d, Error: %v", userID, err)
-		return fmt.Errorf("failed to begin transaction: %v", err)
+func splitInts(s string) []int {
+	ids := []int{}
+	for _, part := range strings.Split(s, ",") {
+		if id, err := strconv.Atoi(part); err == nil {
+			ids = append(ids, id)
+		}
 	}
-	defer tx.Rollback()
+	return ids
+}
 
-	// 1. Lock Seats
-	placeholders := generatePlaceholders(len(seatIDs))
-	lockQuery := fmt.Sprintf("SELECT id FROM seats WHERE id IN (%s) AND (is_reserved = 0 OR (is_reserved = 1 AND payment_status = 'FAILED')) FOR UPDATE", placeholders)
-	lockArgs := sliceToInterface(seatIDs)
+// markSeatsReserved moves the given seats into a PENDING payment hold for the booking and
+// records them on it.
+func markSeatsReserved(ctx context.Context, tx *sql.Tx, userID int, seatIDs []int, sessionID, redirectURL string) error {
+	updateQuery := fmt.Sprintf(`
+		UPDATE seats
+		SET is_reserved = 1,
+		    payment_status = 'PENDING',
+			user_id = ?,
+			payment_session_id = ?,
+            payment_timeout = ?
+		WHERE id IN (%s)`, generatePlaceholders(len(seatIDs)))
 
-	log.Printf("[Booking] Attempting to lock seats - UserID: %d, Query: %s, Args: %v", userID, lockQuery, lockArgs)
-	rows, err := tx.QueryContext(ctx, lockQuery, lockArgs...)
+	until, err := holdUntil(ctx, tx, seatIDs)
 	if err != nil {
-		log.Printf("[Booking] Failed to query seats for locking - UserID: %d, Error: %v", userID, err)
-		return fmt.Errorf("failed to query seats for locking: %w", err)
-	}
-	defer rows.Close()
-
-	lockedSeatsCount := 0
-	for rows.Next() {
-		lockedSeatsCount++
-	}
-	if err = rows.Err(); err != nil {
-		log.Printf("[Booking] Error iterating locked seat rows - UserID: %d, Error: %v", userID, err)
-		return fmt.Errorf("error iterating locked seat rows: %w", err)
+		return err
 	}
+	updateArgs := make([]interface{}, 0, len(seatIDs)+3)
+	updateArgs = append(updateArgs, userID)
+	updateArgs = append(updateArgs, sessionID)
+	updateArgs = append(updateArgs, until)
+	updateArgs = append(updateArgs, sliceToInterface(seatIDs)...)
 
-	if lockedSeatsCount != len(seatIDs) {
-		log.Printf("[Booking] Not all seats available - UserID: %d, Requested: %d, Available: %d",
-			userID, len(seatIDs), lockedSeatsCount)
-		return fmt.Errorf("all seats are not available for booking")
+	if _, err := tx.ExecContext(ctx, updateQuery, updateArgs...); err != nil {
+		return err
 	}
+	return recordBookingHold(ctx, tx, sessionID, userID, seatIDs, redirectURL)
+}
 
-	sessionID := bookingId
-	redirectURL := fmt.Sprintf("https://payment-gateway.example.com/pay/%s", sessionID)
-	log.Printf("[Booking] Generated payment session - UserID: %d, SessionID: %s", userID, sessionID)
-
-	// 2. Update Seats
-	updatePlaceholders := generatePlaceholders(len(seatIDs))
+// markSeatsReservedIfAvailable is markSeatsReserved for strategies that don't hold row locks:
+// the availability predicate stays on the UPDATE so seats taken by other strategies in the
+// meantime are not overwritten.
+func markSeatsReservedIfAvailable(ctx context.Context, tx *sql.Tx, userID int, seatIDs []int, sessionID, redirectURL string) error {
 	updateQuery := fmt.Sprintf(`
-		UPDATE seats 
-		SET is_reserved = 1, 
+		UPDATE seats
+		SET is_reserved = 1,
 		    payment_status = 'PENDING',
-			user_id = ?, 
+			user_id = ?,
 			payment_session_id = ?,
-            payment_redirect_url = ?,
             payment_timeout = ?
-		WHERE id IN (%s)`, updatePlaceholders)
+		WHERE id IN (%s)
+		AND (is_reserved = 0 OR (is_reserved = 1 AND payment_status = 'FAILED'))`, generatePlaceholders(len(seatIDs)))
 
-	updateArgs := make([]interface{}, 0, len(seatIDs)+4)
+	until, err := holdUntil(ctx, tx, seatIDs)
+	if err != nil {
+		return err
+	}
+	updateArgs := make([]interface{}, 0, len(seatIDs)+3)
 	updateArgs = append(updateArgs, userID)
 	updateArgs = append(updateArgs, sessionID)
-	updateArgs = append(updateArgs, redirectURL)
-	updateArgs = append(updateArgs, time.Now().Add(time.Minute))
+	updateArgs = append(updateArgs, until)
 	updateArgs = append(updateArgs, sliceToInterface(seatIDs)...)
 
-	log.Printf("[Booking] Updating seats - UserID: %d, SessionID: %s", userID, sessionID)
-	_, err = tx.ExecContext(ctx, updateQuery, updateArgs...)
+	result, err := tx.ExecContext(ctx, updateQuery, updateArgs...)
 	if err != nil {
-		log.Printf("[Booking] Failed to mark seats as reserved - UserID: %d, Error: %v", userID, err)
+		slog.ErrorContext(ctx, "Failed to mark seats as reserved", "component", "booking", "user_id", userID, "error", err)
 		return fmt.Errorf("failed to mark seats as reserved: %w", err)
 	}
 
-	if err := tx.Commit(); err != nil {
-		log.Printf("[Booking] Failed to commit transaction - UserID: %d, Error: %v", userID, err)
-		return fmt.Errorf("failed to commit transaction: %w", err)
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
 	}
-
-	log.Printf("[Booking] Successfully completed pessimistic locking - UserID: %d, SessionID: %s", userID, sessionID)
-	return nil
+	if int(rowsAffected) != len(seatIDs) {
+		slog.WarnContext(ctx, "Not all seats available", "component", "booking", "user_id", userID, "requested", len(seatIDs), "available", rowsAffected)
+		return fmt.Errorf("all seats are not available for booking")
+	}
+	return recordBookingHold(ctx, tx, sessionID, userID, seatIDs, redirectURL)
 }
 
-// OptimisticLocking: Let multiple users try to book, but only first successful payment wins
-func OptimisticLocking(ctx context.Context, db *sql.DB, userID int, seatIDs []int, bookingId string) error {
-	log.Printf("[Booking] Starting optimistic locking - UserID: %d, Seats: %v", userID, seatIDs)
+// ErrSeatsLocked is returned when a no-wait lock finds the seats already locked by another booking.
+var ErrSeatsLocked = errors.New("seats are locked by another booking")
+
+// ErrOptimisticConflict is returned when a seat's version changed between read and update.
+var ErrOptimisticConflict = errors.New("optimistic lock conflict")
+
+// PessimisticLocking: First come, first serve approach for seat booking. With noWait the row
+// locks are taken with NOWAIT, so a competing booking fails with ErrSeatsLocked immediately
+// instead of sitting out the InnoDB lock wait timeout.
+func PessimisticLocking(ctx context.Context, db *sql.DB, userID int, seatIDs []int, bookingId string, noWait bool) error {
+	slog.InfoContext(ctx, "Starting pessimistic locking", "component", "booking", "user_id", userID, "seat_ids", seatIDs, "no_wait", noWait)
 
 	if len(seatIDs) == 0 {
-		log.Printf("[Booking] No seat IDs provided - UserID: %d", userID)
+		slog.InfoContext(ctx, "No seat IDs provided", "component", "booking", "user_id", userID)
 		return fmt.Errorf("no seat IDs provided")
 	}
 
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{
-		Isolation: sql.LevelReadCommitted,
+	sessionID := bookingId
+	redirectURL := mockPaymentRedirectURL(sessionID)
+
+	err := runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelSerializable}, func(tx *sql.Tx) error {
+		// 1. Lock Seats
+		slog.DebugContext(ctx, "Attempting to lock seats", "component", "booking", "user_id", userID, "seat_ids", seatIDs, "no_wait", noWait)
+		setBookingPhase(ctx, "locking_rows")
+		var seats map[int]SeatAvailability
+		var err error
+		if noWait {
+			seats, err = readSeatAvailability(ctx, tx, seatIDs, seatLockForUpdateNoWait)
+		} else {
+			err = withLockWaitTimeout(ctx, tx, time.Duration(strategyConfig.Pessimistic.LockWaitTimeout), func() (err error) {
+				seats, err = readSeatAvailability(ctx, tx, seatIDs, seatLockForUpdate)
+				return err
+			})
+		}
+		if err != nil {
+			if isLockNotAvailable(err) {
+				slog.InfoContext(ctx, "Seats locked by another booking", "component", "booking", "user_id", userID, "seat_ids", seatIDs)
+				return fmt.Errorf("%w: %v", ErrSeatsLocked, err)
+			}
+			slog.ErrorContext(ctx, "Failed to query seats for locking", "component", "booking", "user_id", userID, "error", err)
+			return fmt.Errorf("failed to query seats for locking: %w", err)
+		}
+
+		if unavailable := unavailableSeats(seatIDs, seats); len(unavailable) > 0 {
+			slog.WarnContext(ctx, "Not all seats available", "component", "booking", "user_id", userID, "requested", len(seatIDs), "unavailable", unavailable)
+			return fmt.Errorf("all seats are not available for booking")
+		}
+
+		slog.DebugContext(ctx, "Generated payment session", "component", "booking", "user_id", userID, "session_id", sessionID)
+
+		// 2. Update Seats
+		slog.DebugContext(ctx, "Updating seats", "component", "booking", "user_id", userID, "session_id", sessionID)
+		setBookingPhase(ctx, "updating")
+		if err := markSeatsReserved(ctx, tx, userID, seatIDs, sessionID, redirectURL); err != nil {
+			slog.ErrorContext(ctx, "Failed to mark seats as reserved", "component", "booking", "user_id", userID, "error", err)
+			return fmt.Errorf("failed to mark seats as reserved: %w", err)
+		}
+		return nil
 	})
 	if err != nil {
-		log.Printf("[Booking] Failed to begin transaction - UserID: %d, Error: %v", userID, err)
-		return fmt.Errorf("failed to begin transaction: %v", err)
+		return err
 	}
-	defer tx.Rollback()
 
-	placeholders := generatePlaceholders(len(seatIDs))
-	selectQuery := fmt.Sprintf(`
-		SELECT id, version 
-		FROM seats 
-		WHERE id IN (%s) 
-		AND (is_reserved = 0 OR (is_reserved = 1 AND payment_status = 'FAILED'))`, placeholders)
-	selectArgs := sliceToInterface(seatIDs)
+	slog.InfoContext(ctx, "Successfully completed pessimistic locking", "component", "booking", "user_id", userID, "session_id", sessionID)
+	return nil
+}
 
-	log.Printf("[Booking] Checking seat versions - UserID: %d, Query: %s", userID, selectQuery)
-	rows, err := tx.QueryContext(ctx, selectQuery, selectArgs...)
-	if err != nil {
-		log.Printf("[Booking] Failed to get seat versions - UserID: %d, Error: %v", userID, err)
-		return fmt.Errorf("failed to get seat versions: %w", err)
-	}
-	defer rows.Close()
-
-	seatVersions := make(map[int]int)
-	countFound := 0
-	for rows.Next() {
-		var seatID, version int
-		if err := rows.Scan(&seatID, &version); err != nil {
-			log.Printf("[Booking] Failed to scan seat version - UserID: %d, Error: %v", userID, err)
-			return fmt.Errorf("failed to scan seat version: %v", err)
-		}
-		seatVersions[seatID] = version
-		countFound++
-	}
-	if err = rows.Err(); err != nil {
-		log.Printf("[Booking] Error iterating seat version rows - UserID: %d, Error: %v", userID, err)
-		return fmt.Errorf("error iterating seat version rows: %w", err)
-	}
+// OptimisticLocking: Let multiple users try to book, but only first successful payment wins
+func OptimisticLocking(ctx context.Context, db *sql.DB, userID int, seatIDs []int, bookingId string) error {
+	slog.InfoContext(ctx, "Starting optimistic locking", "component", "booking", "user_id", userID, "seat_ids", seatIDs)
 
-	if countFound != len(seatIDs) {
-		log.Printf("[Booking] Not all seats available - UserID: %d, Requested: %d, Found: %d",
-			userID, len(seatIDs), countFound)
-		return fmt.Errorf("seats are not available or have pending/successful payment")
+	if len(seatIDs) == 0 {
+		slog.InfoContext(ctx, "No seat IDs provided", "component", "booking", "user_id", userID)
+		return fmt.Errorf("no seat IDs provided")
 	}
 
 	sessionID := bookingId
-	redirectURL := fmt.Sprintf("https://payment-gateway.example.com/pay/%s", sessionID)
-	log.Printf("[Booking] Generated payment session - UserID: %d, SessionID: %s", userID, sessionID)
-
-	updateQuery := `	
-		UPDATE seats 
-		SET is_reserved = 1, 
-			user_id = ?, 
-			payment_status = 'PENDING',
-			payment_session_id = ?,
-            payment_redirect_url = ?,
-            payment_timeout = ?,
-			version = version + 1
-		WHERE id = ? 
-		AND version = ? 
-        AND (is_reserved = 0 OR (is_reserved = 1 AND payment_status = 'FAILED')) 
-	`
-	updateArgs := make([]interface{}, 0, 6)
-	updateArgs = append(updateArgs, userID)
-	updateArgs = append(updateArgs, sessionID)
-	updateArgs = append(updateArgs, redirectURL)
-	updateArgs = append(updateArgs, time.Now().Add(time.Minute))
-
-	var updatedSeatIDs []int
-	for _, seatID := range seatIDs {
-		version := seatVersions[seatID]
-		seatUpdateArgs := append(updateArgs, seatID, version)
+	redirectURL := mockPaymentRedirectURL(sessionID)
 
-		log.Printf("[Booking] Updating seat - UserID: %d, SeatID: %d, Version: %d", userID, seatID, version)
-		result, err := tx.ExecContext(ctx, updateQuery, seatUpdateArgs...)
+	reserve := func(tx *sql.Tx) error {
+		slog.DebugContext(ctx, "Checking seat versions", "component", "booking", "user_id", userID, "seat_ids", seatIDs)
+		setBookingPhase(ctx, "reading_versions")
+		seats, err := readSeatAvailability(ctx, tx, seatIDs, seatLockNone)
 		if err != nil {
-			log.Printf("[Booking] Failed to update seat - UserID: %d, SeatID: %d, Error: %v", userID, seatID, err)
-			return fmt.Errorf("failed to update seat %d: %w", seatID, err)
+			slog.ErrorContext(ctx, "Failed to get seat versions", "component", "booking", "user_id", userID, "error", err)
+			return fmt.Errorf("failed to get seat versions: %w", err)
 		}
 
-		rowsAffected, err := result.RowsAffected()
-		if err != nil {
-			log.Printf("[Booking] Failed to get rows affected - UserID: %d, SeatID: %d, Error: %v", userID, seatID, err)
-			return fmt.Errorf("failed to get rows affected for seat %d: %w", seatID, err)
+		if unavailable := unavailableSeats(seatIDs, seats); len(unavailable) > 0 {
+			slog.WarnContext(ctx, "Not all seats available", "component", "booking", "user_id", userID, "requested", len(seatIDs), "unavailable", unavailable)
+			return fmt.Errorf("seats are not available or have pending/successful payment")
 		}
 
-		if rowsAffected == 0 {
-			log.Printf("[Booking] Optimistic lock conflict - UserID: %d, SeatID: %d", userID, seatID)
-			return fmt.Errorf("optimistic lock conflict on seat %d", seatID)
+		slog.DebugContext(ctx, "Generated payment session", "component", "booking", "user_id", userID, "session_id", sessionID)
+
+		updateQuery := `
+			UPDATE seats
+			SET is_reserved = 1,
+				user_id = ?,
+				payment_status = 'PENDING',
+				payment_session_id = ?,
+				payment_timeout = ?,
+				version = version + 1
+			WHERE id = ?
+			AND version = ?
+			AND (is_reserved = 0 OR (is_reserved = 1 AND payment_status = 'FAILED'))
+		`
+		until, err := holdUntil(ctx, tx, seatIDs)
+		if err != nil {
+			return err
 		}
-		updatedSeatIDs = append(updatedSeatIDs, seatID)
+		updateArgs := make([]interface{}, 0, 5)
+		updateArgs = append(updateArgs, userID)
+		updateArgs = append(updateArgs, sessionID)
+		updateArgs = append(updateArgs, until)
+
+		setBookingPhase(ctx, "updating")
+		for _, seatID := range seatIDs {
+			version := seats[seatID].Version
+			seatUpdateArgs := append(updateArgs, seatID, version)
+
+			slog.DebugContext(ctx, "Updating seat", "component", "booking", "user_id", userID, "seat_id", seatID, "version", version)
+			result, err := tx.ExecContext(ctx, updateQuery, seatUpdateArgs...)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to update seat", "component", "booking", "user_id", userID, "seat_id", seatID, "error", err)
+				return fmt.Errorf("failed to update seat %d: %w", seatID, err)
+			}
+
+			rowsAffected, err := result.RowsAffected()
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to get rows affected", "component", "booking", "user_id", userID, "seat_id", seatID, "error", err)
+				return fmt.Errorf("failed to get rows affected for seat %d: %w", seatID, err)
+			}
+
+			if rowsAffected == 0 {
+				slog.WarnContext(ctx, "Optimistic lock conflict", "component", "booking", "user_id", userID, "seat_id", seatID)
+				return fmt.Errorf("%w on seat %d", ErrOptimisticConflict, seatID)
+			}
+		}
+		return recordBookingHold(ctx, tx, sessionID, userID, seatIDs, redirectURL)
 	}
 
-	if err := tx.Commit(); err != nil {
-		log.Printf("[Booking] Failed to commit transaction - UserID: %d, Error: %v", userID, err)
-		return fmt.Errorf("failed to commit transaction: %w", err)
+	// A conflict only means someone else wrote one of the seats between our read and update;
+	// re-reading usually either succeeds or shows the seat as taken.
+	cfg := strategyConfig.Optimistic
+	for retry := 0; ; retry++ {
+		err := runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, reserve)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrOptimisticConflict) || retry >= cfg.MaxRetries {
+			return err
+		}
+
+		backoff := time.Duration(cfg.Backoff) * time.Duration(retry+1)
+		slog.WarnContext(ctx, "Retrying after optimistic conflict", "component", "booking", "user_id", userID, "retry", retry+1, "backoff", backoff)
+		setBookingPhase(ctx, "retry_backoff")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
 	}
 
-	log.Printf("[Booking] Successfully completed optimistic locking - UserID: %d, SessionID: %s", userID, sessionID)
+	slog.InfoContext(ctx, "Successfully completed optimistic locking", "component", "booking", "user_id", userID, "session_id", sessionID)
 	return nil
 }
 
 // CurrentImplementation: Simple approach using Redis locks first, then database transaction
-func BookMyShowTimeoutImp(ctx context.Context, db *sql.DB, redisClient *redis.Client, userID int, seatIDs []int, bookingId string) error {
-	log.Printf("[Booking] Starting timeout-based booking - UserID: %d, Seats: %v", userID, seatIDs)
+func BookMyShowTimeoutImp(ctx context.Context, db *sql.DB, locks LockProvider, userID int, seatIDs []int, bookingId string) error {
+	slog.InfoContext(ctx, "Starting timeout-based booking", "component", "booking", "user_id", userID, "seat_ids", seatIDs)
 
 	if len(seatIDs) == 0 {
-		log.Printf("[Booking] No seat IDs provided - UserID: %d", userID)
+		slog.InfoContext(ctx, "No seat IDs provided", "component", "booking", "user_id", userID)
 		return fmt.Errorf("no seat IDs provided")
 	}
 
-	lockKey := fmt.Sprintf("seat_lock:%d", seatIDs[0])
-	lockValue := fmt.Sprintf("user:%d", userID)
-	lockTimeout := 1 * time.Minute
-
-	log.Printf("[Booking] Attempting to acquire Redis lock - UserID: %d, LockKey: %s", userID, lockKey)
-	locked, err := redisClient.SetNX(ctx, lockKey, lockValue, lockTimeout).Result()
+	// Every seat is locked, all at once or not at all: the Redis provider sets the keys in one
+	// script, so there is never a moment where this booking holds some seats and waits on others.
+	lockKeys, err := lookupSeatLockKeys(ctx, db, seatIDs)
 	if err != nil {
-		log.Printf("[Booking] Redis error while acquiring lock - UserID: %d, Error: %v", userID, err)
-		return fmt.Errorf("failed to check/set Redis lock for key %s: %w", lockKey, err)
+		slog.ErrorContext(ctx, "Failed to build lock keys", "component", "booking", "user_id", userID, "error", err)
+		return err
 	}
-	if !locked {
-		holder, _ := redisClient.Get(ctx, lockKey).Result()
-		log.Printf("[Booking] Failed to acquire Redis lock - UserID: %d, Current Holder: %s", userID, holder)
-		return fmt.Errorf("failed to acquire Redis lock for seats (key: %s), possibly locked by another user", lockKey)
+	lockValue := seatLockOwner(int64(userID))
+	lockTimeout := time.Duration(strategyConfig.Redis.TTL)
+
+	slog.DebugContext(ctx, "Attempting to acquire locks", "component", "booking", "lock_provider", locks.Name(), "user_id", userID, "lock_keys", lockKeys)
+	setBookingPhase(ctx, "redis_lock")
+	token, err := locks.Acquire(ctx, lockKeys, lockValue, lockTimeout)
+	if err != nil {
+		if holder, held := firstLockHolder(ctx, locks, lockKeys); held {
+			slog.InfoContext(ctx, "Failed to acquire locks", "component", "booking", "lock_provider", locks.Name(), "user_id", userID, "holder", holder.Owner)
+		} else {
+			slog.ErrorContext(ctx, "Failed to acquire locks", "component", "booking", "lock_provider", locks.Name(), "user_id", userID, "error", err)
+		}
+		return err
 	}
 
-	log.Printf("[Booking] Acquired Redis lock - UserID: %d, LockKey: %s", userID, lockKey)
+	slog.InfoContext(ctx, "Acquired locks", "component", "booking", "lock_provider", locks.Name(), "user_id", userID, "lock_keys", lockKeys, "token", token)
+	watchLocks(ctx, locks, lockKeys, lockValue, lockTimeout)
+
+	sessionID := bookingId
+	redirectURL := mockPaymentRedirectURL(sessionID)
 
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{
-		Isolation: sql.LevelSerializable,
+	err = runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelSerializable}, func(tx *sql.Tx) error {
+		slog.DebugContext(ctx, "Checking seat availability", "component", "booking", "user_id", userID)
+		setBookingPhase(ctx, "locking_rows")
+		seats, err := readSeatAvailability(ctx, tx, seatIDs, seatLockForUpdate)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to check seat availability", "component", "booking", "user_id", userID, "error", err)
+			return fmt.Errorf("failed to check seat availability in DB: %w", err)
+		}
+
+		if unavailable := unavailableSeats(seatIDs, seats); len(unavailable) > 0 {
+			slog.WarnContext(ctx, "Not all seats available", "component", "booking", "user_id", userID, "requested", len(seatIDs), "unavailable", unavailable)
+			return fmt.Errorf("not all seats are available in DB despite acquiring lock (%d/%d available)", len(seatIDs)-len(unavailable), len(seatIDs))
+		}
+
+		slog.DebugContext(ctx, "Generated payment session", "component", "booking", "user_id", userID, "session_id", sessionID)
+
+		slog.DebugContext(ctx, "Updating seats", "component", "booking", "user_id", userID, "session_id", sessionID)
+		setBookingPhase(ctx, "updating")
+		if err := markSeatsReservedFenced(ctx, tx, userID, seatIDs, sessionID, redirectURL, token); err != nil {
+			slog.ErrorContext(ctx, "Failed to mark seats as reserved", "component", "booking", "user_id", userID, "error", err)
+			return fmt.Errorf("failed to mark seats as reserved in DB: %w", err)
+		}
+		return nil
 	})
 	if err != nil {
-		log.Printf("[Booking] Failed to begin transaction - UserID: %d, Error: %v", userID, err)
-		return fmt.Errorf("failed to begin transaction: %v", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "Successfully completed timeout-based booking", "component", "booking", "user_id", userID, "session_id", sessionID)
+	return nil
+}
+
+// AdvisoryLocking: Postgres only. Takes a transaction-scoped advisory lock per seat instead of
+// row locks; the locks are released automatically on commit or rollback.
+func AdvisoryLocking(ctx context.Context, db *sql.DB, userID int, seatIDs []int, bookingId string) error {
+	slog.InfoContext(ctx, "Starting advisory locking", "component", "booking", "user_id", userID, "seat_ids", seatIDs)
+
+	if dbDriver != "postgres" {
+		return fmt.Errorf("advisory locking requires DB_DRIVER=postgres, current driver is %s", dbDriver)
 	}
-	defer tx.Rollback()
 
-	placeholders := generatePlaceholders(len(seatIDs))
-	checkQuery := fmt.Sprintf("SELECT COUNT(*) FROM seats WHERE id IN (%s) AND (is_reserved = 0 OR (is_reserved = 1 AND payment_status = 'FAILED')) FOR UPDATE", placeholders)
-	checkArgs := sliceToInterface(seatIDs)
+	if len(seatIDs) == 0 {
+		slog.InfoContext(ctx, "No seat IDs provided", "component", "booking", "user_id", userID)
+		return fmt.Errorf("no seat IDs provided")
+	}
 
-	log.Printf("[Booking] Checking seat availability - UserID: %d", userID)
-	var availableCount int
-	err = tx.QueryRowContext(ctx, checkQuery, checkArgs...).Scan(&availableCount)
+	sessionID := bookingId
+	redirectURL := mockPaymentRedirectURL(sessionID)
+
+	err := runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		// Acquire in a stable order so two overlapping requests contend on the same first seat.
+		setBookingPhase(ctx, "advisory_lock")
+		sortedSeatIDs := append([]int(nil), seatIDs...)
+		sort.Ints(sortedSeatIDs)
+		for _, seatID := range sortedSeatIDs {
+			var locked bool
+			if err := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock(?)", seatID).Scan(&locked); err != nil {
+				slog.ErrorContext(ctx, "Failed to take advisory lock", "component", "booking", "user_id", userID, "seat_id", seatID, "error", err)
+				return fmt.Errorf("failed to take advisory lock on seat %d: %w", seatID, err)
+			}
+			if !locked {
+				slog.InfoContext(ctx, "Advisory lock held by another booking", "component", "booking", "user_id", userID, "seat_id", seatID)
+				return fmt.Errorf("%w: seat %d is being booked by another user", ErrSeatsLocked, seatID)
+			}
+		}
+
+		slog.DebugContext(ctx, "Generated payment session", "component", "booking", "user_id", userID, "session_id", sessionID)
+
+		setBookingPhase(ctx, "updating")
+		return markSeatsReservedIfAvailable(ctx, tx, userID, seatIDs, sessionID, redirectURL)
+	})
 	if err != nil {
-		log.Printf("[Booking] Failed to check seat availability - UserID: %d, Error: %v", userID, err)
-		return fmt.Errorf("failed to check seat availability in DB: %w", err)
+		return err
 	}
 
-	if availableCount != len(seatIDs) {
-		log.Printf("[Booking] Not all seats available - UserID: %d, Requested: %d, Available: %d",
-			userID, len(seatIDs), availableCount)
-		return fmt.Errorf("not all seats are available in DB despite acquiring lock (%d/%d available)", availableCount, len(seatIDs))
+	slog.InfoContext(ctx, "Successfully completed advisory locking", "component", "booking", "user_id", userID, "session_id", sessionID)
+	return nil
+}
+
+// SkipLockedBooking: Best-available flow. Picks `quantity` free seats in the show by prefs and
+// the adjacency rules (best_available.go), skipping rows another transaction has locked, so
+// concurrent buyers never wait on each other.
+func SkipLockedBooking(ctx context.Context, db *sql.DB, userID int, showID int, quantity int, prefs SeatPreferences, bookingId string) ([]int, error) {
+	slog.InfoContext(ctx, "Starting skip-locked booking", "component", "booking", "user_id", userID, "show_id", showID, "quantity", quantity, "section", prefs.Section, "contiguous", prefs.Contiguous)
+
+	if quantity <= 0 || quantity > maxBestAvailableQuantity {
+		slog.WarnContext(ctx, "Invalid quantity", "component", "booking", "user_id", userID, "quantity", quantity)
+		return nil, fmt.Errorf("quantity must be between 1 and %d", maxBestAvailableQuantity)
 	}
 
 	sessionID := bookingId
-	redirectURL := fmt.Sprintf("https://payment-gateway.example.com/pay/%s", sessionID)
-	log.Printf("[Booking] Generated payment session - UserID: %d, SessionID: %s", userID, sessionID)
+	redirectURL := mockPaymentRedirectURL(sessionID)
 
-	updateQuery := fmt.Sprintf(`
-		UPDATE seats 
-		SET is_reserved = 1, 
-		    payment_status = 'PENDING',
-			user_id = ?, 
-			payment_session_id = ?,
-            payment_redirect_url = ?,
-            payment_timeout = ?
-		WHERE id IN (%s)`, placeholders)
+	setBookingPhase(ctx, "choosing_seats")
+	seats, err := freeSeatsForBestAvailable(ctx, showID, prefs.Section)
+	if err != nil {
+		return nil, err
+	}
 
-	updateArgs := make([]interface{}, 0, len(seatIDs)+4)
-	updateArgs = append(updateArgs, userID)
-	updateArgs = append(updateArgs, sessionID)
-	updateArgs = append(updateArgs, redirectURL)
-	updateArgs = append(updateArgs, time.Now().Add(time.Minute))
-	updateArgs = append(updateArgs, sliceToInterface(seatIDs)...)
+	taken := make(map[int]bool)
+	attempts := 0
+	for _, block := range bestAvailableBlocks(seats, quantity) {
+		if attempts == maxBestAvailableAttempts {
+			break
+		}
+		if blockTaken(block, taken) {
+			continue
+		}
+		attempts++
+
+		err := runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+			setBookingPhase(ctx, "locking_rows")
+			locked, err := lockSeatBlock(ctx, tx, block.seatIDs)
+			if err != nil {
+				return err
+			}
+			if len(locked) != len(block.seatIDs) {
+				for _, seatID := range block.seatIDs {
+					if !locked[seatID] {
+						taken[seatID] = true
+					}
+				}
+				return errBlockTaken
+			}
+
+			setBookingPhase(ctx, "updating")
+			if err := markSeatsReserved(ctx, tx, userID, block.seatIDs, sessionID, redirectURL); err != nil {
+				return fmt.Errorf("failed to mark seats as reserved: %w", err)
+			}
+			return nil
+		})
+		if errors.Is(err, errBlockTaken) {
+			slog.DebugContext(ctx, "Best seats taken meanwhile, trying the next", "component", "booking", "user_id", userID, "seat_ids", block.seatIDs)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		slog.InfoContext(ctx, "Successfully completed skip-locked booking", "component", "booking", "user_id", userID, "session_id", sessionID, "seat_ids", block.seatIDs)
+		return block.seatIDs, nil
+	}
+
+	if prefs.Contiguous {
+		slog.InfoContext(ctx, "No seats to match the request", "component", "booking", "user_id", userID, "show_id", showID, "quantity", quantity, "free", len(seats), "attempts", attempts)
+		return nil, fmt.Errorf("%w: no %d seats to match in show %d", ErrNotEnoughSeats, quantity, showID)
+	}
+
+	// No block side by side: the best seats wherever they are.
+	var seatIDs []int
+	err = runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		setBookingPhase(ctx, "locking_rows")
+		var err error
+		seatIDs, err = lockBestFreeSeats(ctx, tx, showID, quantity, prefs.Section)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to select free seats", "component", "booking", "user_id", userID, "error", err)
+			return err
+		}
+		if len(seatIDs) != quantity {
+			slog.InfoContext(ctx, "Not enough free seats", "component", "booking", "user_id", userID, "requested", quantity, "available", len(seatIDs))
+			return fmt.Errorf("%w: only %d of %d seats available in show %d", ErrNotEnoughSeats, len(seatIDs), quantity, showID)
+		}
 
-	log.Printf("[Booking] Updating seats - UserID: %d, SessionID: %s", userID, sessionID)
-	_, err = tx.ExecContext(ctx, updateQuery, updateArgs...)
+		slog.DebugContext(ctx, "Generated payment session", "component", "booking", "user_id", userID, "session_id", sessionID, "seat_ids", seatIDs)
+
+		setBookingPhase(ctx, "updating")
+		if err := markSeatsReserved(ctx, tx, userID, seatIDs, sessionID, redirectURL); err != nil {
+			slog.ErrorContext(ctx, "Failed to mark seats as reserved", "component", "booking", "user_id", userID, "error", err)
+			return fmt.Errorf("failed to mark seats as reserved: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		log.Printf("[Booking] Failed to mark seats as reserved - UserID: %d, Error: %v", userID, err)
-		return fmt.Errorf("failed to mark seats as reserved in DB: %w", err)
+		return nil, err
 	}
 
-	if err := tx.Commit(); err != nil {
-		log.Printf("[Booking] Failed to commit transaction - UserID: %d, Error: %v", userID, err)
-		return fmt.Errorf("failed to commit transaction: %w", err)
+	slog.InfoContext(ctx, "Successfully completed skip-locked booking", "component", "booking", "user_id", userID, "session_id", sessionID, "seat_ids", seatIDs)
+	return seatIDs, nil
+}
+
+// NamedLocking: MySQL only. Serializes bookings on user-level locks (GET_LOCK('seat:<id>'))
+// instead of row locks. Named locks belong to the connection, not the transaction, so the
+// booking pins one connection and releases the locks itself after commit or rollback.
+func NamedLocking(ctx context.Context, db *sql.DB, userID int, seatIDs []int, bookingId string) error {
+	slog.InfoContext(ctx, "Starting named locking", "component", "booking", "user_id", userID, "seat_ids", seatIDs)
+
+	if dbDriver != "mysql" {
+		return fmt.Errorf("named locking requires DB_DRIVER=mysql, current driver is %s", dbDriver)
+	}
+
+	if len(seatIDs) == 0 {
+		slog.InfoContext(ctx, "No seat IDs provided", "component", "booking", "user_id", userID)
+		return fmt.Errorf("no seat IDs provided")
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get connection", "component", "booking", "user_id", userID, "error", err)
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	// Runs after the transaction has committed or rolled back. If the release fails the
+	// connection is discarded instead of going back to the pool; closing the session makes
+	// MySQL drop every lock it still holds.
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT RELEASE_ALL_LOCKS()"); err != nil {
+			slog.ErrorContext(ctx, "Failed to release named locks, discarding connection", "component", "booking", "user_id", userID, "error", err)
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+	}()
+
+	setBookingPhase(ctx, "named_lock")
+	sortedSeatIDs := append([]int(nil), seatIDs...)
+	sort.Ints(sortedSeatIDs)
+	timeoutSeconds := int(time.Duration(strategyConfig.Named.LockTimeout) / time.Second)
+	for _, seatID := range sortedSeatIDs {
+		var locked sql.NullInt64
+		lockName := fmt.Sprintf("seat:%d", seatID)
+		if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", lockName, timeoutSeconds).Scan(&locked); err != nil {
+			slog.ErrorContext(ctx, "Failed to take named lock", "component", "booking", "user_id", userID, "lock", lockName, "error", err)
+			return fmt.Errorf("failed to take named lock %s: %w", lockName, err)
+		}
+		if !locked.Valid || locked.Int64 != 1 {
+			slog.InfoContext(ctx, "Named lock held by another booking", "component", "booking", "user_id", userID, "lock", lockName)
+			return fmt.Errorf("%w: named lock %s not acquired within %ds", ErrSeatsLocked, lockName, timeoutSeconds)
+		}
+	}
+
+	sessionID := bookingId
+	redirectURL := mockPaymentRedirectURL(sessionID)
+	slog.DebugContext(ctx, "Generated payment session", "component", "booking", "user_id", userID, "session_id", sessionID)
+
+	err = runInTx(ctx, conn, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		setBookingPhase(ctx, "updating")
+		return markSeatsReservedIfAvailable(ctx, tx, userID, seatIDs, sessionID, redirectURL)
+	})
+	if err != nil {
+		return err
 	}
 
-	log.Printf("[Booking] Successfully completed timeout-based booking - UserID: %d, SessionID: %s", userID, sessionID)
+	slog.InfoContext(ctx, "Successfully completed named locking", "component", "booking", "user_id", userID, "session_id", sessionID)
 	return nil
 }
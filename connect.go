@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Dependency connections. At startup the database and Redis are tried up to
+// server.connect_attempts times, backing off exponentially from server.connect_backoff, so
+// the service can start alongside them (docker compose, a node coming back) instead of
+// exiting on the first refused connection. Once running, both clients reconnect on their
+// own: database/sql and go-redis drop broken connections and dial new ones on the next call,
+// and the calls made while a dependency is down fail like any other error. The dependency
+// monitor pings both every server.health_check_interval and logs when one goes down and when
+// it is back; on the way back it also drops the database's idle connections, which may point
+// at a server that has since failed over.
+
+// maxConnectBackoff caps the wait between two connection attempts.
+const maxConnectBackoff = 30 * time.Second
+
+// defaultMaxIdleConns is database/sql's default, restored after the idle pool is flushed.
+const defaultMaxIdleConns = 2
+
+// connectWithRetry calls connect until it succeeds or server.connect_attempts is used up.
+func connectWithRetry(name string, connect func(ctx context.Context) error) error {
+	attempts := strategyConfig.Server.ConnectAttempts
+	backoff := time.Duration(strategyConfig.Server.ConnectBackoff)
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err = connect(attemptCtx)
+		cancel()
+		if err == nil {
+			if attempt > 1 {
+				slog.Info("Connected", "component", "startup", "dependency", name, "attempts", attempt)
+			}
+			return nil
+		}
+		if attempt == attempts {
+			break
+		}
+
+		// Up to a fifth of jitter, so instances restarted together don't retry in step.
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)/5+1))
+		slog.Warn("Dependency unavailable, retrying", "component", "startup", "dependency", name, "attempt", attempt, "attempts", attempts, "retry_in", wait, "error", err)
+		time.Sleep(wait)
+		backoff = min(2*backoff, maxConnectBackoff)
+	}
+	return fmt.Errorf("%s unavailable after %d attempts: %w", name, attempts, err)
+}
+
+// pingDatabaseServer checks that the database server answers. On MySQL it connects without
+// selecting the database, which the first migration may still have to create.
+func pingDatabaseServer(ctx context.Context) error {
+	if dbDriver != "mysql" {
+		return db.PingContext(ctx)
+	}
+	cfg, err := mysql.ParseDSN(strategyConfig.Server.DBDSN)
+	if err != nil {
+		return fmt.Errorf("invalid DB_DSN: %w", err)
+	}
+	cfg.DBName = ""
+	server, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	return server.PingContext(ctx)
+}
+
+type dependencyStatus struct {
+	name      string
+	ping      func(ctx context.Context) error
+	onRecover func()
+	downSince time.Time
+}
+
+// check pings the dependency and logs when it goes down or comes back.
+func (d *dependencyStatus) check() {
+	pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	err := d.ping(pingCtx)
+	cancel()
+
+	switch {
+	case err != nil && d.downSince.IsZero():
+		d.downSince = time.Now()
+		slog.Error("Dependency unreachable, calls to it will fail until it is back", "component", "health", "dependency", d.name, "error", err)
+	case err == nil && !d.downSince.IsZero():
+		slog.Info("Dependency reachable again", "component", "health", "dependency", d.name, "downtime", time.Since(d.downSince).Round(time.Millisecond))
+		d.downSince = time.Time{}
+		if d.onRecover != nil {
+			d.onRecover()
+		}
+	}
+}
+
+// runDependencyMonitor pings the database and Redis for as long as the service runs.
+func runDependencyMonitor() error {
+	dependencies := []*dependencyStatus{
+		{
+			name: dbDriver,
+			ping: db.PingContext,
+			onRecover: func() {
+				// Closing the idle connections makes the pool dial fresh ones.
+				db.SetMaxIdleConns(0)
+				db.SetMaxIdleConns(defaultMaxIdleConns)
+			},
+		},
+		{
+			name: "redis",
+			ping: func(ctx context.Context) error { return rdb.Ping(ctx).Err() },
+		},
+	}
+
+	ticker := time.NewTicker(time.Duration(strategyConfig.Server.HealthCheckInterval))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, d := range dependencies {
+			d.check()
+		}
+	}
+	return errors.New("ending dependency monitor")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Circuit breaker for the database. When transactions keep failing because the database is
+// unreachable, out of connections or too slow to answer within the request's deadline, the
+// breaker opens: for db_breaker.open_for every transaction and every new booking fails at once
+// with ErrDatabaseUnavailable, answered 503 with Retry-After, instead of each request holding a
+// goroutine, a backpressure slot and maybe Redis locks while it waits on the sick database.
+// After that a single transaction is let through to probe it; success closes the breaker,
+// failure opens it again. Booking outcomes (seats taken, lock contention) don't count, only
+// failures of the database itself, see isDatabaseUnavailable.
+
+var ErrDatabaseUnavailable = errors.New("database unavailable, try again")
+
+// DBBreakerConfig tunes the breaker, see db_breaker.go.
+type DBBreakerConfig struct {
+	FailureThreshold int      `json:"failure_threshold"` // DB_BREAKER_FAILURE_THRESHOLD, consecutive failures that open it, 0 turns it off
+	OpenFor          Duration `json:"open_for"`          // DB_BREAKER_OPEN_FOR, how long it stays open before probing, also the Retry-After
+}
+
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time // zero while closed
+	probing   bool      // open_for has passed and a probe is running
+}
+
+var dbBreaker = &CircuitBreaker{}
+
+// Allow returns ErrDatabaseUnavailable while the breaker is open. Once open_for has passed it
+// lets one caller through as the probe; that caller must Record its outcome.
+func (b *CircuitBreaker) Allow() error {
+	if strategyConfig.DBBreaker.FailureThreshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return ErrDatabaseUnavailable
+	}
+	b.probing = true
+	return nil
+}
+
+// IsOpen reports whether calls are being refused, without taking the probe.
+func (b *CircuitBreaker) IsOpen() bool {
+	if strategyConfig.DBBreaker.FailureThreshold <= 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero() && (time.Now().Before(b.openUntil) || b.probing)
+}
+
+// Record counts the outcome of a call Allow let through.
+func (b *CircuitBreaker) Record(err error) {
+	cfg := strategyConfig.DBBreaker
+	if cfg.FailureThreshold <= 0 || errors.Is(err, ErrDatabaseUnavailable) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !isDatabaseUnavailable(err) {
+		if !b.openUntil.IsZero() {
+			slog.Info("Database answering again, closing breaker", "component", "db_breaker")
+		}
+		b.failures = 0
+		b.openUntil = time.Time{}
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.probing || b.openUntil.IsZero() && b.failures >= cfg.FailureThreshold {
+		b.openUntil = time.Now().Add(time.Duration(cfg.OpenFor))
+		b.probing = false
+		slog.Error("Database failing, opening breaker", "component", "db_breaker", "failures", b.failures, "open_for", time.Duration(cfg.OpenFor), "error", err)
+	}
+}
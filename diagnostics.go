@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// Runtime diagnostics, for working out where bookings contend under load. They are served on
+// their own listener, server.debug_addr (localhost:6060 by default), never on the API port,
+// and behind ADMIN_TOKEN like the admin API:
+//   - /debug/pprof/ is net/http/pprof: goroutine dumps, CPU, heap, mutex and block profiles.
+//   - /debug/vars is a JSON snapshot of the goroutine count, memory, the database and Redis
+//     connection pools, the booking pipeline and the slow query counts.
+
+// DebugVars is what /debug/vars reports.
+type DebugVars struct {
+	Goroutines int            `json:"goroutines"`
+	Memory     DebugMemory    `json:"memory"`
+	Database   *DebugDatabase `json:"database,omitempty"`
+	DBBreaker  bool           `json:"db_breaker_open"`
+	Leader     bool           `json:"maintenance_leader"`
+	Redis      *DebugRedis    `json:"redis,omitempty"`
+	Bookings   DebugBookings  `json:"bookings"`
+	Slow       SlowCounts     `json:"slow"`
+}
+
+type DebugMemory struct {
+	HeapAllocBytes uint64 `json:"heap_alloc_bytes"`
+	HeapObjects    uint64 `json:"heap_objects"`
+	SysBytes       uint64 `json:"sys_bytes"`
+	NumGC          uint32 `json:"num_gc"`
+	PauseTotalMs   int64  `json:"pause_total_ms"`
+}
+
+// DebugDatabase is the connection pool's sql.DBStats. Waits are what bookings spend queued for
+// a connection when the pool is exhausted.
+type DebugDatabase struct {
+	MaxOpen           int   `json:"max_open"`
+	Open              int   `json:"open"`
+	InUse             int   `json:"in_use"`
+	Idle              int   `json:"idle"`
+	WaitCount         int64 `json:"wait_count"`
+	WaitMs            int64 `json:"wait_ms"`
+	ClosedMaxIdle     int64 `json:"closed_max_idle"`
+	ClosedMaxLifetime int64 `json:"closed_max_lifetime"`
+}
+
+// DebugRedis is the Redis client's redis.PoolStats.
+type DebugRedis struct {
+	Hits       uint32 `json:"hits"`
+	Misses     uint32 `json:"misses"`
+	Timeouts   uint32 `json:"timeouts"`
+	TotalConns uint32 `json:"total_conns"`
+	IdleConns  uint32 `json:"idle_conns"`
+	StaleConns uint32 `json:"stale_conns"`
+}
+
+type DebugBookings struct {
+	InFlight int   `json:"in_flight"` // registered in the in-flight registry
+	Running  int   `json:"running"`   // holding a backpressure slot
+	Waiting  int64 `json:"waiting"`   // queued for a backpressure slot
+}
+
+// runDebugServer serves the diagnostics until the process stops.
+func runDebugServer() error {
+	// Sampled, so the mutex and block profiles have something in them: a fifth of mutex
+	// contention events and blocking events of a millisecond or more.
+	runtime.SetMutexProfileFraction(5)
+	runtime.SetBlockProfileRate(int(time.Millisecond))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", requireAdmin(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", requireAdmin(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", requireAdmin(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", requireAdmin(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", requireAdmin(pprof.Trace))
+	mux.HandleFunc("GET /debug/vars", requireAdmin(handleDebugVars))
+
+	listener, err := net.Listen("tcp", strategyConfig.Server.DebugAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", strategyConfig.Server.DebugAddr, err)
+	}
+	slog.Info("Serving diagnostics", "component", "debug", "addr", listener.Addr())
+
+	// No write timeout: /debug/pprof/profile and /trace stream for as long as asked.
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("debug server stopped: %w", err)
+	}
+	return nil
+}
+
+// handleDebugVars serves GET /debug/vars.
+func handleDebugVars(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	vars := DebugVars{
+		Goroutines: runtime.NumGoroutine(),
+		Memory: DebugMemory{
+			HeapAllocBytes: mem.HeapAlloc,
+			HeapObjects:    mem.HeapObjects,
+			SysBytes:       mem.Sys,
+			NumGC:          mem.NumGC,
+			PauseTotalMs:   time.Duration(mem.PauseTotalNs).Milliseconds(),
+		},
+		Bookings: DebugBookings{
+			InFlight: inFlight.count(),
+			Running:  bookingLimiter.InFlight(),
+			Waiting:  bookingLimiter.Waiting(),
+		},
+		DBBreaker: dbBreaker.IsOpen(),
+		Leader:    isMaintenanceLeader(),
+		Slow:      slowCountsSnapshot(),
+	}
+	if dbDriver != "memory" && db != nil {
+		stats := db.Stats()
+		vars.Database = &DebugDatabase{
+			MaxOpen:           stats.MaxOpenConnections,
+			Open:              stats.OpenConnections,
+			InUse:             stats.InUse,
+			Idle:              stats.Idle,
+			WaitCount:         stats.WaitCount,
+			WaitMs:            stats.WaitDuration.Milliseconds(),
+			ClosedMaxIdle:     stats.MaxIdleClosed,
+			ClosedMaxLifetime: stats.MaxLifetimeClosed,
+		}
+	}
+	if rdb != nil {
+		stats := rdb.PoolStats()
+		vars.Redis = &DebugRedis{
+			Hits:       stats.Hits,
+			Misses:     stats.Misses,
+			Timeouts:   stats.Timeouts,
+			TotalConns: stats.TotalConns,
+			IdleConns:  stats.IdleConns,
+			StaleConns: stats.StaleConns,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(vars)
+}
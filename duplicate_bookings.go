@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Duplicate booking suppression. A user who posts the same seats of the same show again,
+// a double click or a client retrying on a slow answer, while the first booking is still
+// being made or waiting for payment gets that booking back, 200 DUPLICATE, instead of a second
+// booking fighting the first for the seats' locks and failing. Each booking by seat ids claims
+// booking_dedupe:{user}:{show}:{seats} in Redis with its id, for server.request_timeout (the
+// async queue's result_ttl when queued) and, once held, until the hold expires. A request
+// finding the key checks the booking it names: still being made, queued, HELD or
+// PENDING_PAYMENT, it is the answer; otherwise the key is taken over and the request books
+// as usual. A sync booking that fails gives its claim back right away. Quantity and best
+// available requests name no seats and aren't deduplicated, nor are memory bookings, which
+// have no booking rows to check. When Redis can't be reached requests go through unchecked.
+
+// replaceClaimScript sets KEYS[1] to ARGV[2] with PX ARGV[3] when it still holds ARGV[1].
+var replaceClaimScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+	return 1
+end
+return 0
+`)
+
+func bookingDedupeKey(req BookingRequest) string {
+	seats := slices.Compact(slices.Sorted(slices.Values(req.SeatIDs)))
+	parts := make([]string, len(seats))
+	for i, id := range seats {
+		parts[i] = strconv.Itoa(id)
+	}
+	return fmt.Sprintf("booking_dedupe:%d:%d:%s", req.UserID, req.ShowID, strings.Join(parts, ","))
+}
+
+func dedupesBooking(req BookingRequest) bool {
+	return len(req.SeatIDs) > 0 && dbDriver != "memory" && req.Method != "memory"
+}
+
+// claimBooking claims the request's seats for bookingID. It returns the id of the live
+// booking holding the claim instead, when there is one.
+func claimBooking(ctx context.Context, req BookingRequest, bookingID string) (string, error) {
+	key := bookingDedupeKey(req)
+	ttl := time.Duration(strategyConfig.Server.RequestTimeout)
+	if asyncBookingEnabled() {
+		ttl = time.Duration(strategyConfig.AsyncBooking.ResultTTL)
+	}
+	// Twice at most: a claim can end between SETNX and GET, or be taken over by another
+	// duplicate; past that the request just books.
+	for range 2 {
+		claimed, err := rdb.SetNX(ctx, key, bookingID, ttl).Result()
+		if err != nil {
+			return "", fmt.Errorf("failed to claim booking: %w", err)
+		}
+		if claimed {
+			return "", nil
+		}
+		existing, err := rdb.Get(ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read booking claim: %w", err)
+		}
+		live, err := bookingInProgress(ctx, existing)
+		if err != nil {
+			return "", err
+		}
+		if live {
+			return existing, nil
+		}
+		replaced, err := replaceClaimScript.Run(ctx, rdb, []string{key}, existing, bookingID, ttl.Milliseconds()).Int()
+		if err != nil {
+			return "", fmt.Errorf("failed to take over booking claim: %w", err)
+		}
+		if replaced == 1 {
+			return "", nil
+		}
+	}
+	return "", nil
+}
+
+// bookingInProgress reports whether the booking is being made, queued or waiting for payment.
+// A booking with neither a row nor a queue status is taken to be still running; its claim
+// runs out with the request timeout if it never finishes.
+func bookingInProgress(ctx context.Context, bookingID string) (bool, error) {
+	state, err := bookingState(ctx, db, bookingID)
+	if err != nil {
+		return false, err
+	}
+	if state != "" {
+		return state == BookingHeld || state == BookingPendingPayment, nil
+	}
+	if !asyncBookingEnabled() {
+		return true, nil
+	}
+	status, err := asyncBookingStatus(ctx, bookingID)
+	if err != nil {
+		return false, err
+	}
+	return status == "" || status == AsyncBookingAccepted || status == AsyncBookingProcessing, nil
+}
+
+// holdBookingClaim keeps the claim of a booking that got its seats until its hold ends.
+func holdBookingClaim(ctx context.Context, req BookingRequest, bookingID string, expiresAt *time.Time) {
+	until := time.Now().Add(time.Duration(strategyConfig.Payment.HoldTimeout))
+	if expiresAt != nil {
+		until = *expiresAt
+	}
+	ttl := time.Until(until)
+	if ttl <= 0 {
+		return
+	}
+	if err := renewLeaseScript.Run(ctx, rdb, []string{bookingDedupeKey(req)}, bookingID, ttl.Milliseconds()).Err(); err != nil {
+		slog.WarnContext(ctx, "Failed to extend booking claim", "component", "api", "booking_id", bookingID, "error", err)
+	}
+}
+
+// releaseBookingClaim gives back the claim of a booking that failed, if it still has it.
+func releaseBookingClaim(ctx context.Context, req BookingRequest, bookingID string) {
+	if err := releaseSeatsScript.Run(ctx, rdb, []string{bookingDedupeKey(req)}, bookingID).Err(); err != nil {
+		slog.WarnContext(ctx, "Failed to release booking claim", "component", "api", "booking_id", bookingID, "error", err)
+	}
+}
+
+// writeDuplicateBooking answers a duplicate request with the booking already under way.
+func writeDuplicateBooking(w http.ResponseWriter, r *http.Request, req BookingRequest, bookingID string) {
+	// The booking under way was charged to the quota already.
+	giveBackBookingQuota(r.Context())
+	resp := AsyncBookingResponse{
+		BookingID: bookingID,
+		Status:    "DUPLICATE",
+		SeatIDs:   req.SeatIDs,
+		RequestID: requestIDFromContext(r.Context()),
+	}
+	// The booking may not have a row yet; what there is is enough to poll it.
+	if state, err := bookingState(r.Context(), db, bookingID); err == nil && state != "" {
+		resp.State = state
+		if expiresAt, err := bookingHoldExpiry(r.Context(), db, bookingID); err == nil {
+			resp.HoldExpiresAt = expiresAt
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
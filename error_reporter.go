@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+)
+
+// ErrorReporter sends failures nobody is watching the logs for to an alerting service: panics,
+// payment and refund webhooks that failed to apply, and reaper passes that didn't release what
+// they should have. With SENTRY_DSN set they go to Sentry; without it they are only logged, as
+// before. Reports are best effort and never hold up the caller.
+type ErrorReporter interface {
+	Name() string
+	Report(ctx context.Context, report ErrorReport)
+}
+
+// ErrorReport is one failure. Tags carry the request id and the booking fields of the context
+// it happened in, plus whatever the caller adds.
+type ErrorReport struct {
+	Err       error
+	Component string // the log component, "webhook", "reaper", ...
+	Panic     bool
+	Stack     []byte // for panics, where it happened
+	Tags      map[string]string
+}
+
+var errorReporter ErrorReporter = logErrorReporter{}
+
+func newErrorReporter() (ErrorReporter, error) {
+	dsn := os.Getenv("SENTRY_DSN")
+	if dsn == "" {
+		return logErrorReporter{}, nil
+	}
+	return newSentryErrorReporter(dsn)
+}
+
+// reportError reports err from component, tagged with the fields on ctx and tags, key-value
+// pairs as slog takes them.
+func reportError(ctx context.Context, component string, err error, tags ...any) {
+	errorReporter.Report(ctx, ErrorReport{
+		Err:       err,
+		Component: component,
+		Tags:      reportTags(ctx, tags...),
+	})
+}
+
+// reportPanic is deferred by the code it guards: it recovers a panic, logs and reports it, and
+// reports whether there was one.
+func reportPanic(ctx context.Context, component string, recovered any) bool {
+	if recovered == nil {
+		return false
+	}
+	err, ok := recovered.(error)
+	if !ok {
+		err = fmt.Errorf("%v", recovered)
+	}
+	stack := debug.Stack()
+	slog.ErrorContext(ctx, "Recovered panic", "component", component, "error", err, "stack", string(stack))
+	errorReporter.Report(ctx, ErrorReport{
+		Err:       err,
+		Component: component,
+		Panic:     true,
+		Stack:     stack,
+		Tags:      reportTags(ctx),
+	})
+	return true
+}
+
+func reportTags(ctx context.Context, tags ...any) map[string]string {
+	out := make(map[string]string)
+	for _, field := range contextLogFields(ctx) {
+		out[field.Key] = field.Value.String()
+	}
+	for _, field := range slog.Group("", tags...).Value.Group() {
+		out[field.Key] = field.Value.String()
+	}
+	return out
+}
+
+// recoverPanics answers a panicking request with a 500 and reports the panic, instead of
+// net/http dropping the connection with only a log line.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			if reportPanic(r.Context(), "api", recovered) {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logErrorReporter reports nothing beyond the log line the caller already wrote.
+type logErrorReporter struct{}
+
+func (logErrorReporter) Name() string { return "log" }
+
+func (logErrorReporter) Report(ctx context.Context, report ErrorReport) {}
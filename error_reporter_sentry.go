@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// sentryErrorReporter sends reports to Sentry's envelope endpoint, the project named by the
+// DSN (https://<public key>@<host>/<project id>). Events are queued and sent from one goroutine;
+// when Sentry is slow or down the queue fills and further reports are dropped with a log line.
+type sentryErrorReporter struct {
+	dsn         string
+	envelopeURL string
+	authHeader  string
+	environment string
+	serverName  string
+	events      chan sentryEvent
+}
+
+// sentryQueueSize is how many reports can wait to be sent.
+const sentryQueueSize = 100
+
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Platform    string            `json:"platform"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger"`
+	Environment string            `json:"environment,omitempty"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Message     string            `json:"message"`
+	Exception   sentryExceptions  `json:"exception"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Extra       map[string]string `json:"extra,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func newSentryErrorReporter(dsn string) (*sentryErrorReporter, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil || parsed.User == nil || parsed.User.Username() == "" {
+		return nil, fmt.Errorf("invalid SENTRY_DSN")
+	}
+	path := strings.TrimSuffix(parsed.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	projectID := path[slash+1:]
+	if projectID == "" {
+		return nil, fmt.Errorf("invalid SENTRY_DSN: no project id")
+	}
+
+	environment := os.Getenv("APP_ENV")
+	if environment == "" {
+		environment = "development"
+	}
+	serverName, _ := os.Hostname()
+
+	r := &sentryErrorReporter{
+		dsn:         dsn,
+		envelopeURL: fmt.Sprintf("%s://%s%s/api/%s/envelope/", parsed.Scheme, parsed.Host, path[:slash], projectID),
+		authHeader:  "Sentry sentry_version=7, sentry_client=bookmyshow/1.0, sentry_key=" + parsed.User.Username(),
+		environment: environment,
+		serverName:  serverName,
+		events:      make(chan sentryEvent, sentryQueueSize),
+	}
+	go r.run()
+	return r, nil
+}
+
+func (r *sentryErrorReporter) Name() string { return "sentry" }
+
+func (r *sentryErrorReporter) Report(ctx context.Context, report ErrorReport) {
+	level := "error"
+	if report.Panic {
+		level = "fatal"
+	}
+	event := sentryEvent{
+		EventID:     newSentryEventID(),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Platform:    "go",
+		Level:       level,
+		Logger:      report.Component,
+		Environment: r.environment,
+		ServerName:  r.serverName,
+		Message:     report.Err.Error(),
+		Exception: sentryExceptions{Values: []sentryException{{
+			Type:  fmt.Sprintf("%T", report.Err),
+			Value: report.Err.Error(),
+		}}},
+		Tags: report.Tags,
+	}
+	if len(report.Stack) > 0 {
+		event.Extra = map[string]string{"stack": string(report.Stack)}
+	}
+
+	select {
+	case r.events <- event:
+	default:
+		slog.WarnContext(ctx, "Report queue full, dropping report", "component", "sentry", "event_id", event.EventID)
+	}
+}
+
+func (r *sentryErrorReporter) run() {
+	for event := range r.events {
+		if err := r.send(event); err != nil {
+			slog.Error("Failed to send report", "component", "sentry", "event_id", event.EventID, "error", err)
+		}
+	}
+}
+
+// send posts event as an envelope: a header line, an item header line and the event.
+func (r *sentryErrorReporter) send(event sentryEvent) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	if err := enc.Encode(map[string]string{
+		"event_id": event.EventID,
+		"sent_at":  time.Now().UTC().Format(time.RFC3339Nano),
+		"dsn":      r.dsn,
+	}); err != nil {
+		return err
+	}
+	if err := enc.Encode(map[string]string{"type": "event"}); err != nil {
+		return err
+	}
+	if err := enc.Encode(event); err != nil {
+		return err
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(sendCtx, http.MethodPost, r.envelopeURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", r.authHeader)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return fmt.Errorf("sentry returned %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// newSentryEventID is a UUID without dashes, the form Sentry wants event ids in.
+func newSentryEventID() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	raw[6] = raw[6]&0x0f | 0x40
+	raw[8] = raw[8]&0x3f | 0x80
+	return hex.EncodeToString(raw)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Event-sourced seat inventory. With event_store.enabled every seat's life is appended to
+// seat_events as it happens, in the transaction that changes the seat:
+//   - SeatHeld: a booking held it
+//   - PaymentStarted: its checkout was opened
+//   - PaymentConfirmed, PaymentFlagged (paid, amount off, in review), PaymentFailed
+//   - HoldExpired: the reaper (or the expiry listener) took it back
+//   - HoldReleased: given back early, by abandon, a cancelled upgrade, the stuck hold cleanup
+//     or a force release
+//   - SeatRefunded: refunded and back on sale
+//   - SeatBlocked, SeatUnblocked: taken off sale by an operator and put back (seat_blocks.go)
+// Each seat's events are numbered by seq and (seat_id, seq) is unique, so two writers that
+// both saw event n can't both append n+1. In this mode every booking goes through the
+// "events" strategy, which decides availability from the seat's last event rather than the
+// seats row and projects the hold onto seats in the same transaction; the other writers keep
+// updating seats themselves and append the matching event. seats is the current view,
+// seat_events the history: `replay-events` folds a show's events (up to -until) back into seat
+// states and reports where the view disagrees, and -seat prints one seat's timeline, which is
+// usually enough to see which two bookings raced for it.
+//
+// Refund requests (REFUND_PENDING), the seats an upgrade moves to and channel allocations are
+// not in the stream yet, nor are seats held before the mode was turned on; replay reports them.
+
+const (
+	SeatHeld         = "SeatHeld"
+	PaymentStarted   = "PaymentStarted"
+	PaymentConfirmed = "PaymentConfirmed"
+	PaymentFlagged   = "PaymentFlagged"
+	PaymentFailed    = "PaymentFailed"
+	HoldExpired      = "HoldExpired"
+	HoldReleased     = "HoldReleased"
+	SeatRefunded     = "SeatRefunded"
+	SeatBlocked      = "SeatBlocked"
+	SeatUnblocked    = "SeatUnblocked"
+)
+
+// EventStoreConfig turns the event store on, see event_store.go.
+type EventStoreConfig struct {
+	Enabled bool `json:"enabled"` // EVENT_STORE_ENABLED, record seat events and book through the "events" strategy
+}
+
+type SeatEvent struct {
+	ID        int64
+	SeatID    int
+	ShowID    int
+	Seq       int
+	Type      string
+	UserID    sql.NullInt64
+	BookingID sql.NullString
+	CreatedAt time.Time
+}
+
+// seatHead is a seat as the next event appended to it needs it: the row's holder and the
+// seat's last event.
+type seatHead struct {
+	seatID    int
+	showID    int
+	seq       int
+	last      string
+	userID    sql.NullInt64
+	bookingID sql.NullString
+}
+
+// SeatProjection is a seat's state folded from its events.
+type SeatProjection struct {
+	Status         string // AVAILABLE, PENDING, COMPLETED or REVIEW
+	UserID         sql.NullInt64
+	BookingID      sql.NullString
+	PaymentStarted bool
+	Seq            int
+}
+
+func eventStoreEnabled() bool {
+	return strategyConfig.EventStore.Enabled
+}
+
+// seatFreeAfter reports whether a seat whose last event is last can be held.
+func seatFreeAfter(last string) bool {
+	switch last {
+	case "", PaymentFailed, HoldExpired, HoldReleased, SeatRefunded, SeatUnblocked:
+		return true
+	}
+	return false
+}
+
+// appendSeatEvents appends eventType to each of seatIDs, with the holder the seats row has
+// right now. Callers releasing seats append before clearing the holder.
+func appendSeatEvents(ctx context.Context, tx *sql.Tx, eventType string, seatIDs []int) error {
+	if !eventStoreEnabled() || len(seatIDs) == 0 {
+		return nil
+	}
+	heads, err := seatEventHeads(ctx, tx, seatIDs)
+	if err != nil {
+		return err
+	}
+	return insertSeatEvents(ctx, tx, eventType, heads)
+}
+
+// appendBookingEvents appends eventType to the seats the booking holds.
+func appendBookingEvents(ctx context.Context, tx *sql.Tx, eventType, bookingID string) error {
+	if !eventStoreEnabled() {
+		return nil
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM seats WHERE payment_session_id = ?`, bookingID)
+	if err != nil {
+		return fmt.Errorf("failed to load booking seats: %w", err)
+	}
+	var seatIDs []int
+	for rows.Next() {
+		var seatID int
+		if err := rows.Scan(&seatID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan booking seat: %w", err)
+		}
+		seatIDs = append(seatIDs, seatID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load booking seats: %w", err)
+	}
+	return appendSeatEvents(ctx, tx, eventType, seatIDs)
+}
+
+func seatEventHeads(ctx context.Context, tx *sql.Tx, seatIDs []int) ([]seatHead, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+		SELECT s.id, s.show_id, s.user_id, s.payment_session_id, COALESCE(e.seq, 0), COALESCE(e.type, '')
+		FROM seats s
+		LEFT JOIN seat_events e ON e.seat_id = s.id
+			AND e.seq = (SELECT MAX(seq) FROM seat_events WHERE seat_id = s.id)
+		WHERE s.id IN (%s)
+		ORDER BY s.id
+	`, generatePlaceholders(len(seatIDs))), sliceToInterface(seatIDs)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load seat events: %w", err)
+	}
+	defer rows.Close()
+
+	var heads []seatHead
+	for rows.Next() {
+		var h seatHead
+		if err := rows.Scan(&h.seatID, &h.showID, &h.userID, &h.bookingID, &h.seq, &h.last); err != nil {
+			return nil, fmt.Errorf("failed to scan seat event: %w", err)
+		}
+		heads = append(heads, h)
+	}
+	return heads, rows.Err()
+}
+
+// insertSeatEvents appends eventType after each head. A head that is no longer the seat's last
+// event fails with ErrSeatsLocked: someone else wrote the seat in between.
+func insertSeatEvents(ctx context.Context, tx *sql.Tx, eventType string, heads []seatHead) error {
+	values := make([]string, 0, len(heads))
+	args := make([]interface{}, 0, len(heads)*6)
+	for _, h := range heads {
+		values = append(values, "(?, ?, ?, ?, ?, ?)")
+		args = append(args, h.seatID, h.showID, h.seq+1, eventType, h.userID, h.bookingID)
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO seat_events (seat_id, show_id, seq, type, user_id, booking_id)
+		VALUES `+strings.Join(values, ", "), args...)
+	if isDuplicateKey(err) {
+		return fmt.Errorf("%w: a seat changed while %s was recorded", ErrSeatsLocked, eventType)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to append %s: %w", eventType, err)
+	}
+	return nil
+}
+
+// EventSourcedBooking: the "events" strategy. The seats are free when their last event says
+// so; the hold is appended as SeatHeld right after those events and projected onto seats.
+// Two bookings that read the same last event conflict on (seat_id, seq), so one of them fails
+// with ErrSeatsLocked without any lock being taken up front.
+func EventSourcedBooking(ctx context.Context, db *sql.DB, userID int, seatIDs []int, bookingId string) error {
+	slog.InfoContext(ctx, "Starting event-sourced booking", "component", "booking", "user_id", userID, "seat_ids", seatIDs)
+
+	if !eventStoreEnabled() {
+		return errors.New("the events strategy requires EVENT_STORE_ENABLED=true")
+	}
+	if len(seatIDs) == 0 {
+		slog.InfoContext(ctx, "No seat IDs provided", "component", "booking", "user_id", userID)
+		return fmt.Errorf("no seat IDs provided")
+	}
+
+	sessionID := bookingId
+	redirectURL := mockPaymentRedirectURL(sessionID)
+
+	err := runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		setBookingPhase(ctx, "reading_events")
+		heads, err := seatEventHeads(ctx, tx, seatIDs)
+		if err != nil {
+			return err
+		}
+		if len(heads) != len(seatIDs) {
+			return fmt.Errorf("seats are not available or have pending/successful payment")
+		}
+		for _, h := range heads {
+			if !seatFreeAfter(h.last) {
+				slog.WarnContext(ctx, "Seat not available", "component", "booking", "user_id", userID, "seat_id", h.seatID, "last_event", h.last)
+				return fmt.Errorf("seats are not available or have pending/successful payment")
+			}
+		}
+
+		setBookingPhase(ctx, "appending")
+		for i := range heads {
+			heads[i].userID = sql.NullInt64{Int64: int64(userID), Valid: true}
+			heads[i].bookingID = sql.NullString{String: sessionID, Valid: true}
+		}
+		if err := insertSeatEvents(ctx, tx, SeatHeld, heads); err != nil {
+			return err
+		}
+
+		// The predicate on the projection catches holds recorded before the event store was on.
+		setBookingPhase(ctx, "updating")
+		return markSeatsReservedIfAvailable(ctx, tx, userID, seatIDs, sessionID, redirectURL)
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Successfully completed event-sourced booking", "component", "booking", "user_id", userID, "session_id", sessionID)
+	return nil
+}
+
+// projectSeatEvents folds events, in append order, into each seat's state.
+func projectSeatEvents(events []SeatEvent) map[int]*SeatProjection {
+	seats := make(map[int]*SeatProjection)
+	for _, e := range events {
+		p, ok := seats[e.SeatID]
+		if !ok {
+			p = &SeatProjection{Status: "AVAILABLE"}
+			seats[e.SeatID] = p
+		}
+		p.Seq = e.Seq
+		switch e.Type {
+		case SeatHeld:
+			*p = SeatProjection{Status: "PENDING", UserID: e.UserID, BookingID: e.BookingID, Seq: e.Seq}
+		case PaymentStarted:
+			p.PaymentStarted = true
+		case PaymentConfirmed:
+			p.Status = "COMPLETED"
+		case PaymentFlagged:
+			p.Status = "REVIEW"
+		case SeatBlocked:
+			*p = SeatProjection{Status: "BLOCKED", Seq: e.Seq}
+		case PaymentFailed, HoldExpired, HoldReleased, SeatRefunded, SeatUnblocked:
+			*p = SeatProjection{Status: "AVAILABLE", Seq: e.Seq}
+		}
+	}
+	return seats
+}
+
+func loadSeatEvents(ctx context.Context, showID, seatID int, untilID int64) ([]SeatEvent, error) {
+	query := `
+		SELECT id, seat_id, show_id, seq, type, user_id, booking_id, created_at
+		FROM seat_events WHERE show_id = ?`
+	args := []interface{}{showID}
+	if seatID > 0 {
+		query += " AND seat_id = ?"
+		args = append(args, seatID)
+	}
+	if untilID > 0 {
+		query += " AND id <= ?"
+		args = append(args, untilID)
+	}
+	rows, err := db.QueryContext(ctx, query+" ORDER BY seat_id, seq", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load seat events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []SeatEvent
+	for rows.Next() {
+		var e SeatEvent
+		if err := rows.Scan(&e.ID, &e.SeatID, &e.ShowID, &e.Seq, &e.Type, &e.UserID, &e.BookingID, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan seat event: %w", err)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// seatViews reads the show's seats as projections, to compare against the replayed ones.
+func seatViews(ctx context.Context, showID, seatID int) (map[int]*SeatProjection, error) {
+	query := `
+		SELECT id, CASE WHEN is_reserved = 0 OR payment_status = 'FAILED' THEN 'AVAILABLE' ELSE payment_status END,
+		       user_id, payment_session_id
+		FROM seats WHERE show_id = ?`
+	args := []interface{}{showID}
+	if seatID > 0 {
+		query += " AND id = ?"
+		args = append(args, seatID)
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load seats: %w", err)
+	}
+	defer rows.Close()
+
+	views := make(map[int]*SeatProjection)
+	for rows.Next() {
+		var id int
+		p := &SeatProjection{}
+		if err := rows.Scan(&id, &p.Status, &p.UserID, &p.BookingID); err != nil {
+			return nil, fmt.Errorf("failed to scan seat: %w", err)
+		}
+		views[id] = p
+	}
+	return views, rows.Err()
+}
+
+func runReplayEventsCommand(args []string) {
+	flags := flag.NewFlagSet("replay-events", flag.ExitOnError)
+	showID := flags.Int("show", 0, "show whose seat events are replayed (required)")
+	seatID := flags.Int("seat", 0, "only this seat, with its event timeline")
+	untilID := flags.Int64("until", 0, "replay events up to this id only, to see the seats as they were then")
+	configFile := configFlag(flags)
+	flags.Parse(args)
+
+	if *showID <= 0 {
+		log.Fatal("-show is required")
+	}
+	loadConfig(*configFile)
+	if !connectDatabase() {
+		log.Fatalf("Nothing to replay for DB_DRIVER=%s", dbDriver)
+	}
+	defer db.Close()
+
+	events, err := loadSeatEvents(ctx, *showID, *seatID, *untilID)
+	if err != nil {
+		log.Fatalf("Replay failed: %v", err)
+	}
+	if *seatID > 0 {
+		for _, e := range events {
+			slog.Info("Event", "component", "replay", "id", e.ID, "seat_id", e.SeatID, "seq", e.Seq, "type", e.Type,
+				"user_id", e.UserID.Int64, "booking_id", e.BookingID.String, "at", e.CreatedAt)
+		}
+	}
+	replayed := projectSeatEvents(events)
+
+	// Against events up to -until the current view is expected to differ, only show the states.
+	if *untilID > 0 {
+		for id, p := range replayed {
+			slog.Info("Replayed seat", "component", "replay", "seat_id", id, "status", p.Status, "user_id", p.UserID.Int64,
+				"booking_id", p.BookingID.String, "payment_started", p.PaymentStarted, "seq", p.Seq)
+		}
+		slog.Info("Replay done", "component", "replay", "show_id", *showID, "events", len(events), "seats", len(replayed), "until", *untilID)
+		return
+	}
+
+	views, err := seatViews(ctx, *showID, *seatID)
+	if err != nil {
+		log.Fatalf("Replay failed: %v", err)
+	}
+	differing := 0
+	for id, view := range views {
+		p, ok := replayed[id]
+		if !ok {
+			p = &SeatProjection{Status: "AVAILABLE"}
+		}
+		if p.Status != view.Status || p.Status != "AVAILABLE" && (p.UserID != view.UserID || p.BookingID != view.BookingID) {
+			differing++
+			slog.Warn("Seat differs from its events", "component", "replay", "seat_id", id,
+				"status", view.Status, "replayed_status", p.Status,
+				"user_id", view.UserID.Int64, "replayed_user_id", p.UserID.Int64,
+				"booking_id", view.BookingID.String, "replayed_booking_id", p.BookingID.String, "seq", p.Seq)
+		}
+	}
+	slog.Info("Replay done", "component", "replay", "show_id", *showID, "events", len(events), "seats", len(views), "differing", differing)
+}
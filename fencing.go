@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Fencing tokens. A Redis lock can expire while its holder is stalled (GC pause, slow query,
+// network partition) and another booking can take it over; without fencing the stalled holder
+// still writes when it wakes up. Every acquisition of a Redis-backed seat lock takes the next
+// value of a single counter, seat rows remember the highest token that wrote them, and a write
+// carrying an older token is refused.
+
+const fencingCounterKey = "fencing_token"
+
+// ErrStaleFencingToken means a newer lock holder has already written the seat.
+var ErrStaleFencingToken = errors.New("stale fencing token")
+
+func nextFencingToken(ctx context.Context, client redis.UniversalClient) (int64, error) {
+	token, err := client.Incr(ctx, fencingCounterKey).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get fencing token: %w", err)
+	}
+	return token, nil
+}
+
+// markSeatsReservedFenced is markSeatsReserved for lock holders. Seats last written with a
+// token at or above ours are left alone and the whole booking fails.
+func markSeatsReservedFenced(ctx context.Context, tx *sql.Tx, userID int, seatIDs []int, sessionID, redirectURL string, token int64) error {
+	updateQuery := fmt.Sprintf(`
+		UPDATE seats
+		SET is_reserved = 1,
+		    payment_status = 'PENDING',
+			user_id = ?,
+			payment_session_id = ?,
+            payment_timeout = ?,
+            fence_token = ?
+		WHERE id IN (%s)
+		AND fence_token < ?`, generatePlaceholders(len(seatIDs)))
+
+	until, err := holdUntil(ctx, tx, seatIDs)
+	if err != nil {
+		return err
+	}
+	updateArgs := make([]interface{}, 0, len(seatIDs)+5)
+	updateArgs = append(updateArgs, userID)
+	updateArgs = append(updateArgs, sessionID)
+	updateArgs = append(updateArgs, until)
+	updateArgs = append(updateArgs, token)
+	updateArgs = append(updateArgs, sliceToInterface(seatIDs)...)
+	updateArgs = append(updateArgs, token)
+
+	result, err := tx.ExecContext(ctx, updateQuery, updateArgs...)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if int(rowsAffected) != len(seatIDs) {
+		slog.WarnContext(ctx, "Rejected write with stale fencing token", "component", "booking", "user_id", userID, "token", token, "seat_ids", seatIDs)
+		return fmt.Errorf("%w %d: seats were written by a newer lock holder", ErrStaleFencingToken, token)
+	}
+	return recordBookingHold(ctx, tx, sessionID, userID, seatIDs, redirectURL)
+}
+
+// seedFencingCounter moves the counter past every token already stored in the database. Run
+// on promotion, when this region's Redis has never seen the old primary's counter.
+func seedFencingCounter(ctx context.Context, client redis.UniversalClient) (int64, error) {
+	var maxToken int64
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(fence_token), 0) FROM seats").Scan(&maxToken); err != nil {
+		return 0, fmt.Errorf("failed to read max fencing token: %w", err)
+	}
+	current, err := client.Get(ctx, fencingCounterKey).Int64()
+	if err != nil && err != redis.Nil {
+		return 0, fmt.Errorf("failed to read fencing counter: %w", err)
+	}
+	if current >= maxToken {
+		return current, nil
+	}
+	if err := client.Set(ctx, fencingCounterKey, maxToken, 0).Err(); err != nil {
+		return 0, fmt.Errorf("failed to seed fencing counter: %w", err)
+	}
+	return maxToken, nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Force release. When a seat is wedged, held by a booking that will never finish or locked in
+// Redis with nothing behind it, POST /admin/seats/{id}/release or POST
+// /admin/bookings/{id}/release resets it instead of hand-written SQL and redis-cli:
+//   - in one transaction the seats are locked, returned to inventory as the reaper would, a
+//     booking left HELD or PENDING_PAYMENT without seats becomes CANCELLED, and a row in
+//     admin_seat_releases records who did it, why, and what the seats looked like before
+//   - after commit the cancelled bookings' checkouts are closed at the gateway, and the seats'
+//     locks (seat lock and redlock keys) are deleted, comparing the owner, so a lock someone
+//     retook in between is left alone. On a seat that was already free whoever holds its lock
+//     is removed, that's what a seat wedged in Redis alone needs. How many were deleted is
+//     added to the audit row.
+// Paid seats (COMPLETED, REFUND_PENDING) are only released with include_paid, since that
+// sells a seat someone paid for; the booking keeps its state and the payment is left to
+// refunds. Seats handed to a sales channel are released through the channel (allocations.go),
+// and a single seat of a live booking holding others through its booking, whose checkout
+// would otherwise still charge for it. Blocked seats are unblocked instead (seat_blocks.go).
+// GET /admin/seat-releases lists what was released.
+
+const maxSeatReleaseQueryLimit = 500
+
+var (
+	errSeatReleaseNotFound  = errors.New("nothing to release")
+	errSeatReleaseAllocated = errors.New("seat is allocated to a sales channel")
+	errSeatReleasePaid      = errors.New("seat is paid, pass include_paid to release it")
+	errSeatReleasePartial   = errors.New("seat belongs to a live booking holding other seats, release the booking")
+	errSeatReleaseBlocked   = errors.New("seat is blocked, unblock it instead")
+)
+
+type ForceReleaseRequest struct {
+	Reason      string `json:"reason"`
+	Operator    string `json:"operator"`
+	IncludePaid bool   `json:"include_paid"`
+}
+
+type ForceReleaseResponse struct {
+	ReleaseID         int64    `json:"release_id"`
+	ReleasedSeats     []int    `json:"released_seats"`
+	CancelledBookings []string `json:"cancelled_bookings"`
+	LocksCleared      []string `json:"locks_cleared"`
+}
+
+// SeatReleaseRecord is a row of admin_seat_releases.
+type SeatReleaseRecord struct {
+	ID                int64           `json:"id"`
+	Target            string          `json:"target"`
+	TargetID          string          `json:"target_id"`
+	SeatIDs           string          `json:"seat_ids"`
+	CancelledBookings string          `json:"cancelled_bookings,omitempty"`
+	Reason            string          `json:"reason"`
+	Operator          string          `json:"operator,omitempty"`
+	IP                string          `json:"ip,omitempty"`
+	SeatsBefore       json.RawMessage `json:"seats_before"`
+	LocksCleared      int             `json:"locks_cleared"`
+	CreatedAt         time.Time       `json:"created_at"`
+}
+
+// releasedSeat is a seat as it was before the force release.
+type releasedSeat struct {
+	ID            int    `json:"id"`
+	ShowID        int    `json:"show_id"`
+	UserID        *int64 `json:"user_id,omitempty"`
+	BookingID     string `json:"booking_id,omitempty"`
+	PaymentStatus string `json:"payment_status"`
+	IsReserved    bool   `json:"is_reserved"`
+	AllocationID  *int64 `json:"allocation_id,omitempty"`
+	wasFree       bool   `json:"-"`
+}
+
+func handleForceReleaseSeat(w http.ResponseWriter, r *http.Request) {
+	seatID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid seat id", http.StatusBadRequest)
+		return
+	}
+	forceRelease(w, r, "seat", strconv.Itoa(seatID), "WHERE id = ?", seatID)
+}
+
+func handleForceReleaseBooking(w http.ResponseWriter, r *http.Request) {
+	bookingID := r.PathValue("id")
+	forceRelease(w, r, "booking", bookingID, "WHERE payment_session_id = ?", bookingID)
+}
+
+func forceRelease(w http.ResponseWriter, r *http.Request, target, targetID, where string, arg interface{}) {
+	var req ForceReleaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+		http.Error(w, "Invalid request body, a reason is required", http.StatusBadRequest)
+		return
+	}
+
+	slog.WarnContext(r.Context(), "Force release requested", "component", "admin", "target", target, "target_id", targetID, "operator", req.Operator, "reason", req.Reason, "include_paid", req.IncludePaid, "ip", r.RemoteAddr)
+
+	resp, seats, err := forceReleaseSeats(r.Context(), target, targetID, where, arg, req, r.RemoteAddr)
+	switch {
+	case errors.Is(err, errSeatReleaseNotFound):
+		http.Error(w, strings.ToUpper(target[:1])+target[1:]+" not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errSeatReleaseAllocated), errors.Is(err, errSeatReleasePaid), errors.Is(err, errSeatReleasePartial), errors.Is(err, errSeatReleaseBlocked):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Failed to force release", "component", "admin", "target", target, "target_id", targetID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	closeReleasedCheckouts(r.Context(), "admin", resp.CancelledBookings)
+	resp.LocksCleared = clearReleasedSeatLocks(r.Context(), seats)
+	if _, err := db.ExecContext(r.Context(), `UPDATE admin_seat_releases SET locks_cleared = ? WHERE id = ?`, len(resp.LocksCleared), resp.ReleaseID); err != nil {
+		slog.WarnContext(r.Context(), "Failed to record cleared locks", "component", "admin", "release_id", resp.ReleaseID, "error", err)
+	}
+
+	slog.WarnContext(r.Context(), "Force released", "component", "admin", "release_id", resp.ReleaseID, "target", target, "target_id", targetID, "seats", resp.ReleasedSeats, "cancelled_bookings", resp.CancelledBookings, "locks_cleared", resp.LocksCleared)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// forceReleaseSeats resets the seats matched by where in one transaction and records it. It
+// returns the seats as they were, for clearing their locks.
+func forceReleaseSeats(ctx context.Context, target, targetID, where string, arg interface{}, req ForceReleaseRequest, ip string) (ForceReleaseResponse, []releasedSeat, error) {
+	var resp ForceReleaseResponse
+	var seats []releasedSeat
+
+	err := runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		resp = ForceReleaseResponse{ReleasedSeats: []int{}, CancelledBookings: []string{}}
+		seats = nil
+
+		rows, err := tx.QueryContext(ctx, `
+			SELECT id, show_id, user_id, payment_session_id, payment_status, is_reserved, allocation_id
+			FROM seats `+where+`
+			ORDER BY id
+			FOR UPDATE
+		`, arg)
+		if err != nil {
+			return fmt.Errorf("failed to lock seats: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var s releasedSeat
+			var userID, allocationID sql.NullInt64
+			var bookingID sql.NullString
+			if err := rows.Scan(&s.ID, &s.ShowID, &userID, &bookingID, &s.PaymentStatus, &s.IsReserved, &allocationID); err != nil {
+				return fmt.Errorf("failed to scan seat: %w", err)
+			}
+			if userID.Valid {
+				s.UserID = &userID.Int64
+			}
+			if allocationID.Valid {
+				s.AllocationID = &allocationID.Int64
+			}
+			s.BookingID = bookingID.String
+			seats = append(seats, s)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating seats: %w", err)
+		}
+
+		bookings := make(map[string]bool)
+		if target == "booking" {
+			bookings[targetID] = true
+		}
+		for i := range seats {
+			s := &seats[i]
+			if s.AllocationID != nil {
+				return fmt.Errorf("%w: seat %d", errSeatReleaseAllocated, s.ID)
+			}
+			switch {
+			case !s.IsReserved || s.PaymentStatus == "FAILED":
+				s.wasFree = true
+				continue
+			case s.PaymentStatus == "BLOCKED":
+				return fmt.Errorf("%w: seat %d", errSeatReleaseBlocked, s.ID)
+			case (s.PaymentStatus == "COMPLETED" || s.PaymentStatus == "REFUND_PENDING") && !req.IncludePaid:
+				return fmt.Errorf("%w: seat %d is %s", errSeatReleasePaid, s.ID, s.PaymentStatus)
+			}
+			resp.ReleasedSeats = append(resp.ReleasedSeats, s.ID)
+			if s.BookingID != "" {
+				bookings[s.BookingID] = true
+			}
+		}
+
+		if len(resp.ReleasedSeats) > 0 {
+			if err := releaseSeatRows(ctx, tx, resp.ReleasedSeats, HoldReleased); err != nil {
+				return fmt.Errorf("failed to release seats: %w", err)
+			}
+		}
+
+		// A booking still waiting on its hold is over once it has no seats left.
+		for bookingID := range bookings {
+			state, err := lockBookingState(ctx, tx, bookingID)
+			if err != nil {
+				return err
+			}
+			if state != BookingHeld && state != BookingPendingPayment {
+				continue
+			}
+			var remaining int
+			if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM seats WHERE payment_session_id = ?`, bookingID).Scan(&remaining); err != nil {
+				return fmt.Errorf("failed to count booking seats: %w", err)
+			}
+			if remaining > 0 {
+				// Its checkout would still charge for the released seat.
+				return fmt.Errorf("%w: booking %s", errSeatReleasePartial, bookingID)
+			}
+			if err := transitionBooking(ctx, tx, bookingID, BookingCancelled, truncate("released by admin: "+req.Reason, 255)); err != nil {
+				return err
+			}
+			resp.CancelledBookings = append(resp.CancelledBookings, bookingID)
+		}
+
+		if len(seats) == 0 && len(resp.CancelledBookings) == 0 {
+			if target == "seat" {
+				return errSeatReleaseNotFound
+			}
+			if state, err := bookingState(ctx, tx, targetID); err != nil {
+				return err
+			} else if state == "" {
+				return errSeatReleaseNotFound
+			}
+		}
+
+		before, err := json.Marshal(seats)
+		if err != nil {
+			return fmt.Errorf("failed to encode seats: %w", err)
+		}
+		id, err := insertReturningID(ctx, tx, `
+			INSERT INTO admin_seat_releases (target, target_id, seat_ids, cancelled_bookings, reason, operator, ip, seats_before)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, target, targetID, joinInts(resp.ReleasedSeats), strings.Join(resp.CancelledBookings, ","),
+			truncate(req.Reason, 255), nullString(truncate(req.Operator, 100)), nullString(truncate(ip, 64)), string(before))
+		if err != nil {
+			return fmt.Errorf("failed to record seat release: %w", err)
+		}
+		resp.ReleaseID = int64(id)
+		return nil
+	})
+	return resp, seats, err
+}
+
+// clearReleasedSeatLocks deletes the seat locks and redlock keys of seats that were just
+// released, or were free already, and returns the keys deleted.
+func clearReleasedSeatLocks(ctx context.Context, seats []releasedSeat) []string {
+	cleared := []string{}
+	for _, s := range seats {
+		key := seatLockKey(s.ShowID, s.ID)
+		holder, held, err := lockProvider.Inspect(ctx, key)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to read seat lock", "component", "admin", "lock_key", key, "error", err)
+		} else if held && (s.wasFree || (s.UserID != nil && holder.Owner == seatLockOwner(*s.UserID))) {
+			if err := lockProvider.Release(ctx, []string{key}, holder.Owner); err != nil {
+				slog.WarnContext(ctx, "Failed to release seat lock", "component", "admin", "lock_key", key, "owner", holder.Owner, "error", err)
+			} else {
+				cleared = append(cleared, key)
+			}
+		}
+
+		redlockKey := redlockSeatKeys([]int{s.ID})[0]
+		deleted := false
+		for i, client := range redlock.clients {
+			if clearRedlockKey(ctx, client, i, redlockKey, s) {
+				deleted = true
+			}
+		}
+		if deleted {
+			cleared = append(cleared, redlockKey)
+		}
+	}
+	return cleared
+}
+
+// clearRedlockKey deletes one node's redlock key for the seat if the seat's booking holds it,
+// or anyone does when the seat was free.
+func clearRedlockKey(ctx context.Context, client redis.UniversalClient, node int, key string, s releasedSeat) bool {
+	value, err := client.Get(ctx, key).Result()
+	if err != nil {
+		if err != redis.Nil {
+			slog.WarnContext(ctx, "Failed to read redlock key", "component", "admin", "node", node, "key", key, "error", err)
+		}
+		return false
+	}
+	if !s.wasFree && value != s.BookingID {
+		return false
+	}
+	n, err := releaseSeatsScript.Run(ctx, client, []string{key}, value).Int()
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to delete redlock key", "component", "admin", "node", node, "key", key, "error", err)
+		return false
+	}
+	return n > 0
+}
+
+// handleSeatReleases serves GET /admin/seat-releases, the force releases newest first,
+// optionally for one seat or booking (?target=seat&target_id=12).
+func handleSeatReleases(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var conditions []string
+	var args []interface{}
+	if v := query.Get("target"); v != "" {
+		conditions = append(conditions, "target = ?")
+		args = append(args, v)
+	}
+	if v := query.Get("target_id"); v != "" {
+		conditions = append(conditions, "target_id = ?")
+		args = append(args, v)
+	}
+	limit := 100
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSeatReleaseQueryLimit)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit)
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, target, target_id, seat_ids, cancelled_bookings, reason, operator, ip, seats_before, locks_cleared, created_at
+		FROM admin_seat_releases `+where+`
+		ORDER BY id DESC LIMIT ?
+	`, args...)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to query seat releases", "component", "admin", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	records := []SeatReleaseRecord{}
+	for rows.Next() {
+		var rec SeatReleaseRecord
+		var cancelled, operator, ip sql.NullString
+		var before string
+		if err := rows.Scan(&rec.ID, &rec.Target, &rec.TargetID, &rec.SeatIDs, &cancelled, &rec.Reason, &operator, &ip, &before, &rec.LocksCleared, &rec.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to scan seat release", "component", "admin", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		rec.CancelledBookings = cancelled.String
+		rec.Operator = operator.String
+		rec.IP = ip.String
+		rec.SeatsBefore = json.RawMessage(before)
+		records = append(records, rec)
+	}
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read seat releases", "component", "admin", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
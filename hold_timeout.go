@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Payment holds last payment.hold_timeout, unless the show sets its own in
+// shows.hold_timeout_seconds: a high-value event can give buyers ten minutes to pay while
+// everything else keeps the short default. The hold is read when the seats are reserved, so
+// changing it only affects new bookings.
+
+// showHoldTimeout is how long a hold on seatIDs lasts. The seats of a booking are all of one
+// show, the first one decides.
+func showHoldTimeout(ctx context.Context, q rowQueryer, seatIDs []int) (time.Duration, error) {
+	holdTimeout := time.Duration(strategyConfig.Payment.HoldTimeout)
+	if len(seatIDs) == 0 {
+		return holdTimeout, nil
+	}
+	var seconds sql.NullInt64
+	err := q.QueryRowContext(ctx, `
+		SELECT sh.hold_timeout_seconds FROM seats s JOIN shows sh ON sh.id = s.show_id WHERE s.id = ?
+	`, seatIDs[0]).Scan(&seconds)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to read hold timeout: %w", err)
+	}
+	if seconds.Valid {
+		holdTimeout = time.Duration(seconds.Int64) * time.Second
+	}
+	return holdTimeout, nil
+}
+
+// holdUntil is when a hold on seatIDs taken now ends.
+func holdUntil(ctx context.Context, q rowQueryer, seatIDs []int) (time.Time, error) {
+	holdTimeout, err := showHoldTimeout(ctx, q, seatIDs)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().Add(holdTimeout), nil
+}
+
+// bookingHoldExpiry is when the booking's hold ends, nil once nothing is held for payment.
+func bookingHoldExpiry(ctx context.Context, q rowQueryer, bookingID string) (*time.Time, error) {
+	var expiresAt sql.NullTime
+	err := q.QueryRowContext(ctx, `
+		SELECT MIN(payment_timeout) FROM seats WHERE payment_session_id = ? AND payment_status = 'PENDING'
+	`, bookingID).Scan(&expiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hold expiry: %w", err)
+	}
+	if !expiresAt.Valid {
+		return nil, nil
+	}
+	return &expiresAt.Time, nil
+}
+
+// holdExpiry is bookingHoldExpiry for a booking of any strategy, the memory strategy's are in
+// its store.
+func holdExpiry(ctx context.Context, bookingID string) (*time.Time, error) {
+	if expiresAt, ok := memoryStore.HoldExpiry(bookingID); ok {
+		return expiresAt, nil
+	}
+	if db == nil {
+		return nil, nil
+	}
+	return bookingHoldExpiry(ctx, db, bookingID)
+}
+
+// ShowHoldTimeoutRequest sets a show's hold; a null hold_timeout goes back to the default.
+type ShowHoldTimeoutRequest struct {
+	HoldTimeout *Duration `json:"hold_timeout"`
+}
+
+// handleUpdateShowHoldTimeout serves PUT /admin/shows/{id}/hold-timeout.
+func handleUpdateShowHoldTimeout(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+
+	var req ShowHoldTimeoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+		req.HoldTimeout != nil && time.Duration(*req.HoldTimeout) < 10*time.Second {
+		http.Error(w, "Invalid request body, hold_timeout must be at least 10s", http.StatusBadRequest)
+		return
+	}
+
+	var seconds sql.NullInt64
+	if req.HoldTimeout != nil {
+		seconds = sql.NullInt64{Int64: int64(time.Duration(*req.HoldTimeout) / time.Second), Valid: true}
+	}
+	result, err := db.ExecContext(ctx, "UPDATE shows SET hold_timeout_seconds = ? WHERE id = ?", seconds, showID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update hold timeout", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Updated hold timeout", "component", "admin", "show_id", showID, "hold_timeout_seconds", seconds.Int64, "default", !seconds.Valid)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Two-phase booking. POST /api/holds books like /api/book, with the same body and checks, but
+// stops once the seats are held: the booking stays HELD with no checkout, so a UI can let the
+// user review the selection first. POST /api/holds/{id}/checkout then opens the checkout and
+// answers where to pay, the booking going PENDING_PAYMENT as /api/book's do at once. The hold
+// lasts the show's hold timeout (hold_timeout.go) from when it was made, checkout or not,
+// and the reaper releases it when that runs out like any other.
+
+type HoldCheckoutRequest struct {
+	UserID int `json:"user_id"`
+}
+
+type HoldCheckoutResponse struct {
+	BookingID     string       `json:"booking_id"`
+	Status        string       `json:"status"`
+	State         BookingState `json:"state"`
+	RedirectURL   string       `json:"redirect_url"`
+	HoldExpiresAt *time.Time   `json:"hold_expires_at,omitempty"`
+	RequestID     string       `json:"request_id,omitempty"`
+}
+
+// handleCreateHold serves POST /api/holds.
+func handleCreateHold(w http.ResponseWriter, r *http.Request) {
+	var req BookingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.WarnContext(r.Context(), "Invalid request body", "component", "api", "ip", r.RemoteAddr, "error", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if dbDriver == "memory" {
+		http.Error(w, "Holds need a database", http.StatusBadRequest)
+		return
+	}
+	req.Hold = true
+	serveBooking(w, r, req)
+}
+
+// handleHoldCheckout serves POST /api/holds/{id}/checkout. Like abandoning a booking, the
+// caller names the user holding it. Asking again once the checkout is open answers the same
+// checkout, and so do two calls racing on the hold: the one storing its checkout second has
+// its own closed again (openPaymentSession).
+func handleHoldCheckout(w http.ResponseWriter, r *http.Request) {
+	bookingID := r.PathValue("id")
+	var req HoldCheckoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var userID, showID int
+	var state BookingState
+	err := db.QueryRowContext(r.Context(), `SELECT user_id, show_id, state FROM bookings WHERE id = ?`, bookingID).Scan(&userID, &showID, &state)
+	if err == sql.ErrNoRows || (err == nil && userID != req.UserID) {
+		http.Error(w, "Hold not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load hold", "component", "api", "booking_id", bookingID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := HoldCheckoutResponse{BookingID: bookingID, State: state, RequestID: requestIDFromContext(r.Context())}
+	switch state {
+	case BookingHeld:
+		if showCancelled(r.Context(), showID) {
+			writeShowCancelled(w, r)
+			return
+		}
+		expiresAt, err := holdExpiry(r.Context(), bookingID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to read hold expiry", "component", "api", "booking_id", bookingID, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if expiresAt == nil || !time.Now().Before(*expiresAt) {
+			http.Error(w, "Hold has expired", http.StatusConflict)
+			return
+		}
+		session, err := attachPaymentSession(r.Context(), bookingID)
+		if err != nil {
+			// The seats stay held, the checkout can be asked for again.
+			slog.ErrorContext(r.Context(), "Failed to open checkout for hold", "component", "api", "booking_id", bookingID, "error", err)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Failed to open checkout, try again", http.StatusServiceUnavailable)
+			return
+		}
+		slog.InfoContext(r.Context(), "Opened checkout for hold", "component", "api", "booking_id", bookingID, "user_id", req.UserID)
+		resp.State = BookingPendingPayment
+		resp.RedirectURL = session.RedirectURL
+		resp.HoldExpiresAt = expiresAt
+	case BookingPendingPayment:
+		checkout, err := loadBookingCheckout(r.Context(), db, bookingID)
+		if err == nil {
+			resp.HoldExpiresAt, err = holdExpiry(r.Context(), bookingID)
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to load checkout", "component", "api", "booking_id", bookingID, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		resp.RedirectURL = checkout.RedirectURL.String
+	default:
+		http.Error(w, "Hold is "+string(state), http.StatusConflict)
+		return
+	}
+
+	resp.Status = bookingPaymentStatus(resp.State)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
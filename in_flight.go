@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// In-flight registry. BookSeats registers every booking for the duration of the strategy call
+// and the strategies report which phase they are in (waiting on Redis, on row locks, on
+// commit...), so /admin/in-flight shows where requests are stuck during an incident.
+
+type inFlightBooking struct {
+	BookingID   string    `json:"booking_id"`
+	UserID      int       `json:"user_id"`
+	ShowID      int       `json:"show_id"`
+	Strategy    string    `json:"strategy"`
+	Phase       string    `json:"phase"`
+	GoroutineID uint64    `json:"goroutine_id"`
+	StartedAt   time.Time `json:"started_at"`
+	PhaseSince  time.Time `json:"phase_since"`
+	locks       []heldLock
+}
+
+type InFlightRegistry struct {
+	mu       sync.Mutex
+	bookings map[string]*inFlightBooking
+}
+
+var inFlight = &InFlightRegistry{bookings: make(map[string]*inFlightBooking)}
+
+type inFlightContextKey struct{}
+
+// Start registers a booking and returns a context carrying it plus the func that removes it.
+func (r *InFlightRegistry) Start(ctx context.Context, bookingID string, req BookingRequest) (context.Context, func()) {
+	now := time.Now()
+	entry := &inFlightBooking{
+		BookingID:   bookingID,
+		UserID:      req.UserID,
+		ShowID:      req.ShowID,
+		Strategy:    req.Method,
+		Phase:       "started",
+		GoroutineID: currentGoroutineID(),
+		StartedAt:   now,
+		PhaseSince:  now,
+	}
+
+	r.mu.Lock()
+	r.bookings[bookingID] = entry
+	r.mu.Unlock()
+
+	return context.WithValue(ctx, inFlightContextKey{}, bookingID), func() {
+		r.mu.Lock()
+		delete(r.bookings, bookingID)
+		r.mu.Unlock()
+	}
+}
+
+func (r *InFlightRegistry) setPhase(bookingID, phase string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.bookings[bookingID]; ok {
+		entry.Phase = phase
+		entry.PhaseSince = time.Now()
+	}
+}
+
+func (r *InFlightRegistry) addLocks(bookingID string, locks []heldLock) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.bookings[bookingID]; ok {
+		entry.locks = append(entry.locks, locks...)
+	}
+}
+
+// heldLocks returns the distributed locks held by every booking still executing.
+func (r *InFlightRegistry) heldLocks() []heldLock {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var locks []heldLock
+	for _, entry := range r.bookings {
+		locks = append(locks, entry.locks...)
+	}
+	return locks
+}
+
+// locksByBooking returns the distributed locks held by each booking still executing.
+func (r *InFlightRegistry) locksByBooking() map[string][]heldLock {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	locks := make(map[string][]heldLock)
+	for bookingID, entry := range r.bookings {
+		if len(entry.locks) > 0 {
+			locks[bookingID] = slices.Clone(entry.locks)
+		}
+	}
+	return locks
+}
+
+func (r *InFlightRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.bookings)
+}
+
+func (r *InFlightRegistry) Snapshot() []inFlightBooking {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := make([]inFlightBooking, 0, len(r.bookings))
+	for _, entry := range r.bookings {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].StartedAt.Before(entries[j].StartedAt) })
+	return entries
+}
+
+// setBookingPhase is called by the strategies; it is a no-op for contexts that aren't
+// registered (reapers, tools).
+func setBookingPhase(ctx context.Context, phase string) {
+	if bookingID, ok := ctx.Value(inFlightContextKey{}).(string); ok {
+		inFlight.setPhase(bookingID, phase)
+	}
+}
+
+// currentGoroutineID parses the id out of the "goroutine N [running]:" stack header. Only
+// used for display, so a failed parse just yields 0.
+func currentGoroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i > 0 {
+		buf = buf[:i]
+	}
+	id, _ := strconv.ParseUint(string(buf), 10, 64)
+	return id
+}
+
+type inFlightView struct {
+	inFlightBooking
+	ElapsedMs      int64 `json:"elapsed_ms"`
+	PhaseElapsedMs int64 `json:"phase_elapsed_ms"`
+}
+
+// handleInFlight serves GET /admin/in-flight, oldest booking first.
+func handleInFlight(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	entries := inFlight.Snapshot()
+
+	views := make([]inFlightView, len(entries))
+	for i, entry := range entries {
+		views[i] = inFlightView{
+			inFlightBooking: entry,
+			ElapsedMs:       now.Sub(entry.StartedAt).Milliseconds(),
+			PhaseElapsedMs:  now.Sub(entry.PhaseSince).Milliseconds(),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":    len(views),
+		"bookings": views,
+		// Requests waiting for a slot in front of /api/book, see backpressure.go.
+		"waiting": bookingLimiter.Waiting(),
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Leader election for the maintenance jobs. Every instance serves bookings, but the jobs that
+// sweep the whole seats table (the reaper lanes, expired channel allocations, payment
+// reconciliation, hold lock renewal, search notifications, journal pruning, the outbox relay,
+// booking callbacks, the seat status relay) only run on one of them: the holder of a lease in
+// Redis, maintenance_leader, written with SET NX and renewed every lease_ttl/3 while its value
+// is still this instance's id. A leader that can't renew stops counting itself leader once its
+// lease would have expired, before anyone else can take it over, so two instances never sweep
+// at the same time. Leadership is only about the background jobs; the primary region check
+// still applies on top of it.
+
+const maintenanceLeaderKey = "maintenance_leader"
+
+// renewLeaseScript sets PEXPIRE ARGV[2] on KEYS[1] when it still holds ARGV[1].
+var renewLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// LeaderConfig tunes the maintenance lease, see leader_election.go.
+type LeaderConfig struct {
+	LeaseTTL Duration `json:"lease_ttl"` // LEADER_LEASE_TTL, how long a leader that stopped renewing keeps the jobs
+}
+
+type LeaderState struct {
+	mu         sync.Mutex
+	id         string
+	leaseUntil time.Time // zero while not leader
+}
+
+var leader = &LeaderState{id: newInstanceID()}
+
+// newInstanceID names this process in the lease: the host, the pid and a random suffix so a
+// restarted process with the same pid doesn't inherit its predecessor's lease.
+func newInstanceID() string {
+	host, _ := os.Hostname()
+	raw := make([]byte, 4)
+	rand.Read(raw)
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(raw))
+}
+
+// isMaintenanceLeader reports whether this instance runs the maintenance jobs right now.
+func isMaintenanceLeader() bool {
+	leader.mu.Lock()
+	defer leader.mu.Unlock()
+	return time.Now().Before(leader.leaseUntil)
+}
+
+// runsMaintenance reports whether the maintenance jobs run here: in the primary region, on
+// its leader.
+func runsMaintenance() bool {
+	return isPrimaryRegion() && isMaintenanceLeader()
+}
+
+func runLeaderElection() error {
+	ttl := time.Duration(strategyConfig.Leader.LeaseTTL)
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	leader.campaign(ttl)
+	for range ticker.C {
+		leader.campaign(ttl)
+	}
+	return errors.New("ending leader election")
+}
+
+// campaign renews the lease when this instance holds it and tries to take it otherwise.
+func (l *LeaderState) campaign(ttl time.Duration) {
+	started := time.Now()
+	wasLeader := isMaintenanceLeader()
+
+	callCtx, cancel := context.WithTimeout(ctx, ttl/3)
+	defer cancel()
+	var held bool
+	var err error
+	if wasLeader {
+		var renewed int
+		renewed, err = renewLeaseScript.Run(callCtx, rdb, []string{maintenanceLeaderKey}, l.id, ttl.Milliseconds()).Int()
+		held = renewed == 1
+	} else {
+		held, err = rdb.SetNX(callCtx, maintenanceLeaderKey, l.id, ttl).Result()
+	}
+	if err != nil {
+		// Keep the lease we have until it runs out, Redis may be back before then.
+		slog.Warn("Failed to campaign for maintenance leader", "component", "leader", "leader", wasLeader, "error", err)
+		return
+	}
+
+	l.mu.Lock()
+	if held {
+		// Counted from before the call: Redis started the TTL no earlier than that.
+		l.leaseUntil = started.Add(ttl)
+	} else {
+		l.leaseUntil = time.Time{}
+	}
+	l.mu.Unlock()
+
+	switch {
+	case held && !wasLeader:
+		slog.Info("Became maintenance leader", "component", "leader", "instance", l.id)
+	case !held && wasLeader:
+		slog.Warn("Lost maintenance leadership", "component", "leader", "instance", l.id)
+	}
+}
+
+// resign gives the lease up on shutdown so another instance takes the jobs over right away
+// instead of after lease_ttl.
+func (l *LeaderState) resign() {
+	if !isMaintenanceLeader() {
+		return
+	}
+	l.mu.Lock()
+	l.leaseUntil = time.Time{}
+	l.mu.Unlock()
+
+	releaseCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := releaseSeatsScript.Run(releaseCtx, rdb, []string{maintenanceLeaderKey}, l.id).Err(); err != nil {
+		slog.Warn("Failed to resign maintenance leadership", "component", "leader", "error", err)
+		return
+	}
+	slog.Info("Resigned maintenance leadership", "component", "leader", "instance", l.id)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Event-driven hold release. The lock watchdog keeps a held seat's seat_lock alive until the
+// hold's payment_timeout plus lockHoldGrace, so the key expiring is the moment the hold lapsed.
+// With redis.expiry_events on, the service subscribes to Redis' expired key events and releases
+// those seats right away instead of waiting for the next reaper pass. The seats table stays the
+// source of truth: a seat is only released if its hold has expired there, and the reaper keeps
+// running for events Redis dropped (they are fire and forget, lost while the subscriber is
+// reconnecting) and for lock providers other than Redis.
+
+// keyspaceExpiredEvents are the notify-keyspace-events flags expiry events need: keyevent
+// notifications (E) of expirations (x).
+const keyspaceExpiredEvents = "Ex"
+
+func runLockExpiryListener() error {
+	nodes, err := lockExpiryNodes()
+	if err != nil {
+		return err
+	}
+
+	seatIDs := make(chan int, strategyConfig.Reaper.BatchSize)
+	for _, node := range nodes {
+		enableExpiryEvents(node)
+		pubsub := node.PSubscribe(ctx, "__keyevent@*__:expired")
+		go func() {
+			for msg := range pubsub.Channel() {
+				if seatID, ok := seatIDFromLockKey(msg.Payload); ok {
+					seatIDs <- seatID
+				}
+			}
+		}()
+	}
+	slog.Info("Listening for seat lock expiry", "component", "lock_expiry", "nodes", len(nodes))
+
+	for seatID := range seatIDs {
+		// Keys of one booking expire together, release them in one go.
+		batch := []int{seatID}
+	drain:
+		for len(batch) < strategyConfig.Reaper.BatchSize {
+			select {
+			case seatID := <-seatIDs:
+				batch = append(batch, seatID)
+			default:
+				break drain
+			}
+		}
+		releaseExpiredLocks(batch)
+	}
+	return errors.New("ending lock expiry listener")
+}
+
+// lockExpiryNodes are the nodes to subscribe to: expiry events are only published on the node
+// that held the key, so on a cluster that is every master.
+func lockExpiryNodes() ([]redis.UniversalClient, error) {
+	var mu sync.Mutex
+	var nodes []redis.UniversalClient
+	err := forEachRedisNode(ctx, rdb, func(node redis.UniversalClient) error {
+		mu.Lock()
+		defer mu.Unlock()
+		nodes = append(nodes, node)
+		return nil
+	})
+	return nodes, err
+}
+
+// enableExpiryEvents turns on expired key events when the node has them off. Managed Redis
+// often refuses CONFIG SET; then they have to be enabled in its settings.
+func enableExpiryEvents(node redis.UniversalClient) {
+	current, err := node.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err == nil && len(current) == 2 {
+		flags, _ := current[1].(string)
+		if strings.Contains(flags, "E") && (strings.Contains(flags, "x") || strings.Contains(flags, "A")) {
+			return
+		}
+		err = node.ConfigSet(ctx, "notify-keyspace-events", flags+keyspaceExpiredEvents).Err()
+	}
+	if err != nil {
+		slog.Warn("Could not enable expiry events, set notify-keyspace-events Ex on the server, holds are released by the reaper until then",
+			"component", "lock_expiry", "error", err)
+	}
+}
+
+// seatIDFromLockKey parses the seat out of a seat_lock key, striped or not.
+func seatIDFromLockKey(key string) (int, bool) {
+	if !strings.HasPrefix(key, "seat_lock:") {
+		return 0, false
+	}
+	seatID, err := strconv.Atoi(key[strings.LastIndexByte(key, ':')+1:])
+	return seatID, err == nil
+}
+
+func releaseExpiredLocks(seatIDs []int) {
+	// Every instance gets the event, the leader of the primary region does the releasing.
+	if !runsMaintenance() {
+		return
+	}
+	defer func() { reportPanic(ctx, "lock_expiry", recover()) }()
+
+	released, err := reapExpiredSeats(seatIDs)
+	if err != nil {
+		slog.Error("Failed to release expired holds", "component", "lock_expiry", "seat_ids", seatIDs, "error", err)
+		reportError(ctx, "lock_expiry", err)
+		return
+	}
+	if released > 0 {
+		slog.Info("Released expired holds", "component", "lock_expiry", "released", released, "seat_ids", seatIDs)
+	}
+}
+
+// lockExpiryEnabled reports whether runLockExpiryListener should run: the seat locks it
+// watches are only in Redis with the Redis lock provider.
+func lockExpiryEnabled() bool {
+	return strategyConfig.Redis.ExpiryEvents && lockProvider.Name() == "redis"
+}
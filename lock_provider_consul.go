@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Consul lock provider. Every acquisition creates a session and locks all its keys with it in
+// one KV transaction, so it is all-or-nothing. The session carries the lock TTL and the
+// health checks in ConsulSessionChecks (the agent's serfHealth by default): when the TTL
+// runs out or a check goes critical, Consul invalidates the session and, with the delete
+// behavior, removes its keys. The fencing token is the Raft index the keys were written at.
+// Consul only renews a session to its original TTL and treats TTLs as a lower bound, so
+// expiry is less precise than with the other providers. Consul's lock-delay is turned off,
+// an invalidated seat lock should be free for the next booking right away.
+
+const (
+	consulLockPrefix    = "bookmyshow/locks/"
+	consulMinSessionTTL = 10 * time.Second
+)
+
+type consulLockProvider struct {
+	client *api.Client
+	checks []string
+}
+
+func newConsulLockProvider(addr string, checks []string) (*consulLockProvider, error) {
+	cfg := api.DefaultConfig()
+	cfg.Address = addr
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consul client for %s: %w", addr, err)
+	}
+	return &consulLockProvider{client: client, checks: checks}, nil
+}
+
+func (p *consulLockProvider) Name() string { return "consul" }
+
+func (p *consulLockProvider) Acquire(ctx context.Context, keys []string, owner string, ttl time.Duration) (int64, error) {
+	wopts := (&api.WriteOptions{}).WithContext(ctx)
+	session, _, err := p.client.Session().Create(&api.SessionEntry{
+		Name:       "seat-lock " + owner,
+		TTL:        max(ttl, consulMinSessionTTL).Round(time.Second).String(),
+		Behavior:   api.SessionBehaviorDelete,
+		LockDelay:  time.Millisecond,
+		NodeChecks: p.checks,
+	}, wopts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create consul session: %w", err)
+	}
+
+	ops := make(api.TxnOps, len(keys))
+	for i, key := range keys {
+		ops[i] = &api.TxnOp{KV: &api.KVTxnOp{
+			Verb:    api.KVLock,
+			Key:     consulLockPrefix + key,
+			Value:   []byte(owner),
+			Session: session,
+		}}
+	}
+	ok, resp, _, err := p.client.Txn().Txn(ops, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil || !ok {
+		p.client.Session().Destroy(session, nil)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to acquire consul lock for keys %v: %w", keys, err)
+	}
+	if !ok {
+		return 0, fmt.Errorf("%w: failed to acquire consul lock for seats (keys: %v), possibly locked by another user", ErrSeatsLocked, keys)
+	}
+
+	var token int64
+	for _, result := range resp.Results {
+		if result.KV != nil {
+			token = max(token, int64(result.KV.ModifyIndex))
+		}
+	}
+	return token, nil
+}
+
+// owned returns the sessions holding keys for owner.
+func (p *consulLockProvider) owned(ctx context.Context, keys []string, owner string) (map[string]bool, error) {
+	sessions := make(map[string]bool)
+	for _, key := range keys {
+		pair, _, err := p.client.KV().Get(consulLockPrefix+key, (&api.QueryOptions{}).WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read consul lock %s: %w", key, err)
+		}
+		if pair != nil && pair.Session != "" && string(pair.Value) == owner {
+			sessions[pair.Session] = true
+		}
+	}
+	return sessions, nil
+}
+
+// Extend renews the owner's sessions, which resets them to the TTL they were created with;
+// ttl itself can't be applied to an existing session.
+func (p *consulLockProvider) Extend(ctx context.Context, keys []string, owner string, ttl time.Duration) error {
+	sessions, err := p.owned(ctx, keys, owner)
+	if err != nil {
+		return err
+	}
+	for session := range sessions {
+		if _, _, err := p.client.Session().Renew(session, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+			return fmt.Errorf("failed to renew consul session %s: %w", session, err)
+		}
+	}
+	return nil
+}
+
+// Release destroys the owner's sessions, which deletes every key they hold. An acquisition
+// has a session of its own, so that is exactly the keys taken together with these.
+func (p *consulLockProvider) Release(ctx context.Context, keys []string, owner string) error {
+	sessions, err := p.owned(ctx, keys, owner)
+	if err != nil {
+		return err
+	}
+	for session := range sessions {
+		if _, err := p.client.Session().Destroy(session, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+			return fmt.Errorf("failed to destroy consul session %s: %w", session, err)
+		}
+	}
+	return nil
+}
+
+func (p *consulLockProvider) Inspect(ctx context.Context, key string) (LockState, bool, error) {
+	pair, _, err := p.client.KV().Get(consulLockPrefix+key, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil || pair == nil || pair.Session == "" {
+		return LockState{}, false, err
+	}
+	state := LockState{Owner: string(pair.Value)}
+	session, _, err := p.client.Session().Info(pair.Session, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read consul session", "component", "locks", "session", pair.Session, "error", err)
+	} else if session != nil {
+		// Consul doesn't expose the time left, only the TTL the session renews to.
+		state.TTL, _ = time.ParseDuration(session.TTL)
+	}
+	return state, true, nil
+}
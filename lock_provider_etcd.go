@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcd lock provider. Each acquisition puts its keys under one lease in a single transaction
+// that only succeeds if none of the keys exist, so it is all-or-nothing like the Redis script,
+// and the keys vanish with the lease if the service dies. The transaction's revision is the
+// fencing token. Revisions are per cluster: after failing over to a region with its own etcd
+// cluster, tokens are not comparable with ones written before.
+
+const etcdLockPrefix = "bookmyshow/locks/"
+
+type etcdLockProvider struct {
+	client *clientv3.Client
+}
+
+func newEtcdLockProvider(endpoints []string) (*etcdLockProvider, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to etcd %v: %w", endpoints, err)
+	}
+	return &etcdLockProvider{client: client}, nil
+}
+
+func (p *etcdLockProvider) Name() string { return "etcd" }
+
+// leaseSeconds rounds up, etcd leases have whole-second TTLs.
+func leaseSeconds(ttl time.Duration) int64 {
+	return max(int64((ttl+time.Second-1)/time.Second), 1)
+}
+
+func (p *etcdLockProvider) Acquire(ctx context.Context, keys []string, owner string, ttl time.Duration) (int64, error) {
+	lease, err := p.client.Grant(ctx, leaseSeconds(ttl))
+	if err != nil {
+		return 0, fmt.Errorf("failed to grant etcd lease: %w", err)
+	}
+
+	cmps := make([]clientv3.Cmp, len(keys))
+	ops := make([]clientv3.Op, len(keys))
+	for i, key := range keys {
+		cmps[i] = clientv3.Compare(clientv3.CreateRevision(etcdLockPrefix+key), "=", 0)
+		ops[i] = clientv3.OpPut(etcdLockPrefix+key, owner, clientv3.WithLease(lease.ID))
+	}
+
+	resp, err := p.client.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil || !resp.Succeeded {
+		p.client.Revoke(context.Background(), lease.ID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to acquire etcd lock for keys %v: %w", keys, err)
+	}
+	if !resp.Succeeded {
+		return 0, fmt.Errorf("%w: failed to acquire etcd lock for seats (keys: %v), possibly locked by another user", ErrSeatsLocked, keys)
+	}
+	return resp.Header.Revision, nil
+}
+
+// Extend moves the keys owner still holds onto a fresh lease. A lease can only be renewed to
+// the TTL it was granted with, and payment holds need arbitrary TTLs; the old lease expires
+// on its own once nothing is attached to it.
+func (p *etcdLockProvider) Extend(ctx context.Context, keys []string, owner string, ttl time.Duration) error {
+	lease, err := p.client.Grant(ctx, leaseSeconds(ttl))
+	if err != nil {
+		return fmt.Errorf("failed to grant etcd lease: %w", err)
+	}
+	for _, key := range keys {
+		_, err := p.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.Value(etcdLockPrefix+key), "=", owner)).
+			Then(clientv3.OpPut(etcdLockPrefix+key, owner, clientv3.WithLease(lease.ID))).
+			Commit()
+		if err != nil {
+			return fmt.Errorf("failed to extend etcd lock %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (p *etcdLockProvider) Release(ctx context.Context, keys []string, owner string) error {
+	for _, key := range keys {
+		_, err := p.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.Value(etcdLockPrefix+key), "=", owner)).
+			Then(clientv3.OpDelete(etcdLockPrefix + key)).
+			Commit()
+		if err != nil {
+			return fmt.Errorf("failed to release etcd lock %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (p *etcdLockProvider) Inspect(ctx context.Context, key string) (LockState, bool, error) {
+	resp, err := p.client.Get(ctx, etcdLockPrefix+key)
+	if err != nil {
+		return LockState{}, false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return LockState{}, false, nil
+	}
+	kv := resp.Kvs[0]
+	state := LockState{Owner: string(kv.Value)}
+	if lease, err := p.client.TimeToLive(ctx, clientv3.LeaseID(kv.Lease)); err == nil {
+		state.TTL = time.Duration(lease.TTL) * time.Second
+	}
+	return state, true, nil
+}
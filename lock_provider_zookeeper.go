@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// ZooKeeper lock provider, the standard lock recipe: every contender creates an ephemeral
+// sequential node under the key's directory and the lowest live node holds the lock. Ephemeral
+// nodes disappear with the ZooKeeper session, so a crashed or partitioned service drops its
+// locks once the session expires. ZooKeeper has no per-node TTL, so each node stores its
+// owner and deadline; a node past its deadline is ignored and cleaned up by the next acquirer.
+// This never waits for the lock: a key held by someone else fails the acquisition like the
+// Redis provider does. The fencing token is the node's creation zxid, which ZooKeeper orders
+// across the whole ensemble.
+
+const (
+	zkLockRoot       = "/bookmyshow/locks"
+	zkSessionTimeout = 10 * time.Second
+)
+
+type zkLockProvider struct {
+	conn *zk.Conn
+}
+
+type zkLockNode struct {
+	path     string
+	owner    string
+	deadline time.Time
+}
+
+func newZookeeperLockProvider(servers []string) (*zkLockProvider, error) {
+	conn, events, err := zk.Connect(servers, zkSessionTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to zookeeper %v: %w", servers, err)
+	}
+	go func() {
+		for event := range events {
+			if event.State == zk.StateExpired {
+				slog.Warn("ZooKeeper session expired, held seat locks were released", "component", "locks", "servers", servers)
+			}
+		}
+	}()
+	return &zkLockProvider{conn: conn}, nil
+}
+
+func (p *zkLockProvider) Name() string { return "zookeeper" }
+
+func zkLockData(owner string, deadline time.Time) []byte {
+	return []byte(owner + "\n" + strconv.FormatInt(deadline.UnixMilli(), 10))
+}
+
+func parseZkLockData(path string, data []byte) zkLockNode {
+	owner, deadline, _ := strings.Cut(string(data), "\n")
+	ms, _ := strconv.ParseInt(deadline, 10, 64)
+	return zkLockNode{path: path, owner: owner, deadline: time.UnixMilli(ms)}
+}
+
+// ensureDir creates dir and its parents as persistent nodes.
+func (p *zkLockProvider) ensureDir(dir string) error {
+	path := ""
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		path += "/" + part
+		_, err := p.conn.Create(path, nil, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && err != zk.ErrNodeExists {
+			return fmt.Errorf("failed to create zookeeper node %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// nodes returns the live lock nodes for key in sequence order, the holder first. With reap,
+// expired nodes are deleted on the way.
+func (p *zkLockProvider) nodes(key string, reap bool) ([]zkLockNode, error) {
+	dir := zkLockRoot + "/" + key
+	children, _, err := p.conn.Children(dir)
+	if err == zk.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Sequence suffixes are zero padded, so name order is creation order.
+	sort.Strings(children)
+
+	now := time.Now()
+	var nodes []zkLockNode
+	for _, child := range children {
+		path := dir + "/" + child
+		data, _, err := p.conn.Get(path)
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		node := parseZkLockData(path, data)
+		if !node.deadline.After(now) {
+			if reap {
+				p.conn.Delete(path, -1)
+			}
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func (p *zkLockProvider) Acquire(ctx context.Context, keys []string, owner string, ttl time.Duration) (int64, error) {
+	data := zkLockData(owner, time.Now().Add(ttl))
+	var created []string
+	abort := func() {
+		for _, path := range created {
+			p.conn.Delete(path, -1)
+		}
+	}
+
+	var token int64
+	for _, key := range keys {
+		dir := zkLockRoot + "/" + key
+		if err := p.ensureDir(dir); err != nil {
+			abort()
+			return 0, err
+		}
+		path, err := p.conn.Create(dir+"/lock-", data, zk.FlagEphemeralSequential, zk.WorldACL(zk.PermAll))
+		if err != nil {
+			abort()
+			return 0, fmt.Errorf("failed to create zookeeper lock node for key %s: %w", key, err)
+		}
+		created = append(created, path)
+
+		nodes, err := p.nodes(key, true)
+		if err != nil {
+			abort()
+			return 0, fmt.Errorf("failed to list zookeeper lock nodes for key %s: %w", key, err)
+		}
+		if len(nodes) == 0 || nodes[0].path != path {
+			abort()
+			return 0, fmt.Errorf("%w: failed to acquire zookeeper lock for seats (keys: %v), possibly locked by another user", ErrSeatsLocked, keys)
+		}
+
+		_, stat, err := p.conn.Exists(path)
+		if err != nil || stat == nil {
+			abort()
+			return 0, fmt.Errorf("failed to read zookeeper lock node %s: %w", path, err)
+		}
+		token = max(token, stat.Czxid)
+	}
+	return token, nil
+}
+
+func (p *zkLockProvider) Extend(ctx context.Context, keys []string, owner string, ttl time.Duration) error {
+	data := zkLockData(owner, time.Now().Add(ttl))
+	for _, key := range keys {
+		nodes, err := p.nodes(key, false)
+		if err != nil {
+			return fmt.Errorf("failed to list zookeeper lock nodes for key %s: %w", key, err)
+		}
+		for _, node := range nodes {
+			if node.owner != owner {
+				continue
+			}
+			if _, err := p.conn.Set(node.path, data, -1); err != nil && err != zk.ErrNoNode {
+				return fmt.Errorf("failed to extend zookeeper lock %s: %w", node.path, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *zkLockProvider) Release(ctx context.Context, keys []string, owner string) error {
+	for _, key := range keys {
+		nodes, err := p.nodes(key, false)
+		if err != nil {
+			return fmt.Errorf("failed to list zookeeper lock nodes for key %s: %w", key, err)
+		}
+		for _, node := range nodes {
+			if node.owner != owner {
+				continue
+			}
+			if err := p.conn.Delete(node.path, -1); err != nil && err != zk.ErrNoNode {
+				return fmt.Errorf("failed to release zookeeper lock %s: %w", node.path, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *zkLockProvider) Inspect(ctx context.Context, key string) (LockState, bool, error) {
+	nodes, err := p.nodes(key, false)
+	if err != nil || len(nodes) == 0 {
+		return LockState{}, false, err
+	}
+	return LockState{Owner: nodes[0].owner, TTL: time.Until(nodes[0].deadline)}, true, nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis/database lock reconciliation, the reconcile-locks command. It cross-checks every
+// seat_lock key against the seat it guards:
+//   - a lock on a seat that is free or already paid for guards nothing and is deleted
+//   - a live PENDING hold with neither a seat_lock nor a redlock key is reported; holds made by
+//     the lockless strategies (optimistic, pessimistic, ...) never had one, so the report is
+//     for comparing against what the "current" and "redlock" strategies booked
+// A lock taken by a booking that hasn't written its seats yet looks exactly like a stale one,
+// so candidates are checked twice, -confirm-after apart (by default the request timeout, the
+// longest a booking runs), and only deleted if they still hold the same owner and the seat is
+// still free or paid. Deletes compare the owner, so a lock retaken in between is left alone.
+
+// maxReportedSeats caps the seat ids listed in a log line.
+const maxReportedSeats = 50
+
+type seatLockEntry struct {
+	key    string
+	seatID int
+	owner  string
+}
+
+type LockReconcileResult struct {
+	Locks         int
+	Stale         int
+	Deleted       int
+	HoldsNoLock   int
+	NoLockSeatIDs []int
+}
+
+func runReconcileLocksCommand(args []string) {
+	flags := flag.NewFlagSet("reconcile-locks", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report stale locks without deleting them")
+	confirmAfter := flags.Duration("confirm-after", 0, "how long a lock has to stay stale before it is deleted (default server.request_timeout)")
+	configFile := configFlag(flags)
+	flags.Parse(args)
+
+	loadConfig(*configFile)
+	if !connectDatabase() {
+		log.Fatalf("Nothing to reconcile for DB_DRIVER=%s", dbDriver)
+	}
+	defer db.Close()
+	connectServices()
+	if lockProvider.Name() != "redis" {
+		log.Fatalf("seat locks are kept by %s, not Redis, nothing to reconcile", lockProvider.Name())
+	}
+	if *confirmAfter <= 0 {
+		*confirmAfter = time.Duration(strategyConfig.Server.RequestTimeout)
+	}
+
+	result, err := reconcileSeatLocks(ctx, *confirmAfter, *dryRun)
+	if err != nil {
+		log.Fatalf("Lock reconcile failed: %v", err)
+	}
+	slog.Info("Lock reconcile done", "component", "lock_reconcile", "locks", result.Locks, "stale", result.Stale,
+		"deleted", result.Deleted, "dry_run", *dryRun, "holds_without_lock", result.HoldsNoLock)
+	if len(result.NoLockSeatIDs) > 0 {
+		slog.Warn("Held seats without a lock", "component", "lock_reconcile", "seat_ids", result.NoLockSeatIDs)
+	}
+}
+
+func reconcileSeatLocks(ctx context.Context, confirmAfter time.Duration, dryRun bool) (*LockReconcileResult, error) {
+	result := &LockReconcileResult{}
+
+	locks, err := scanSeatLocks(ctx, "seat_lock:*")
+	if err != nil {
+		return nil, err
+	}
+	result.Locks = len(locks)
+
+	candidates, err := staleSeatLocks(ctx, locks)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Found stale lock candidates", "component", "lock_reconcile", "locks", len(locks), "candidates", len(candidates), "confirm_after", confirmAfter)
+
+	if len(candidates) > 0 {
+		time.Sleep(confirmAfter)
+		if candidates, err = confirmStaleLocks(ctx, candidates); err != nil {
+			return nil, err
+		}
+	}
+	result.Stale = len(candidates)
+
+	for _, lock := range candidates {
+		if dryRun {
+			slog.Info("Stale lock", "component", "lock_reconcile", "key", lock.key, "owner", lock.owner)
+			continue
+		}
+		deleted, err := releaseSeatsScript.Run(ctx, rdb, []string{lock.key}, lock.owner).Int()
+		if err != nil {
+			return result, fmt.Errorf("failed to delete %s: %w", lock.key, err)
+		}
+		result.Deleted += deleted
+	}
+
+	noLock, err := holdsWithoutLock(ctx, 0)
+	if err != nil {
+		return result, err
+	}
+	result.HoldsNoLock = len(noLock)
+	result.NoLockSeatIDs = noLock[:min(len(noLock), maxReportedSeats)]
+	return result, nil
+}
+
+// scanSeatLocks reads every seat_lock key matching pattern and its owner, from every node of
+// a cluster.
+func scanSeatLocks(ctx context.Context, pattern string) ([]seatLockEntry, error) {
+	var mu sync.Mutex
+	var locks []seatLockEntry
+	err := forEachRedisNode(ctx, rdb, func(node redis.UniversalClient) error {
+		var keys []string
+		iter := node.Scan(ctx, 0, pattern, 500).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			return fmt.Errorf("failed to scan seat locks: %w", err)
+		}
+
+		owners, err := lockOwners(ctx, node, keys)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for i, key := range keys {
+			seatID, ok := seatIDFromLockKey(key)
+			if ok && owners[i] != "" {
+				locks = append(locks, seatLockEntry{key: key, seatID: seatID, owner: owners[i]})
+			}
+		}
+		return nil
+	})
+	return locks, err
+}
+
+// lockOwners GETs keys in one pipeline, "" for those gone in the meantime.
+func lockOwners(ctx context.Context, client redis.UniversalClient, keys []string) ([]string, error) {
+	cmds, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Get(ctx, key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to read seat locks: %w", err)
+	}
+	owners := make([]string, len(keys))
+	for i, cmd := range cmds {
+		owners[i] = cmd.(*redis.StringCmd).Val()
+	}
+	return owners, nil
+}
+
+// staleSeatLocks returns the locks on seats that are free, paid for or gone.
+func staleSeatLocks(ctx context.Context, locks []seatLockEntry) ([]seatLockEntry, error) {
+	seatIDs := make([]int, len(locks))
+	for i, lock := range locks {
+		seatIDs[i] = lock.seatID
+	}
+	guarded, err := guardedSeats(ctx, seatIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []seatLockEntry
+	for _, lock := range locks {
+		if !guarded[lock.seatID] {
+			stale = append(stale, lock)
+		}
+	}
+	return stale, nil
+}
+
+// confirmStaleLocks keeps the candidates that still hold the same owner and are still stale.
+func confirmStaleLocks(ctx context.Context, candidates []seatLockEntry) ([]seatLockEntry, error) {
+	keys := make([]string, len(candidates))
+	for i, lock := range candidates {
+		keys[i] = lock.key
+	}
+	owners, err := lockOwners(ctx, rdb, keys)
+	if err != nil {
+		return nil, err
+	}
+	var unchanged []seatLockEntry
+	for i, lock := range candidates {
+		if owners[i] == lock.owner {
+			unchanged = append(unchanged, lock)
+		}
+	}
+	return staleSeatLocks(ctx, unchanged)
+}
+
+// guardedSeats reports, for each of seatIDs, whether the seat is something a lock may still
+// guard: reserved and not yet paid, or in review or refund.
+func guardedSeats(ctx context.Context, seatIDs []int) (map[int]bool, error) {
+	guarded := make(map[int]bool, len(seatIDs))
+	for start := 0; start < len(seatIDs); start += 500 {
+		chunk := seatIDs[start:min(start+500, len(seatIDs))]
+		rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+			SELECT id FROM seats
+			WHERE id IN (%s) AND is_reserved = 1 AND payment_status NOT IN ('FAILED', 'COMPLETED', 'BLOCKED')
+		`, generatePlaceholders(len(chunk))), sliceToInterface(chunk)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read seat states: %w", err)
+		}
+		for rows.Next() {
+			var seatID int
+			if err := rows.Scan(&seatID); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan seat state: %w", err)
+			}
+			guarded[seatID] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read seat states: %w", err)
+		}
+	}
+	return guarded, nil
+}
+
+// holdsWithoutLock lists live payment holds with no seat_lock and no redlock key on any node,
+// of one show, or of all with showID 0.
+func holdsWithoutLock(ctx context.Context, showID int) ([]int, error) {
+	query := `
+		SELECT id, show_id FROM seats
+		WHERE is_reserved = 1 AND payment_status = 'PENDING' AND payment_timeout > ? AND allocation_id IS NULL`
+	args := []interface{}{time.Now()}
+	if showID != 0 {
+		query += " AND show_id = ?"
+		args = append(args, showID)
+	}
+	rows, err := db.QueryContext(ctx, query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load held seats: %w", err)
+	}
+	var seatIDs []int
+	var keys []string
+	for rows.Next() {
+		var seatID, showID int
+		if err := rows.Scan(&seatID, &showID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan held seat: %w", err)
+		}
+		seatIDs = append(seatIDs, seatID)
+		keys = append(keys, seatLockKey(showID, seatID))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load held seats: %w", err)
+	}
+
+	locked := make([]bool, len(seatIDs))
+	if err := markExistingKeys(ctx, rdb, keys, locked); err != nil {
+		return nil, err
+	}
+	redlockKeys := redlockSeatKeys(seatIDs)
+	for _, client := range redlock.clients {
+		if err := markExistingKeys(ctx, client, redlockKeys, locked); err != nil {
+			return nil, err
+		}
+	}
+
+	var noLock []int
+	for i, seatID := range seatIDs {
+		if !locked[i] {
+			noLock = append(noLock, seatID)
+		}
+	}
+	return noLock, nil
+}
+
+// markExistingKeys sets found[i] for each of keys that exists on client.
+func markExistingKeys(ctx context.Context, client redis.UniversalClient, keys []string, found []bool) error {
+	cmds, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Exists(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check locks: %w", err)
+	}
+	for i, cmd := range cmds {
+		if cmd.(*redis.IntCmd).Val() > 0 {
+			found[i] = true
+		}
+	}
+	return nil
+}
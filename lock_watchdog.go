@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Lock watchdog. Redis seat locks are taken with a fixed TTL, but a booking can outlive it: the
+// transaction can be slow under load, and the payment hold in the database starts after the
+// lock was taken, so it outlasts the lock by however long the booking took. Every
+// strategyConfig.Redis.RenewalInterval the watchdog pushes the TTL out, through whichever
+// lock provider is configured, for
+//   - locks held by bookings still executing (from the in-flight registry), by the lock's TTL
+//   - locks backing a PENDING payment hold, to the hold's payment_timeout plus a grace period,
+//     on the maintenance leader only (leader_election.go)
+// Extension only touches locks still held by their owner, so one that changed hands is left alone.
+
+const lockHoldGrace = 5 * time.Second
+
+// extendLocksScript sets PEXPIRE ARGV[2i] on KEYS[i] when it still holds ARGV[2i-1].
+var extendLocksScript = redis.NewScript(`
+local extended = 0
+for i, key in ipairs(KEYS) do
+	if redis.call("GET", key) == ARGV[2*i-1] then
+		redis.call("PEXPIRE", key, ARGV[2*i])
+		extended = extended + 1
+	end
+end
+return extended
+`)
+
+// lockExtender is anything that can push out the expiry of locks it handed out: a
+// LockProvider or the Redlock node set.
+type lockExtender interface {
+	Extend(ctx context.Context, keys []string, owner string, ttl time.Duration) error
+}
+
+type heldLock struct {
+	extender lockExtender
+	keys     []string
+	owner    string
+	ttl      time.Duration
+}
+
+// watchLocks registers locks taken by the booking in ctx so the watchdog keeps them alive
+// while the booking runs. No-op outside a registered booking.
+func watchLocks(ctx context.Context, extender lockExtender, keys []string, owner string, ttl time.Duration) {
+	bookingID, ok := ctx.Value(inFlightContextKey{}).(string)
+	if !ok {
+		return
+	}
+	inFlight.addLocks(bookingID, []heldLock{{extender: extender, keys: keys, owner: owner, ttl: ttl}})
+}
+
+// extendLocks runs extendLocksScript with the same owner and TTL for every key.
+func extendLocks(ctx context.Context, client redis.UniversalClient, keys []string, owner string, ttl time.Duration) error {
+	args := make([]interface{}, 0, 2*len(keys))
+	for range keys {
+		args = append(args, owner, ttl.Milliseconds())
+	}
+	return extendLocksScript.Run(ctx, client, keys, args...).Err()
+}
+
+func extendHeldLocks(locks []heldLock) int {
+	extended := 0
+	for _, lock := range locks {
+		if err := lock.extender.Extend(ctx, lock.keys, lock.owner, lock.ttl); err != nil {
+			slog.Error("Failed to extend locks", "component", "watchdog", "keys", lock.keys, "error", err)
+			continue
+		}
+		extended += len(lock.keys)
+	}
+	return extended
+}
+
+func runLockWatchdog() error {
+	ticker := time.NewTicker(time.Duration(strategyConfig.Redis.RenewalInterval))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !isPrimaryRegion() {
+			continue
+		}
+
+		// Every instance keeps its own bookings' locks alive, the leader those of the holds.
+		locks := inFlight.heldLocks()
+		var holds []heldLock
+		if isMaintenanceLeader() {
+			var err error
+			if holds, err = paymentHoldLocks(); err != nil {
+				slog.Error("Failed to load payment holds", "component", "watchdog", "error", err)
+			}
+		}
+
+		if extended := extendHeldLocks(append(locks, holds...)); extended > 0 {
+			slog.Info("Extended locks", "component", "watchdog", "count", extended)
+		}
+	}
+
+	return errors.New("ending lock watchdog")
+}
+
+// paymentHoldLocks lists the locks backing every live payment hold, one entry per booking
+// and lock kind. seat_lock keys are owned by "user:<id>" and redlock keys by the booking id,
+// as written by the strategies.
+func paymentHoldLocks() ([]heldLock, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, show_id, user_id, payment_session_id, payment_timeout
+		FROM seats
+		WHERE is_reserved = 1 AND payment_status = 'PENDING' AND payment_timeout > ?
+		ORDER BY payment_session_id
+	`, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query payment holds: %w", err)
+	}
+	defer rows.Close()
+
+	var locks []heldLock
+	lastSession := ""
+	for rows.Next() {
+		var seatID, showID, userID int
+		var sessionID string
+		var timeout time.Time
+		if err := rows.Scan(&seatID, &showID, &userID, &sessionID, &timeout); err != nil {
+			return nil, fmt.Errorf("failed to scan payment hold: %w", err)
+		}
+		if sessionID != lastSession {
+			ttl := time.Until(timeout) + lockHoldGrace
+			locks = append(locks,
+				heldLock{extender: lockProvider, owner: seatLockOwner(int64(userID)), ttl: ttl},
+				heldLock{extender: redlock, owner: sessionID, ttl: ttl})
+			lastSession = sessionID
+		}
+		n := len(locks)
+		locks[n-2].keys = append(locks[n-2].keys, seatLockKey(showID, seatID))
+		locks[n-1].keys = append(locks[n-1].keys, redlockSeatKeys([]int{seatID})[0])
+	}
+	return locks, rows.Err()
+}
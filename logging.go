@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Logging. Everything logs through log/slog with a "component" field in place of the old
+// "[API]"/"[Booking]" prefixes, and snake_case fields (booking_id, user_id, seat_ids, ...)
+// instead of formatted text. Lines are JSON in production and plain key=value otherwise.
+// BookSeats puts the booking's fields on its context, so every line logged under it carries
+// booking_id, user_id, seat_ids and strategy without each strategy repeating them.
+
+// LogConfig is how much is logged and in which format.
+type LogConfig struct {
+	Level  string `json:"level"`  // LOG_LEVEL, "debug", "info", "warn" or "error"
+	Format string `json:"format"` // LOG_FORMAT, "json", "text" or "auto": json when APP_ENV=production
+	// LOG_SLOW_QUERY and LOG_SLOW_TRANSACTION, statements and transactions taking longer are
+	// logged and counted, 0 for never; see slow_queries.go
+	SlowQuery       Duration `json:"slow_query"`
+	SlowTransaction Duration `json:"slow_transaction"`
+}
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// setupLogging makes the configured logger the default, for the log package too.
+func setupLogging(cfg LogConfig) {
+	opts := &slog.HandlerOptions{Level: logLevels[strings.ToLower(cfg.Level)]}
+
+	var handler slog.Handler
+	if cfg.Format == "json" || cfg.Format == "auto" && isProduction() {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(contextFieldsHandler{handler}))
+}
+
+type logFieldsContextKey struct{}
+
+// withLogFields returns a context whose log lines carry args, key-value pairs as slog takes them.
+func withLogFields(ctx context.Context, args ...any) context.Context {
+	fields := contextLogFields(ctx)
+	fields = append(fields[:len(fields):len(fields)], slog.Group("", args...).Value.Group()...)
+	return context.WithValue(ctx, logFieldsContextKey{}, fields)
+}
+
+// contextLogFields returns the fields withLogFields put on ctx.
+func contextLogFields(ctx context.Context) []slog.Attr {
+	fields, _ := ctx.Value(logFieldsContextKey{}).([]slog.Attr)
+	return fields
+}
+
+// contextFieldsHandler adds the context's log fields to each record, except those the line
+// sets itself.
+type contextFieldsHandler struct {
+	slog.Handler
+}
+
+func (h contextFieldsHandler) Handle(ctx context.Context, r slog.Record) error {
+	if fields := contextLogFields(ctx); len(fields) > 0 {
+		own := make(map[string]bool, r.NumAttrs())
+		r.Attrs(func(a slog.Attr) bool {
+			own[a.Key] = true
+			return true
+		})
+		for _, field := range fields {
+			if !own[field.Key] {
+				r.AddAttrs(field)
+			}
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextFieldsHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextFieldsHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextFieldsHandler) WithGroup(name string) slog.Handler {
+	return contextFieldsHandler{h.Handler.WithGroup(name)}
+}
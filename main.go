@@ -5,10 +5,13 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/go-redis/redis/v8"
 	_ "github.com/go-sql-driver/mysql"
 	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
@@ -22,370 +25,862 @@ type Seat struct {
 }
 
 type BookingRequest struct {
-	UserID  int
-	ShowID  int
-	SeatIDs []int
-	Method  string // "pessimistic", "optimistic", or "current"
+	UserID   int
+	ShowID   int
+	SeatIDs  []int
+	Quantity int    // only used by "skip_locked" and "best_available", which pick the seats themselves
+	Method   string // "pessimistic", "optimistic", "current", "redlock", "advisory", "named", "skip_locked", "best_available", "events", "memory", or "auto"
+	NoWait   bool   // "pessimistic" only: fail with 409 instead of waiting on row locks
+	// waiting room shows only: the token from the QUEUED response, and the admission token
+	// from /api/queue-status once admitted (the queue token alone works too)
+	QueueToken     string
+	AdmissionToken string
+	// CallbackURL is notified when the booking ends, see booking_callbacks.go.
+	CallbackURL string `json:"callback_url"`
+	// PresaleCode is needed while the show is in its presale, see presale.go.
+	PresaleCode string `json:"presale_code"`
+	// Preferences guide "best_available", see best_available.go.
+	Preferences SeatPreferences `json:"preferences"`
+	// Hold leaves the checkout to POST /api/holds/{id}/checkout, see holds.go. Only /api/holds
+	// sets it.
+	Hold bool `json:"hold,omitempty"`
 }
 
 type AsyncBookingResponse struct {
-	BookingID string `json:"booking_id"`
-	Status    string `json:"status"`
+	BookingID  string       `json:"booking_id"`
+	Status     string       `json:"status"`
+	SeatIDs    []int        `json:"seat_ids,omitempty"`
+	QueueToken string       `json:"queue_token,omitempty"`
+	State      BookingState `json:"state,omitempty"`
+	// HoldExpiresAt is when the seats are released unless the booking is paid.
+	HoldExpiresAt *time.Time `json:"hold_expires_at,omitempty"`
+	RequestID     string     `json:"request_id,omitempty"`
 }
 
 var (
-	db  *sql.DB
-	rdb *redis.Client
-	ctx = context.Background()
+	db      *sql.DB
+	rdb     redis.UniversalClient
+	redlock *Redlock
+	ctx     = context.Background()
 )
 
-func BookSeats(req BookingRequest, bookingId string) error {
+// BookSeats returns the seats that were reserved, which differ from req.SeatIDs for
+// strategies that choose seats themselves. ctx is the request's: once it is done the booking
+// stops wherever it got to and rolls back.
+func BookSeats(ctx context.Context, req BookingRequest, bookingId string) ([]int, error) {
 	var err error
+	seatIDs := req.SeatIDs
+
+	// Without a database the in-process store is the only inventory there is.
+	if dbDriver == "memory" {
+		req.Method = "memory"
+	} else if eventStoreEnabled() {
+		req.Method = "events"
+	} else if len(req.SeatIDs) > strategyConfig.Bulk.MaxSeatsPerRequest {
+		req.Method = "bulk"
+	} else if method := showStrategy(req.ShowID); method != "" && req.Method != "skip_locked" && req.Method != "best_available" {
+		// Not for the strategies that pick the seats, the request has none to give another.
+		req.Method = method
+	}
+	if req.Method == "auto" {
+		req.Method = contentionTracker.ChooseMethod(req.ShowID)
+	}
+	// A request over the limit on its own can't fit whatever the user holds already.
+	if limit := seatLimit(); limit > 0 && max(len(req.SeatIDs), req.Quantity) > limit {
+		return nil, fmt.Errorf("%w: %d seats requested, the limit is %d", ErrSeatLimitExceeded, max(len(req.SeatIDs), req.Quantity), limit)
+	}
+
+	ctx = withLogFields(ctx, "booking_id", bookingId, "user_id", req.UserID, "seat_ids", req.SeatIDs, "strategy", req.Method)
+	ctx = withSeatAuditStrategy(ctx, req.Method)
+	ctx = withBookingCallback(ctx, req.CallbackURL)
+	ctx, done := inFlight.Start(ctx, bookingId, req)
+	defer done()
+
+	if req.Method != "memory" {
+		// Before the semaphore and the locks: with the database down they'd be held for nothing.
+		if dbBreaker.IsOpen() {
+			return nil, ErrDatabaseUnavailable
+		}
+		setBookingPhase(ctx, "show_semaphore")
+		releaseSlot, err := acquireShowSlot(ctx, req.ShowID, bookingId)
+		if err != nil {
+			return nil, err
+		}
+		defer releaseSlot()
+	}
 
 	// Choose concurrency control method based on request
 	switch req.Method {
 	case "pessimistic":
-		err = PessimisticLocking(ctx, db, req.UserID, req.SeatIDs, bookingId)
+		err = PessimisticLocking(ctx, db, req.UserID, req.SeatIDs, bookingId, req.NoWait)
 	case "optimistic":
 		err = OptimisticLocking(ctx, db, req.UserID, req.SeatIDs, bookingId)
 	case "current":
-		err = BookMyShowTimeoutImp(ctx, db, rdb, req.UserID, req.SeatIDs, bookingId)
+		err = BookMyShowTimeoutImp(ctx, db, lockProvider, req.UserID, req.SeatIDs, bookingId)
+	case "redlock":
+		err = RedlockBooking(ctx, db, redlock, req.UserID, req.SeatIDs, bookingId)
+	case "advisory":
+		err = AdvisoryLocking(ctx, db, req.UserID, req.SeatIDs, bookingId)
+	case "named":
+		err = NamedLocking(ctx, db, req.UserID, req.SeatIDs, bookingId)
+	case "memory":
+		err = MemoryBooking(ctx, memoryStore, req.UserID, req.SeatIDs, bookingId)
+	case "events":
+		err = EventSourcedBooking(ctx, db, req.UserID, req.SeatIDs, bookingId)
+	case "bulk":
+		err = BulkBooking(ctx, db, req.UserID, req.SeatIDs, bookingId)
+	case "skip_locked", "best_available":
+		seatIDs, err = SkipLockedBooking(ctx, db, req.UserID, req.ShowID, req.Quantity, req.Preferences, bookingId)
 	default:
-		return fmt.Errorf("invalid concurrency control method: %s", req.Method)
+		return nil, fmt.Errorf("invalid concurrency control method: %s", req.Method)
 	}
 
+	contentionTracker.Record(req.ShowID, isContentionError(err))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+
+	if req.Method != "memory" && !req.Hold {
+		setBookingPhase(ctx, "payment_session")
+		if _, err := attachPaymentSession(ctx, bookingId); err != nil {
+			slog.ErrorContext(ctx, "Failed to open payment session, releasing hold", "component", "booking", "error", err)
+			if _, releaseErr := releaseBookingHold(context.WithoutCancel(ctx), bookingId, req.UserID); releaseErr != nil {
+				slog.ErrorContext(ctx, "Failed to release hold", "component", "booking", "error", releaseErr)
+			}
+			return nil, err
+		}
+	}
+	return seatIDs, nil
 
 }
 
 func handlePaymentWebhook(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[Webhook] Payment webhook received from IP: %s", r.RemoteAddr)
+	slog.DebugContext(r.Context(), "Payment webhook received", "component", "webhook", "ip", r.RemoteAddr)
 
 	if r.Method != http.MethodPost {
-		log.Printf("[Webhook] Invalid method %s from IP: %s", r.Method, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Invalid method", "component", "webhook", "method", r.Method, "ip", r.RemoteAddr)
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	var payload struct {
-		SessionID string `json:"session_id"`
-		Status    string `json:"status"`
+		SessionID   string `json:"session_id"`
+		Status      string `json:"status"`
+		EventID     string `json:"event_id"`
+		AmountCents *int64 `json:"amount_cents"`
+		Currency    string `json:"currency"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		log.Printf("[Webhook] Invalid payload from IP: %s, Error: %v", r.RemoteAddr, err)
+		slog.WarnContext(r.Context(), "Invalid payload", "component", "webhook", "ip", r.RemoteAddr, "error", err)
 		http.Error(w, "Invalid payload", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("[Webhook] Processing payment - SessionID: %s, Status: %s", payload.SessionID, payload.Status)
-
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	slog.InfoContext(r.Context(), "Processing payment", "component", "webhook", "session_id", payload.SessionID, "status", payload.Status)
 
-	if err != nil {
-		fmt.Printf("Failed at transaction beginning. %v", err)
+	outcome, err := applyPaymentResult(r.Context(), payload.SessionID, PaymentResult{
+		Status:      payload.Status,
+		AmountCents: payload.AmountCents,
+		Currency:    payload.Currency,
+	}, payload.EventID)
+	switch {
+	case errors.Is(err, ErrNoPendingSeats):
+		http.Error(w, "No pending seats found", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrUnknownPaymentStatus), errors.Is(err, ErrIllegalPaymentTransition):
+		slog.WarnContext(r.Context(), "Rejected payment status", "component", "webhook", "session_id", payload.SessionID, "error", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, ErrConcurrentPaymentUpdate):
+		slog.InfoContext(r.Context(), "Concurrent modification", "component", "webhook", "session_id", payload.SessionID)
+		http.Error(w, "Concurrent modification detected", http.StatusConflict)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Failed to process payment", "component", "webhook", "session_id", payload.SessionID, "error", err)
+		reportError(r.Context(), "webhook", err, "session_id", payload.SessionID)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	defer tx.Rollback()
+	switch outcome {
+	case "duplicate":
+		slog.WarnContext(r.Context(), "Duplicate delivery ignored", "component", "webhook", "session_id", payload.SessionID, "status", payload.Status, "event_id", payload.EventID)
+	case "ignored":
+		slog.WarnContext(r.Context(), "Stale delivery ignored, session already settled", "component", "webhook", "session_id", payload.SessionID, "status", payload.Status)
+	case "review":
+		slog.InfoContext(r.Context(), "Payment flagged for review", "component", "webhook", "session_id", payload.SessionID)
+	case "refunded":
+		slog.InfoContext(r.Context(), "Late payment queued for refund", "component", "webhook", "session_id", payload.SessionID)
+	default:
+		slog.InfoContext(r.Context(), "Successfully processed payment", "component", "webhook", "session_id", payload.SessionID, "status", payload.Status)
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": outcome, "request_id": requestIDFromContext(r.Context())})
+}
 
-	fmt.Printf("select pending rows %v", payload)
+func handleAsyncBooking(w http.ResponseWriter, r *http.Request) {
+	slog.DebugContext(r.Context(), "Starting async booking request", "component", "api", "ip", r.RemoteAddr)
 
-	query := `
-	SELECT id, user_id, version FROM seats 
-	WHERE payment_session_id = ? AND payment_status = 'PENDING'
-`
+	if r.Method != http.MethodPost {
+		slog.WarnContext(r.Context(), "Invalid method", "component", "api", "method", r.Method, "ip", r.RemoteAddr)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	rows, err := tx.QueryContext(ctx, query, payload.SessionID)
-	if err != nil {
-		fmt.Printf("failed at fetching pending data %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	var req BookingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.WarnContext(r.Context(), "Invalid request body", "component", "api", "ip", r.RemoteAddr, "error", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
+	req.Hold = false
+	serveBooking(w, r, req)
+}
 
-	var seatVersions = make(map[int]int)
-	var seatUser = make(map[int]int)
-	for rows.Next() {
-		fmt.Println(rows)
-		var seatID, version, user_id int
-		if err := rows.Scan(&seatID, &user_id, &version); err != nil {
-			fmt.Printf("failed at scaning data %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
+// serveBooking takes a decoded booking request through the checks in front of the booking
+// and books it, or queues it when async booking is on.
+func serveBooking(w http.ResponseWriter, r *http.Request, req BookingRequest) {
+	if err := checkCallbackURL(req.CallbackURL); err != nil {
+		slog.WarnContext(r.Context(), "Invalid callback URL", "component", "api", "user_id", req.UserID, "error", err)
+		if errors.Is(err, ErrCallbacksNotConfigured) {
+			http.Error(w, "Callbacks not configured", http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 		}
-
-		seatVersions[seatID] = version
-		seatUser[seatID] = user_id
+		return
 	}
 
-	fmt.Println(seatUser)
-	fmt.Println(seatVersions)
+	slog.InfoContext(r.Context(), "Valid booking request", "component", "api", "user_id", req.UserID, "show_id", req.ShowID, "seat_ids", req.SeatIDs, "method", req.Method)
 
-	if len(seatVersions) == 0 {
-		http.Error(w, "No pending seats found", http.StatusNotFound)
+	if showCancelled(r.Context(), req.ShowID) {
+		slog.InfoContext(r.Context(), "Show cancelled", "component", "api", "user_id", req.UserID, "show_id", req.ShowID)
+		if attempt, ok := bookingAttemptFromContext(r.Context()); ok {
+			attempt.Outcome = "rejected_show_cancelled"
+		}
+		writeShowCancelled(w, r)
 		return
 	}
 
-	for seatID, version := range seatVersions {
-		result, err := tx.ExecContext(ctx, `
-            UPDATE seats 
-            SET payment_status = ?,
-                version = version + 1
-            WHERE id = ? AND version = ?
-        `, payload.Status, seatID, version)
-		if err != nil {
-			fmt.Printf("failed at updating the seats %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
+	if showSoldOut(r.Context(), req.ShowID) {
+		slog.InfoContext(r.Context(), "Show sold out", "component", "api", "user_id", req.UserID, "show_id", req.ShowID)
+		if attempt, ok := bookingAttemptFromContext(r.Context()); ok {
+			attempt.Outcome = "rejected_sold_out"
 		}
+		writeSoldOut(w, r)
+		return
+	}
 
-		rowsAffected, err := result.RowsAffected()
-		if err != nil {
-			fmt.Printf("failed at result.RowsAffected() %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
+	now := time.Now()
+	presale, err := checkSaleWindow(req.ShowID, now)
+	var windowErr *SaleWindowError
+	if errors.As(err, &windowErr) {
+		slog.InfoContext(r.Context(), "Show not on sale", "component", "api", "user_id", req.UserID, "show_id", req.ShowID, "status", windowErr.Status)
+		if attempt, ok := bookingAttemptFromContext(r.Context()); ok {
+			attempt.Outcome = "rejected_sale_window"
+			attempt.Error = windowErr.Error()
 		}
+		writeSaleWindowError(w, r, windowErr, now)
+		return
+	}
 
-		if rowsAffected == 0 {
-			fmt.Printf("Concurrent modification detected %v", err)
-			http.Error(w, "Concurrent modification detected", http.StatusConflict)
-			return
+	queueToken, err := enterWaitingRoom(r.Context(), req)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Waiting room check failed", "component", "api", "user_id", req.UserID, "show_id", req.ShowID, "error", err)
+		if attempt, ok := bookingAttemptFromContext(r.Context()); ok {
+			attempt.Error = err.Error()
 		}
+		if errors.Is(err, ErrAdmissionUsed) {
+			http.Error(w, "Queue token was already used", http.StatusConflict)
+		} else {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
 	}
-
-	if err := tx.Commit(); err != nil {
-		fmt.Printf("failing at commit %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if queueToken != "" {
+		if attempt, ok := bookingAttemptFromContext(r.Context()); ok {
+			attempt.Outcome = "queued"
+		}
+		// Nothing is booked until the request comes back with its token.
+		giveBackBookingQuota(r.Context())
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(AsyncBookingResponse{
+			Status:     "QUEUED",
+			QueueToken: queueToken,
+			RequestID:  requestIDFromContext(r.Context()),
+		})
 		return
 	}
 
-	// Cleanup Redis Lock
-	for seatID, userId := range seatUser {
-		lockKey := fmt.Sprintf("seat_lock:%d", seatID)
-		lockValue := fmt.Sprintf("user:%d", userId)
+	bookingID := fmt.Sprintf("book_%d_%d", req.UserID, time.Now().UnixNano())
 
-		val, err := rdb.Get(ctx, lockKey).Result()
-		if err == nil && val == lockValue {
-			rdb.Del(ctx, lockKey)
-			log.Printf("[Webhook] Released Redis lock - SeatID: %d, UserID: %d, LockKey: %s",
-				seatID, userId, lockKey)
+	dedupe := dedupesBooking(req)
+	if dedupe {
+		existing, err := claimBooking(r.Context(), req, bookingID)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Duplicate booking check failed, booking anyway", "component", "api", "user_id", req.UserID, "show_id", req.ShowID, "error", err)
+			dedupe = false
+		}
+		if existing != "" {
+			slog.InfoContext(r.Context(), "Duplicate booking request", "component", "api", "booking_id", existing, "user_id", req.UserID, "show_id", req.ShowID)
+			if attempt, ok := bookingAttemptFromContext(r.Context()); ok {
+				attempt.BookingID = existing
+				attempt.Outcome = "duplicate"
+			}
+			writeDuplicateBooking(w, r, req, existing)
+			return
 		}
 	}
 
-	log.Printf("[Webhook] Successfully processed payment - SessionID: %s, Status: %s",
-		payload.SessionID, payload.Status)
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
-}
-
-func handleAsyncBooking(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[API] Starting async booking request from IP: %s", r.RemoteAddr)
-
-	if r.Method != http.MethodPost {
-		log.Printf("[API] Invalid method %s from IP: %s", r.Method, r.RemoteAddr)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	if presale {
+		if err := usePresaleCode(r.Context(), req.ShowID, req.PresaleCode); err != nil {
+			slog.InfoContext(r.Context(), "Presale code refused", "component", "api", "user_id", req.UserID, "show_id", req.ShowID, "error", err)
+			if attempt, ok := bookingAttemptFromContext(r.Context()); ok {
+				attempt.Outcome = "rejected_presale_code"
+				attempt.Error = err.Error()
+			}
+			if dedupe {
+				releaseBookingClaim(context.WithoutCancel(r.Context()), req, bookingID)
+			}
+			if errors.Is(err, ErrPresaleCodeRequired) || errors.Is(err, ErrInvalidPresaleCode) {
+				writePresaleError(w, r, err)
+			} else {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
 	}
 
-	var req BookingRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("[API] Invalid request body from IP: %s, error: %v", r.RemoteAddr, err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if asyncBookingEnabled() {
+		if attempt, ok := bookingAttemptFromContext(r.Context()); ok {
+			attempt.BookingID = bookingID
+			attempt.Outcome = "enqueued"
+		}
+		if err := enqueueBooking(r.Context(), bookingID, req); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to queue booking", "component", "api", "booking_id", bookingID, "user_id", req.UserID, "error", err)
+			if presale {
+				returnPresaleCode(context.WithoutCancel(r.Context()), req.PresaleCode)
+			}
+			if dedupe {
+				releaseBookingClaim(context.WithoutCancel(r.Context()), req, bookingID)
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Queued booking", "component", "api", "booking_id", bookingID, "user_id", req.UserID)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(AsyncBookingResponse{
+			BookingID: bookingID,
+			Status:    AsyncBookingAccepted,
+			RequestID: requestIDFromContext(r.Context()),
+		})
 		return
 	}
 
-	log.Printf("[API] Valid booking request - UserID: %d, ShowID: %d, Seats: %v, Method: %s",
-		req.UserID, req.ShowID, req.SeatIDs, req.Method)
+	slog.InfoContext(r.Context(), "Starting booking process", "component", "booking", "booking_id", bookingID, "user_id", req.UserID)
 
-	bookingID := fmt.Sprintf("book_%d_%d", req.UserID, time.Now().UnixNano())
-	log.Printf("[API] Generated booking ID: %s for UserID: %d", bookingID, req.UserID)
-
-	log.Printf("[Booking] Starting booking process - BookingID: %s, UserID: %d", bookingID, req.UserID)
-
-	err := BookSeats(req, bookingID)
+	seatIDs, err := BookSeats(r.Context(), req, bookingID)
+	if attempt, ok := bookingAttemptFromContext(r.Context()); ok {
+		attempt.BookingID = bookingID
+		if err != nil {
+			attempt.Error = err.Error()
+		} else if len(seatIDs) > 0 {
+			attempt.SeatIDs = seatIDs
+		}
+	}
 	if err != nil {
-		log.Printf("[Booking] Failed booking - BookingID: %s, UserID: %d, Error: %v",
-			bookingID, req.UserID, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed booking", "component", "booking", "booking_id", bookingID, "user_id", req.UserID, "error", err)
+		if presale {
+			returnPresaleCode(context.WithoutCancel(r.Context()), req.PresaleCode)
+		}
+		if dedupe {
+			releaseBookingClaim(context.WithoutCancel(r.Context()), req, bookingID)
+		}
+		if errors.Is(err, ErrDatabaseUnavailable) {
+			retryAfter := int(math.Ceil(time.Duration(strategyConfig.DBBreaker.OpenFor).Seconds()))
+			w.Header().Set("Retry-After", fmt.Sprint(max(retryAfter, 1)))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(AsyncBookingResponse{
+				BookingID: bookingID,
+				Status:    "TRY_AGAIN",
+				RequestID: requestIDFromContext(r.Context()),
+			})
+			return
+		}
+		if errors.Is(err, ErrShowBusy) {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(AsyncBookingResponse{
+				BookingID: bookingID,
+				Status:    "TRY_AGAIN",
+				RequestID: requestIDFromContext(r.Context()),
+			})
+			return
+		}
+		if errors.Is(err, ErrSeatLimitExceeded) {
+			if attempt, ok := bookingAttemptFromContext(r.Context()); ok {
+				attempt.Outcome = "rejected_seat_limit"
+			}
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(AsyncBookingResponse{
+				BookingID: bookingID,
+				Status:    "SEAT_LIMIT_EXCEEDED",
+				RequestID: requestIDFromContext(r.Context()),
+			})
+			return
+		}
+		if errors.Is(err, ErrSeatsLocked) || errors.Is(err, ErrNotEnoughSeats) {
+			w.WriteHeader(http.StatusConflict)
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			w.WriteHeader(http.StatusGatewayTimeout)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 		json.NewEncoder(w).Encode(AsyncBookingResponse{
 			BookingID: bookingID,
 			Status:    "FAILED",
+			RequestID: requestIDFromContext(r.Context()),
 		})
 	} else {
-		log.Printf("[Booking] Successfully initiated booking - BookingID: %s, UserID: %d",
-			bookingID, req.UserID)
+		slog.InfoContext(r.Context(), "Successfully initiated booking", "component", "booking", "booking_id", bookingID, "user_id", req.UserID)
 
-		log.Printf("[API] Returning booking response - BookingID: %s, Status: PENDING", bookingID)
+		// The seats are held either way, a failed read only leaves the expiry out.
+		expiresAt, err := holdExpiry(r.Context(), bookingID)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Failed to read hold expiry", "component", "api", "booking_id", bookingID, "error", err)
+		}
+		if dedupe {
+			holdBookingClaim(r.Context(), req, bookingID, expiresAt)
+		}
+
+		status := "PENDING"
+		if req.Hold {
+			status = string(BookingHeld)
+		}
+		slog.InfoContext(r.Context(), "Returning booking response", "component", "api", "booking_id", bookingID, "status", status)
 		w.WriteHeader(http.StatusAccepted)
 		json.NewEncoder(w).Encode(AsyncBookingResponse{
-			BookingID: bookingID,
-			Status:    "PENDING",
+			BookingID:     bookingID,
+			Status:        status,
+			SeatIDs:       seatIDs,
+			HoldExpiresAt: expiresAt,
+			RequestID:     requestIDFromContext(r.Context()),
 		})
 	}
 
 }
 
 func handleBookingStatus(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[API] Status check request from IP: %s", r.RemoteAddr)
+	slog.DebugContext(r.Context(), "Status check request", "component", "api", "ip", r.RemoteAddr)
 
 	if r.Method != http.MethodGet {
-		log.Printf("[API] Invalid method %s from IP: %s", r.Method, r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Invalid method", "component", "api", "method", r.Method, "ip", r.RemoteAddr)
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	bookingID := r.URL.Query().Get("booking_id")
 	if bookingID == "" {
-		log.Printf("[API] Missing booking_id parameter from IP: %s", r.RemoteAddr)
+		slog.WarnContext(r.Context(), "Missing booking_id parameter", "component", "api", "ip", r.RemoteAddr)
 		http.Error(w, "Booking ID is required", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("[API] Checking status for BookingID: %s", bookingID)
+	wait, err := parseBookingStatusWait(r.URL.Query().Get("wait"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	slog.DebugContext(r.Context(), "Checking status", "component", "api", "booking_id", bookingID, "wait", wait)
 
-	var status string
-	err := db.QueryRowContext(ctx, `
-		SELECT COALESCE(MIN(payment_status), 'NOT_FOUND') as status
-		FROM seats 
-		WHERE payment_session_id = ?
-	`, bookingID).Scan(&status)
+	if wait > 0 {
+		if err := awaitBookingStatus(r.Context(), bookingID, wait); err != nil {
+			slog.ErrorContext(r.Context(), "Error while waiting on booking status", "component", "api", "booking_id", bookingID, "error", err)
+			http.Error(w, "Error fetching booking status", http.StatusInternalServerError)
+			return
+		}
+	}
 
+	state, status, err := bookingStatus(r.Context(), db, bookingID)
 	if err != nil {
-		log.Printf("[API] Database error while checking status - BookingID: %s, Error: %v", bookingID, err)
+		slog.ErrorContext(r.Context(), "Database error while checking status", "component", "api", "booking_id", bookingID, "error", err)
 		http.Error(w, "Error fetching booking status", http.StatusInternalServerError)
 		return
 	}
 
-	if status == "NOT_FOUND" {
-		log.Printf("[API] Booking not found - BookingID: %s", bookingID)
+	if state == "" && asyncBookingEnabled() {
+		// Queued bookings have no row until they get their seats.
+		status, err = asyncBookingStatus(r.Context(), bookingID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Redis error while checking status", "component", "api", "booking_id", bookingID, "error", err)
+			http.Error(w, "Error fetching booking status", http.StatusInternalServerError)
+			return
+		}
+		if status != "" {
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(AsyncBookingResponse{
+				BookingID: bookingID,
+				Status:    status,
+				RequestID: requestIDFromContext(r.Context()),
+			})
+			return
+		}
+	}
+
+	if state == "" {
+		slog.WarnContext(r.Context(), "Booking not found", "component", "api", "booking_id", bookingID)
 		http.Error(w, "Booking not found", http.StatusNotFound)
 		return
 	}
 
-	log.Printf("[API] Retrieved status for BookingID: %s - Status: %s", bookingID, status)
+	seatIDs, err := bookingSeatIDs(r.Context(), db, bookingID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Database error while loading seats", "component", "api", "booking_id", bookingID, "error", err)
+		http.Error(w, "Error fetching booking status", http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt, err := bookingHoldExpiry(r.Context(), db, bookingID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Database error while loading hold", "component", "api", "booking_id", bookingID, "error", err)
+		http.Error(w, "Error fetching booking status", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Retrieved status", "component", "api", "booking_id", bookingID, "status", status)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(AsyncBookingResponse{
-		BookingID: bookingID,
-		Status:    status,
+		BookingID:     bookingID,
+		Status:        status,
+		State:         state,
+		SeatIDs:       seatIDs,
+		HoldExpiresAt: expiresAt,
+		RequestID:     requestIDFromContext(r.Context()),
 	})
 }
 
+// withRequestTimeout puts server.request_timeout on the request's context. Everything the
+// handler does runs under it, so a client that hangs up or a request that runs too long stops
+// its database and lock calls instead of running on.
+func withRequestTimeout(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reqCtx, cancel := context.WithTimeout(r.Context(), time.Duration(strategyConfig.Server.RequestTimeout))
+		defer cancel()
+		next(w, r.WithContext(reqCtx))
+	}
+}
+
 func startServer() error {
-	http.HandleFunc("/webhook/payment", handlePaymentWebhook)
-	http.HandleFunc("/api/book", handleAsyncBooking)
-	http.HandleFunc("/api/booking-status", handleBookingStatus)
-	log.Fatal(http.ListenAndServe(":8081", nil))
-	return errors.New("ending server")
+	apiMux.HandleFunc("/webhook/payment", withRequestTimeout(requirePrimary(requireWebhookSignature(handlePaymentWebhook))))
+	apiMux.HandleFunc("/api/book", withRequestTimeout(requirePrimary(journalBookingAttempts(limitBookings(requirePartnerScope(ScopeBookingsWrite, handleAsyncBooking))))))
+	apiMux.HandleFunc("/api/booking-status", withRequestTimeout(requireFreshReplica(handleBookingStatus)))
+	apiMux.HandleFunc("GET /api/queue-status", requirePrimary(handleQueueStatus))
+	apiMux.HandleFunc("POST /api/book-best-available", withRequestTimeout(requirePrimary(journalBookingAttempts(limitBookings(requirePartnerScope(ScopeBookingsWrite, handleBestAvailableBooking))))))
+	apiMux.HandleFunc("POST /api/holds", withRequestTimeout(requirePrimary(journalBookingAttempts(limitBookings(requirePartnerScope(ScopeBookingsWrite, handleCreateHold))))))
+	apiMux.HandleFunc("POST /api/holds/{id}/checkout", withRequestTimeout(requirePrimary(requirePartnerScope(ScopeBookingsWrite, handleHoldCheckout))))
+	apiMux.HandleFunc("POST /api/book/dry-run", requireFreshReplica(handleBookingDryRun))
+	apiMux.HandleFunc("POST /api/quote", requireFreshReplica(handleQuote))
+	apiMux.HandleFunc("POST /api/bookings/{id}/abandon", requirePrimary(handleAbandonBooking))
+	apiMux.HandleFunc("DELETE /api/bookings/{id}", requirePrimary(handleCancelBooking))
+	apiMux.HandleFunc("POST /api/bookings/{id}/upgrade", requirePrimary(handleSeatUpgrade))
+	apiMux.HandleFunc("POST /api/bookings/{id}/seats", withRequestTimeout(requirePrimary(requirePartnerSeats(ScopeBookingsWrite, seatChangeSeats, handleChangeBookingSeats))))
+	apiMux.HandleFunc("POST /api/bookings/{id}/refund", requirePrimary(handleRefundBooking))
+	apiMux.HandleFunc("POST /webhook/refund", withRequestTimeout(requirePrimary(requireWebhookSignature(handleRefundWebhook))))
+	apiMux.HandleFunc("/api/channels/allocate", requirePrimary(requirePartnerKey(ScopeChannelsWrite, handleChannelAllocate)))
+	apiMux.HandleFunc("/api/channels/claim", requirePrimary(requirePartnerKey(ScopeChannelsWrite, handleChannelClaim)))
+	apiMux.HandleFunc("/api/channels/allocation-status", requireFreshReplica(requirePartnerKey(ScopeChannelsWrite, handleChannelAllocationStatus)))
+	apiMux.HandleFunc("GET /api/shows/{id}/snapshot", requireFreshReplica(requirePartnerScope(ScopeAvailabilityRead, handleShowSnapshot)))
+	apiMux.HandleFunc("GET /api/shows/{id}/changes", requireFreshReplica(requirePartnerScope(ScopeAvailabilityRead, handleShowChanges)))
+	apiMux.HandleFunc("GET /api/shows/{id}/seats", requireFreshReplica(requirePartnerScope(ScopeAvailabilityRead, handleSeatMap)))
+	apiMux.HandleFunc("POST /api/shows/{id}/waitlist", requirePrimary(handleJoinWaitlist))
+	apiMux.HandleFunc("GET /api/waitlist/{id}", handleWaitlistEntry)
+	apiMux.HandleFunc("POST /api/waitlist/{id}/leave", requirePrimary(handleLeaveWaitlist))
+	apiMux.HandleFunc("GET /api/shows/{id}/availability", requirePartnerScope(ScopeAvailabilityRead, handleShowAvailability))
+	apiMux.HandleFunc("GET /ws/shows/{id}/seats", requirePartnerScope(ScopeAvailabilityRead, handleSeatStatusSocket))
+	apiMux.HandleFunc("GET /sse/shows/{id}/seats", requirePartnerScope(ScopeAvailabilityRead, handleSeatStatusEvents))
+	apiMux.HandleFunc("GET /api/partner/usage", handlePartnerUsage)
+	apiMux.HandleFunc("GET /admin/bookings/{id}/debug", requireAdmin(handleBookingDebug))
+	apiMux.HandleFunc("POST /admin/partner-keys", requireAdmin(requirePrimary(handleCreatePartnerKey)))
+	apiMux.HandleFunc("GET /admin/in-flight", requireAdmin(handleInFlight))
+	apiMux.HandleFunc("GET /admin/shows", requireAdmin(handleListShows))
+	apiMux.HandleFunc("POST /admin/shows", requireAdmin(requirePrimary(handleCreateShow)))
+	apiMux.HandleFunc("GET /admin/shows/{id}", requireAdmin(handleGetShow))
+	apiMux.HandleFunc("PUT /admin/shows/{id}", requireAdmin(requirePrimary(handleUpdateShow)))
+	apiMux.HandleFunc("DELETE /admin/shows/{id}", requireAdmin(requirePrimary(handleDeleteShow)))
+	apiMux.HandleFunc("POST /admin/shows/{id}/seats", requireAdmin(requirePrimary(handleGenerateShowSeats)))
+	apiMux.HandleFunc("GET /admin/shows/{id}/seats/blocked", requireAdmin(handleBlockedSeats))
+	apiMux.HandleFunc("POST /admin/shows/{id}/seats/block", requireAdmin(requirePrimary(handleBlockSeats)))
+	apiMux.HandleFunc("POST /admin/shows/{id}/seats/unblock", requireAdmin(requirePrimary(handleUnblockSeats)))
+	apiMux.HandleFunc("GET /admin/shows/{id}/presale-codes", requireAdmin(handlePresaleCodeBatches))
+	apiMux.HandleFunc("POST /admin/shows/{id}/presale-codes", requireAdmin(requirePrimary(handleCreatePresaleCodes)))
+	apiMux.HandleFunc("POST /admin/shows/{id}/cancel", requireAdmin(requirePrimary(handleCancelShow)))
+	apiMux.HandleFunc("GET /admin/shows/{id}/cancellation", requireAdmin(handleShowCancellation))
+	apiMux.HandleFunc("GET /admin/venues", requireAdmin(handleListVenues))
+	apiMux.HandleFunc("POST /admin/venues", requireAdmin(requirePrimary(handleCreateVenue)))
+	apiMux.HandleFunc("GET /admin/venues/{id}", requireAdmin(handleGetVenue))
+	apiMux.HandleFunc("PUT /admin/shows/{id}/price", requireAdmin(requirePrimary(handleUpdateShowPrice)))
+	apiMux.HandleFunc("PUT /admin/shows/{id}/waiting-room", requireAdmin(requirePrimary(handleUpdateWaitingRoom)))
+	apiMux.HandleFunc("PUT /admin/shows/{id}/hold-timeout", requireAdmin(requirePrimary(handleUpdateShowHoldTimeout)))
+	apiMux.HandleFunc("GET /admin/booking-attempts", requireAdmin(handleBookingAttempts))
+	apiMux.HandleFunc("GET /admin/seat-audit", requireAdmin(handleSeatAudit))
+	apiMux.HandleFunc("POST /admin/seats/{id}/release", requireAdmin(requirePrimary(handleForceReleaseSeat)))
+	apiMux.HandleFunc("POST /admin/bookings/{id}/release", requireAdmin(requirePrimary(handleForceReleaseBooking)))
+	apiMux.HandleFunc("GET /admin/seat-releases", requireAdmin(handleSeatReleases))
+	apiMux.HandleFunc("GET /admin/locks", requireAdmin(handleAdminLocks))
+	apiMux.HandleFunc("GET /admin/booking-jobs/dead", requireAdmin(handleDeadBookingJobs))
+	apiMux.HandleFunc("POST /admin/booking-jobs/dead/{id}/requeue", requireAdmin(requirePrimary(handleRequeueDeadBookingJob)))
+	apiMux.HandleFunc("GET /admin/config/strategies", requireAdmin(handleStrategyConfig))
+	apiMux.HandleFunc("GET /admin/region", requireAdmin(handleRegionStatus))
+	apiMux.HandleFunc("POST /admin/region/promote", requireAdmin(handleRegionPromote))
+	apiMux.HandleFunc("POST /admin/region/demote", requireAdmin(handleRegionDemote))
+	if strategyConfig.Server.DevEndpoints && !isProduction() {
+		apiMux.HandleFunc("/dev/webhook-replay", requireAdmin(handleWebhookReplay))
+	}
+	return serveHTTP()
 }
 
-func checkPaymentTimeouts() error {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
+func main() {
+	runCommand(os.Args[1:])
+}
 
-	for range ticker.C {
-		tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
-		if err != nil {
-			log.Printf("Error starting transaction: %v", err)
-			continue
+// runServeCommand runs the booking API with its background jobs until it is stopped.
+func runServeCommand(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configFile := configFlag(flags)
+	flags.Parse(args)
+
+	loadConfig(*configFile)
+	if !connectDatabase() {
+		slog.Info("Running without database or Redis, booking from the in-memory store", "component", "api", "shows", strategyConfig.Memory.Shows, "seats_per_show", strategyConfig.Memory.SeatsPerShow)
+		errorCh := make(chan error, 3)
+		go func() {
+			err := reapMemoryHolds()
+			errorCh <- err
+		}()
+		if strategyConfig.Server.DebugAddr != "" {
+			go func() {
+				err := runDebugServer()
+				errorCh <- err
+			}()
 		}
+		go func() {
+			err := startMemoryServer()
+			errorCh <- err
+		}()
+		waitForShutdown(errorCh)
+		return
+	}
+	connectServices()
 
-		rows, err := tx.QueryContext(ctx, `
-            SELECT id, show_id, user_id 
-            FROM seats 
-            WHERE payment_status = 'PENDING' 
-            AND payment_timeout < NOW()
-        `)
-		if err != nil {
-			tx.Rollback()
-			log.Printf("Error querying expired payments: %v", err)
-			continue
-		}
+	errorCh := make(chan error, 24)
+	go func() {
+		err := runLeaderElection()
+		errorCh <- err
+	}()
 
-		var expiredSeats []struct {
-			id     int
-			showID int
-			userID int
-		}
+	go func() {
+		err := checkPaymentTimeouts()
+		errorCh <- err
+	}()
 
-		for rows.Next() {
-			var seat struct {
-				id     int
-				showID int
-				userID int
-			}
-			if err := rows.Scan(&seat.id, &seat.showID, &seat.userID); err != nil {
-				log.Printf("Error scanning seat: %v", err)
-				continue
-			}
-			expiredSeats = append(expiredSeats, seat)
-		}
-		rows.Close()
-
-		for _, seat := range expiredSeats {
-			_, err := tx.ExecContext(ctx, `
-                UPDATE seats 
-                SET is_reserved = FALSE,
-                    payment_status = 'FAILED',
-                    user_id = NULL,
-                    reserved_until = NULL,
-                    payment_timeout = NULL,
-                    payment_session_id = NULL,
-                    payment_redirect_url = NULL
-                WHERE id = ?
-            `, seat.id)
-			if err != nil {
-				log.Printf("Error updating expired seat %d: %v", seat.id, err)
-				continue
-			}
+	go func() {
+		err := checkHighValuePaymentTimeouts()
+		errorCh <- err
+	}()
 
-			key := fmt.Sprintf("lock:seat:%d", seat.id)
-			rdb.Del(ctx, key)
-		}
+	go func() {
+		err := releaseExpiredAllocations()
+		errorCh <- err
+	}()
 
-		if err := tx.Commit(); err != nil {
-			log.Printf("Error committing transaction: %v", err)
-		}
+	go func() {
+		err := runStuckHoldDetector()
+		errorCh <- err
+	}()
+
+	go func() {
+		err := runOutboxRelay()
+		errorCh <- err
+	}()
+
+	go func() {
+		err := runBookingCallbackDispatcher()
+		errorCh <- err
+	}()
+
+	go func() {
+		err := runShowCancellations()
+		errorCh <- err
+	}()
+
+	go func() {
+		err := publishAvailabilityChanges()
+		errorCh <- err
+	}()
+
+	go func() {
+		err := runSeatStatusRelay()
+		errorCh <- err
+	}()
+
+	go func() {
+		err := runSeatStatusSubscriber()
+		errorCh <- err
+	}()
+
+	go func() {
+		err := runSoldOutResync()
+		errorCh <- err
+	}()
+
+	go func() {
+		err := runLockWatchdog()
+		errorCh <- err
+	}()
+
+	go func() {
+		err := runBookingJournal()
+		errorCh <- err
+	}()
+
+	go func() {
+		err := runRegionHeartbeat()
+		errorCh <- err
+	}()
+
+	go func() {
+		err := runWaitingRoomDispatcher()
+		errorCh <- err
+	}()
+
+	go func() {
+		err := runShowSettingsRefresher()
+		errorCh <- err
+	}()
+
+	go func() {
+		err := runPaymentReconciler()
+		errorCh <- err
+	}()
+
+	go func() {
+		err := runDependencyMonitor()
+		errorCh <- err
+	}()
+
+	if lockExpiryEnabled() {
+		go func() {
+			err := runLockExpiryListener()
+			errorCh <- err
+		}()
 	}
 
-	return errors.New("ending timeout payment function")
+	if asyncBookingEnabled() {
+		go func() {
+			err := runAsyncBookingWorkers()
+			errorCh <- err
+		}()
+	}
+
+	if strategyConfig.Server.DebugAddr != "" {
+		go func() {
+			err := runDebugServer()
+			errorCh <- err
+		}()
+	}
+
+	go func() {
+		err := startServer()
+		errorCh <- err
+	}()
+
+	waitForShutdown(errorCh)
 }
 
-func main() {
+// loadConfig loads the config, from configFile too when it is set, and what is built from it.
+func loadConfig(configFile string) {
 	var err error
-	db, err = sql.Open("mysql", "root:password@tcp(localhost:3306)/bms")
+	strategyConfig, err = loadStrategyConfig(configFile)
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	setupLogging(strategyConfig.Log)
+	errorReporter, err = newErrorReporter()
 	if err != nil {
 		log.Fatal(err)
 	}
+	dbDriver = strategyConfig.Server.DBDriver
+
+	memoryStore = newMemorySeatStore(strategyConfig.Memory)
+	bookingLimiter = newBookingLimiter(strategyConfig.Backpressure)
+}
 
-	if err = db.Ping(); err != nil {
+// connectDatabase opens the database, migrated unless server.auto_migrate is off. It reports
+// false for DB_DRIVER=memory, which has no database.
+func connectDatabase() bool {
+	var err error
+	db, err = openDatabase()
+	if err != nil {
 		log.Fatal(err)
 	}
+	if dbDriver == "memory" {
+		return false
+	}
 
-	rdb = redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
+	// The migration pool connects the same way, so once this answers it can too. On MySQL the
+	// database itself may not exist before the first migration; the server answering is enough.
+	if err = connectWithRetry(dbDriver, pingDatabaseServer); err != nil {
+		log.Fatal(err)
+	}
 
-	// Test Redis connection
-	if err = rdb.Ping(ctx).Err(); err != nil {
+	if strategyConfig.Server.AutoMigrate {
+		if err = migrateDatabase(ctx, 0); err != nil {
+			log.Fatalf("Schema migration failed: %v", err)
+		}
+	}
+
+	if err = db.PingContext(ctx); err != nil {
 		log.Fatal(err)
 	}
+	return true
+}
 
-	errorCh := make(chan error, 2)
-	go func() {
-		err := checkPaymentTimeouts()
-		errorCh <- err
-	}()
+// connectServices sets up redis, the lock and payment providers and redlock.
+func connectServices() {
+	rdb = newRedisClient()
 
-	go func() {
-		err := startServer()
-		errorCh <- err
-	}()
+	// Test Redis connection. The "current" strategy can run without Redis when its locks
+	// live elsewhere, so it isn't waited for then.
+	pingRedis := func(ctx context.Context) error { return rdb.Ping(ctx).Err() }
+	if strategyConfig.Locks.Provider == "redis" {
+		if err := connectWithRetry("redis", pingRedis); err != nil {
+			log.Fatal(err)
+		}
+	} else if err := pingRedis(ctx); err != nil {
+		slog.Warn("Redis unavailable, continuing with another lock provider", "component", "api", "lock_provider", strategyConfig.Locks.Provider, "error", err)
+	}
+
+	var err error
+	lockProvider, err = newLockProvider(strategyConfig.Locks)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	paymentProvider, err = newPaymentProvider()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	redlock = NewRedlock(redlockClientsFromEnv(rdb), strategyConfig.Redlock)
+
+	outboxPublisher, err = newOutboxPublisher(strategyConfig.Outbox)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
+func waitForShutdown(errorCh <-chan error) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
@@ -393,6 +888,7 @@ func main() {
 	case gErr := <-errorCh:
 		log.Fatalf("Service error: %v", gErr)
 	case sig := <-sigs:
-		log.Printf("Received signal: %v, shutting down gracefully", sig)
+		slog.Info("Received signal, shutting down gracefully", "signal", sig)
 	}
+	shutdownServer()
 }
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// In-process seat store behind the "memory" strategy. Every seat has its own mutex; a booking
+// locks its seats in id order, checks them and marks them held, the same shape as the
+// pessimistic strategy with the database taken out. With DB_DRIVER=memory the service runs on
+// this store alone, without MySQL or Redis, which is enough to demo or benchmark the booking
+// flow. Otherwise "memory" is just another method with its own inventory, seeded like the
+// first migration: shows 1..Shows with SeatsPerShow consecutive seat ids each. Nothing
+// survives a restart.
+
+type memorySeat struct {
+	mu        sync.Mutex
+	id        int
+	showID    int
+	reserved  bool
+	status    string
+	userID    int
+	sessionID string
+	timeout   time.Time
+	version   int
+}
+
+func (s *memorySeat) available(now time.Time) bool {
+	return !s.reserved || s.status == "FAILED" || (s.status == "PENDING" && now.After(s.timeout))
+}
+
+func (s *memorySeat) release() {
+	s.reserved = false
+	s.status = "FAILED"
+	s.userID = 0
+	s.sessionID = ""
+	s.timeout = time.Time{}
+	s.version++
+}
+
+type MemorySeatStore struct {
+	// seats is filled once and never changes shape, so it is read without a lock.
+	seats map[int]*memorySeat
+
+	mu       sync.Mutex
+	sessions map[string][]int
+	// users serializes a user's bookings while the seat limit is counted.
+	users map[int]*sync.Mutex
+}
+
+var memoryStore *MemorySeatStore
+
+func newMemorySeatStore(cfg MemoryConfig) *MemorySeatStore {
+	store := &MemorySeatStore{
+		seats:    make(map[int]*memorySeat, cfg.Shows*cfg.SeatsPerShow),
+		sessions: make(map[string][]int),
+		users:    make(map[int]*sync.Mutex),
+	}
+	for show := 1; show <= cfg.Shows; show++ {
+		for n := 1; n <= cfg.SeatsPerShow; n++ {
+			id := (show-1)*cfg.SeatsPerShow + n
+			store.seats[id] = &memorySeat{id: id, showID: show, status: "PENDING", version: 1}
+		}
+	}
+	return store
+}
+
+// lock locks the given seats in id order and returns them with the func that unlocks them.
+// Seats that don't exist are reported instead.
+func (m *MemorySeatStore) lock(seatIDs []int) ([]*memorySeat, []int, func()) {
+	ordered := slices.Clone(seatIDs)
+	slices.Sort(ordered)
+	ordered = slices.Compact(ordered)
+
+	var seats []*memorySeat
+	var missing []int
+	for _, id := range ordered {
+		seat, ok := m.seats[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		seat.mu.Lock()
+		seats = append(seats, seat)
+	}
+	return seats, missing, func() {
+		for _, seat := range seats {
+			seat.mu.Unlock()
+		}
+	}
+}
+
+// Reserve holds every seat for the session, or none of them.
+func (m *MemorySeatStore) Reserve(userID int, seatIDs []int, sessionID string, holdFor time.Duration) error {
+	if limit := seatLimit(); limit > 0 {
+		unlockUser := m.lockUser(userID)
+		defer unlockUser()
+		if err := m.checkSeatLimit(userID, seatIDs, limit); err != nil {
+			return err
+		}
+	}
+
+	seats, missing, unlock := m.lock(seatIDs)
+	defer unlock()
+
+	if len(missing) > 0 {
+		return fmt.Errorf("seats %v do not exist", missing)
+	}
+	now := time.Now()
+	for _, seat := range seats {
+		if !seat.available(now) {
+			return fmt.Errorf("not all seats are available (seat %d is held)", seat.id)
+		}
+	}
+
+	for _, seat := range seats {
+		seat.reserved = true
+		seat.status = "PENDING"
+		seat.userID = userID
+		seat.sessionID = sessionID
+		seat.timeout = now.Add(holdFor)
+		seat.version++
+	}
+
+	m.mu.Lock()
+	m.sessions[sessionID] = slices.Clone(seatIDs)
+	m.mu.Unlock()
+	return nil
+}
+
+// lockUser locks the user's mutex and returns the func that unlocks it.
+func (m *MemorySeatStore) lockUser(userID int) func() {
+	m.mu.Lock()
+	mu, ok := m.users[userID]
+	if !ok {
+		mu = &sync.Mutex{}
+		m.users[userID] = mu
+	}
+	m.mu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// checkSeatLimit fails with ErrSeatLimitExceeded when the seats would take the user over the
+// limit in one of their shows. It locks one seat at a time, so it runs before Reserve locks
+// the seats it books; with the user's mutex held their count can only go down meanwhile.
+func (m *MemorySeatStore) checkSeatLimit(userID int, seatIDs []int, limit int) error {
+	wanted := make(map[int]int)
+	for _, id := range slices.Compact(slices.Sorted(slices.Values(seatIDs))) {
+		if seat, ok := m.seats[id]; ok {
+			wanted[seat.showID]++
+		}
+	}
+	now := time.Now()
+	held := make(map[int]int)
+	for _, seat := range m.seats {
+		seat.mu.Lock()
+		if seat.userID == userID && wanted[seat.showID] > 0 && !seat.available(now) && !slices.Contains(seatIDs, seat.id) {
+			held[seat.showID]++
+		}
+		seat.mu.Unlock()
+	}
+	for showID, n := range wanted {
+		if held[showID]+n > limit {
+			return fmt.Errorf("%w: user %d would hold %d seats of show %d, the limit is %d", ErrSeatLimitExceeded, userID, held[showID]+n, showID, limit)
+		}
+	}
+	return nil
+}
+
+// Status aggregates the session's seats the same way the database status query does.
+func (m *MemorySeatStore) Status(sessionID string) (string, bool) {
+	m.mu.Lock()
+	seatIDs := m.sessions[sessionID]
+	m.mu.Unlock()
+
+	seats, _, unlock := m.lock(seatIDs)
+	defer unlock()
+
+	status := ""
+	for _, seat := range seats {
+		if seat.sessionID == sessionID && (status == "" || seat.status < status) {
+			status = seat.status
+		}
+	}
+	return status, status != ""
+}
+
+// HoldExpiry is when the session's PENDING hold ends, nil when nothing is held. It reports
+// false for sessions the store doesn't know.
+func (m *MemorySeatStore) HoldExpiry(sessionID string) (*time.Time, bool) {
+	m.mu.Lock()
+	seatIDs, ok := m.sessions[sessionID]
+	m.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	seats, _, unlock := m.lock(seatIDs)
+	defer unlock()
+
+	var expiresAt *time.Time
+	for _, seat := range seats {
+		if seat.sessionID == sessionID && seat.status == "PENDING" && (expiresAt == nil || seat.timeout.Before(*expiresAt)) {
+			timeout := seat.timeout
+			expiresAt = &timeout
+		}
+	}
+	return expiresAt, true
+}
+
+// CompletePayment applies a gateway result to the session's PENDING seats and returns how
+// many it changed.
+func (m *MemorySeatStore) CompletePayment(sessionID, status string) int {
+	m.mu.Lock()
+	seatIDs := m.sessions[sessionID]
+	m.mu.Unlock()
+
+	seats, _, unlock := m.lock(seatIDs)
+	defer unlock()
+
+	updated := 0
+	for _, seat := range seats {
+		if seat.sessionID == sessionID && seat.status == "PENDING" {
+			seat.status = status
+			seat.version++
+			updated++
+		}
+	}
+	return updated
+}
+
+// ReleaseExpired frees PENDING holds past their timeout, one seat at a time.
+func (m *MemorySeatStore) ReleaseExpired() int {
+	now := time.Now()
+	released := 0
+	for _, seat := range m.seats {
+		seat.mu.Lock()
+		if seat.reserved && seat.status == "PENDING" && now.After(seat.timeout) {
+			m.mu.Lock()
+			delete(m.sessions, seat.sessionID)
+			m.mu.Unlock()
+			seat.release()
+			released++
+		}
+		seat.mu.Unlock()
+	}
+	return released
+}
+
+// MemoryBooking books seats in the in-process store with the usual one minute payment hold.
+func MemoryBooking(ctx context.Context, store *MemorySeatStore, userID int, seatIDs []int, bookingId string) error {
+	slog.InfoContext(ctx, "Starting memory booking", "component", "booking", "user_id", userID, "seat_ids", seatIDs)
+
+	if len(seatIDs) == 0 {
+		slog.InfoContext(ctx, "No seat IDs provided", "component", "booking", "user_id", userID)
+		return fmt.Errorf("no seat IDs provided")
+	}
+
+	setBookingPhase(ctx, "locking_seats")
+	if err := store.Reserve(userID, seatIDs, bookingId, time.Duration(strategyConfig.Payment.HoldTimeout)); err != nil {
+		slog.ErrorContext(ctx, "Memory booking failed", "component", "booking", "user_id", userID, "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "Successfully completed memory booking", "component", "booking", "user_id", userID, "session_id", bookingId)
+	return nil
+}
+
+func reapMemoryHolds() error {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if released := memoryStore.ReleaseExpired(); released > 0 {
+			slog.Warn("Released expired memory holds", "component", "reaper", "seats", released)
+		}
+	}
+	return errors.New("ending memory reaper")
+}
+
+func handleMemoryBookingStatus(w http.ResponseWriter, r *http.Request) {
+	bookingID := r.URL.Query().Get("booking_id")
+	if bookingID == "" {
+		http.Error(w, "Booking ID is required", http.StatusBadRequest)
+		return
+	}
+
+	status, ok := memoryStore.Status(bookingID)
+	if !ok {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+	expiresAt, _ := memoryStore.HoldExpiry(bookingID)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AsyncBookingResponse{
+		BookingID:     bookingID,
+		Status:        status,
+		HoldExpiresAt: expiresAt,
+		RequestID:     requestIDFromContext(r.Context()),
+	})
+}
+
+func handleMemoryPaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payload struct {
+		SessionID string `json:"session_id"`
+		Status    string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	if memoryStore.CompletePayment(payload.SessionID, payload.Status) == 0 {
+		http.Error(w, "No pending seats found", http.StatusNotFound)
+		return
+	}
+	slog.InfoContext(r.Context(), "Processed memory payment", "component", "webhook", "session_id", payload.SessionID, "status", payload.Status)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// startMemoryServer serves the subset of the API that works without a database.
+func startMemoryServer() error {
+	apiMux.HandleFunc("/webhook/payment", requireWebhookSignature(handleMemoryPaymentWebhook))
+	apiMux.HandleFunc("/api/book", withRequestTimeout(limitBookings(handleAsyncBooking)))
+	apiMux.HandleFunc("/api/booking-status", handleMemoryBookingStatus)
+	apiMux.HandleFunc("GET /admin/in-flight", requireAdmin(handleInFlight))
+	apiMux.HandleFunc("GET /admin/config/strategies", requireAdmin(handleStrategyConfig))
+	return serveHTTP()
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Schema migrations. The schema ships inside the binary as migrations/<driver>/NNN_name.sql,
+// applied in order of NNN and recorded in schema_migrations, so a fresh database is set up by
+// the service itself (on MySQL the database is created too). They run at startup unless
+// server.auto_migrate is off, or on their own with `migrate`. Processes starting together take
+// turns on a database lock, so each migration runs once.
+//
+// MySQL commits DDL as it goes: a migration that fails halfway keeps its first statements and
+// has to be cleaned up by hand before it is retried. On Postgres each one runs in a
+// transaction.
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+const (
+	migrationLockName    = "bms:schema_migrations" // MySQL GET_LOCK name
+	migrationLockKey     = 7081                    // Postgres advisory lock key
+	migrationLockTimeout = 300                     // seconds
+)
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations returns the driver's migrations in the order they apply.
+func loadMigrations(driver string) ([]migration, error) {
+	dir := path.Join("migrations", driver)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s: %w", driver, err)
+	}
+
+	var migrations []migration
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s doesn't start with a version number", name)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, name, version)
+		}
+		seen[version] = name
+
+		body, err := fs.ReadFile(migrationFiles, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(body)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// migrateDatabase applies the migrations the database doesn't have yet. Migrations up to
+// baseline are recorded without running them, for databases that were set up by hand from the
+// SQL files.
+func migrateDatabase(ctx context.Context, baseline int) error {
+	migrations, err := loadMigrations(dbDriver)
+	if err != nil {
+		return err
+	}
+
+	mdb, err := openMigrationDatabase(ctx)
+	if err != nil {
+		return err
+	}
+	defer mdb.Close()
+
+	conn, err := mdb.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	unlock, err := lockMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 && baseline == 0 {
+		// Running 001 over tables created by hand would fail on the first ALTER anyway.
+		unmanaged, err := hasUnmanagedSchema(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if unmanaged {
+			return errors.New("database already has tables but no schema_migrations, run `migrate -baseline <last version applied by hand>` first")
+		}
+	}
+
+	pending := 0
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		if m.version <= baseline {
+			if err := recordMigration(ctx, conn, m); err != nil {
+				return err
+			}
+			slog.InfoContext(ctx, "Baselined migration", "component", "migrate", "version", m.version, "name", m.name)
+			continue
+		}
+		if err := applyMigration(ctx, conn, m); err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+		slog.InfoContext(ctx, "Applied migration", "component", "migrate", "version", m.version, "name", m.name)
+		pending++
+	}
+	slog.InfoContext(ctx, "Schema up to date", "component", "migrate", "driver", dbDriver, "applied", pending, "total", len(migrations))
+	return nil
+}
+
+// openMigrationDatabase opens a separate pool for migrations: on MySQL it needs
+// multiStatements to run a whole file in one Exec, and the database may not exist yet.
+func openMigrationDatabase(ctx context.Context) (*sql.DB, error) {
+	if dbDriver == "postgres" {
+		return sql.Open(postgresDriverName, strategyConfig.Server.DBDSN)
+	}
+
+	cfg, err := mysql.ParseDSN(strategyConfig.Server.DBDSN)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DB_DSN: %w", err)
+	}
+	cfg.MultiStatements = true
+	if err := createMySQLDatabase(ctx, cfg); err != nil {
+		return nil, err
+	}
+	return sql.Open("mysql", cfg.FormatDSN())
+}
+
+// createMySQLDatabase creates the DSN's database if the server doesn't have it.
+func createMySQLDatabase(ctx context.Context, cfg *mysql.Config) error {
+	if cfg.DBName == "" {
+		return nil
+	}
+	serverCfg := cfg.Clone()
+	serverCfg.DBName = ""
+	server, err := sql.Open("mysql", serverCfg.FormatDSN())
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	name := "`" + strings.ReplaceAll(cfg.DBName, "`", "``") + "`"
+	if _, err := server.ExecContext(ctx, "CREATE DATABASE IF NOT EXISTS "+name); err != nil {
+		return fmt.Errorf("failed to create database %s: %w", cfg.DBName, err)
+	}
+	return nil
+}
+
+// lockMigrations waits for other processes' migrations and returns the unlock.
+func lockMigrations(ctx context.Context, conn *sql.Conn) (func(), error) {
+	if dbDriver == "postgres" {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock(?)", migrationLockKey); err != nil {
+			return nil, fmt.Errorf("failed to take migration lock: %w", err)
+		}
+		return func() {
+			conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(?)", migrationLockKey)
+		}, nil
+	}
+
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", migrationLockName, migrationLockTimeout).Scan(&locked); err != nil {
+		return nil, fmt.Errorf("failed to take migration lock: %w", err)
+	}
+	if locked.Int64 != 1 {
+		return nil, errors.New("timed out waiting for another process's migrations")
+	}
+	return func() {
+		conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", migrationLockName)
+	}, nil
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]bool, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("failed to scan applied migration: %w", err)
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// hasUnmanagedSchema reports whether the booking tables exist without any recorded migration.
+func hasUnmanagedSchema(ctx context.Context, conn *sql.Conn) (bool, error) {
+	schema := "DATABASE()"
+	if dbDriver == "postgres" {
+		schema = "current_schema()"
+	}
+	var count int
+	err := conn.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM information_schema.tables
+		WHERE table_schema = `+schema+` AND table_name = 'seats'
+	`).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect schema: %w", err)
+	}
+	return count > 0, nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration) error {
+	if dbDriver != "postgres" {
+		if _, err := conn.ExecContext(ctx, m.sql); err != nil {
+			return err
+		}
+		return recordMigration(ctx, conn, m)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.version, m.name); err != nil {
+		return fmt.Errorf("failed to record migration: %w", err)
+	}
+	return tx.Commit()
+}
+
+func recordMigration(ctx context.Context, conn *sql.Conn, m migration) error {
+	_, err := conn.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.version, m.name)
+	if err != nil {
+		return fmt.Errorf("failed to record migration: %w", err)
+	}
+	return nil
+}
+
+// runMigrateCommand is `migrate [-baseline N]`: migrate the database and exit.
+func runMigrateCommand(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	baseline := flags.Int("baseline", 0, "record migrations up to this version as applied without running them")
+	configFile := configFlag(flags)
+	flags.Parse(args)
+
+	loadConfig(*configFile)
+	if dbDriver != "mysql" && dbDriver != "postgres" {
+		log.Fatalf("Nothing to migrate for DB_DRIVER=%s", dbDriver)
+	}
+	if err := migrateDatabase(ctx, *baseline); err != nil {
+		log.Fatalf("Schema migration failed: %v", err)
+	}
+}
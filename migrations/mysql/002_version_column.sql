@@ -0,0 +1,2 @@
+-- Version column for optimistic locking on seats.
+ALTER TABLE seats ADD COLUMN version INT NOT NULL DEFAULT 1;
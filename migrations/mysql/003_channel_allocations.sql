@@ -0,0 +1,26 @@
+-- Partner sales channels (aggregators) with their own quotas and hold windows
+CREATE TABLE IF NOT EXISTS sales_channels (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(100) UNIQUE NOT NULL,
+    seat_quota INT NOT NULL,
+    max_hold_minutes INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Bulk seat allocations handed out to a channel for one show
+CREATE TABLE IF NOT EXISTS channel_allocations (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    channel_id INT NOT NULL,
+    show_id INT NOT NULL,
+    status ENUM('ACTIVE', 'RELEASED') DEFAULT 'ACTIVE',
+    hold_until DATETIME NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (channel_id) REFERENCES sales_channels(id),
+    FOREIGN KEY (show_id) REFERENCES shows(id)
+);
+
+ALTER TABLE seats ADD COLUMN allocation_id INT NULL;
+ALTER TABLE seats ADD FOREIGN KEY (allocation_id) REFERENCES channel_allocations(id);
+
+INSERT INTO sales_channels (name, seat_quota, max_hold_minutes) VALUES
+('aggregator-one', 50, 120);
@@ -0,0 +1,22 @@
+-- Change log of seat availability, used by the kiosk snapshot/delta endpoints.
+-- Filled by a trigger so every writer (strategies, webhook, reclaimers) is covered.
+CREATE TABLE IF NOT EXISTS seat_changes (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    show_id INT NOT NULL,
+    seat_id INT NOT NULL,
+    available BOOLEAN NOT NULL,
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_seat_changes_show (show_id, id)
+);
+
+CREATE TRIGGER seats_availability_change AFTER UPDATE ON seats
+FOR EACH ROW
+BEGIN
+    DECLARE was_available BOOLEAN;
+    DECLARE now_available BOOLEAN;
+    SET was_available = (OLD.is_reserved = 0 OR OLD.payment_status = 'FAILED');
+    SET now_available = (NEW.is_reserved = 0 OR NEW.payment_status = 'FAILED');
+    IF was_available <> now_available THEN
+        INSERT INTO seat_changes (show_id, seat_id, available) VALUES (NEW.show_id, NEW.id, now_available);
+    END IF;
+END;
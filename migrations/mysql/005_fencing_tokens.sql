@@ -0,0 +1,2 @@
+-- Highest fencing token that has written each seat; writes from older Redis lock holders are rejected.
+ALTER TABLE seats ADD COLUMN fence_token BIGINT NOT NULL DEFAULT 0;
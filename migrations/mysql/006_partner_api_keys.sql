@@ -0,0 +1,11 @@
+-- API keys for partner integrations (resellers). Only the sha256 of the key is stored.
+CREATE TABLE IF NOT EXISTS partner_api_keys (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    partner_name VARCHAR(100) NOT NULL,
+    key_hash CHAR(64) UNIQUE NOT NULL,
+    scopes VARCHAR(255) NOT NULL,
+    daily_seat_limit INT NOT NULL DEFAULT 0,
+    allowed_show_ids VARCHAR(1000),
+    is_active BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
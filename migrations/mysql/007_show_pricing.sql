@@ -0,0 +1,3 @@
+-- Ticket price per show, in minor units of the currency.
+ALTER TABLE shows ADD COLUMN price_cents INT NOT NULL DEFAULT 0;
+ALTER TABLE shows ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'INR';
@@ -0,0 +1,2 @@
+-- Shows flagged here get their expired holds reaped on the fast lane.
+ALTER TABLE shows ADD COLUMN is_high_value BOOLEAN NOT NULL DEFAULT FALSE;
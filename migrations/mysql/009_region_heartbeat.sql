@@ -0,0 +1,8 @@
+-- Written every second by the primary region; standbys read it back from their replica to
+-- measure replication lag.
+CREATE TABLE IF NOT EXISTS region_heartbeat (
+    id INT PRIMARY KEY,
+    region VARCHAR(64) NOT NULL,
+    beat_ms BIGINT NOT NULL
+);
+INSERT INTO region_heartbeat (id, region, beat_ms) VALUES (1, '', 0);
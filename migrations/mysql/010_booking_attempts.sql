@@ -0,0 +1,21 @@
+-- Append-only journal of every booking request, accepted or not. Pruned by age, never updated.
+CREATE TABLE IF NOT EXISTS booking_attempts (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    booking_id VARCHAR(100) NOT NULL DEFAULT '',
+    user_id INT NOT NULL,
+    show_id INT NOT NULL,
+    seat_ids VARCHAR(1000) NOT NULL DEFAULT '',
+    strategy VARCHAR(20) NOT NULL DEFAULT '',
+    client_ip VARCHAR(64) NOT NULL,
+    forwarded_for VARCHAR(255) NOT NULL DEFAULT '',
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    partner_id INT,
+    outcome VARCHAR(30) NOT NULL,
+    http_status INT NOT NULL,
+    error VARCHAR(1000) NOT NULL DEFAULT '',
+    duration_ms BIGINT NOT NULL,
+    attempted_at DATETIME(3) NOT NULL,
+    INDEX idx_booking_attempts_user (user_id, id),
+    INDEX idx_booking_attempts_ip (client_ip, id),
+    INDEX idx_booking_attempts_time (attempted_at)
+);
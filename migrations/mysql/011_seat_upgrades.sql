@@ -0,0 +1,19 @@
+-- Per-seat price for premium rows; NULL means the show's price_cents.
+ALTER TABLE seats ADD COLUMN price_cents INT NULL;
+
+-- Seat upgrades on confirmed bookings. The new seats are held under payment_session_id until
+-- the difference is paid; downgrades complete right away and record what is owed back.
+CREATE TABLE IF NOT EXISTS seat_upgrades (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    booking_id VARCHAR(100) NOT NULL,
+    user_id INT NOT NULL,
+    payment_session_id VARCHAR(100) NOT NULL UNIQUE,
+    from_seat_ids VARCHAR(1000) NOT NULL,
+    to_seat_ids VARCHAR(1000) NOT NULL,
+    price_diff_cents INT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    status ENUM('PENDING', 'COMPLETED', 'FAILED') NOT NULL DEFAULT 'PENDING',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at DATETIME,
+    INDEX idx_seat_upgrades_booking (booking_id)
+);
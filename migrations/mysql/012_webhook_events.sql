@@ -0,0 +1,10 @@
+-- Payment webhook deliveries already applied, see webhook_events.go. event_id is '' when the
+-- gateway doesn't send one.
+CREATE TABLE IF NOT EXISTS payment_webhook_events (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    session_id VARCHAR(100) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    event_id VARCHAR(100) NOT NULL DEFAULT '',
+    processed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_payment_webhook_events (session_id, status, event_id)
+);
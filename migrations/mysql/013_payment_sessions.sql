@@ -0,0 +1,2 @@
+-- The gateway's id for the checkout opened for a hold; payment_session_id stays the booking id.
+ALTER TABLE seats ADD COLUMN provider_session_id VARCHAR(255) NULL;
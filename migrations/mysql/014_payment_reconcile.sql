@@ -0,0 +1,2 @@
+-- When the gateway checkout was opened, so the reconciler can poll the ones left PENDING.
+ALTER TABLE seats ADD COLUMN provider_session_opened_at TIMESTAMP NULL;
@@ -0,0 +1,17 @@
+-- Refunds, see refunds.go. Seats wait for the gateway as REFUND_PENDING.
+ALTER TABLE seats MODIFY payment_status ENUM('PENDING', 'COMPLETED', 'FAILED', 'REFUND_PENDING') DEFAULT 'PENDING';
+
+CREATE TABLE IF NOT EXISTS refunds (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    booking_id VARCHAR(100) NOT NULL,
+    user_id INT NOT NULL,
+    seat_ids VARCHAR(1000) NOT NULL,
+    provider_session_id VARCHAR(255) NOT NULL,
+    provider_refund_id VARCHAR(255) NULL UNIQUE,
+    amount_cents INT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    status ENUM('REFUND_PENDING', 'REFUNDED', 'FAILED') NOT NULL DEFAULT 'REFUND_PENDING',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at DATETIME,
+    INDEX idx_refunds_booking (booking_id)
+);
@@ -0,0 +1,5 @@
+-- What a checkout was opened for, checked against what the payment webhook says was paid.
+-- Mismatched payments leave the seats in REVIEW instead of COMPLETED.
+ALTER TABLE seats ADD COLUMN payment_amount_cents BIGINT NULL;
+ALTER TABLE seats ADD COLUMN payment_currency CHAR(3) NULL;
+ALTER TABLE seats MODIFY payment_status ENUM('PENDING', 'COMPLETED', 'FAILED', 'REFUND_PENDING', 'REVIEW') DEFAULT 'PENDING';
@@ -0,0 +1,2 @@
+-- Shows flagged here queue /api/book requests in the waiting room, see waiting_room.go.
+ALTER TABLE shows ADD COLUMN waiting_room BOOLEAN NOT NULL DEFAULT FALSE;
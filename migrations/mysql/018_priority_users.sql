@@ -0,0 +1,2 @@
+-- Users flagged here queue in the waiting room's priority lane.
+ALTER TABLE users ADD COLUMN priority BOOLEAN NOT NULL DEFAULT FALSE;
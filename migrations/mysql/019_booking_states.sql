@@ -0,0 +1,11 @@
+-- Booking state machine audit trail, see booking_state.go. The state itself is on bookings
+-- since 020_bookings.sql.
+CREATE TABLE IF NOT EXISTS booking_transitions (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    booking_id VARCHAR(100) NOT NULL,
+    from_state VARCHAR(20) NOT NULL DEFAULT '',
+    to_state VARCHAR(20) NOT NULL,
+    reason VARCHAR(100) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_booking_transitions_booking (booking_id, id)
+);
@@ -0,0 +1,52 @@
+-- Bookings get their own tables, see bookings.go. Existing holds and paid bookings are copied
+-- over, then the checkout columns are dropped from seats.
+CREATE TABLE IF NOT EXISTS bookings (
+    id VARCHAR(100) PRIMARY KEY,
+    user_id INT NOT NULL,
+    show_id INT NOT NULL,
+    state VARCHAR(20) NOT NULL,
+    payment_redirect_url VARCHAR(255) NULL,
+    provider_session_id VARCHAR(255) NULL,
+    provider_session_opened_at TIMESTAMP NULL,
+    payment_amount_cents BIGINT NULL,
+    payment_currency CHAR(3) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_bookings_state (state, provider_session_opened_at),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (show_id) REFERENCES shows(id)
+);
+
+CREATE TABLE IF NOT EXISTS booking_seats (
+    booking_id VARCHAR(100) NOT NULL,
+    seat_id INT NOT NULL,
+    PRIMARY KEY (booking_id, seat_id),
+    INDEX idx_booking_seats_seat (seat_id),
+    FOREIGN KEY (booking_id) REFERENCES bookings(id),
+    FOREIGN KEY (seat_id) REFERENCES seats(id)
+);
+
+INSERT IGNORE INTO bookings (id, user_id, show_id, state, payment_redirect_url, provider_session_id,
+                             provider_session_opened_at, payment_amount_cents, payment_currency)
+SELECT payment_session_id, MIN(user_id), MIN(show_id),
+       CASE
+           WHEN SUM(payment_status IN ('PENDING', 'REVIEW')) = 0 THEN 'CONFIRMED'
+           WHEN MAX(provider_session_id) IS NULL THEN 'HELD'
+           ELSE 'PENDING_PAYMENT'
+       END,
+       MAX(payment_redirect_url), MAX(provider_session_id), MAX(provider_session_opened_at),
+       MAX(payment_amount_cents), MAX(payment_currency)
+FROM seats
+WHERE is_reserved = 1 AND payment_session_id IS NOT NULL AND user_id IS NOT NULL
+GROUP BY payment_session_id;
+
+INSERT IGNORE INTO booking_seats (booking_id, seat_id)
+SELECT s.payment_session_id, s.id
+FROM seats s JOIN bookings b ON b.id = s.payment_session_id;
+
+ALTER TABLE seats
+    DROP COLUMN payment_redirect_url,
+    DROP COLUMN provider_session_id,
+    DROP COLUMN provider_session_opened_at,
+    DROP COLUMN payment_amount_cents,
+    DROP COLUMN payment_currency;
@@ -0,0 +1,36 @@
+-- Append-only audit log of seat state changes, see seat_audit.go. Filled by a trigger like
+-- seat_changes, so every writer is covered; source, strategy and request_id come from the
+-- session variables the writing transaction set (NULL when it set none).
+CREATE TABLE IF NOT EXISTS seat_audit (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    seat_id INT NOT NULL,
+    show_id INT NOT NULL,
+    user_id INT,
+    booking_id VARCHAR(100),
+    old_status VARCHAR(20) NOT NULL,
+    new_status VARCHAR(20) NOT NULL,
+    source VARCHAR(20),
+    strategy VARCHAR(20),
+    request_id VARCHAR(128),
+    changed_at TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+    INDEX idx_seat_audit_seat (seat_id, id),
+    INDEX idx_seat_audit_show (show_id, id),
+    INDEX idx_seat_audit_booking (booking_id, id)
+);
+
+CREATE TRIGGER seats_audit AFTER UPDATE ON seats
+FOR EACH ROW
+BEGIN
+    DECLARE old_status VARCHAR(20);
+    DECLARE new_status VARCHAR(20);
+    SET old_status = IF(OLD.is_reserved = 0 OR OLD.payment_status = 'FAILED', 'AVAILABLE', OLD.payment_status);
+    SET new_status = IF(NEW.is_reserved = 0 OR NEW.payment_status = 'FAILED', 'AVAILABLE', NEW.payment_status);
+    IF old_status <> new_status
+        OR NOT (OLD.user_id <=> NEW.user_id)
+        OR NOT (OLD.payment_session_id <=> NEW.payment_session_id) THEN
+        INSERT INTO seat_audit (seat_id, show_id, user_id, booking_id, old_status, new_status, source, strategy, request_id)
+        VALUES (NEW.id, NEW.show_id, COALESCE(NEW.user_id, OLD.user_id),
+                COALESCE(NEW.payment_session_id, OLD.payment_session_id), old_status, new_status,
+                @seat_audit_source, @seat_audit_strategy, @seat_audit_request_id);
+    END IF;
+END;
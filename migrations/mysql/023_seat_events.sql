@@ -0,0 +1,14 @@
+-- Seat event store, see event_store.go. Append-only; seq numbers each seat's events from 1 and
+-- the unique key makes two writers appending after the same event conflict.
+CREATE TABLE IF NOT EXISTS seat_events (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    seat_id INT NOT NULL,
+    show_id INT NOT NULL,
+    seq INT NOT NULL,
+    type VARCHAR(30) NOT NULL,
+    user_id INT,
+    booking_id VARCHAR(100),
+    created_at TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+    UNIQUE KEY uq_seat_events_seq (seat_id, seq),
+    INDEX idx_seat_events_show (show_id, id)
+);
@@ -0,0 +1,11 @@
+-- Transactional outbox for booking lifecycle events, see outbox.go. Rows are written in the
+-- booking's transaction and marked published by the relay.
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    type VARCHAR(50) NOT NULL,
+    booking_id VARCHAR(100) NOT NULL,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+    published_at TIMESTAMP(6) NULL,
+    INDEX idx_outbox_unpublished (published_at, id)
+);
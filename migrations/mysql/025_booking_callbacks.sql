@@ -0,0 +1,17 @@
+-- Client callbacks on terminal booking states, see booking_callbacks.go. The booking keeps
+-- the callback_url it was made with; a notification is queued in booking_callbacks in the
+-- transaction that ends the booking and delivered, with retries, by the dispatcher.
+ALTER TABLE bookings ADD COLUMN callback_url VARCHAR(2048) NULL;
+
+CREATE TABLE IF NOT EXISTS booking_callbacks (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    booking_id VARCHAR(100) NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+    last_error VARCHAR(255) NULL,
+    created_at TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+    delivered_at TIMESTAMP(6) NULL,
+    INDEX idx_booking_callbacks_due (delivered_at, next_attempt_at)
+);
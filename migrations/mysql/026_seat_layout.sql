@@ -0,0 +1,11 @@
+-- Seat layout for the seat map (seat_map.go): the row and column a seat is drawn at, and its
+-- price tier. Existing seats are numbered <row letters><column>, like the seed data, and get
+-- both from their seat_number.
+ALTER TABLE seats ADD COLUMN seat_row VARCHAR(10) NULL;
+ALTER TABLE seats ADD COLUMN seat_column INT NULL;
+ALTER TABLE seats ADD COLUMN price_tier VARCHAR(30) NULL;
+
+UPDATE seats
+SET seat_row = REGEXP_SUBSTR(seat_number, '^[A-Z]+'),
+    seat_column = CAST(REGEXP_SUBSTR(seat_number, '[0-9]+$') AS UNSIGNED)
+WHERE seat_row IS NULL AND seat_number REGEXP '^[A-Z]+[0-9]+$';
@@ -0,0 +1,7 @@
+-- Shows managed through /admin/shows, see shows.go: where the show is, when its seats go on
+-- sale (bookings before that are refused) and the booking strategy every booking of the show
+-- uses, whatever the request asks for. NULL is no venue, on sale already, the request's
+-- strategy.
+ALTER TABLE shows ADD COLUMN venue VARCHAR(100) NULL;
+ALTER TABLE shows ADD COLUMN on_sale_at DATETIME NULL;
+ALTER TABLE shows ADD COLUMN strategy VARCHAR(20) NULL;
@@ -0,0 +1,34 @@
+-- Venues and their seating layout, see venues.go: sections (priced as a tier) of rows of
+-- seats. A show's seats are generated from its venue's layout, and keep no link to it after.
+CREATE TABLE IF NOT EXISTS venues (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    city VARCHAR(100) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS venue_sections (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    venue_id INT NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    price_tier VARCHAR(30) NULL,
+    price_cents INT NULL,
+    position INT NOT NULL,
+    FOREIGN KEY (venue_id) REFERENCES venues(id),
+    INDEX idx_venue_sections_venue (venue_id, position)
+);
+
+CREATE TABLE IF NOT EXISTS venue_rows (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    venue_id INT NOT NULL,
+    section_id INT NOT NULL,
+    label VARCHAR(5) NOT NULL,
+    seat_count INT NOT NULL,
+    position INT NOT NULL,
+    FOREIGN KEY (venue_id) REFERENCES venues(id),
+    FOREIGN KEY (section_id) REFERENCES venue_sections(id),
+    UNIQUE KEY uq_venue_rows_label (venue_id, label)
+);
+
+ALTER TABLE shows ADD COLUMN venue_id INT NULL;
+ALTER TABLE shows ADD FOREIGN KEY (venue_id) REFERENCES venues(id);
@@ -0,0 +1,4 @@
+-- Sale window of a show, see sale_window.go: bookings are taken from sale_start (on_sale_at
+-- until now) until sale_end. NULL leaves that side open.
+ALTER TABLE shows RENAME COLUMN on_sale_at TO sale_start;
+ALTER TABLE shows ADD COLUMN sale_end DATETIME NULL;
@@ -0,0 +1,14 @@
+-- Presales, see presale.go: from presale_start until sale_start a show only takes bookings
+-- that bring one of its presale codes, each good for max_uses bookings.
+ALTER TABLE shows ADD COLUMN presale_start DATETIME NULL;
+
+CREATE TABLE IF NOT EXISTS presale_codes (
+    code VARCHAR(32) PRIMARY KEY,
+    show_id INT NOT NULL,
+    batch_id VARCHAR(40) NOT NULL,
+    max_uses INT NOT NULL,
+    uses INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (show_id) REFERENCES shows(id),
+    INDEX idx_presale_codes_show (show_id, batch_id)
+);
@@ -0,0 +1,3 @@
+-- Sold-out flag, see sold_out.go: set when the last of a show's seats is paid for, cleared
+-- when one comes back on sale.
+ALTER TABLE shows ADD COLUMN sold_out_at DATETIME NULL;
@@ -0,0 +1,16 @@
+-- Waitlists of sold-out shows, see waitlist.go. An entry is WAITING until seats freed for the
+-- show are offered to it, OFFERED with the booking holding them, or LEFT.
+CREATE TABLE IF NOT EXISTS waitlist_entries (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    show_id INT NOT NULL,
+    user_id INT NOT NULL,
+    quantity INT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'WAITING',
+    callback_url VARCHAR(2048) NULL,
+    booking_id VARCHAR(100) NULL,
+    offer_expires_at DATETIME NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    FOREIGN KEY (show_id) REFERENCES shows(id),
+    INDEX idx_waitlist_entries_show (show_id, status, id)
+);
@@ -0,0 +1,8 @@
+-- Show cancellation, see show_cancellation.go. Refunds of a cancelled show's bookings are
+-- queued with next_attempt_at and sent to the gateway by the maintenance leader.
+ALTER TABLE shows ADD COLUMN cancelled_at DATETIME NULL, ADD COLUMN cancel_reason VARCHAR(255) NULL;
+ALTER TABLE refunds
+    ADD COLUMN attempts INT NOT NULL DEFAULT 0,
+    ADD COLUMN next_attempt_at DATETIME NULL,
+    ADD COLUMN last_error VARCHAR(255) NULL,
+    ADD INDEX idx_refunds_due (status, next_attempt_at);
@@ -0,0 +1,16 @@
+-- Force releases of wedged seats by an operator, see force_release.go. seats_before is the
+-- JSON of the seats as they were before the release.
+CREATE TABLE IF NOT EXISTS admin_seat_releases (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    target VARCHAR(20) NOT NULL,
+    target_id VARCHAR(100) NOT NULL,
+    seat_ids TEXT NOT NULL,
+    cancelled_bookings TEXT NULL,
+    reason VARCHAR(255) NOT NULL,
+    operator VARCHAR(100) NULL,
+    ip VARCHAR(64) NULL,
+    seats_before TEXT NOT NULL,
+    locks_cleared INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_admin_seat_releases_target (target, target_id)
+);
@@ -0,0 +1,4 @@
+-- Blocked seats, see seat_blocks.go: house seats, broken seats or distancing, taken off sale
+-- by an operator with payment_status BLOCKED, why and since when.
+ALTER TABLE seats MODIFY payment_status ENUM('PENDING', 'COMPLETED', 'FAILED', 'REFUND_PENDING', 'REVIEW', 'BLOCKED') DEFAULT 'PENDING';
+ALTER TABLE seats ADD COLUMN block_reason VARCHAR(255) NULL, ADD COLUMN blocked_at DATETIME NULL;
@@ -0,0 +1,9 @@
+-- Seat limit per user and show, see seat_limit.go. A booking locks its user's row for the show
+-- before counting their seats, so bookings of one user for one show are counted in turn.
+CREATE TABLE IF NOT EXISTS seat_limit_locks (
+    user_id INT NOT NULL,
+    show_id INT NOT NULL,
+    PRIMARY KEY (user_id, show_id),
+    FOREIGN KEY (show_id) REFERENCES shows(id) ON DELETE CASCADE
+);
+ALTER TABLE seats ADD INDEX idx_seats_show_user (show_id, user_id);
@@ -0,0 +1,208 @@
+-- Postgres version of the mysql migrations up to 020_bookings.sql, keep the two in sync;
+-- later schema changes get their own numbered file in both directories. Applied with
+-- DB_DRIVER=postgres. is_reserved is a SMALLINT so the same 0/1 predicates work on both databases.
+
+CREATE TABLE IF NOT EXISTS users (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    email VARCHAR(100) UNIQUE NOT NULL,
+    priority BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS shows (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    start_time TIMESTAMP NOT NULL,
+    end_time TIMESTAMP NOT NULL,
+    is_high_value BOOLEAN NOT NULL DEFAULT FALSE,
+    waiting_room BOOLEAN NOT NULL DEFAULT FALSE,
+    price_cents INT NOT NULL DEFAULT 0,
+    currency CHAR(3) NOT NULL DEFAULT 'INR',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS sales_channels (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) UNIQUE NOT NULL,
+    seat_quota INT NOT NULL,
+    max_hold_minutes INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS channel_allocations (
+    id SERIAL PRIMARY KEY,
+    channel_id INT NOT NULL REFERENCES sales_channels(id),
+    show_id INT NOT NULL REFERENCES shows(id),
+    status VARCHAR(10) DEFAULT 'ACTIVE' CHECK (status IN ('ACTIVE', 'RELEASED')),
+    hold_until TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS seats (
+    id SERIAL PRIMARY KEY,
+    show_id INT NOT NULL REFERENCES shows(id),
+    seat_number VARCHAR(10) NOT NULL,
+    is_reserved SMALLINT DEFAULT 0,
+    reserved_until TIMESTAMP,
+    user_id INT REFERENCES users(id),
+    payment_status VARCHAR(20) DEFAULT 'PENDING' CHECK (payment_status IN ('PENDING', 'COMPLETED', 'FAILED', 'REFUND_PENDING', 'REVIEW')),
+    payment_timeout TIMESTAMP,
+    payment_session_id VARCHAR(100),
+    version INT NOT NULL DEFAULT 1,
+    allocation_id INT REFERENCES channel_allocations(id),
+    fence_token BIGINT NOT NULL DEFAULT 0,
+    price_cents INT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO users (name, email) VALUES
+('John Doe', 'john@example.com'),
+('Jane Smith', 'jane@example.com');
+
+INSERT INTO shows (name, start_time, end_time) VALUES
+('Avengers: Endgame', '2024-03-20 18:00:00', '2024-03-20 21:00:00'),
+('Inception', '2024-03-20 20:00:00', '2024-03-20 23:00:00');
+
+INSERT INTO seats (show_id, seat_number)
+SELECT 1, 'A' || n FROM generate_series(1, 100) AS n;
+
+INSERT INTO seats (show_id, seat_number)
+SELECT 2, 'B' || n FROM generate_series(1, 100) AS n;
+
+INSERT INTO sales_channels (name, seat_quota, max_hold_minutes) VALUES
+('aggregator-one', 50, 120);
+
+CREATE TABLE IF NOT EXISTS seat_changes (
+    id BIGSERIAL PRIMARY KEY,
+    show_id INT NOT NULL,
+    seat_id INT NOT NULL,
+    available BOOLEAN NOT NULL,
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_seat_changes_show ON seat_changes (show_id, id);
+
+CREATE OR REPLACE FUNCTION record_seat_change() RETURNS TRIGGER AS $$
+DECLARE
+    was_available BOOLEAN := (OLD.is_reserved = 0 OR OLD.payment_status = 'FAILED');
+    now_available BOOLEAN := (NEW.is_reserved = 0 OR NEW.payment_status = 'FAILED');
+BEGIN
+    IF was_available <> now_available THEN
+        INSERT INTO seat_changes (show_id, seat_id, available) VALUES (NEW.show_id, NEW.id, now_available);
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER seats_availability_change AFTER UPDATE ON seats
+FOR EACH ROW EXECUTE FUNCTION record_seat_change();
+
+CREATE TABLE IF NOT EXISTS partner_api_keys (
+    id SERIAL PRIMARY KEY,
+    partner_name VARCHAR(100) NOT NULL,
+    key_hash CHAR(64) UNIQUE NOT NULL,
+    scopes VARCHAR(255) NOT NULL,
+    daily_seat_limit INT NOT NULL DEFAULT 0,
+    allowed_show_ids VARCHAR(1000),
+    is_active BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS region_heartbeat (
+    id INT PRIMARY KEY,
+    region VARCHAR(64) NOT NULL,
+    beat_ms BIGINT NOT NULL
+);
+INSERT INTO region_heartbeat (id, region, beat_ms) VALUES (1, '', 0);
+
+CREATE TABLE IF NOT EXISTS booking_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    booking_id VARCHAR(100) NOT NULL DEFAULT '',
+    user_id INT NOT NULL,
+    show_id INT NOT NULL,
+    seat_ids VARCHAR(1000) NOT NULL DEFAULT '',
+    strategy VARCHAR(20) NOT NULL DEFAULT '',
+    client_ip VARCHAR(64) NOT NULL,
+    forwarded_for VARCHAR(255) NOT NULL DEFAULT '',
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    partner_id INT,
+    outcome VARCHAR(30) NOT NULL,
+    http_status INT NOT NULL,
+    error VARCHAR(1000) NOT NULL DEFAULT '',
+    duration_ms BIGINT NOT NULL,
+    attempted_at TIMESTAMP(3) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_booking_attempts_user ON booking_attempts (user_id, id);
+CREATE INDEX IF NOT EXISTS idx_booking_attempts_ip ON booking_attempts (client_ip, id);
+CREATE INDEX IF NOT EXISTS idx_booking_attempts_time ON booking_attempts (attempted_at);
+
+CREATE TABLE IF NOT EXISTS seat_upgrades (
+    id BIGSERIAL PRIMARY KEY,
+    booking_id VARCHAR(100) NOT NULL,
+    user_id INT NOT NULL,
+    payment_session_id VARCHAR(100) NOT NULL UNIQUE,
+    from_seat_ids VARCHAR(1000) NOT NULL,
+    to_seat_ids VARCHAR(1000) NOT NULL,
+    price_diff_cents INT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    status VARCHAR(10) NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'COMPLETED', 'FAILED')),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_seat_upgrades_booking ON seat_upgrades (booking_id);
+
+CREATE TABLE IF NOT EXISTS payment_webhook_events (
+    id BIGSERIAL PRIMARY KEY,
+    session_id VARCHAR(100) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    event_id VARCHAR(100) NOT NULL DEFAULT '',
+    processed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (session_id, status, event_id)
+);
+
+CREATE TABLE IF NOT EXISTS refunds (
+    id BIGSERIAL PRIMARY KEY,
+    booking_id VARCHAR(100) NOT NULL,
+    user_id INT NOT NULL,
+    seat_ids VARCHAR(1000) NOT NULL,
+    provider_session_id VARCHAR(255) NOT NULL,
+    provider_refund_id VARCHAR(255) UNIQUE,
+    amount_cents INT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'REFUND_PENDING' CHECK (status IN ('REFUND_PENDING', 'REFUNDED', 'FAILED')),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_refunds_booking ON refunds (booking_id);
+
+CREATE TABLE IF NOT EXISTS booking_transitions (
+    id BIGSERIAL PRIMARY KEY,
+    booking_id VARCHAR(100) NOT NULL,
+    from_state VARCHAR(20) NOT NULL DEFAULT '',
+    to_state VARCHAR(20) NOT NULL,
+    reason VARCHAR(100) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_booking_transitions_booking ON booking_transitions (booking_id, id);
+
+CREATE TABLE IF NOT EXISTS bookings (
+    id VARCHAR(100) PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),
+    show_id INT NOT NULL REFERENCES shows(id),
+    state VARCHAR(20) NOT NULL,
+    payment_redirect_url VARCHAR(255),
+    provider_session_id VARCHAR(255),
+    provider_session_opened_at TIMESTAMP,
+    payment_amount_cents BIGINT,
+    payment_currency CHAR(3),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_bookings_state ON bookings (state, provider_session_opened_at);
+
+CREATE TABLE IF NOT EXISTS booking_seats (
+    booking_id VARCHAR(100) NOT NULL REFERENCES bookings(id),
+    seat_id INT NOT NULL REFERENCES seats(id),
+    PRIMARY KEY (booking_id, seat_id)
+);
+CREATE INDEX IF NOT EXISTS idx_booking_seats_seat ON booking_seats (seat_id);
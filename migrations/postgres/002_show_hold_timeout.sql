@@ -0,0 +1,2 @@
+-- Per show payment hold, overriding payment.hold_timeout when set, see hold_timeout.go.
+ALTER TABLE shows ADD COLUMN IF NOT EXISTS hold_timeout_seconds INT;
@@ -0,0 +1,41 @@
+-- Append-only audit log of seat state changes, see seat_audit.go and
+-- mysql/022_seat_audit.sql. source, strategy and request_id come from the transaction's
+-- seat_audit.* settings.
+CREATE TABLE IF NOT EXISTS seat_audit (
+    id BIGSERIAL PRIMARY KEY,
+    seat_id INT NOT NULL,
+    show_id INT NOT NULL,
+    user_id INT,
+    booking_id VARCHAR(100),
+    old_status VARCHAR(20) NOT NULL,
+    new_status VARCHAR(20) NOT NULL,
+    source VARCHAR(20),
+    strategy VARCHAR(20),
+    request_id VARCHAR(128),
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_seat_audit_seat ON seat_audit (seat_id, id);
+CREATE INDEX IF NOT EXISTS idx_seat_audit_show ON seat_audit (show_id, id);
+CREATE INDEX IF NOT EXISTS idx_seat_audit_booking ON seat_audit (booking_id, id);
+
+CREATE OR REPLACE FUNCTION record_seat_audit() RETURNS TRIGGER AS $$
+DECLARE
+    old_status VARCHAR(20) := CASE WHEN OLD.is_reserved = 0 OR OLD.payment_status = 'FAILED' THEN 'AVAILABLE' ELSE OLD.payment_status END;
+    new_status VARCHAR(20) := CASE WHEN NEW.is_reserved = 0 OR NEW.payment_status = 'FAILED' THEN 'AVAILABLE' ELSE NEW.payment_status END;
+BEGIN
+    IF old_status <> new_status
+        OR OLD.user_id IS DISTINCT FROM NEW.user_id
+        OR OLD.payment_session_id IS DISTINCT FROM NEW.payment_session_id THEN
+        INSERT INTO seat_audit (seat_id, show_id, user_id, booking_id, old_status, new_status, source, strategy, request_id)
+        VALUES (NEW.id, NEW.show_id, COALESCE(NEW.user_id, OLD.user_id),
+                COALESCE(NEW.payment_session_id, OLD.payment_session_id), old_status, new_status,
+                NULLIF(current_setting('seat_audit.source', true), ''),
+                NULLIF(current_setting('seat_audit.strategy', true), ''),
+                NULLIF(current_setting('seat_audit.request_id', true), ''));
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER seats_audit AFTER UPDATE ON seats
+FOR EACH ROW EXECUTE FUNCTION record_seat_audit();
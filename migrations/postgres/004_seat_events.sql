@@ -0,0 +1,13 @@
+-- Seat event store, see event_store.go and mysql/023_seat_events.sql.
+CREATE TABLE IF NOT EXISTS seat_events (
+    id BIGSERIAL PRIMARY KEY,
+    seat_id INT NOT NULL,
+    show_id INT NOT NULL,
+    seq INT NOT NULL,
+    type VARCHAR(30) NOT NULL,
+    user_id INT,
+    booking_id VARCHAR(100),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (seat_id, seq)
+);
+CREATE INDEX IF NOT EXISTS idx_seat_events_show ON seat_events (show_id, id);
@@ -0,0 +1,10 @@
+-- Transactional outbox for booking lifecycle events, see outbox.go and mysql/024_outbox.sql.
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id BIGSERIAL PRIMARY KEY,
+    type VARCHAR(50) NOT NULL,
+    booking_id VARCHAR(100) NOT NULL,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    published_at TIMESTAMP NULL
+);
+CREATE INDEX IF NOT EXISTS idx_outbox_unpublished ON outbox_events (published_at, id);
@@ -0,0 +1,16 @@
+-- Client callbacks on terminal booking states, see booking_callbacks.go and
+-- mysql/025_booking_callbacks.sql.
+ALTER TABLE bookings ADD COLUMN IF NOT EXISTS callback_url VARCHAR(2048);
+
+CREATE TABLE IF NOT EXISTS booking_callbacks (
+    id BIGSERIAL PRIMARY KEY,
+    booking_id VARCHAR(100) NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_error VARCHAR(255) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP NULL
+);
+CREATE INDEX IF NOT EXISTS idx_booking_callbacks_due ON booking_callbacks (delivered_at, next_attempt_at);
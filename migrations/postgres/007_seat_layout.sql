@@ -0,0 +1,9 @@
+-- Seat layout for the seat map, see seat_map.go and mysql/026_seat_layout.sql.
+ALTER TABLE seats ADD COLUMN IF NOT EXISTS seat_row VARCHAR(10);
+ALTER TABLE seats ADD COLUMN IF NOT EXISTS seat_column INT;
+ALTER TABLE seats ADD COLUMN IF NOT EXISTS price_tier VARCHAR(30);
+
+UPDATE seats
+SET seat_row = substring(seat_number from '^[A-Z]+'),
+    seat_column = substring(seat_number from '[0-9]+$')::INT
+WHERE seat_row IS NULL AND seat_number ~ '^[A-Z]+[0-9]+$';
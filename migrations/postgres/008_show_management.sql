@@ -0,0 +1,4 @@
+-- Shows managed through /admin/shows, see shows.go and mysql/027_show_management.sql.
+ALTER TABLE shows ADD COLUMN IF NOT EXISTS venue VARCHAR(100);
+ALTER TABLE shows ADD COLUMN IF NOT EXISTS on_sale_at TIMESTAMP;
+ALTER TABLE shows ADD COLUMN IF NOT EXISTS strategy VARCHAR(20);
@@ -0,0 +1,29 @@
+-- Venues and their seating layout, see venues.go and mysql/028_venues.sql.
+CREATE TABLE IF NOT EXISTS venues (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    city VARCHAR(100),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS venue_sections (
+    id SERIAL PRIMARY KEY,
+    venue_id INT NOT NULL REFERENCES venues(id),
+    name VARCHAR(100) NOT NULL,
+    price_tier VARCHAR(30),
+    price_cents INT,
+    position INT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_venue_sections_venue ON venue_sections (venue_id, position);
+
+CREATE TABLE IF NOT EXISTS venue_rows (
+    id SERIAL PRIMARY KEY,
+    venue_id INT NOT NULL REFERENCES venues(id),
+    section_id INT NOT NULL REFERENCES venue_sections(id),
+    label VARCHAR(5) NOT NULL,
+    seat_count INT NOT NULL,
+    position INT NOT NULL,
+    UNIQUE (venue_id, label)
+);
+
+ALTER TABLE shows ADD COLUMN IF NOT EXISTS venue_id INT REFERENCES venues(id);
@@ -0,0 +1,3 @@
+-- Sale window of a show, see sale_window.go and mysql/029_sale_window.sql.
+ALTER TABLE shows RENAME COLUMN on_sale_at TO sale_start;
+ALTER TABLE shows ADD COLUMN IF NOT EXISTS sale_end TIMESTAMP;
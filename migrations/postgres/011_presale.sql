@@ -0,0 +1,12 @@
+-- Presales, see presale.go and mysql/030_presale.sql.
+ALTER TABLE shows ADD COLUMN IF NOT EXISTS presale_start TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS presale_codes (
+    code VARCHAR(32) PRIMARY KEY,
+    show_id INT NOT NULL REFERENCES shows(id),
+    batch_id VARCHAR(40) NOT NULL,
+    max_uses INT NOT NULL,
+    uses INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_presale_codes_show ON presale_codes (show_id, batch_id);
@@ -0,0 +1,2 @@
+-- Sold-out flag, see sold_out.go and mysql/031_sold_out.sql.
+ALTER TABLE shows ADD COLUMN IF NOT EXISTS sold_out_at TIMESTAMP;
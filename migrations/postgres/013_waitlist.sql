@@ -0,0 +1,14 @@
+-- Waitlists of sold-out shows, see waitlist.go and mysql/032_waitlist.sql.
+CREATE TABLE IF NOT EXISTS waitlist_entries (
+    id BIGSERIAL PRIMARY KEY,
+    show_id INT NOT NULL REFERENCES shows(id),
+    user_id INT NOT NULL,
+    quantity INT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'WAITING',
+    callback_url VARCHAR(2048),
+    booking_id VARCHAR(100),
+    offer_expires_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_waitlist_entries_show ON waitlist_entries (show_id, status, id);
@@ -0,0 +1,7 @@
+-- Show cancellation, see show_cancellation.go and mysql/033_show_cancellation.sql.
+ALTER TABLE shows ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMP;
+ALTER TABLE shows ADD COLUMN IF NOT EXISTS cancel_reason VARCHAR(255);
+ALTER TABLE refunds ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+ALTER TABLE refunds ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP;
+ALTER TABLE refunds ADD COLUMN IF NOT EXISTS last_error VARCHAR(255);
+CREATE INDEX IF NOT EXISTS idx_refunds_due ON refunds (status, next_attempt_at);
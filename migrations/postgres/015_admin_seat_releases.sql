@@ -0,0 +1,15 @@
+-- Force releases of wedged seats, see force_release.go and mysql/034_admin_seat_releases.sql.
+CREATE TABLE IF NOT EXISTS admin_seat_releases (
+    id BIGSERIAL PRIMARY KEY,
+    target VARCHAR(20) NOT NULL,
+    target_id VARCHAR(100) NOT NULL,
+    seat_ids TEXT NOT NULL,
+    cancelled_bookings TEXT,
+    reason VARCHAR(255) NOT NULL,
+    operator VARCHAR(100),
+    ip VARCHAR(64),
+    seats_before TEXT NOT NULL,
+    locks_cleared INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_admin_seat_releases_target ON admin_seat_releases (target, target_id);
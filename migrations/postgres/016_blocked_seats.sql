@@ -0,0 +1,6 @@
+-- Blocked seats, see seat_blocks.go and mysql/035_blocked_seats.sql.
+ALTER TABLE seats DROP CONSTRAINT IF EXISTS seats_payment_status_check;
+ALTER TABLE seats ADD CONSTRAINT seats_payment_status_check
+    CHECK (payment_status IN ('PENDING', 'COMPLETED', 'FAILED', 'REFUND_PENDING', 'REVIEW', 'BLOCKED'));
+ALTER TABLE seats ADD COLUMN IF NOT EXISTS block_reason VARCHAR(255);
+ALTER TABLE seats ADD COLUMN IF NOT EXISTS blocked_at TIMESTAMP;
@@ -0,0 +1,7 @@
+-- Seat limit per user and show, see seat_limit.go and mysql/036_seat_limit.sql.
+CREATE TABLE IF NOT EXISTS seat_limit_locks (
+    user_id INT NOT NULL,
+    show_id INT NOT NULL REFERENCES shows(id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, show_id)
+);
+CREATE INDEX IF NOT EXISTS idx_seats_show_user ON seats (show_id, user_id);
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Transactional outbox for booking lifecycle events. recordBookingTransition writes an
+// outbox_events row in the same transaction as the move it records, so an event exists if and
+// only if the booking change committed:
+//   - booking.created: the booking was created HELD
+//   - booking.confirmed: it was paid (or had nothing to pay)
+//   - booking.expired: the reaper ended its hold
+//   - booking.failed: it was cancelled, by a failed payment, an abandon, a cancelled upgrade or
+//     its show being cancelled; reason says which
+//   - booking.show_cancelled: its show was cancelled after it was paid, and it is being
+//     refunded (show_cancellation.go); this one is written without a move
+// A relay on the maintenance leader publishes unpublished rows in id order to outbox.broker
+// and marks them published. On the default broker, the Redis stream outbox.stream, a relay
+// that dies between the two publishes the batch again, so each XADD goes through
+// publishOutboxScript, which only adds an event whose dedupe key it hasn't set before: every
+// event lands in the stream exactly once. The dedupe keys, like published rows, are kept for
+// outboxRetention. The Kafka and NATS brokers are in outbox_kafka.go and outbox_nats.go. A
+// booking's events are published in order, its moves take turns on its row; events of
+// different bookings may commit, and so be published, slightly out of id order.
+
+const (
+	outboxRetention     = 7 * 24 * time.Hour
+	outboxPruneInterval = 1 * time.Hour
+	// outboxStreamMaxLen roughly caps the stream, consumers are expected to keep up well within it.
+	outboxStreamMaxLen = 1000000
+)
+
+// outboxEventTypes are the events booking states are published as; other states have none.
+var outboxEventTypes = map[BookingState]string{
+	BookingHeld:      "booking.created",
+	BookingConfirmed: "booking.confirmed",
+	BookingExpired:   "booking.expired",
+	BookingCancelled: "booking.failed",
+}
+
+// publishOutboxScript XADDs ARGV[3..] to KEYS[1] unless KEYS[2], the event's dedupe key, is
+// already set; it sets it for ARGV[1] ms and MAXLEN ~ ARGV[2]. Returns 1 when added, 0 for a
+// duplicate.
+var publishOutboxScript = redis.NewScript(`
+if redis.call("SET", KEYS[2], "1", "NX", "PX", ARGV[1]) == false then
+	return 0
+end
+redis.call("XADD", KEYS[1], "MAXLEN", "~", ARGV[2], "*", unpack(ARGV, 3))
+return 1
+`)
+
+// OutboxConfig tunes the outbox relay, see outbox.go.
+type OutboxConfig struct {
+	Broker            string   `json:"broker"`               // OUTBOX_BROKER, "redis", "kafka" or "nats"
+	KafkaBrokers      []string `json:"kafka_brokers"`        // KAFKA_BROKERS, comma separated
+	KafkaTopic        string   `json:"kafka_topic"`          // KAFKA_TOPIC
+	KafkaTopicPerType bool     `json:"kafka_topic_per_type"` // KAFKA_TOPIC_PER_TYPE, publish to <kafka_topic>.<type> instead
+	NatsURL           string   `json:"nats_url"`             // NATS_URL
+	NatsStream        string   `json:"nats_stream"`          // NATS_STREAM, the JetStream stream, created on startup
+	NatsSubject       string   `json:"nats_subject"`         // NATS_SUBJECT, events go to <nats_subject>.<type>
+	NatsConsumers     []string `json:"nats_consumers"`       // NATS_CONSUMERS, durable consumers created on startup, comma separated
+	Stream            string   `json:"stream"`               // OUTBOX_STREAM, the Redis stream events are published to
+	Interval          Duration `json:"interval"`             // OUTBOX_RELAY_INTERVAL, how often the relay looks for new events
+	BatchSize         int      `json:"batch_size"`           // OUTBOX_BATCH_SIZE, events published per round trip
+}
+
+type OutboxEvent struct {
+	EventID    int64        `json:"event_id"`
+	Type       string       `json:"type"`
+	BookingID  string       `json:"booking_id"`
+	UserID     int          `json:"user_id"`
+	ShowID     int          `json:"show_id"`
+	State      BookingState `json:"state"`
+	Reason     string       `json:"reason"`
+	OccurredAt time.Time    `json:"occurred_at"`
+}
+
+// writeOutboxEvent queues the event for the booking's move to `to`, if that state has one.
+func writeOutboxEvent(ctx context.Context, tx *sql.Tx, bookingID string, to BookingState, reason string) error {
+	eventType, ok := outboxEventTypes[to]
+	if !ok {
+		return nil
+	}
+	return writeOutboxEventOfType(ctx, tx, bookingID, eventType, to, reason)
+}
+
+// writeOutboxEventOfType queues an event of eventType for the booking, in state.
+func writeOutboxEventOfType(ctx context.Context, tx *sql.Tx, bookingID, eventType string, to BookingState, reason string) error {
+	event := OutboxEvent{Type: eventType, BookingID: bookingID, State: to, Reason: reason, OccurredAt: time.Now().UTC()}
+	err := tx.QueryRowContext(ctx, `SELECT user_id, show_id FROM bookings WHERE id = ?`, bookingID).Scan(&event.UserID, &event.ShowID)
+	if err != nil {
+		return fmt.Errorf("failed to load booking for outbox: %w", err)
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode outbox event: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO outbox_events (type, booking_id, payload) VALUES (?, ?, ?)
+	`, eventType, bookingID, string(payload))
+	if err != nil {
+		return fmt.Errorf("failed to write outbox event: %w", err)
+	}
+	return nil
+}
+
+func runOutboxRelay() error {
+	ticker := time.NewTicker(time.Duration(strategyConfig.Outbox.Interval))
+	defer ticker.Stop()
+	var lastPrune time.Time
+
+	for range ticker.C {
+		if !runsMaintenance() {
+			continue
+		}
+		relayOutbox()
+		if time.Since(lastPrune) >= outboxPruneInterval {
+			pruneOutbox()
+			lastPrune = time.Now()
+		}
+	}
+	return errors.New("ending outbox relay")
+}
+
+// relayOutbox publishes batches until the outbox is drained or publishing fails.
+func relayOutbox() {
+	defer func() { reportPanic(ctx, "outbox", recover()) }()
+
+	for runsMaintenance() {
+		published, err := relayOutboxBatch()
+		if err != nil {
+			slog.Error("Failed to relay outbox", "component", "outbox", "error", err)
+			reportError(ctx, "outbox", err)
+			return
+		}
+		if published < strategyConfig.Outbox.BatchSize {
+			return
+		}
+	}
+}
+
+// OutboxPublisher delivers relayed events to a broker.
+type OutboxPublisher interface {
+	Name() string
+	// Publish sends events in order and reports how many of them, from the start, were
+	// delivered before it failed.
+	Publish(ctx context.Context, events []OutboxEvent) (int, error)
+}
+
+var outboxPublisher OutboxPublisher
+
+func newOutboxPublisher(cfg OutboxConfig) (OutboxPublisher, error) {
+	switch cfg.Broker {
+	case "redis":
+		return &redisOutboxPublisher{client: rdb, stream: cfg.Stream}, nil
+	case "kafka":
+		return newKafkaOutboxPublisher(cfg)
+	case "nats":
+		return newNatsOutboxPublisher(cfg)
+	default:
+		return nil, fmt.Errorf("unknown outbox broker %q", cfg.Broker)
+	}
+}
+
+func relayOutboxBatch() (int, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, payload FROM outbox_events
+		WHERE published_at IS NULL
+		ORDER BY id
+		LIMIT ?
+	`, strategyConfig.Outbox.BatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load outbox: %w", err)
+	}
+	var events []OutboxEvent
+	for rows.Next() {
+		var id int64
+		var payload string
+		if err := rows.Scan(&id, &payload); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan outbox event: %w", err)
+		}
+		var event OutboxEvent
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("invalid outbox event %d: %w", id, err)
+		}
+		// event_id is the row id, only known once inserted.
+		event.EventID = id
+		events = append(events, event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to load outbox: %w", err)
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	published, publishErr := outboxPublisher.Publish(ctx, events)
+	if published > 0 {
+		ids := make([]int, published)
+		for i, event := range events[:published] {
+			ids[i] = int(event.EventID)
+		}
+		if err := markOutboxPublished(ids); err != nil {
+			return 0, err
+		}
+	}
+	if publishErr != nil {
+		return 0, fmt.Errorf("failed to publish outbox event %d to %s: %w", events[published].EventID, outboxPublisher.Name(), publishErr)
+	}
+	slog.Debug("Relayed outbox events", "component", "outbox", "events", published, "broker", outboxPublisher.Name())
+	return published, nil
+}
+
+type redisOutboxPublisher struct {
+	client redis.UniversalClient
+	stream string
+}
+
+func (p *redisOutboxPublisher) Name() string { return "redis" }
+
+// Publish adds the events one at a time through publishOutboxScript, so one already in the
+// stream is skipped instead of added again.
+func (p *redisOutboxPublisher) Publish(ctx context.Context, events []OutboxEvent) (int, error) {
+	for i, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return i, err
+		}
+		keys := []string{p.stream, outboxDedupeKey(p.stream, event.EventID)}
+		added, err := publishOutboxScript.Run(ctx, p.client, keys, outboxRetention.Milliseconds(), outboxStreamMaxLen,
+			"event_id", event.EventID, "type", event.Type, "booking_id", event.BookingID, "payload", string(payload)).Int()
+		if err != nil {
+			return i, err
+		}
+		if added == 0 {
+			slog.Info("Outbox event already published", "component", "outbox", "event_id", event.EventID, "type", event.Type)
+		}
+	}
+	return len(events), nil
+}
+
+// outboxDedupeKey shares the stream's hash slot, the script needs both on one cluster node.
+func outboxDedupeKey(stream string, id int64) string {
+	return "{" + stream + "}:outbox_published:" + strconv.FormatInt(id, 10)
+}
+
+func markOutboxPublished(ids []int) error {
+	args := append([]interface{}{time.Now()}, sliceToInterface(ids)...)
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+		UPDATE outbox_events SET published_at = ? WHERE id IN (%s)
+	`, generatePlaceholders(len(ids))), args...)
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox events published: %w", err)
+	}
+	return nil
+}
+
+// pruneOutbox deletes published events older than outboxRetention, by then their dedupe keys
+// are gone too.
+func pruneOutbox() {
+	cutoff := time.Now().Add(-outboxRetention)
+	result, err := db.ExecContext(ctx, "DELETE FROM outbox_events WHERE published_at < ?", cutoff)
+	if err != nil {
+		slog.Error("Failed to prune outbox", "component", "outbox", "cutoff", cutoff, "error", err)
+		return
+	}
+	if pruned, _ := result.RowsAffected(); pruned > 0 {
+		slog.Info("Pruned outbox", "component", "outbox", "cutoff", cutoff, "rows", pruned)
+	}
+}
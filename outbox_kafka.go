@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka outbox broker. Events go to outbox.kafka_topic, or with kafka_topic_per_type to
+// <kafka_topic>.<type> (booking_events.booking.confirmed, ...), keyed by show id so each show's
+// events stay in one partition, in order. The value is the event's JSON; event_id and type are
+// also headers. Writes wait for all in-sync replicas. Kafka has no dedupe like the Redis
+// script: a relay that dies after a write but before marking it published writes it again, so
+// consumers drop event_ids they have already seen.
+
+type kafkaOutboxPublisher struct {
+	writer       *kafka.Writer
+	topic        string
+	topicPerType bool
+}
+
+func newKafkaOutboxPublisher(cfg OutboxConfig) (*kafkaOutboxPublisher, error) {
+	return &kafkaOutboxPublisher{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.KafkaBrokers...),
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 10 * time.Millisecond,
+			WriteTimeout: 10 * time.Second,
+		},
+		topic:        cfg.KafkaTopic,
+		topicPerType: cfg.KafkaTopicPerType,
+	}, nil
+}
+
+func (p *kafkaOutboxPublisher) Name() string { return "kafka" }
+
+// Publish writes the batch in one call. When some messages fail, the ones before the first
+// failure count as published and the rest are retried on the next run.
+func (p *kafkaOutboxPublisher) Publish(ctx context.Context, events []OutboxEvent) (int, error) {
+	messages := make([]kafka.Message, len(events))
+	for i, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return 0, err
+		}
+		topic := p.topic
+		if p.topicPerType {
+			topic += "." + event.Type
+		}
+		messages[i] = kafka.Message{
+			Topic: topic,
+			Key:   []byte(strconv.Itoa(event.ShowID)),
+			Value: value,
+			Headers: []kafka.Header{
+				{Key: "event_id", Value: []byte(strconv.FormatInt(event.EventID, 10))},
+				{Key: "type", Value: []byte(event.Type)},
+			},
+		}
+	}
+	if err := p.writer.WriteMessages(ctx, messages...); err != nil {
+		var writeErrs kafka.WriteErrors
+		if errors.As(err, &writeErrs) {
+			for i, writeErr := range writeErrs {
+				if writeErr != nil {
+					return i, writeErr
+				}
+			}
+		}
+		return 0, err
+	}
+	return len(events), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATS JetStream outbox broker, for deployments without Kafka. Events are published to
+// <outbox.nats_subject>.<type> (booking_events.booking.confirmed, ...), the JSON event as the
+// body, with event_id and type headers. On startup the stream outbox.nats_stream is created to
+// capture <nats_subject>.>, or updated to if it exists, along with a durable pull consumer for
+// each of outbox.nats_consumers, so consumers can start reading before the first event. Each
+// message carries its event id as Nats-Msg-Id: a batch published again after a relay died
+// before marking it is dropped by the stream's duplicate window instead of stored twice.
+
+// natsDuplicateWindow is how long the stream remembers message ids. A relay replays a batch
+// within an interval or two of publishing it, this is generous.
+const natsDuplicateWindow = 10 * time.Minute
+
+type natsOutboxPublisher struct {
+	conn    *nats.Conn
+	js      nats.JetStreamContext
+	subject string
+}
+
+func newNatsOutboxPublisher(cfg OutboxConfig) (*natsOutboxPublisher, error) {
+	conn, err := nats.Connect(cfg.NatsURL, nats.Name("bookmyshow-outbox"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %w", err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open jetstream: %w", err)
+	}
+	p := &natsOutboxPublisher{conn: conn, js: js, subject: cfg.NatsSubject}
+	if err := p.provision(cfg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// provision creates or updates the stream and the durable consumers.
+func (p *natsOutboxPublisher) provision(cfg OutboxConfig) error {
+	stream := &nats.StreamConfig{
+		Name:       cfg.NatsStream,
+		Subjects:   []string{p.subject + ".>"},
+		Storage:    nats.FileStorage,
+		MaxAge:     outboxRetention,
+		Duplicates: natsDuplicateWindow,
+	}
+	_, err := p.js.StreamInfo(cfg.NatsStream)
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+		_, err = p.js.AddStream(stream)
+	case err == nil:
+		_, err = p.js.UpdateStream(stream)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to provision nats stream %s: %w", cfg.NatsStream, err)
+	}
+
+	for _, name := range cfg.NatsConsumers {
+		_, err := p.js.ConsumerInfo(cfg.NatsStream, name)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, nats.ErrConsumerNotFound) {
+			return fmt.Errorf("failed to look up nats consumer %s: %w", name, err)
+		}
+		_, err = p.js.AddConsumer(cfg.NatsStream, &nats.ConsumerConfig{
+			Durable:       name,
+			AckPolicy:     nats.AckExplicitPolicy,
+			DeliverPolicy: nats.DeliverAllPolicy,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create nats consumer %s: %w", name, err)
+		}
+		slog.Info("Created nats consumer", "component", "outbox", "stream", cfg.NatsStream, "consumer", name)
+	}
+	return nil
+}
+
+func (p *natsOutboxPublisher) Name() string { return "nats" }
+
+// Publish sends the events one at a time, each waiting for the stream's ack.
+func (p *natsOutboxPublisher) Publish(ctx context.Context, events []OutboxEvent) (int, error) {
+	for i, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return i, err
+		}
+		eventID := strconv.FormatInt(event.EventID, 10)
+		msg := nats.NewMsg(p.subject + "." + event.Type)
+		msg.Data = value
+		msg.Header.Set(nats.MsgIdHdr, eventID)
+		msg.Header.Set("event_id", eventID)
+		msg.Header.Set("type", event.Type)
+		ack, err := p.js.PublishMsg(msg, nats.Context(ctx))
+		if err != nil {
+			return i, err
+		}
+		if ack.Duplicate {
+			slog.Info("Outbox event already published", "component", "outbox", "event_id", event.EventID, "type", event.Type)
+		}
+	}
+	return len(events), nil
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Partner API keys. Requests with an X-API-Key header are checked against the key's scopes,
+// show restrictions and daily seat quota. Requests without one are treated as first-party
+// traffic, but once any partner key is active, keyless bookings count against
+// partner.anonymous_daily_seats per client address, so a partner can't dodge its quota by
+// leaving the header off. The client address is the connection's, or, behind one of
+// partner.trusted_proxies, the last X-Forwarded-For entry those proxies didn't add. A booking
+// is charged once it is made or queued; a duplicate request answered with the booking already
+// under way gives its seats back, and so does a queued booking that fails. Usage counters live
+// in Redis, one key per partner (or address) per day. The sales channel endpoints
+// (channel_allocations.go) always need a key with channels:write, and a key acts for the sales
+// channel named like its partner.
+
+type PartnerConfig struct {
+	AnonymousDailySeats int      `json:"anonymous_daily_seats"` // PARTNER_ANONYMOUS_DAILY_SEATS, 0 to leave keyless bookings unmetered
+	TrustedProxies      []string `json:"trusted_proxies"`       // PARTNER_TRUSTED_PROXIES, comma separated addresses or CIDRs whose X-Forwarded-For is believed
+}
+
+const (
+	ScopeAvailabilityRead = "availability:read"
+	ScopeBookingsWrite    = "bookings:write"
+	ScopeChannelsWrite    = "channels:write"
+)
+
+type PartnerKey struct {
+	ID             int
+	PartnerName    string
+	Scopes         map[string]bool
+	DailySeatLimit int
+	AllowedShowIDs map[int]bool // empty means every show
+}
+
+type partnerContextKey struct{}
+
+func partnerFromContext(ctx context.Context) (*PartnerKey, bool) {
+	partner, ok := ctx.Value(partnerContextKey{}).(*PartnerKey)
+	return partner, ok
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func lookupPartnerKey(ctx context.Context, key string) (*PartnerKey, error) {
+	var scopes string
+	var allowedShows sql.NullString
+	partner := &PartnerKey{Scopes: map[string]bool{}, AllowedShowIDs: map[int]bool{}}
+
+	err := db.QueryRowContext(ctx, `
+		SELECT id, partner_name, scopes, daily_seat_limit, allowed_show_ids
+		FROM partner_api_keys
+		WHERE key_hash = ? AND is_active
+	`, hashAPIKey(key)).Scan(&partner.ID, &partner.PartnerName, &scopes, &partner.DailySeatLimit, &allowedShows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, scope := range strings.Split(scopes, ",") {
+		partner.Scopes[strings.TrimSpace(scope)] = true
+	}
+	if allowedShows.Valid {
+		for _, id := range strings.Split(allowedShows.String, ",") {
+			if showID, err := strconv.Atoi(strings.TrimSpace(id)); err == nil {
+				partner.AllowedShowIDs[showID] = true
+			}
+		}
+	}
+	return partner, nil
+}
+
+func (p *PartnerKey) canAccessShow(showID int) bool {
+	return len(p.AllowedShowIDs) == 0 || p.AllowedShowIDs[showID]
+}
+
+func partnerUsageKeys(partnerID int, day time.Time) (seats, requests string) {
+	stamp := day.UTC().Format("20060102")
+	return fmt.Sprintf("partner_usage:%d:%s:seats", partnerID, stamp),
+		fmt.Sprintf("partner_usage:%d:%s:requests", partnerID, stamp)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// authenticatePartner checks the request's API key for scope and counts the request. It
+// answers the request itself and reports false when the key is unknown or lacks the scope.
+func authenticatePartner(w http.ResponseWriter, r *http.Request, apiKey, scope string) (*PartnerKey, bool) {
+	partner, err := lookupPartnerKey(r.Context(), apiKey)
+	if err == sql.ErrNoRows {
+		slog.WarnContext(r.Context(), "Unknown or inactive API key", "component", "partner", "ip", r.RemoteAddr)
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return nil, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to look up API key", "component", "partner", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !partner.Scopes[scope] {
+		slog.WarnContext(r.Context(), "Missing scope", "component", "partner", "partner", partner.PartnerName, "scope", scope, "path", r.URL.Path)
+		http.Error(w, "API key lacks scope "+scope, http.StatusForbidden)
+		return nil, false
+	}
+
+	_, requestsKey := partnerUsageKeys(partner.ID, time.Now())
+	rdb.Incr(ctx, requestsKey)
+	rdb.Expire(ctx, requestsKey, 48*time.Hour)
+	return partner, true
+}
+
+// requirePartnerKey lets only requests with an API key holding scope through.
+func requirePartnerKey(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey := r.Header.Get("X-API-Key")
+		if apiKey == "" {
+			http.Error(w, "X-API-Key is required", http.StatusUnauthorized)
+			return
+		}
+		partner, ok := authenticatePartner(w, r, apiKey, scope)
+		if !ok {
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), partnerContextKey{}, partner)))
+	}
+}
+
+// requirePartnerScope enforces partner key rules for requests carrying X-API-Key. Once any
+// partner key is active, booking requests without one are metered too, against the anonymous
+// daily seat quota of their client address, so leaving the key off doesn't skip the quota.
+func requirePartnerScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return requirePartnerSeats(scope, bookingRequestSeats, next)
+}
+
+// requestSeats reads from a bookings:write request the show it books and the seats it takes
+// from the quota. A body it can't read fails with errInvalidRequestBody.
+type requestSeats func(r *http.Request, body []byte) (showID, seats int, err error)
+
+var errInvalidRequestBody = errors.New("invalid request body")
+
+// requirePartnerSeats is requirePartnerScope for routes whose body isn't a BookingRequest,
+// with seatsOf counting what a request takes.
+func requirePartnerSeats(scope string, seatsOf requestSeats, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey := r.Header.Get("X-API-Key")
+		if apiKey == "" {
+			limit := strategyConfig.Partner.AnonymousDailySeats
+			if scope != ScopeBookingsWrite || limit == 0 || !partnerKeysInUse(r.Context()) {
+				next(w, r)
+				return
+			}
+			addr := clientAddr(r)
+			meterBookingSeats(w, r, seatsOf, anonymousUsageKey(addr, time.Now()), limit, nil, "anonymous:"+addr, next)
+			return
+		}
+
+		partner, ok := authenticatePartner(w, r, apiKey, scope)
+		if !ok {
+			return
+		}
+
+		if showID, err := strconv.Atoi(r.PathValue("id")); err == nil && !partner.canAccessShow(showID) {
+			http.Error(w, "API key not valid for this show", http.StatusForbidden)
+			return
+		}
+
+		if attempt, ok := bookingAttemptFromContext(r.Context()); ok {
+			attempt.PartnerID = &partner.ID
+		}
+		r = r.WithContext(context.WithValue(r.Context(), partnerContextKey{}, partner))
+		if scope != ScopeBookingsWrite {
+			next(w, r)
+			return
+		}
+		seatsKey, _ := partnerUsageKeys(partner.ID, time.Now())
+		meterBookingSeats(w, r, seatsOf, seatsKey, partner.DailySeatLimit, partner, partner.PartnerName, next)
+	}
+}
+
+// meterBookingSeats peeks at a booking request's body for the show and seat count, reserves
+// the seats against the daily quota counted in seatsKey, and gives them back if the booking
+// doesn't go through. partner, when set, also restricts the show.
+func meterBookingSeats(w http.ResponseWriter, r *http.Request, seatsOf requestSeats, seatsKey string, limit int, partner *PartnerKey, name string, next http.HandlerFunc) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	showID, seats, err := seatsOf(r, body)
+	if errors.Is(err, errInvalidRequestBody) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to count requested seats", "component", "partner", "partner", name, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if partner != nil && !partner.canAccessShow(showID) {
+		slog.InfoContext(r.Context(), "Show not permitted", "component", "partner", "partner", name, "show_id", showID)
+		http.Error(w, "API key not valid for this show", http.StatusForbidden)
+		return
+	}
+
+	used, err := rdb.IncrBy(ctx, seatsKey, int64(seats)).Result()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update usage", "component", "partner", "partner", name, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	rdb.Expire(ctx, seatsKey, 48*time.Hour)
+
+	if used > int64(limit) {
+		rdb.DecrBy(ctx, seatsKey, int64(seats))
+		slog.WarnContext(r.Context(), "Daily seat quota exceeded", "component", "partner", "partner", name, "used", used-int64(seats), "limit", limit)
+		http.Error(w, "Daily seat quota exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	quota := &bookingQuota{Key: seatsKey, Seats: seats}
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	next(recorder, r.WithContext(context.WithValue(r.Context(), bookingQuotaContextKey{}, quota)))
+	if recorder.status >= 300 {
+		quota.giveBack(context.WithoutCancel(r.Context()))
+	}
+}
+
+// bookingQuota is the daily seat quota a booking request was charged against.
+type bookingQuota struct {
+	Key   string `json:"key"`
+	Seats int    `json:"seats"`
+}
+
+type bookingQuotaContextKey struct{}
+
+func bookingQuotaFromContext(ctx context.Context) (*bookingQuota, bool) {
+	quota, ok := ctx.Value(bookingQuotaContextKey{}).(*bookingQuota)
+	return quota, ok
+}
+
+// giveBack returns the seats to the quota, once.
+func (q *bookingQuota) giveBack(ctx context.Context) {
+	if q.Seats == 0 {
+		return
+	}
+	if err := rdb.DecrBy(ctx, q.Key, int64(q.Seats)).Err(); err != nil {
+		slog.WarnContext(ctx, "Failed to give seats back to the quota", "component", "partner", "key", q.Key, "error", err)
+		return
+	}
+	q.Seats = 0
+}
+
+// giveBackBookingQuota gives the seats of the booking request under ctx back to the quota it
+// was charged against, for requests that didn't book anything new.
+func giveBackBookingQuota(ctx context.Context) {
+	if quota, ok := bookingQuotaFromContext(ctx); ok {
+		quota.giveBack(ctx)
+	}
+}
+
+// bookingRequestSeats counts the seats of a BookingRequest.
+func bookingRequestSeats(r *http.Request, body []byte) (int, int, error) {
+	var req BookingRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return 0, 0, errInvalidRequestBody
+	}
+	return req.ShowID, max(len(req.SeatIDs), req.Quantity), nil
+}
+
+func anonymousUsageKey(addr string, day time.Time) string {
+	return fmt.Sprintf("partner_usage:anonymous:%s:%s:seats", addr, day.UTC().Format("20060102"))
+}
+
+// clientAddr is the request's client IP, without the port. Behind a trusted proxy it is the
+// last X-Forwarded-For entry not added by a trusted proxy; entries before it are whatever the
+// client sent.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		if !isTrustedProxy(addr) {
+			return addr
+		}
+		host = addr
+	}
+	return host
+}
+
+// isTrustedProxy reports whether addr is one of partner.trusted_proxies.
+func isTrustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, proxy := range strategyConfig.Partner.TrustedProxies {
+		prefix, err := parseTrustedProxy(proxy)
+		if err == nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxy parses a partner.trusted_proxies entry, an address or a CIDR.
+func parseTrustedProxy(proxy string) (netip.Prefix, error) {
+	proxy = strings.TrimSpace(proxy)
+	if strings.Contains(proxy, "/") {
+		prefix, err := netip.ParsePrefix(proxy)
+		return prefix.Masked(), err
+	}
+	ip, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	ip = ip.Unmap()
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// partnerKeysActive caches whether any partner key is active, refreshed every
+// partnerKeysRefresh.
+var partnerKeysActive struct {
+	sync.Mutex
+	active    bool
+	checkedAt time.Time
+}
+
+const partnerKeysRefresh = time.Minute
+
+// partnerKeysInUse reports whether any partner key is active. When the check fails the last
+// answer stands.
+func partnerKeysInUse(ctx context.Context) bool {
+	partnerKeysActive.Lock()
+	defer partnerKeysActive.Unlock()
+	if time.Since(partnerKeysActive.checkedAt) < partnerKeysRefresh {
+		return partnerKeysActive.active
+	}
+	var active bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM partner_api_keys WHERE is_active)`).Scan(&active)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to check for partner keys", "component", "partner", "error", err)
+		return partnerKeysActive.active
+	}
+	partnerKeysActive.active, partnerKeysActive.checkedAt = active, time.Now()
+	return active
+}
+
+type PartnerUsageResponse struct {
+	Partner        string   `json:"partner"`
+	Day            string   `json:"day"`
+	Requests       int64    `json:"requests"`
+	SeatsBooked    int64    `json:"seats_booked"`
+	DailySeatLimit int      `json:"daily_seat_limit"`
+	SeatsRemaining int64    `json:"seats_remaining"`
+	Scopes         []string `json:"scopes"`
+}
+
+// handlePartnerUsage serves GET /api/partner/usage for the calling key.
+func handlePartnerUsage(w http.ResponseWriter, r *http.Request) {
+	partner, err := lookupPartnerKey(r.Context(), r.Header.Get("X-API-Key"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to look up API key", "component", "partner", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	seatsKey, requestsKey := partnerUsageKeys(partner.ID, now)
+	seats, _ := rdb.Get(ctx, seatsKey).Int64()
+	requests, _ := rdb.Get(ctx, requestsKey).Int64()
+
+	resp := PartnerUsageResponse{
+		Partner:        partner.PartnerName,
+		Day:            now.UTC().Format("2006-01-02"),
+		Requests:       requests,
+		SeatsBooked:    seats,
+		DailySeatLimit: partner.DailySeatLimit,
+		SeatsRemaining: int64(partner.DailySeatLimit) - seats,
+		Scopes:         []string{},
+	}
+	for scope := range partner.Scopes {
+		resp.Scopes = append(resp.Scopes, scope)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+type CreatePartnerKeyRequest struct {
+	PartnerName    string   `json:"partner_name"`
+	Scopes         []string `json:"scopes"`
+	DailySeatLimit int      `json:"daily_seat_limit"`
+	ShowIDs        []int    `json:"show_ids"`
+}
+
+// handleCreatePartnerKey serves POST /admin/partner-keys. The plaintext key is only ever
+// returned in this response.
+func handleCreatePartnerKey(w http.ResponseWriter, r *http.Request) {
+	var req CreatePartnerKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PartnerName == "" || len(req.Scopes) == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if scope != ScopeAvailabilityRead && scope != ScopeBookingsWrite && scope != ScopeChannelsWrite {
+			http.Error(w, "Unknown scope "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	apiKey := "pk_" + hex.EncodeToString(raw)
+
+	var allowedShows sql.NullString
+	if len(req.ShowIDs) > 0 {
+		ids := make([]string, len(req.ShowIDs))
+		for i, id := range req.ShowIDs {
+			ids[i] = strconv.Itoa(id)
+		}
+		allowedShows = sql.NullString{String: strings.Join(ids, ","), Valid: true}
+	}
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO partner_api_keys (partner_name, key_hash, scopes, daily_seat_limit, allowed_show_ids)
+		VALUES (?, ?, ?, ?, ?)
+	`, req.PartnerName, hashAPIKey(apiKey), strings.Join(req.Scopes, ","), req.DailySeatLimit, allowedShows)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create partner key", "component", "admin", "partner", req.PartnerName, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Created partner key", "component", "admin", "partner", req.PartnerName, "scopes", req.Scopes)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"partner_name": req.PartnerName, "api_key": apiKey})
+}
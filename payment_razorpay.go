@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Razorpay adapter on Payment Links, authenticated with RAZORPAY_KEY_ID and
+// RAZORPAY_KEY_SECRET. Razorpay wants a link to stay open at least 15 minutes, so like
+// Stripe a link can outlive the seat hold.
+
+const (
+	razorpayAPIBase       = "https://api.razorpay.com/v1"
+	razorpayMinLinkExpiry = 16 * time.Minute
+)
+
+type razorpayPaymentProvider struct {
+	keyID     string
+	keySecret string
+}
+
+type razorpayPaymentLink struct {
+	ID         string `json:"id"`
+	ShortURL   string `json:"short_url"`
+	Status     string `json:"status"` // created, partially_paid, paid, expired, cancelled
+	AmountPaid int64  `json:"amount_paid"`
+	Currency   string `json:"currency"`
+	Payments   []struct {
+		PaymentID string `json:"payment_id"`
+		Status    string `json:"status"`
+	} `json:"payments"`
+}
+
+func newRazorpayPaymentProvider() (*razorpayPaymentProvider, error) {
+	keyID, keySecret := os.Getenv("RAZORPAY_KEY_ID"), os.Getenv("RAZORPAY_KEY_SECRET")
+	if keyID == "" || keySecret == "" {
+		return nil, errors.New("RAZORPAY_KEY_ID and RAZORPAY_KEY_SECRET are required for the razorpay payment provider")
+	}
+	return &razorpayPaymentProvider{keyID: keyID, keySecret: keySecret}, nil
+}
+
+func (p *razorpayPaymentProvider) Name() string { return "razorpay" }
+
+func (p *razorpayPaymentProvider) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, razorpayAPIBase+path, &body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(p.keyID, p.keySecret)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return doPaymentRequest(req, out)
+}
+
+func (p *razorpayPaymentProvider) CreateSession(ctx context.Context, req PaymentSessionRequest) (PaymentSession, error) {
+	success, _ := paymentReturnURLs()
+	expiresAt := req.ExpiresAt
+	if earliest := time.Now().Add(razorpayMinLinkExpiry); expiresAt.Before(earliest) {
+		expiresAt = earliest
+	}
+
+	notes := map[string]string{"booking_id": req.BookingID}
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		notes["request_id"] = requestID
+	}
+
+	var link razorpayPaymentLink
+	err := p.do(ctx, http.MethodPost, "/payment_links", map[string]interface{}{
+		"amount":          req.AmountCents,
+		"currency":        req.Currency,
+		"accept_partial":  false,
+		"expire_by":       expiresAt.Unix(),
+		"reference_id":    req.BookingID,
+		"description":     req.Description,
+		"callback_url":    success,
+		"callback_method": "get",
+		"notes":           notes,
+	}, &link)
+	if err != nil {
+		return PaymentSession{}, fmt.Errorf("failed to create razorpay payment link: %w", err)
+	}
+	return PaymentSession{ID: link.ID, RedirectURL: link.ShortURL}, nil
+}
+
+func (p *razorpayPaymentProvider) link(ctx context.Context, sessionID string) (razorpayPaymentLink, error) {
+	var link razorpayPaymentLink
+	if err := p.do(ctx, http.MethodGet, "/payment_links/"+url.PathEscape(sessionID), nil, &link); err != nil {
+		return link, fmt.Errorf("failed to read razorpay payment link %s: %w", sessionID, err)
+	}
+	return link, nil
+}
+
+func (p *razorpayPaymentProvider) GetStatus(ctx context.Context, sessionID string) (PaymentResult, error) {
+	link, err := p.link(ctx, sessionID)
+	if err != nil {
+		return PaymentResult{}, err
+	}
+	switch link.Status {
+	case "paid":
+		return PaymentResult{Status: "COMPLETED", AmountCents: &link.AmountPaid, Currency: link.Currency}, nil
+	case "expired", "cancelled":
+		return PaymentResult{Status: "FAILED"}, nil
+	default:
+		return PaymentResult{Status: "PENDING"}, nil
+	}
+}
+
+func (p *razorpayPaymentProvider) Refund(ctx context.Context, sessionID string, amountCents int64) (string, error) {
+	link, err := p.link(ctx, sessionID)
+	if err != nil {
+		return "", err
+	}
+	paymentID := ""
+	for _, payment := range link.Payments {
+		if payment.Status == "captured" {
+			paymentID = payment.PaymentID
+		}
+	}
+	if paymentID == "" {
+		return "", fmt.Errorf("razorpay payment link %s has no captured payment to refund", sessionID)
+	}
+
+	var refund struct {
+		ID string `json:"id"`
+	}
+	err = p.do(ctx, http.MethodPost, "/payments/"+url.PathEscape(paymentID)+"/refund", map[string]interface{}{
+		"amount": amountCents,
+		"notes":  map[string]string{"session_id": sessionID},
+	}, &refund)
+	if err != nil {
+		return "", fmt.Errorf("failed to refund razorpay payment %s: %w", paymentID, err)
+	}
+	return refund.ID, nil
+}
+
+func (p *razorpayPaymentProvider) CancelSession(ctx context.Context, sessionID string) error {
+	var link razorpayPaymentLink
+	if err := p.do(ctx, http.MethodPost, "/payment_links/"+url.PathEscape(sessionID)+"/cancel", nil, &link); err != nil {
+		return fmt.Errorf("failed to cancel razorpay payment link %s: %w", sessionID, err)
+	}
+	return nil
+}
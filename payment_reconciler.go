@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"log/slog"
+	"time"
+)
+
+// Payment reconciliation. Webhooks get lost, so checkouts still PENDING Reconcile.After
+// after they were opened are looked up at the gateway, and the ones it has settled are
+// applied through applyPaymentResult like a webhook delivery would be. It has to run well
+// inside the hold: once the reaper releases the seats a payment has nothing left to confirm.
+// The mock gateway only settles through the webhook, so there is nothing to poll with it.
+
+// reconcileEventID is the event id reconciled results are recorded under, so a webhook that
+// does turn up later for the same session answers "ignored".
+const reconcileEventID = "reconcile"
+
+type stalePaymentSession struct {
+	sessionID         string
+	providerSessionID string
+}
+
+func runPaymentReconciler() error {
+	ticker := time.NewTicker(time.Duration(strategyConfig.Reconcile.Interval))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !runsMaintenance() || paymentProvider.Name() == "mock" {
+			continue
+		}
+		reconcilePayments()
+	}
+	return errors.New("ending payment reconciler")
+}
+
+// reconcilePayments runs one pass and returns how many sessions it settled.
+func reconcilePayments() int {
+	sessions, err := stalePaymentSessions()
+	if err != nil {
+		slog.Error("Failed to find pending sessions", "component", "payment", "error", err)
+		return 0
+	}
+
+	reconciled := 0
+
+	for _, session := range sessions {
+		result, err := paymentProvider.GetStatus(ctx, session.providerSessionID)
+		if err != nil {
+			slog.Error("Failed to poll gateway", "component", "payment", "session_id", session.sessionID, "provider_session_id", session.providerSessionID, "error", err)
+			continue
+		}
+		if result.Status == "PENDING" {
+			continue
+		}
+
+		outcome, err := applyPaymentResult(withSeatAudit(ctx, SeatAuditReconciler), session.sessionID, result, reconcileEventID)
+		if err != nil {
+			// ErrNoPendingSeats means the reaper or the webhook got there in between.
+			if !errors.Is(err, ErrNoPendingSeats) {
+				slog.Error("Failed to reconcile", "component", "payment", "session_id", session.sessionID, "status", result.Status, "error", err)
+			}
+			continue
+		}
+		slog.Info("Reconciled missed webhook", "component", "payment", "session_id", session.sessionID, "provider_session_id", session.providerSessionID, "status", result.Status, "outcome", outcome)
+		reconciled++
+	}
+	return reconciled
+}
+
+// runReconcileCommand is `reconcile`: one reconciliation pass, for when the service's own
+// loop isn't running (standby region, or a missed webhook that can't wait for the next tick).
+func runReconcileCommand(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	configFile := configFlag(flags)
+	flags.Parse(args)
+
+	loadConfig(*configFile)
+	if !connectDatabase() {
+		log.Fatalf("Nothing to reconcile for DB_DRIVER=%s", dbDriver)
+	}
+	defer db.Close()
+	connectServices()
+
+	if paymentProvider.Name() == "mock" {
+		slog.Info("Nothing to reconcile, the mock gateway only settles through the webhook", "component", "payment")
+		return
+	}
+	reconciled := reconcilePayments()
+	slog.Info("Reconcile pass done", "component", "payment", "provider", paymentProvider.Name(), "reconciled", reconciled)
+}
+
+// stalePaymentSessions returns the oldest checkouts still PENDING past Reconcile.After.
+func stalePaymentSessions() ([]stalePaymentSession, error) {
+	cfg := strategyConfig.Reconcile
+	rows, err := db.QueryContext(ctx, `
+		SELECT b.id, b.provider_session_id
+		FROM bookings b
+		WHERE b.state = 'PENDING_PAYMENT'
+		AND b.provider_session_id IS NOT NULL
+		AND b.provider_session_opened_at < ?
+		AND EXISTS (SELECT 1 FROM seats s WHERE s.payment_session_id = b.id AND s.payment_status = 'PENDING')
+		ORDER BY b.provider_session_opened_at
+		LIMIT ?
+	`, time.Now().Add(-time.Duration(cfg.After)), cfg.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []stalePaymentSession
+	for rows.Next() {
+		var session stalePaymentSession
+		if err := rows.Scan(&session.sessionID, &session.providerSessionID); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
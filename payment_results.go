@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Settling a payment session. Gateway webhooks and the reconciler both end up here, so a
+// payment moves its seats the same way whichever of them learns about it first. A COMPLETED
+// payment whose amount or currency doesn't match what the checkout was opened for doesn't
+// confirm the seats: they go to REVIEW, still held, for someone to look at.
+//
+// A result can only settle a PENDING session, as COMPLETED or FAILED. Once settled, the same
+// result again is ignored, and a different one is an illegal transition: nothing moves a
+// session out of COMPLETED or FAILED through a payment result. A COMPLETED result for a
+// booking whose hold was released before it was paid has no seats to confirm, and its payment
+// is queued for a refund instead.
+
+var (
+	ErrNoPendingSeats           = errors.New("no pending seats found")
+	ErrConcurrentPaymentUpdate  = errors.New("concurrent modification detected")
+	ErrUnknownPaymentStatus     = errors.New("unknown payment status")
+	ErrIllegalPaymentTransition = errors.New("illegal payment status transition")
+)
+
+// paymentTransitions are the statuses a payment result can move a session's seats to.
+var paymentTransitions = map[string][]string{
+	"PENDING": {"COMPLETED", "FAILED"},
+}
+
+// paymentEvents are the seat events recorded for each status a result moves seats to.
+var paymentEvents = map[string]string{
+	"COMPLETED": PaymentConfirmed,
+	"REVIEW":    PaymentFlagged,
+	"FAILED":    PaymentFailed,
+}
+
+// applyPaymentResult moves the session's PENDING seats to the result's status (COMPLETED or
+// FAILED, or REVIEW for a mismatched payment) and frees their locks. eventID dedupes repeated
+// deliveries of the same result. It reports "success", "review" when the payment was flagged,
+// "duplicate" when the event was already applied, "ignored" when the session was settled by
+// an earlier result, or "refunded" when the hold was gone and the payment is being refunded.
+func applyPaymentResult(ctx context.Context, sessionID string, result PaymentResult, eventID string) (string, error) {
+	status := result.Status
+	if !slices.Contains(paymentTransitions["PENDING"], status) {
+		return "", fmt.Errorf("%w: %q", ErrUnknownPaymentStatus, status)
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := tagSeatAudit(ctx, tx, seatAuditFromContext(ctx)); err != nil {
+		return "", err
+	}
+
+	duplicate, err := recordWebhookEvent(ctx, tx, sessionID, status, eventID)
+	if err != nil {
+		return "", fmt.Errorf("failed to record event: %w", err)
+	}
+	if duplicate {
+		return "duplicate", nil
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, show_id, user_id, version FROM seats
+		WHERE payment_session_id = ? AND payment_status = 'PENDING'
+	`, sessionID)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch pending seats: %w", err)
+	}
+	defer rows.Close()
+
+	seatVersions := make(map[int]int)
+	seatUser := make(map[int]int)
+	seatShow := make(map[int]int)
+	for rows.Next() {
+		var seatID, showID, userID, version int
+		if err := rows.Scan(&seatID, &showID, &userID, &version); err != nil {
+			return "", fmt.Errorf("failed to scan pending seat: %w", err)
+		}
+		seatVersions[seatID] = version
+		seatUser[seatID] = userID
+		seatShow[seatID] = showID
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("failed to fetch pending seats: %w", err)
+	}
+
+	if len(seatVersions) == 0 {
+		// A late or repeated result for a session that is already settled must not flip it.
+		applied, err := appliedPaymentStatuses(ctx, tx, sessionID, status, eventID)
+		if err != nil {
+			return "", err
+		}
+		if len(applied) == 0 {
+			if status != "COMPLETED" {
+				return "", ErrNoPendingSeats
+			}
+			// Paid after the hold was released: the money goes back.
+			refund, err := queueLatePaymentRefund(ctx, tx, sessionID, result)
+			if err != nil {
+				return "", err
+			}
+			if refund == nil {
+				return "", ErrNoPendingSeats
+			}
+			if err := tx.Commit(); err != nil {
+				return "", fmt.Errorf("failed to queue refund: %w", err)
+			}
+			slog.WarnContext(ctx, "Payment arrived after the hold was released, refunding", "component", "payment", "session_id", sessionID, "refund_id", refund.RefundID, "amount", fmt.Sprintf("%d %s", refund.AmountCents, refund.Currency))
+			return "refunded", nil
+		}
+		if !slices.Contains(applied, status) {
+			return "", fmt.Errorf("%w: session %s is already %s, not %s",
+				ErrIllegalPaymentTransition, sessionID, strings.Join(applied, "/"), status)
+		}
+		if err := tx.Commit(); err != nil {
+			return "", fmt.Errorf("failed to record stale event: %w", err)
+		}
+		return "ignored", nil
+	}
+
+	checkout, err := loadBookingCheckout(ctx, tx, sessionID)
+	if err != nil {
+		return "", err
+	}
+	outcome := "success"
+	// Holds opened before amounts were recorded have nothing to check against.
+	if status == "COMPLETED" && checkout.AmountCents.Valid && !paymentMatches(result, checkout.AmountCents.Int64, checkout.Currency.String) {
+		slog.WarnContext(ctx, "Paid amount doesn't match checkout, flagging for review", "component", "payment", "session_id", sessionID, "expected", fmt.Sprintf("%d %s", checkout.AmountCents.Int64, checkout.Currency.String), "paid", fmt.Sprintf("%s %s", formatPaidAmount(result.AmountCents), result.Currency))
+		status, outcome = "REVIEW", "review"
+	}
+
+	for seatID, version := range seatVersions {
+		res, err := tx.ExecContext(ctx, `
+			UPDATE seats
+			SET payment_status = ?,
+			    version = version + 1
+			WHERE id = ? AND version = ?
+		`, status, seatID, version)
+		if err != nil {
+			return "", fmt.Errorf("failed to update seat %d: %w", seatID, err)
+		}
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return "", fmt.Errorf("failed to update seat %d: %w", seatID, err)
+		}
+		if rowsAffected == 0 {
+			return "", ErrConcurrentPaymentUpdate
+		}
+	}
+
+	seatIDs := make([]int, 0, len(seatVersions))
+	for seatID := range seatVersions {
+		seatIDs = append(seatIDs, seatID)
+	}
+	if err := appendSeatEvents(ctx, tx, paymentEvents[status], seatIDs); err != nil {
+		return "", err
+	}
+
+	switch status {
+	case "COMPLETED":
+		err = transitionBooking(ctx, tx, sessionID, BookingConfirmed, "payment completed")
+	case "FAILED":
+		err = transitionBooking(ctx, tx, sessionID, BookingCancelled, "payment failed")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := applyUpgradePayment(ctx, tx, sessionID, status); err != nil {
+		return "", fmt.Errorf("failed to apply seat upgrade: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit: %w", err)
+	}
+
+	// Cleanup seat locks, even if the webhook's caller has gone away by now.
+	ctx = context.WithoutCancel(ctx)
+	seatIDs = make([]int, 0, len(seatUser))
+	lockKeys := make(map[string][]string)
+	for seatID, userID := range seatUser {
+		owner := seatLockOwner(int64(userID))
+		lockKeys[owner] = append(lockKeys[owner], seatLockKey(seatShow[seatID], seatID))
+		seatIDs = append(seatIDs, seatID)
+	}
+	releaseSeatLocks(ctx, "payment", lockKeys)
+	redlock.Unlock(ctx, redlockSeatKeys(seatIDs), sessionID)
+
+	return outcome, nil
+}
+
+// appliedPaymentStatuses returns the statuses of the results already applied to the session,
+// not counting the one being processed.
+func appliedPaymentStatuses(ctx context.Context, tx *sql.Tx, sessionID, status, eventID string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT DISTINCT status FROM payment_webhook_events
+		WHERE session_id = ? AND NOT (status = ? AND event_id = ?)
+	`, sessionID, status, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check session: %w", err)
+	}
+	defer rows.Close()
+
+	var statuses []string
+	for rows.Next() {
+		var applied string
+		if err := rows.Scan(&applied); err != nil {
+			return nil, fmt.Errorf("failed to check session: %w", err)
+		}
+		statuses = append(statuses, applied)
+	}
+	return statuses, rows.Err()
+}
+
+// paymentMatches reports whether the gateway took exactly the checkout's amount, in its
+// currency. A payment that doesn't say how much was paid doesn't match.
+func paymentMatches(result PaymentResult, amountCents int64, currency string) bool {
+	return result.AmountCents != nil && *result.AmountCents == amountCents && strings.EqualFold(result.Currency, currency)
+}
+
+func formatPaidAmount(amountCents *int64) string {
+	if amountCents == nil {
+		return "unknown"
+	}
+	return strconv.FormatInt(*amountCents, 10)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Checkout sessions. A strategy reserves the seats under the booking id with the mock
+// redirect URL; BookSeats then asks the configured PaymentProvider for a checkout priced from
+// the held seats and stores the gateway's session id and URL on the booking. The gateway is
+// called after the strategy's transaction so no row locks are held across the network, and
+// if it fails the hold is released and the booking fails with it.
+//
+// A checkout can outlive its hold, so whenever a hold is released its checkout is closed too:
+// before the release in releaseBookingHold, where the user gives the hold up or the show is
+// cancelled, and right after it where the reaper or an admin released the seats. A payment
+// that gets through anyway finds no seats and is refunded.
+
+var (
+	errCheckoutNotClosed  = errors.New("payment gateway refused to close the checkout")
+	errCheckoutSuperseded = errors.New("booking already has a checkout")
+)
+
+// openPaymentSession creates the checkout for sessionID and stores it on the booking, along
+// with the amount the webhook has to see paid. When another call stored a checkout for the
+// booking first (two checkout requests for one hold), the one just created is closed again and
+// the stored one is returned, so the booking never has two checkouts that can be paid.
+func openPaymentSession(ctx context.Context, sessionID string, amountCents int64, currency string, expiresAt time.Time, description string) (PaymentSession, error) {
+	session, err := paymentProvider.CreateSession(ctx, PaymentSessionRequest{
+		BookingID:   sessionID,
+		AmountCents: amountCents,
+		Currency:    currency,
+		ExpiresAt:   expiresAt,
+		Description: description,
+	})
+	if err != nil {
+		return session, err
+	}
+
+	var existing bookingCheckout
+	err = runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		if _, err := lockBookingState(ctx, tx, sessionID); err != nil {
+			return err
+		}
+		existing, err = loadBookingCheckout(ctx, tx, sessionID)
+		if err != nil {
+			return err
+		}
+		if existing.ProviderSessionID.Valid && existing.ProviderSessionID.String != session.ID {
+			// Another call opened a checkout for the booking meanwhile; that one stands.
+			return errCheckoutSuperseded
+		}
+		if err := setBookingCheckout(ctx, tx, sessionID, session, amountCents, currency); err != nil {
+			return err
+		}
+		if err := appendBookingEvents(ctx, tx, PaymentStarted, sessionID); err != nil {
+			return err
+		}
+		return transitionBooking(ctx, tx, sessionID, BookingPendingPayment, "checkout opened")
+	})
+	if errors.Is(err, errCheckoutSuperseded) {
+		if err := paymentProvider.CancelSession(ctx, session.ID); err != nil {
+			// Left open it could be paid on top of the other one.
+			slog.ErrorContext(ctx, "Failed to close superseded checkout", "component", "payment", "session_id", sessionID, "provider", paymentProvider.Name(), "provider_session_id", session.ID, "error", err)
+			reportError(ctx, "payment", err, "session_id", sessionID, "provider_session_id", session.ID)
+		}
+		slog.InfoContext(ctx, "Checkout already opened, answering that one", "component", "payment", "session_id", sessionID, "provider_session_id", existing.ProviderSessionID.String)
+		return PaymentSession{ID: existing.ProviderSessionID.String, RedirectURL: existing.RedirectURL.String}, nil
+	}
+	if err != nil {
+		return session, fmt.Errorf("failed to store payment session: %w", err)
+	}
+	slog.InfoContext(ctx, "Opened checkout", "component", "payment", "session_id", sessionID, "provider", paymentProvider.Name(), "provider_session_id", session.ID, "amount", fmt.Sprintf("%d %s", amountCents, currency))
+	return session, nil
+}
+
+// attachPaymentSession prices a booking the strategy just reserved and opens its checkout,
+// open until the hold ends.
+func attachPaymentSession(ctx context.Context, bookingID string) (PaymentSession, error) {
+	var seats int
+	var amount int64
+	var currency string
+	var holdUntil time.Time
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(COALESCE(s.price_cents, sh.price_cents)), 0), MIN(sh.currency), MIN(s.payment_timeout)
+		FROM seats s JOIN shows sh ON sh.id = s.show_id
+		WHERE s.payment_session_id = ? AND s.payment_status = 'PENDING'
+		GROUP BY s.payment_session_id
+	`, bookingID).Scan(&seats, &amount, &currency, &holdUntil)
+	if err != nil {
+		return PaymentSession{}, fmt.Errorf("failed to price booking %s: %w", bookingID, err)
+	}
+
+	return openPaymentSession(ctx, bookingID, amount, currency, holdUntil,
+		fmt.Sprintf("%d seat(s), booking %s", seats, bookingID))
+}
+
+// closeBookingCheckout closes the checkout of the user's open booking at the gateway before
+// its hold is released, so it can't be paid for seats that are back on sale. A booking
+// without a checkout, or no longer open, has nothing to close.
+func closeBookingCheckout(ctx context.Context, bookingID string, userID int) error {
+	var providerSessionID sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT provider_session_id FROM bookings
+		WHERE id = ? AND user_id = ? AND state IN ('HELD', 'PENDING_PAYMENT')
+	`, bookingID, userID).Scan(&providerSessionID)
+	if err == sql.ErrNoRows || err == nil && !providerSessionID.Valid {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load checkout: %w", err)
+	}
+	if err := paymentProvider.CancelSession(ctx, providerSessionID.String); err != nil {
+		return fmt.Errorf("%w: %v", errCheckoutNotClosed, err)
+	}
+	return nil
+}
+
+// closeReleasedCheckouts closes the checkouts of bookings whose holds were already released,
+// by the reaper or an admin. One the gateway won't close is only logged: a payment that still
+// lands on it finds no seats and is refunded (applyPaymentResult).
+func closeReleasedCheckouts(ctx context.Context, component string, bookingIDs []string) {
+	if len(bookingIDs) == 0 {
+		return
+	}
+	args := make([]interface{}, len(bookingIDs))
+	for i, id := range bookingIDs {
+		args[i] = id
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT id, provider_session_id FROM bookings
+		WHERE id IN (%s) AND provider_session_id IS NOT NULL
+	`, generatePlaceholders(len(bookingIDs))), args...)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load checkouts to close", "component", component, "error", err)
+		return
+	}
+	checkouts := make(map[string]string)
+	for rows.Next() {
+		var bookingID, providerSessionID string
+		if err := rows.Scan(&bookingID, &providerSessionID); err != nil {
+			slog.ErrorContext(ctx, "Failed to scan checkout", "component", component, "error", err)
+			continue
+		}
+		checkouts[bookingID] = providerSessionID
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(ctx, "Failed to load checkouts to close", "component", component, "error", err)
+	}
+
+	for bookingID, providerSessionID := range checkouts {
+		if err := paymentProvider.CancelSession(ctx, providerSessionID); err != nil {
+			slog.WarnContext(ctx, "Gateway refused to close checkout of released hold", "component", component, "booking_id", bookingID, "provider", paymentProvider.Name(), "provider_session_id", providerSessionID, "error", err)
+		}
+	}
+}
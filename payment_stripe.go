@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stripe adapter on Checkout Sessions, authenticated with STRIPE_SECRET_KEY. Stripe won't
+// expire a session sooner than 30 minutes after creating it, so a checkout can outlive the
+// seat hold; a payment that arrives after the hold was reaped finds no PENDING seats.
+
+const (
+	stripeAPIBase          = "https://api.stripe.com/v1"
+	stripeMinSessionExpiry = 30 * time.Minute
+)
+
+type stripePaymentProvider struct {
+	secretKey string
+}
+
+type stripeCheckoutSession struct {
+	ID            string `json:"id"`
+	URL           string `json:"url"`
+	Status        string `json:"status"`         // open, complete, expired
+	PaymentStatus string `json:"payment_status"` // paid, unpaid, no_payment_required
+	PaymentIntent string `json:"payment_intent"`
+	AmountTotal   int64  `json:"amount_total"`
+	Currency      string `json:"currency"`
+}
+
+func newStripePaymentProvider() (*stripePaymentProvider, error) {
+	key := os.Getenv("STRIPE_SECRET_KEY")
+	if key == "" {
+		return nil, errors.New("STRIPE_SECRET_KEY is required for the stripe payment provider")
+	}
+	return &stripePaymentProvider{secretKey: key}, nil
+}
+
+func (p *stripePaymentProvider) Name() string { return "stripe" }
+
+func (p *stripePaymentProvider) do(ctx context.Context, method, path string, form url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, stripeAPIBase+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.secretKey)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return doPaymentRequest(req, out)
+}
+
+func (p *stripePaymentProvider) CreateSession(ctx context.Context, req PaymentSessionRequest) (PaymentSession, error) {
+	success, cancel := paymentReturnURLs()
+	expiresAt := req.ExpiresAt
+	if earliest := time.Now().Add(stripeMinSessionExpiry); expiresAt.Before(earliest) {
+		expiresAt = earliest
+	}
+
+	form := url.Values{}
+	form.Set("mode", "payment")
+	form.Set("success_url", success)
+	form.Set("cancel_url", cancel)
+	form.Set("client_reference_id", req.BookingID)
+	form.Set("expires_at", strconv.FormatInt(expiresAt.Unix(), 10))
+	form.Set("metadata[booking_id]", req.BookingID)
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		form.Set("metadata[request_id]", requestID)
+	}
+	form.Set("line_items[0][quantity]", "1")
+	form.Set("line_items[0][price_data][currency]", strings.ToLower(req.Currency))
+	form.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(req.AmountCents, 10))
+	form.Set("line_items[0][price_data][product_data][name]", req.Description)
+
+	var session stripeCheckoutSession
+	if err := p.do(ctx, http.MethodPost, "/checkout/sessions", form, &session); err != nil {
+		return PaymentSession{}, fmt.Errorf("failed to create stripe checkout session: %w", err)
+	}
+	return PaymentSession{ID: session.ID, RedirectURL: session.URL}, nil
+}
+
+func (p *stripePaymentProvider) session(ctx context.Context, sessionID string) (stripeCheckoutSession, error) {
+	var session stripeCheckoutSession
+	if err := p.do(ctx, http.MethodGet, "/checkout/sessions/"+url.PathEscape(sessionID), nil, &session); err != nil {
+		return session, fmt.Errorf("failed to read stripe checkout session %s: %w", sessionID, err)
+	}
+	return session, nil
+}
+
+func (p *stripePaymentProvider) GetStatus(ctx context.Context, sessionID string) (PaymentResult, error) {
+	session, err := p.session(ctx, sessionID)
+	if err != nil {
+		return PaymentResult{}, err
+	}
+	switch {
+	case session.PaymentStatus == "paid":
+		return PaymentResult{Status: "COMPLETED", AmountCents: &session.AmountTotal, Currency: strings.ToUpper(session.Currency)}, nil
+	case session.Status == "expired":
+		return PaymentResult{Status: "FAILED"}, nil
+	default:
+		return PaymentResult{Status: "PENDING"}, nil
+	}
+}
+
+func (p *stripePaymentProvider) Refund(ctx context.Context, sessionID string, amountCents int64) (string, error) {
+	session, err := p.session(ctx, sessionID)
+	if err != nil {
+		return "", err
+	}
+	if session.PaymentIntent == "" {
+		return "", fmt.Errorf("stripe checkout session %s has no payment to refund", sessionID)
+	}
+
+	form := url.Values{}
+	form.Set("payment_intent", session.PaymentIntent)
+	form.Set("amount", strconv.FormatInt(amountCents, 10))
+	form.Set("metadata[session_id]", sessionID)
+
+	var refund struct {
+		ID string `json:"id"`
+	}
+	if err := p.do(ctx, http.MethodPost, "/refunds", form, &refund); err != nil {
+		return "", fmt.Errorf("failed to refund stripe session %s: %w", sessionID, err)
+	}
+	return refund.ID, nil
+}
+
+func (p *stripePaymentProvider) CancelSession(ctx context.Context, sessionID string) error {
+	var session stripeCheckoutSession
+	if err := p.do(ctx, http.MethodPost, "/checkout/sessions/"+url.PathEscape(sessionID)+"/expire", url.Values{}, &session); err != nil {
+		return fmt.Errorf("failed to expire stripe checkout session %s: %w", sessionID, err)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Presales. A show with a presale_start (shows.go) takes bookings from then until its
+// sale_start only with a presale code in the request's presale_code. Admins generate codes in
+// batches with POST /admin/shows/{id}/presale-codes, each good for max_uses bookings (1 by
+// default). /api/book uses a code up after the waiting room and before the booking is made or
+// queued, and gives it back when a booking it made straight away fails; a queued booking that
+// fails later keeps it used.
+
+const (
+	maxPresaleCodesPerBatch = 10000
+	maxPresalePrefix        = 10
+	presaleCodeLength       = 10
+	// presaleCodeAlphabet leaves out 0/O and 1/I, which are easy to mistype.
+	presaleCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+var (
+	ErrPresaleCodeRequired = errors.New("presale code required")
+	ErrInvalidPresaleCode  = errors.New("presale code is invalid or used up")
+)
+
+// usePresaleCode takes one use of code for the show.
+func usePresaleCode(ctx context.Context, showID int, code string) error {
+	if code == "" {
+		return ErrPresaleCodeRequired
+	}
+	result, err := db.ExecContext(ctx, `
+		UPDATE presale_codes SET uses = uses + 1 WHERE code = ? AND show_id = ? AND uses < max_uses
+	`, strings.ToUpper(code), showID)
+	if err != nil {
+		return fmt.Errorf("failed to use presale code: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrInvalidPresaleCode
+	}
+	return nil
+}
+
+// returnPresaleCode gives back a use of code taken by a booking that failed.
+func returnPresaleCode(ctx context.Context, code string) {
+	_, err := db.ExecContext(ctx, `UPDATE presale_codes SET uses = uses - 1 WHERE code = ? AND uses > 0`, strings.ToUpper(code))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to return presale code", "component", "presale", "error", err)
+	}
+}
+
+func writePresaleError(w http.ResponseWriter, r *http.Request, err error) {
+	status := "PRESALE_CODE_REQUIRED"
+	if errors.Is(err, ErrInvalidPresaleCode) {
+		status = "INVALID_PRESALE_CODE"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(SaleWindowResponse{
+		Status:     status,
+		Error:      err.Error(),
+		ServerTime: time.Now().UTC(),
+		RequestID:  requestIDFromContext(r.Context()),
+	})
+}
+
+func newPresaleCode(prefix string) (string, error) {
+	raw := make([]byte, presaleCodeLength)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	code := make([]byte, presaleCodeLength)
+	for i, b := range raw {
+		// 256 is a multiple of the alphabet's 32 letters, so every letter is as likely.
+		code[i] = presaleCodeAlphabet[int(b)%len(presaleCodeAlphabet)]
+	}
+	return prefix + string(code), nil
+}
+
+type PresaleCodeBatchRequest struct {
+	Count   int    `json:"count"`
+	MaxUses int    `json:"max_uses"`
+	Prefix  string `json:"prefix"`
+}
+
+type PresaleCodeBatch struct {
+	BatchID string   `json:"batch_id"`
+	ShowID  int      `json:"show_id"`
+	MaxUses int      `json:"max_uses"`
+	Count   int      `json:"count"`
+	Uses    int      `json:"uses"`
+	Codes   []string `json:"codes,omitempty"`
+}
+
+// handleCreatePresaleCodes serves POST /admin/shows/{id}/presale-codes.
+func handleCreatePresaleCodes(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+	req := PresaleCodeBatchRequest{MaxUses: 1}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Prefix = strings.ToUpper(req.Prefix)
+	switch {
+	case req.Count <= 0 || req.Count > maxPresaleCodesPerBatch:
+		http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxPresaleCodesPerBatch), http.StatusBadRequest)
+		return
+	case req.MaxUses <= 0:
+		http.Error(w, "max_uses must be > 0", http.StatusBadRequest)
+		return
+	case len(req.Prefix) > maxPresalePrefix:
+		http.Error(w, fmt.Sprintf("prefix is up to %d characters", maxPresalePrefix), http.StatusBadRequest)
+		return
+	}
+
+	batchID, err := newWaitingRoomToken("presale_")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to generate presale batch", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	batch := PresaleCodeBatch{BatchID: batchID, ShowID: showID, MaxUses: req.MaxUses, Count: req.Count, Codes: make([]string, 0, req.Count)}
+	for len(batch.Codes) < req.Count {
+		code, err := newPresaleCode(req.Prefix)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to generate presale code", "component", "admin", "show_id", showID, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		batch.Codes = append(batch.Codes, code)
+	}
+
+	err = seedInTx(r.Context(), db, func(tx *sql.Tx) error {
+		var id int
+		if err := tx.QueryRowContext(r.Context(), `SELECT id FROM shows WHERE id = ?`, showID).Scan(&id); err != nil {
+			return err
+		}
+		for from := 0; from < len(batch.Codes); from += seedBatchSize {
+			to := min(from+seedBatchSize, len(batch.Codes))
+			values := make([]interface{}, 0, 4*(to-from))
+			placeholders := make([]string, 0, to-from)
+			for _, code := range batch.Codes[from:to] {
+				placeholders = append(placeholders, "(?, ?, ?, ?)")
+				values = append(values, code, showID, batchID, req.MaxUses)
+			}
+			_, err := tx.ExecContext(r.Context(), `INSERT INTO presale_codes (code, show_id, batch_id, max_uses) VALUES `+strings.Join(placeholders, ", "), values...)
+			if err != nil {
+				return fmt.Errorf("failed to insert presale codes: %w", err)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create presale codes", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Created presale codes", "component", "admin", "show_id", showID, "batch_id", batchID, "count", req.Count, "max_uses", req.MaxUses)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(batch)
+}
+
+// handlePresaleCodeBatches serves GET /admin/shows/{id}/presale-codes: the show's batches
+// with how much they were used, without the codes.
+func handlePresaleCodeBatches(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT batch_id, MAX(max_uses), COUNT(*), SUM(uses) FROM presale_codes
+		WHERE show_id = ?
+		GROUP BY batch_id
+		ORDER BY MIN(created_at), batch_id
+	`, showID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list presale codes", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	batches := []PresaleCodeBatch{}
+	for rows.Next() {
+		batch := PresaleCodeBatch{ShowID: showID}
+		if err := rows.Scan(&batch.BatchID, &batch.MaxUses, &batch.Count, &batch.Uses); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to scan presale batch", "component", "admin", "show_id", showID, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		batches = append(batches, batch)
+	}
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list presale codes", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":   len(batches),
+		"batches": batches,
+	})
+}
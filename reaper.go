@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// The reaper returns seats whose payment window lapsed to inventory. Each pass works through
+// expired holds oldest first in batches of reaper.batch_size, one short transaction and one
+// UPDATE per batch, pausing reaper.batch_pause between batches so bookings get at the rows and
+// connections in between. Every batch commits on its own, so a pass cut short (leadership
+// moved, an error, a restart) loses nothing and the next one picks up at the oldest hold left.
+// After reaper.max_batches_per_pass a pass ends; with a backlog left the lane starts the next
+// one straight away instead of waiting for its interval, so a flash sale's worth of expired
+// holds drains at a steady pace without one long transaction. High-value shows get their own,
+// more frequent lane.
+const (
+	reaperInterval         = 1 * time.Minute
+	reaperFastLaneInterval = 10 * time.Second
+)
+
+// ReaperConfig paces the reaper, see reaper.go.
+type ReaperConfig struct {
+	BatchSize         int      `json:"batch_size"`           // REAPER_BATCH_SIZE, holds released per transaction
+	BatchPause        Duration `json:"batch_pause"`          // REAPER_BATCH_PAUSE
+	MaxBatchesPerPass int      `json:"max_batches_per_pass"` // REAPER_MAX_BATCHES_PER_PASS
+}
+
+func checkPaymentTimeouts() error {
+	return runReaperLane("normal", false, reaperInterval)
+}
+
+func checkHighValuePaymentTimeouts() error {
+	return runReaperLane("fast", true, reaperFastLaneInterval)
+}
+
+func runReaperLane(lane string, highValueOnly bool, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for reapExpiredHolds(lane, highValueOnly) {
+			time.Sleep(time.Duration(strategyConfig.Reaper.BatchPause))
+		}
+	}
+
+	return fmt.Errorf("ending %s reaper lane", lane)
+}
+
+// reapExpiredHolds runs one pass and reports whether it stopped with a backlog left.
+func reapExpiredHolds(lane string, highValueOnly bool) (backlog bool) {
+	// A panicking pass is reported and the next one tries again, the lane keeps running.
+	defer func() { reportPanic(ctx, "reaper", recover()) }()
+
+	cfg := strategyConfig.Reaper
+	start := time.Now()
+	total := 0
+
+	for batch := 0; batch < cfg.MaxBatchesPerPass; batch++ {
+		// The standby's replica is read-only; holds are reaped by the primary region's leader.
+		// Checked per batch so a pass stops soon after leadership moves.
+		if !runsMaintenance() {
+			return false
+		}
+		if batch > 0 {
+			time.Sleep(time.Duration(cfg.BatchPause))
+		}
+
+		released, err := reapExpiredBatch(highValueOnly)
+		total += released
+		if err != nil {
+			slog.Error("Batch failed", "component", "reaper", "lane", lane, "batch", batch, "error", err)
+			reportError(ctx, "reaper", err, "lane", lane)
+			return false
+		}
+		if released < cfg.BatchSize {
+			if total > 0 {
+				slog.Info("Pass complete", "component", "reaper", "lane", lane, "released", total, "took", time.Since(start))
+			}
+			return false
+		}
+		slog.Info("Batch released, continuing", "component", "reaper", "lane", lane, "batch", batch, "released", released, "pass_released", total, "took", time.Since(start))
+	}
+
+	slog.Info("Pass limit reached, starting the next pass", "component", "reaper", "lane", lane, "released", total, "took", time.Since(start))
+	return true
+}
+
+// reapExpiredBatch releases up to strategyConfig.Reaper.BatchSize of the oldest expired holds.
+// Rows locked by the webhook or the other lane are skipped rather than waited on.
+func reapExpiredBatch(highValueOnly bool) (int, error) {
+	showFilter := ""
+	if highValueOnly {
+		showFilter = "JOIN shows sh ON sh.id = s.show_id AND sh.is_high_value"
+	}
+	return reapExpired(SeatAuditReaper, showFilter, "", nil)
+}
+
+// reapExpiredSeats releases the holds on seatIDs that have expired, the others are left alone.
+func reapExpiredSeats(seatIDs []int) (int, error) {
+	return reapExpired(SeatAuditLockExpiry, "", fmt.Sprintf("AND s.id IN (%s)", generatePlaceholders(len(seatIDs))), sliceToInterface(seatIDs))
+}
+
+// reapExpired releases up to strategyConfig.Reaper.BatchSize expired holds among the seats
+// joined by showFilter and matching seatFilter with its args, recorded in the seat audit as
+// source, and closes the expired bookings' checkouts.
+func reapExpired(source, showFilter, seatFilter string, args []interface{}) (int, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := tagSeatAudit(ctx, tx, SeatAudit{Source: source}); err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+		SELECT s.id, s.show_id, s.user_id, s.payment_session_id
+		FROM seats s %s
+		WHERE s.payment_status = 'PENDING'
+		AND s.payment_timeout < NOW()
+		%s
+		ORDER BY s.payment_timeout, s.id
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED
+	`, showFilter, seatFilter), append(args, strategyConfig.Reaper.BatchSize)...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query expired payments: %w", err)
+	}
+
+	type expiredSeat struct {
+		id        int
+		showID    int
+		userID    sql.NullInt64
+		bookingID sql.NullString
+	}
+	var expiredSeats []expiredSeat
+	for rows.Next() {
+		var seat expiredSeat
+		if err := rows.Scan(&seat.id, &seat.showID, &seat.userID, &seat.bookingID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan seat: %w", err)
+		}
+		expiredSeats = append(expiredSeats, seat)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating expired seats: %w", err)
+	}
+
+	if len(expiredSeats) == 0 {
+		return 0, nil
+	}
+
+	// Each booking expires under a savepoint: one that can't is reported and keeps its seats
+	// for someone to look at, instead of failing the whole batch on every pass or leaving the
+	// booking open without seats.
+	expiredBookings := make(map[string]bool)
+	stuck := make(map[string]bool)
+	for _, seat := range expiredSeats {
+		if !seat.bookingID.Valid || expiredBookings[seat.bookingID.String] || stuck[seat.bookingID.String] {
+			continue
+		}
+		bookingID := seat.bookingID.String
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT expire_booking"); err != nil {
+			return 0, fmt.Errorf("failed to set savepoint: %w", err)
+		}
+		if err := transitionBooking(ctx, tx, bookingID, BookingExpired, "hold expired"); err != nil {
+			slog.Error("Failed to expire booking, keeping its seats", "component", "reaper", "booking_id", bookingID, "error", err)
+			reportError(ctx, "reaper", err, "booking_id", bookingID)
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT expire_booking"); err != nil {
+				return 0, fmt.Errorf("failed to roll back to savepoint: %w", err)
+			}
+			stuck[bookingID] = true
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT expire_booking"); err != nil {
+			return 0, fmt.Errorf("failed to release savepoint: %w", err)
+		}
+		expiredBookings[bookingID] = true
+	}
+	if len(stuck) > 0 {
+		kept := expiredSeats[:0]
+		for _, seat := range expiredSeats {
+			if !stuck[seat.bookingID.String] {
+				kept = append(kept, seat)
+			}
+		}
+		expiredSeats = kept
+		if len(expiredSeats) == 0 {
+			return 0, nil
+		}
+	}
+
+	// One statement for the batch: the rows are already locked by the SELECT, and the ids it
+	// returned are what the lock cleanup below works from.
+	seatIDs := make([]int, len(expiredSeats))
+	for i, seat := range expiredSeats {
+		seatIDs[i] = seat.id
+	}
+	if err := releaseSeatRows(ctx, tx, seatIDs, HoldExpired); err != nil {
+		return 0, fmt.Errorf("failed to release expired seats: %w", err)
+	}
+	released := len(seatIDs)
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// Drop the "current" strategy's locks, but only those still belonging to the expired holder.
+	lockKeys := make(map[string][]string)
+	for _, seat := range expiredSeats {
+		if !seat.userID.Valid {
+			continue
+		}
+		owner := seatLockOwner(seat.userID.Int64)
+		lockKeys[owner] = append(lockKeys[owner], seatLockKey(seat.showID, seat.id))
+	}
+	releaseSeatLocks(ctx, "reaper", lockKeys)
+
+	bookingIDs := make([]string, 0, len(expiredBookings))
+	for bookingID := range expiredBookings {
+		bookingIDs = append(bookingIDs, bookingID)
+	}
+	closeReleasedCheckouts(ctx, "reaper", bookingIDs)
+
+	return released, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// newRedisClient connects to the Redis the locks, semaphores and waiting room live in: the
+// node at server.redis_addr, the master behind Sentinel, or a Redis Cluster.
+//
+// With server.redis_sentinel_master set the client asks the sentinels for the current master
+// and follows a failover to the promoted replica without a restart. Replication is
+// asynchronous, so a lock written just before the master died can be missing on the new one;
+// the fencing tokens (fencing.go) still keep a booking that lost its lock that way from
+// overwriting the seats another one took.
+//
+// With server.redis_cluster_addrs set it is a cluster client. Seat locks are then hash tagged
+// by show, seat_lock:{<show>}:<seat> (see lock_striping.go), so the multi-key lock scripts
+// only ever touch one slot. The waiting room's transactions become one per slot, no longer
+// atomic across a show's queue and its tokens.
+func newRedisClient() redis.UniversalClient {
+	cfg := strategyConfig.Server
+	switch {
+	case len(cfg.RedisClusterAddrs) > 0:
+		return redis.NewClusterClient(&redis.ClusterOptions{Addrs: cfg.RedisClusterAddrs})
+	case cfg.RedisSentinelMaster != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.RedisSentinelMaster,
+			SentinelAddrs:    cfg.RedisSentinelAddrs,
+			SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+		})
+	default:
+		return redis.NewClient(&redis.Options{Addr: cfg.RedisAddr})
+	}
+}
+
+// redisCluster reports whether Redis is a cluster, where keys used together must share a slot.
+func redisCluster() bool {
+	return len(strategyConfig.Server.RedisClusterAddrs) > 0
+}
+
+// forEachRedisNode calls fn with every node holding client's keys: the client itself, or each
+// master of a cluster. Key scans need it, SCAN only walks the node it is sent to.
+func forEachRedisNode(ctx context.Context, client redis.UniversalClient, fn func(node redis.UniversalClient) error) error {
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return fn(node)
+		})
+	}
+	return fn(client)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// acquireSeatsScript sets every key to ARGV[1] with a PX of ARGV[2], or none of them
+// if any key is already held.
+var acquireSeatsScript = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+	if redis.call("EXISTS", key) == 1 then
+		return 0
+	end
+end
+for _, key in ipairs(KEYS) do
+	redis.call("SET", key, ARGV[1], "PX", ARGV[2])
+end
+return 1
+`)
+
+// releaseSeatsScript deletes only the keys that still hold ARGV[1].
+var releaseSeatsScript = redis.NewScript(`
+local released = 0
+for _, key in ipairs(KEYS) do
+	if redis.call("GET", key) == ARGV[1] then
+		redis.call("DEL", key)
+		released = released + 1
+	end
+end
+return released
+`)
+
+// Redlock implements the Redlock algorithm over a set of independent Redis nodes.
+// A lock is held once a majority of nodes accepted it within its validity time.
+type Redlock struct {
+	clients     []redis.UniversalClient
+	ttl         time.Duration
+	nodeTimeout time.Duration
+	driftFactor float64
+	retryCount  int
+	retryDelay  time.Duration
+}
+
+func NewRedlock(clients []redis.UniversalClient, cfg RedlockConfig) *Redlock {
+	return &Redlock{
+		clients:     clients,
+		ttl:         time.Duration(cfg.TTL),
+		nodeTimeout: time.Duration(cfg.NodeTimeout),
+		driftFactor: cfg.DriftFactor,
+		retryCount:  cfg.RetryCount,
+		retryDelay:  time.Duration(cfg.RetryDelay),
+	}
+}
+
+// redlockClientsFromEnv builds one client per address in REDLOCK_ADDRS (comma separated),
+// falling back to the main Redis client, Sentinel-backed or not. A cluster is no fallback:
+// Redlock wants independent nodes, and a booking's keys would span slots.
+func redlockClientsFromEnv(fallback redis.UniversalClient) []redis.UniversalClient {
+	addrs := os.Getenv("REDLOCK_ADDRS")
+	if addrs == "" {
+		if redisCluster() {
+			return nil
+		}
+		return []redis.UniversalClient{fallback}
+	}
+
+	var clients []redis.UniversalClient
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		clients = append(clients, redis.NewClient(&redis.Options{Addr: addr}))
+	}
+	return clients
+}
+
+func redlockSeatKeys(seatIDs []int) []string {
+	keys := make([]string, len(seatIDs))
+	for i, seatID := range seatIDs {
+		keys[i] = fmt.Sprintf("redlock:seat:%d", seatID)
+	}
+	return keys
+}
+
+// Lock acquires keys on a quorum of nodes and returns the remaining validity of the lock.
+func (r *Redlock) Lock(ctx context.Context, keys []string, value string) (time.Duration, error) {
+	quorum := len(r.clients)/2 + 1
+
+	for attempt := 0; attempt < r.retryCount; attempt++ {
+		start := time.Now()
+		acquired := 0
+		for i, client := range r.clients {
+			nodeCtx, cancel := context.WithTimeout(ctx, r.nodeTimeout)
+			ok, err := acquireSeatsScript.Run(nodeCtx, client, keys, value, r.ttl.Milliseconds()).Int()
+			cancel()
+			if err != nil {
+				slog.WarnContext(ctx, "Node unavailable", "component", "redlock", "node", i, "keys", keys, "error", err)
+				continue
+			}
+			if ok == 1 {
+				acquired++
+			}
+		}
+
+		drift := time.Duration(float64(r.ttl)*r.driftFactor) + 2*time.Millisecond
+		validity := r.ttl - time.Since(start) - drift
+		if acquired >= quorum && validity > 0 {
+			slog.InfoContext(ctx, "Acquired lock", "component", "redlock", "keys", keys, "nodes", fmt.Sprintf("%d/%d", acquired, len(r.clients)), "validity", validity)
+			return validity, nil
+		}
+
+		slog.WarnContext(ctx, "Quorum not reached", "component", "redlock", "keys", keys, "nodes", fmt.Sprintf("%d/%d", acquired, len(r.clients)), "attempt", attempt+1)
+		r.Unlock(ctx, keys, value)
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(r.retryDelay/2 + time.Duration(rand.Int63n(int64(r.retryDelay)))):
+		}
+	}
+
+	return 0, fmt.Errorf("failed to acquire redlock on a quorum of %d/%d nodes for keys %v", quorum, len(r.clients), keys)
+}
+
+// Unlock releases keys on every node, including nodes where acquisition may have partially succeeded.
+// It runs even when ctx is already done, so a cancelled booking still gives its locks back.
+func (r *Redlock) Unlock(ctx context.Context, keys []string, value string) {
+	ctx = context.WithoutCancel(ctx)
+	for i, client := range r.clients {
+		nodeCtx, cancel := context.WithTimeout(ctx, r.nodeTimeout)
+		if err := releaseSeatsScript.Run(nodeCtx, client, keys, value).Err(); err != nil {
+			slog.WarnContext(ctx, "Failed to release on node", "component", "redlock", "node", i, "keys", keys, "error", err)
+		}
+		cancel()
+	}
+}
+
+// Release is Unlock for callers that release through lockReleaser.
+func (r *Redlock) Release(ctx context.Context, keys []string, value string) error {
+	r.Unlock(ctx, keys, value)
+	return nil
+}
+
+// Extend pushes out the TTL of keys on every node still holding them for value. The lock
+// survives as long as a quorum was extended.
+func (r *Redlock) Extend(ctx context.Context, keys []string, value string, ttl time.Duration) error {
+	extended := 0
+	for i, client := range r.clients {
+		nodeCtx, cancel := context.WithTimeout(ctx, r.nodeTimeout)
+		if err := extendLocks(nodeCtx, client, keys, value, ttl); err != nil {
+			slog.WarnContext(ctx, "Failed to extend on node", "component", "redlock", "node", i, "keys", keys, "error", err)
+		} else {
+			extended++
+		}
+		cancel()
+	}
+	if quorum := len(r.clients)/2 + 1; extended < quorum {
+		return fmt.Errorf("extended redlock on %d/%d nodes, below quorum of %d", extended, len(r.clients), quorum)
+	}
+	return nil
+}
+
+// RedlockBooking: Same flow as the timeout implementation, but the seat locks are held on a
+// quorum of independent Redis nodes so a single node failure doesn't drop them.
+func RedlockBooking(ctx context.Context, db *sql.DB, rl *Redlock, userID int, seatIDs []int, bookingId string) (err error) {
+	slog.InfoContext(ctx, "Starting redlock booking", "component", "booking", "user_id", userID, "seat_ids", seatIDs)
+
+	if len(seatIDs) == 0 {
+		slog.InfoContext(ctx, "No seat IDs provided", "component", "booking", "user_id", userID)
+		return fmt.Errorf("no seat IDs provided")
+	}
+
+	if len(rl.clients) == 0 {
+		return fmt.Errorf("redlock has no nodes: set REDLOCK_ADDRS when Redis is a cluster")
+	}
+
+	keys := redlockSeatKeys(seatIDs)
+	setBookingPhase(ctx, "redlock")
+	validity, err := rl.Lock(ctx, keys, bookingId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to acquire redlock", "component", "booking", "user_id", userID, "error", err)
+		return err
+	}
+	watchLocks(ctx, rl, keys, bookingId, rl.ttl)
+	// The lock doubles as the payment hold, so it is only released here if booking fails.
+	defer func() {
+		if err != nil {
+			rl.Unlock(ctx, keys, bookingId)
+		}
+	}()
+
+	token, err := nextFencingToken(ctx, rdb)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get fencing token", "component", "booking", "user_id", userID, "error", err)
+		return err
+	}
+
+	txCtx, cancel := context.WithTimeout(ctx, validity)
+	defer cancel()
+
+	sessionID := bookingId
+	redirectURL := mockPaymentRedirectURL(sessionID)
+
+	err = runInTx(txCtx, db, &sql.TxOptions{Isolation: sql.LevelSerializable}, func(tx *sql.Tx) error {
+		setBookingPhase(ctx, "locking_rows")
+		seats, err := readSeatAvailability(txCtx, tx, seatIDs, seatLockForUpdate)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to check seat availability", "component", "booking", "user_id", userID, "error", err)
+			return fmt.Errorf("failed to check seat availability in DB: %w", err)
+		}
+
+		if unavailable := unavailableSeats(seatIDs, seats); len(unavailable) > 0 {
+			slog.WarnContext(ctx, "Not all seats available", "component", "booking", "user_id", userID, "requested", len(seatIDs), "unavailable", unavailable)
+			return fmt.Errorf("not all seats are available in DB despite acquiring lock (%d/%d available)", len(seatIDs)-len(unavailable), len(seatIDs))
+		}
+
+		slog.DebugContext(ctx, "Generated payment session", "component", "booking", "user_id", userID, "session_id", sessionID)
+
+		setBookingPhase(ctx, "updating")
+		if err := markSeatsReservedFenced(txCtx, tx, userID, seatIDs, sessionID, redirectURL, token); err != nil {
+			slog.ErrorContext(ctx, "Failed to mark seats as reserved", "component", "booking", "user_id", userID, "error", err)
+			return fmt.Errorf("failed to mark seats as reserved in DB: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Successfully completed redlock booking", "component", "booking", "user_id", userID, "session_id", sessionID)
+	return nil
+}
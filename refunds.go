@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Refunds. A user can ask for the money back on a paid booking: its seats move to
+// REFUND_PENDING, which keeps them off sale, and the refund is requested from the gateway the
+// booking was paid through. The gateway reports the outcome on /webhook/refund, keyed by its
+// refund id: REFUNDED releases the seats back to inventory, FAILED puts them back to
+// COMPLETED. A refund can cover some of the booking's seats only: those are refunded at their
+// own price and released, and the rest stay confirmed under the same booking. A refund row
+// records every request; once all the seats are released the booking becomes REFUNDED. A
+// payment that lands after its hold was released is refunded the same way, queued with no
+// seats, and leaves the booking as it was.
+
+var (
+	errRefundGatewayFailed = errors.New("payment gateway refused the refund")
+	errRefundNotFound      = errors.New("no pending refund found")
+	errRefundInvalidSeats  = errors.New("seats to refund must be paid seats of the booking")
+)
+
+type RefundRequest struct {
+	UserID  int   `json:"user_id"`
+	SeatIDs []int `json:"seat_ids"` // empty refunds the whole booking
+}
+
+type RefundResponse struct {
+	RefundID         int64  `json:"refund_id"`
+	BookingID        string `json:"booking_id"`
+	Status           string `json:"status"`
+	SeatIDs          []int  `json:"seat_ids"`
+	AmountCents      int    `json:"amount_cents"`
+	Currency         string `json:"currency"`
+	ProviderRefundID string `json:"provider_refund_id"`
+}
+
+// handleRefundBooking serves POST /api/bookings/{id}/refund.
+func handleRefundBooking(w http.ResponseWriter, r *http.Request) {
+	bookingID := r.PathValue("id")
+
+	var req RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Refund requested", "component", "api", "booking_id", bookingID, "user_id", req.UserID, "seat_ids", req.SeatIDs)
+
+	resp, err := requestRefund(r.Context(), bookingID, req.UserID, req.SeatIDs)
+	switch {
+	case errors.Is(err, errConfirmedBookingNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errRefundInvalidSeats):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errUpgradeInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errRefundGatewayFailed):
+		slog.WarnContext(r.Context(), "Refund refused by gateway", "component", "api", "booking_id", bookingID, "error", err)
+		http.Error(w, errRefundGatewayFailed.Error(), http.StatusBadGateway)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Failed to refund booking", "component", "api", "booking_id", bookingID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Refund pending", "component", "api", "booking_id", bookingID, "refund_id", resp.RefundID, "amount", fmt.Sprintf("%d %s", resp.AmountCents, resp.Currency))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// requestRefund refunds onlySeatIDs of the booking, or all of its paid seats when empty.
+func requestRefund(ctx context.Context, bookingID string, userID int, onlySeatIDs []int) (*RefundResponse, error) {
+	var resp *RefundResponse
+	var providerSessionID string
+	err := runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		seatIDs, _, err := lockConfirmedSeats(ctx, tx, bookingID, userID)
+		if err != nil {
+			return err
+		}
+		if len(onlySeatIDs) > 0 {
+			requested := append([]int(nil), onlySeatIDs...)
+			slices.Sort(requested)
+			requested = slices.Compact(requested)
+			for _, seatID := range requested {
+				if !slices.Contains(seatIDs, seatID) {
+					return fmt.Errorf("%w: seat %d", errRefundInvalidSeats, seatID)
+				}
+			}
+			seatIDs = requested
+		}
+		if err := checkNoUpgradeInProgress(ctx, tx, bookingID); err != nil {
+			return err
+		}
+		resp, providerSessionID, err = recordRefund(ctx, tx, bookingID, userID, seatIDs)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The gateway is called outside the transaction; the seats are already off sale as
+	// REFUND_PENDING, so nothing else can touch them meanwhile.
+	providerRefundID, err := paymentProvider.Refund(ctx, providerSessionID, int64(resp.AmountCents))
+	if err != nil {
+		if failErr := failRefund(ctx, resp.RefundID); failErr != nil {
+			slog.ErrorContext(ctx, "Failed to roll back refund", "component", "payment", "refund_id", resp.RefundID, "error", failErr)
+		}
+		return nil, fmt.Errorf("%w: %v", errRefundGatewayFailed, err)
+	}
+
+	_, err = db.ExecContext(ctx, `UPDATE refunds SET provider_refund_id = ? WHERE id = ?`, providerRefundID, resp.RefundID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store provider refund id: %w", err)
+	}
+	resp.ProviderRefundID = providerRefundID
+	slog.InfoContext(ctx, "Refund requested", "component", "payment", "booking_id", bookingID, "refund_id", resp.RefundID, "provider", paymentProvider.Name(), "provider_refund_id", providerRefundID)
+	return resp, nil
+}
+
+// recordRefund takes the booking's paid seatIDs off sale as REFUND_PENDING and records their
+// refund, priced at their own price, for the gateway to be asked. It returns the refund and
+// the gateway session it is to be paid back from.
+func recordRefund(ctx context.Context, tx *sql.Tx, bookingID string, userID int, seatIDs []int) (*RefundResponse, string, error) {
+	prices, currency, err := seatPrices(ctx, tx, seatIDs)
+	if err != nil {
+		return nil, "", err
+	}
+	amount := 0
+	for _, seatID := range seatIDs {
+		amount += prices[seatID]
+	}
+
+	checkout, err := loadBookingCheckout(ctx, tx, bookingID)
+	if err != nil {
+		return nil, "", err
+	}
+	// The mock gateway's sessions are the booking id.
+	providerSessionID := bookingID
+	if checkout.ProviderSessionID.Valid {
+		providerSessionID = checkout.ProviderSessionID.String
+	}
+
+	if err := setSeatPaymentStatus(ctx, tx, seatIDs, "REFUND_PENDING"); err != nil {
+		return nil, "", err
+	}
+	refundID, err := insertReturningID(ctx, tx, `
+		INSERT INTO refunds (booking_id, user_id, seat_ids, provider_session_id, amount_cents, currency)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, bookingID, userID, joinInts(seatIDs), providerSessionID, amount, currency)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to record refund: %w", err)
+	}
+
+	return &RefundResponse{
+		RefundID:    int64(refundID),
+		BookingID:   bookingID,
+		Status:      "REFUND_PENDING",
+		SeatIDs:     seatIDs,
+		AmountCents: amount,
+		Currency:    currency,
+	}, providerSessionID, nil
+}
+
+// queueLatePaymentRefund queues the refund of a payment made on a booking's checkout after its
+// hold was released, for sendQueuedRefunds to send. It covers no seats, and returns nil when
+// there is no such booking or nothing says how much was paid.
+func queueLatePaymentRefund(ctx context.Context, tx *sql.Tx, bookingID string, result PaymentResult) (*RefundResponse, error) {
+	var userID int
+	err := tx.QueryRowContext(ctx, `SELECT user_id FROM bookings WHERE id = ?`, bookingID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load booking: %w", err)
+	}
+	checkout, err := loadBookingCheckout(ctx, tx, bookingID)
+	if err != nil {
+		return nil, err
+	}
+
+	refund := &RefundResponse{BookingID: bookingID, Status: "REFUND_PENDING", SeatIDs: []int{}, Currency: result.Currency}
+	switch {
+	case result.AmountCents != nil:
+		refund.AmountCents = int(*result.AmountCents)
+	case checkout.AmountCents.Valid:
+		refund.AmountCents = int(checkout.AmountCents.Int64)
+	default:
+		return nil, nil
+	}
+	if refund.Currency == "" {
+		refund.Currency = checkout.Currency.String
+	}
+	// The mock gateway's sessions are the booking id.
+	providerSessionID := bookingID
+	if checkout.ProviderSessionID.Valid {
+		providerSessionID = checkout.ProviderSessionID.String
+	}
+
+	refundID, err := insertReturningID(ctx, tx, `
+		INSERT INTO refunds (booking_id, user_id, seat_ids, provider_session_id, amount_cents, currency, next_attempt_at)
+		VALUES (?, ?, '', ?, ?, ?, ?)
+	`, bookingID, userID, providerSessionID, refund.AmountCents, refund.Currency, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to queue refund: %w", err)
+	}
+	refund.RefundID = int64(refundID)
+	return refund, nil
+}
+
+// setSeatPaymentStatus sets the seats' payment_status, bumping their version.
+func setSeatPaymentStatus(ctx context.Context, tx *sql.Tx, seatIDs []int, status string) error {
+	args := append([]interface{}{status}, sliceToInterface(seatIDs)...)
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		UPDATE seats SET payment_status = ?, version = version + 1 WHERE id IN (%s)
+	`, generatePlaceholders(len(seatIDs))), args...)
+	if err != nil {
+		return fmt.Errorf("failed to mark seats %s: %w", status, err)
+	}
+	return nil
+}
+
+type pendingRefund struct {
+	ID        int64
+	BookingID string
+	SeatIDs   []int
+}
+
+// lockPendingRefund locks the REFUND_PENDING refund whose column (id or provider_refund_id)
+// equals value, or returns nil when there is none.
+func lockPendingRefund(ctx context.Context, tx *sql.Tx, column string, value interface{}) (*pendingRefund, error) {
+	var refund pendingRefund
+	var seatIDs string
+	err := tx.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT id, booking_id, seat_ids FROM refunds
+		WHERE %s = ? AND status = 'REFUND_PENDING'
+		FOR UPDATE
+	`, column), value).Scan(&refund.ID, &refund.BookingID, &seatIDs)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load refund: %w", err)
+	}
+	refund.SeatIDs = splitInts(seatIDs)
+	return &refund, nil
+}
+
+// settleRefund applies the gateway's verdict on a pending refund: REFUNDED releases its
+// seats, FAILED confirms them again.
+func settleRefund(ctx context.Context, tx *sql.Tx, refund *pendingRefund, status string) error {
+	if len(refund.SeatIDs) == 0 {
+		// A late payment's refund (queueLatePaymentRefund) has no seats to move.
+		_, err := tx.ExecContext(ctx, `UPDATE refunds SET status = ?, completed_at = ? WHERE id = ?`, status, time.Now(), refund.ID)
+		if err != nil {
+			return fmt.Errorf("failed to settle refund: %w", err)
+		}
+		return nil
+	}
+
+	// Only seats still waiting on this refund; anything else was moved on since.
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+		SELECT id FROM seats
+		WHERE payment_session_id = ? AND payment_status = 'REFUND_PENDING' AND id IN (%s)
+		FOR UPDATE
+	`, generatePlaceholders(len(refund.SeatIDs))), append([]interface{}{refund.BookingID}, sliceToInterface(refund.SeatIDs)...)...)
+	if err != nil {
+		return fmt.Errorf("failed to lock refunded seats: %w", err)
+	}
+	var seatIDs []int
+	for rows.Next() {
+		var seatID int
+		if err := rows.Scan(&seatID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan refunded seat: %w", err)
+		}
+		seatIDs = append(seatIDs, seatID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating refunded seats: %w", err)
+	}
+
+	if len(seatIDs) > 0 {
+		if status == "REFUNDED" {
+			err = releaseSeatRows(ctx, tx, seatIDs, SeatRefunded)
+		} else {
+			err = setSeatPaymentStatus(ctx, tx, seatIDs, "COMPLETED")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to settle refunded seats: %w", err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE refunds SET status = ?, completed_at = ? WHERE id = ?`, status, time.Now(), refund.ID)
+	if err != nil {
+		return fmt.Errorf("failed to settle refund: %w", err)
+	}
+	if status != "REFUNDED" {
+		return nil
+	}
+
+	// A partial refund leaves the booking confirmed with the rest of its seats.
+	var remaining int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM seats WHERE payment_session_id = ?`, refund.BookingID).Scan(&remaining)
+	if err != nil {
+		return fmt.Errorf("failed to count remaining seats: %w", err)
+	}
+	if remaining > 0 {
+		return nil
+	}
+	return transitionBooking(ctx, tx, refund.BookingID, BookingRefunded, "refunded")
+}
+
+// failRefund gives a booking its seats back when the gateway wouldn't take the refund.
+func failRefund(ctx context.Context, refundID int64) error {
+	return runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		refund, err := lockPendingRefund(ctx, tx, "id", refundID)
+		if err != nil || refund == nil {
+			return err
+		}
+		return settleRefund(ctx, tx, refund, "FAILED")
+	})
+}
+
+// handleRefundWebhook serves POST /webhook/refund, the gateway's report on a refund. Like the
+// payment webhook it takes {"refund_id", "status", "event_id"} and dedupes deliveries.
+func handleRefundWebhook(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		RefundID string `json:"refund_id"`
+		Status   string `json:"status"`
+		EventID  string `json:"event_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.RefundID == "" {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+	if payload.Status != "REFUNDED" && payload.Status != "FAILED" {
+		http.Error(w, "status must be REFUNDED or FAILED", http.StatusUnprocessableEntity)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Processing refund", "component", "webhook", "refund_id", payload.RefundID, "status", payload.Status)
+
+	outcome := "success"
+	err := runInTx(r.Context(), db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		duplicate, err := recordWebhookEvent(r.Context(), tx, payload.RefundID, payload.Status, payload.EventID)
+		if err != nil {
+			return err
+		}
+		if duplicate {
+			outcome = "duplicate"
+			return nil
+		}
+
+		refund, err := lockPendingRefund(r.Context(), tx, "provider_refund_id", payload.RefundID)
+		if err != nil {
+			return err
+		}
+		if refund == nil {
+			settled, err := sessionSettled(r.Context(), tx, payload.RefundID)
+			if err != nil {
+				return err
+			}
+			if !settled {
+				return errRefundNotFound
+			}
+			outcome = "ignored"
+			return nil
+		}
+		return settleRefund(r.Context(), tx, refund, payload.Status)
+	})
+	if errors.Is(err, errRefundNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrDatabaseUnavailable) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to process refund", "component", "webhook", "refund_id", payload.RefundID, "error", err)
+		reportError(r.Context(), "webhook", err, "refund_id", payload.RefundID)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Refund processed", "component", "webhook", "refund_id", payload.RefundID, "status", payload.Status, "outcome", outcome)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": outcome})
+}
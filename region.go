@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Active-passive regions. Exactly one region is primary: it takes bookings, webhooks and admin
+// writes, runs the background jobs, and stamps region_heartbeat every second. A standby rejects
+// writes with 503 and serves reads from its replica only while the replicated heartbeat is
+// recent enough. Promotion flips the role in-process and rebuilds this region's Redis holds
+// from the seats table, since Redis is not replicated across regions.
+
+const (
+	regionHeartbeatInterval  = 1 * time.Second
+	defaultMaxReplicationLag = 5 * time.Second
+)
+
+type RegionState struct {
+	mu              sync.RWMutex
+	name            string
+	primary         bool
+	maxLag          time.Duration
+	lag             time.Duration
+	lagErr          error
+	lastHeartbeatBy string
+	roleChangedAt   time.Time
+}
+
+var region = newRegionStateFromEnv()
+
+// newRegionStateFromEnv reads REGION_NAME, REGION_ROLE ("primary" or "standby", default
+// primary) and MAX_REPLICATION_LAG_MS.
+func newRegionStateFromEnv() *RegionState {
+	name := os.Getenv("REGION_NAME")
+	if name == "" {
+		name = "default"
+	}
+	maxLag := defaultMaxReplicationLag
+	if ms, err := strconv.Atoi(os.Getenv("MAX_REPLICATION_LAG_MS")); err == nil && ms > 0 {
+		maxLag = time.Duration(ms) * time.Millisecond
+	}
+	return &RegionState{
+		name:          name,
+		primary:       !strings.EqualFold(os.Getenv("REGION_ROLE"), "standby"),
+		maxLag:        maxLag,
+		roleChangedAt: time.Now(),
+	}
+}
+
+func isPrimaryRegion() bool {
+	region.mu.RLock()
+	defer region.mu.RUnlock()
+	return region.primary
+}
+
+func (s *RegionState) setPrimary(primary bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.primary = primary
+	s.roleChangedAt = time.Now()
+}
+
+// replicationLag returns the last measured lag. On the primary it is always zero.
+func (s *RegionState) replicationLag() (time.Duration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.primary {
+		return 0, nil
+	}
+	return s.lag, s.lagErr
+}
+
+// runRegionHeartbeat writes the heartbeat while primary and measures replication lag from it
+// while standby. Lag is measured against the local clock, so regions need NTP.
+func runRegionHeartbeat() error {
+	ticker := time.NewTicker(regionHeartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if isPrimaryRegion() {
+			_, err := db.ExecContext(ctx, "UPDATE region_heartbeat SET region = ?, beat_ms = ? WHERE id = 1",
+				region.name, time.Now().UnixMilli())
+			if err != nil {
+				slog.Error("Failed to write heartbeat", "component", "region", "region", region.name, "error", err)
+			}
+			continue
+		}
+
+		var beatMs int64
+		var writer string
+		err := db.QueryRowContext(ctx, "SELECT region, beat_ms FROM region_heartbeat WHERE id = 1").Scan(&writer, &beatMs)
+
+		region.mu.Lock()
+		if err != nil {
+			region.lagErr = fmt.Errorf("failed to read heartbeat: %w", err)
+		} else {
+			region.lag = time.Since(time.UnixMilli(beatMs))
+			region.lagErr = nil
+			region.lastHeartbeatBy = writer
+		}
+		region.mu.Unlock()
+	}
+
+	return errors.New("ending region heartbeat")
+}
+
+// requirePrimary rejects writes when this region is not primary.
+func requirePrimary(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isPrimaryRegion() {
+			slog.WarnContext(r.Context(), "Rejected write on standby", "component", "region", "region", region.name, "path", r.URL.Path)
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Region is standby, writes are disabled", http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireFreshReplica rejects reads on a standby whose replica is further behind than
+// MAX_REPLICATION_LAG_MS, or whose lag can't be measured.
+func requireFreshReplica(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lag, err := region.replicationLag()
+		if err != nil || lag > region.maxLag {
+			slog.WarnContext(r.Context(), "Rejected read, replica too far behind", "component", "region", "region", region.name, "lag", lag, "error", err)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Replica is behind, try again shortly", http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
+type RegionStatus struct {
+	Region          string    `json:"region"`
+	Role            string    `json:"role"`
+	RoleChangedAt   time.Time `json:"role_changed_at"`
+	ReplicationLag  int64     `json:"replication_lag_ms"`
+	MaxLag          int64     `json:"max_replication_lag_ms"`
+	LagError        string    `json:"lag_error,omitempty"`
+	LastHeartbeatBy string    `json:"last_heartbeat_by,omitempty"`
+}
+
+func (s *RegionState) status() RegionStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status := RegionStatus{
+		Region:          s.name,
+		Role:            "standby",
+		RoleChangedAt:   s.roleChangedAt,
+		MaxLag:          s.maxLag.Milliseconds(),
+		LastHeartbeatBy: s.lastHeartbeatBy,
+	}
+	if s.primary {
+		status.Role = "primary"
+		return status
+	}
+	status.ReplicationLag = s.lag.Milliseconds()
+	if s.lagErr != nil {
+		status.LagError = s.lagErr.Error()
+	}
+	return status
+}
+
+// handleRegionStatus serves GET /admin/region.
+func handleRegionStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(region.status())
+}
+
+type PromotionResult struct {
+	Region            string `json:"region"`
+	HeldSeats         int    `json:"held_seats"`
+	LocksWritten      int    `json:"locks_written"`
+	StaleLocksRemoved int    `json:"stale_locks_removed"`
+	FencingToken      int64  `json:"fencing_token"`
+}
+
+// handleRegionPromote serves POST /admin/region/promote. The database in this region must
+// already have been promoted to a writable primary; this only switches the application over
+// and rebuilds the Redis holds.
+func handleRegionPromote(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Promotion requested", "component", "region", "region", region.name, "ip", r.RemoteAddr)
+
+	result, err := rebuildLockState()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to rebuild lock state, staying standby", "component", "region", "region", region.name, "error", err)
+		http.Error(w, "Failed to rebuild lock state", http.StatusInternalServerError)
+		return
+	}
+	region.setPrimary(true)
+
+	slog.InfoContext(r.Context(), "Promoted to primary", "component", "region", "region", region.name, "held_seats", result.HeldSeats, "locks_written", result.LocksWritten, "stale_locks_removed", result.StaleLocksRemoved)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleRegionDemote serves POST /admin/region/demote, used when failing back.
+func handleRegionDemote(w http.ResponseWriter, r *http.Request) {
+	region.setPrimary(false)
+	slog.InfoContext(r.Context(), "Demoted to standby", "component", "region", "region", region.name, "ip", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(region.status())
+}
+
+// rebuildLockState makes this region's Redis agree with the seats table: the fencing counter is
+// moved past every stored token, every seat with a live PENDING hold gets its seat_lock and
+// redlock keys back with the remaining hold as TTL, and lock keys for seats that are not held
+// are deleted. The owning strategy isn't recorded, so both key families are written for every
+// held seat.
+func rebuildLockState() (*PromotionResult, error) {
+	result := &PromotionResult{Region: region.name}
+
+	token, err := seedFencingCounter(ctx, rdb)
+	if err != nil {
+		return nil, err
+	}
+	result.FencingToken = token
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, show_id, user_id, payment_session_id, payment_timeout
+		FROM seats
+		WHERE is_reserved = 1 AND payment_status = 'PENDING'
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load held seats: %w", err)
+	}
+	defer rows.Close()
+
+	live := make(map[string]bool)
+	now := time.Now()
+	for rows.Next() {
+		var seatID, showID int
+		var userID sql.NullInt64
+		var sessionID sql.NullString
+		var timeout sql.NullTime
+		if err := rows.Scan(&seatID, &showID, &userID, &sessionID, &timeout); err != nil {
+			return nil, fmt.Errorf("failed to scan held seat: %w", err)
+		}
+		// Already expired holds are left for the reaper.
+		if !timeout.Valid || !timeout.Time.After(now) {
+			continue
+		}
+		ttl := timeout.Time.Sub(now)
+		result.HeldSeats++
+
+		// Other lock providers keep their state outside this region's Redis.
+		if lockProvider.Name() == "redis" {
+			lockKey := seatLockKey(showID, seatID)
+			live[lockKey] = true
+			if err := rdb.Set(ctx, lockKey, seatLockOwner(userID.Int64), ttl).Err(); err != nil {
+				return nil, fmt.Errorf("failed to write %s: %w", lockKey, err)
+			}
+			result.LocksWritten++
+		}
+
+		redlockKey := redlockSeatKeys([]int{seatID})[0]
+		live[redlockKey] = true
+		for _, client := range redlock.clients {
+			if err := client.Set(ctx, redlockKey, sessionID.String, ttl).Err(); err != nil {
+				// Redlock only needs a majority, so one unreachable node is not fatal.
+				slog.Error("Failed to write redlock key", "component", "region", "key", redlockKey, "error", err)
+				continue
+			}
+			result.LocksWritten++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating held seats: %w", err)
+	}
+
+	clients := append(redlock.clients[:len(redlock.clients):len(redlock.clients)], rdb)
+	for _, client := range clients {
+		err := forEachRedisNode(ctx, client, func(node redis.UniversalClient) error {
+			var stale []string
+			for _, pattern := range []string{"seat_lock:*", "redlock:seat:*"} {
+				iter := node.Scan(ctx, 0, pattern, 500).Iterator()
+				for iter.Next(ctx) {
+					if !live[iter.Val()] {
+						stale = append(stale, iter.Val())
+					}
+				}
+				if err := iter.Err(); err != nil {
+					return fmt.Errorf("failed to scan %s: %w", pattern, err)
+				}
+			}
+			// One DEL per key, so keys of different slots can share the pipeline.
+			cmds, _ := node.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, key := range stale {
+					pipe.Del(ctx, key)
+				}
+				return nil
+			})
+			for _, cmd := range cmds {
+				if cmd.Err() == nil {
+					result.StaleLocksRemoved++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
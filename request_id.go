@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// Request IDs. Every request gets one: the caller's X-Request-ID when it sends a usable one
+// (a load balancer or the partner's own system), a fresh one otherwise. It is echoed in the
+// X-Request-ID response header and the booking responses, put on every log line of the
+// request, and sent on to the payment gateway with the calls made for it, so one id follows a
+// booking from the client through our logs to the gateway's dashboard.
+
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds what is accepted from callers, the id ends up in every log line.
+const maxRequestIDLength = 128
+
+type requestIDContextKey struct{}
+
+// withRequestID wraps the whole server, so requests that don't reach a handler have an id too.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		reqCtx := context.WithValue(r.Context(), requestIDContextKey{}, requestID)
+		reqCtx = withLogFields(reqCtx, "request_id", requestID)
+		next.ServeHTTP(w, r.WithContext(reqCtx))
+	})
+}
+
+// requestIDFromContext returns the id of the request ctx belongs to, "" outside of one.
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// validRequestID accepts printable ASCII without spaces, which is safe to log and to forward.
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] <= ' ' || requestID[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		// crypto/rand doesn't fail on the platforms we run on; an id is not worth failing for.
+		return "req_unknown"
+	}
+	return "req_" + hex.EncodeToString(raw)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Sale windows. A show takes bookings from its sale_start until its sale_end, either left
+// open when unset (shows.go). A booking outside the window is refused with 403 before it is
+// queued or touches a seat: status NOT_ON_SALE with sale_start and opens_in_seconds, and a
+// Retry-After, while sales haven't opened, SALE_ENDED with sale_end once they have closed.
+// server_time comes with both so clients can count down without trusting their own clock.
+// A show with a presale_start takes bookings with a presale code before its sale_start
+// (presale.go).
+
+// saleWindow is a show's sale window, a zero time for an open side. presaleStart is only set
+// with start.
+type saleWindow struct {
+	presaleStart time.Time
+	start        time.Time
+	end          time.Time
+}
+
+// SaleWindowError is a booking refused for falling outside its show's sale window.
+type SaleWindowError struct {
+	Status       string // NOT_ON_SALE or SALE_ENDED
+	PresaleStart time.Time
+	SaleStart    time.Time
+	SaleEnd      time.Time
+}
+
+func (e *SaleWindowError) Error() string {
+	if e.Status == "SALE_ENDED" {
+		return fmt.Sprintf("sales closed at %s", e.SaleEnd.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("sales open at %s", e.SaleStart.Format(time.RFC3339))
+}
+
+type SaleWindowResponse struct {
+	Status         string     `json:"status"`
+	Error          string     `json:"error"`
+	PresaleStart   *time.Time `json:"presale_start,omitempty"`
+	SaleStart      *time.Time `json:"sale_start,omitempty"`
+	SaleEnd        *time.Time `json:"sale_end,omitempty"`
+	OpensInSeconds int64      `json:"opens_in_seconds,omitempty"`
+	ServerTime     time.Time  `json:"server_time"`
+	RequestID      string     `json:"request_id,omitempty"`
+}
+
+// checkSaleWindow returns a *SaleWindowError when the show isn't on sale at now, and whether
+// it is in its presale, when bookings need a presale code.
+func checkSaleWindow(showID int, now time.Time) (presale bool, err error) {
+	window := showSaleWindow(showID)
+	if !window.start.IsZero() && now.Before(window.start) {
+		if !window.presaleStart.IsZero() && !now.Before(window.presaleStart) {
+			return true, nil
+		}
+		return false, &SaleWindowError{Status: "NOT_ON_SALE", PresaleStart: window.presaleStart, SaleStart: window.start, SaleEnd: window.end}
+	}
+	if !window.end.IsZero() && !now.Before(window.end) {
+		return false, &SaleWindowError{Status: "SALE_ENDED", SaleStart: window.start, SaleEnd: window.end}
+	}
+	return false, nil
+}
+
+func writeSaleWindowError(w http.ResponseWriter, r *http.Request, err *SaleWindowError, now time.Time) {
+	resp := SaleWindowResponse{
+		Status:     err.Status,
+		Error:      err.Error(),
+		ServerTime: now.UTC(),
+		RequestID:  requestIDFromContext(r.Context()),
+	}
+	if !err.PresaleStart.IsZero() {
+		resp.PresaleStart = &err.PresaleStart
+	}
+	if !err.SaleStart.IsZero() {
+		resp.SaleStart = &err.SaleStart
+	}
+	if !err.SaleEnd.IsZero() {
+		resp.SaleEnd = &err.SaleEnd
+	}
+	if err.Status == "NOT_ON_SALE" {
+		opensIn := int64(math.Ceil(err.SaleStart.Sub(now).Seconds()))
+		resp.OpensInSeconds = opensIn
+		w.Header().Set("Retry-After", fmt.Sprint(opensIn))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notifications for the discovery/search indexer, delivered as outbound webhooks to
+// SEARCH_INDEX_WEBHOOK_URL. Availability is published as a coarse bucket per show and only
+// when the bucket changes, so the indexer can show "filling fast" badges without polling us.
+
+const (
+	searchNotifyInterval = 15 * time.Second
+	searchNotifyRetries  = 3
+)
+
+type SearchNotification struct {
+	Type       string    `json:"type"` // "availability.changed" or "price.changed"
+	ShowID     int       `json:"show_id"`
+	Remaining  *int      `json:"remaining,omitempty"`
+	Total      *int      `json:"total,omitempty"`
+	Bucket     string    `json:"bucket,omitempty"`
+	PriceCents *int      `json:"price_cents,omitempty"`
+	Currency   string    `json:"currency,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+var searchHTTPClient = &http.Client{Timeout: 5 * time.Second}
+
+func availabilityBucket(remaining, total int) string {
+	switch {
+	case remaining == 0:
+		return "sold_out"
+	case remaining*10 <= total:
+		return "almost_full"
+	case remaining*2 <= total:
+		return "filling_fast"
+	default:
+		return "available"
+	}
+}
+
+// publishSearchNotification posts n to the indexer with a few retries. Without a configured
+// URL notifications are dropped.
+func publishSearchNotification(n SearchNotification) {
+	url := os.Getenv("SEARCH_INDEX_WEBHOOK_URL")
+	if url == "" {
+		return
+	}
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		slog.Error("Failed to encode notification", "component", "search", "show_id", n.ShowID, "error", err)
+		return
+	}
+
+	backoff := 500 * time.Millisecond
+	for attempt := 1; attempt <= searchNotifyRetries; attempt++ {
+		err = postSearchNotification(url, body)
+		if err == nil {
+			slog.Info("Published notification", "component", "search", "type", n.Type, "show_id", n.ShowID)
+			return
+		}
+		slog.Error("Notification attempt failed", "component", "search", "type", n.Type, "show_id", n.ShowID, "attempt", attempt, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postSearchNotification(url string, body []byte) error {
+	resp, err := searchHTTPClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("indexer responded %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// publishAvailabilityChanges polls per-show availability and publishes a notification for
+// every show whose bucket moved since the last pass.
+func publishAvailabilityChanges() error {
+	ticker := time.NewTicker(searchNotifyInterval)
+	defer ticker.Stop()
+
+	lastBuckets := make(map[int]string)
+	for range ticker.C {
+		if !runsMaintenance() {
+			continue
+		}
+
+		rows, err := db.QueryContext(ctx, `
+			SELECT show_id,
+			       SUM(CASE WHEN is_reserved = 0 OR payment_status = 'FAILED' THEN 1 ELSE 0 END) AS remaining,
+			       COUNT(*) AS total
+			FROM seats
+			GROUP BY show_id
+		`)
+		if err != nil {
+			slog.Error("Error querying availability", "component", "search", "error", err)
+			continue
+		}
+
+		var changed []SearchNotification
+		for rows.Next() {
+			var showID, remaining, total int
+			if err := rows.Scan(&showID, &remaining, &total); err != nil {
+				slog.Error("Error scanning availability", "component", "search", "error", err)
+				continue
+			}
+			bucket := availabilityBucket(remaining, total)
+			if lastBuckets[showID] == bucket {
+				continue
+			}
+			lastBuckets[showID] = bucket
+			changed = append(changed, SearchNotification{
+				Type:       "availability.changed",
+				ShowID:     showID,
+				Remaining:  &remaining,
+				Total:      &total,
+				Bucket:     bucket,
+				OccurredAt: time.Now(),
+			})
+		}
+		rows.Close()
+
+		for _, n := range changed {
+			publishSearchNotification(n)
+		}
+	}
+
+	return errors.New("ending availability publisher")
+}
+
+type ShowPriceRequest struct {
+	PriceCents int    `json:"price_cents"`
+	Currency   string `json:"currency"`
+}
+
+// handleUpdateShowPrice serves PUT /admin/shows/{id}/price and notifies the indexer.
+func handleUpdateShowPrice(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+
+	var req ShowPriceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PriceCents < 0 || len(req.Currency) != 3 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.ExecContext(ctx, `UPDATE shows SET price_cents = ?, currency = ? WHERE id = ?`,
+		req.PriceCents, req.Currency, showID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update price", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Updated price", "component", "admin", "show_id", showID, "price", fmt.Sprintf("%d %s", req.PriceCents, req.Currency))
+	go publishSearchNotification(SearchNotification{
+		Type:       "price.changed",
+		ShowID:     showID,
+		PriceCents: &req.PriceCents,
+		Currency:   req.Currency,
+		OccurredAt: time.Now(),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
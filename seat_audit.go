@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Seat audit log. Every change of a seat's status (AVAILABLE, PENDING, COMPLETED, REVIEW,
+// REFUND_PENDING, BLOCKED), holder or booking is appended to seat_audit by a trigger on seats,
+// in the transaction that made it, so nothing that writes seats can skip it. What the trigger
+// can't see on the row, where the change came from, is put on the transaction by tagSeatAudit:
+//   - source: api, webhook or admin for requests (by path), reaper, lock_expiry, reconciler,
+//     allocations, stuck_holds, waitlist or show_cancellation for the background jobs
+//   - strategy: the concurrency control strategy of a booking
+//   - request_id: the request's X-Request-ID, to find its log lines
+// Rows are never updated or deleted. GET /admin/seat-audit queries them. The memory store
+// keeps no audit.
+
+const maxSeatAuditQueryLimit = 1000
+
+// Sources of seat changes made outside of a request.
+const (
+	SeatAuditReaper      = "reaper"
+	SeatAuditLockExpiry  = "lock_expiry"
+	SeatAuditReconciler  = "reconciler"
+	SeatAuditAllocations = "allocations"
+	SeatAuditStuckHolds  = "stuck_holds"
+	SeatAuditWaitlist    = "waitlist"
+	// SeatAuditShowCancellation is the release and refund of a cancelled show's bookings.
+	SeatAuditShowCancellation = "show_cancellation"
+)
+
+// SeatAudit is what a transaction tells the audit trigger about itself.
+type SeatAudit struct {
+	Source    string
+	Strategy  string
+	RequestID string
+}
+
+type SeatAuditEntry struct {
+	ID        int64     `json:"id"`
+	SeatID    int       `json:"seat_id"`
+	ShowID    int       `json:"show_id"`
+	UserID    *int      `json:"user_id,omitempty"`
+	BookingID string    `json:"booking_id,omitempty"`
+	OldStatus string    `json:"old_status"`
+	NewStatus string    `json:"new_status"`
+	Source    string    `json:"source,omitempty"`
+	Strategy  string    `json:"strategy,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+type seatAuditContextKey struct{}
+
+// withSeatAudit sets the source of the seat changes made under ctx, keeping its strategy.
+func withSeatAudit(ctx context.Context, source string) context.Context {
+	audit := seatAuditFromContext(ctx)
+	audit.Source = source
+	return context.WithValue(ctx, seatAuditContextKey{}, audit)
+}
+
+// withSeatAuditStrategy sets the strategy of the seat changes made under ctx.
+func withSeatAuditStrategy(ctx context.Context, strategy string) context.Context {
+	audit := seatAuditFromContext(ctx)
+	audit.Strategy = strategy
+	return context.WithValue(ctx, seatAuditContextKey{}, audit)
+}
+
+func seatAuditFromContext(ctx context.Context) SeatAudit {
+	audit, _ := ctx.Value(seatAuditContextKey{}).(SeatAudit)
+	audit.RequestID = requestIDFromContext(ctx)
+	return audit
+}
+
+// auditRequestSource marks the seat changes a request makes with where it came in.
+func auditRequestSource(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		source := "api"
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/webhook/"), strings.HasPrefix(r.URL.Path, "/dev/webhook-replay"):
+			source = "webhook"
+		case strings.HasPrefix(r.URL.Path, "/admin/"):
+			source = "admin"
+		}
+		next.ServeHTTP(w, r.WithContext(withSeatAudit(r.Context(), source)))
+	})
+}
+
+// tagSeatAudit hands audit to the seats_audit trigger for the rest of tx. It has to run in
+// every transaction that may change seats: on MySQL the values are session variables and
+// would otherwise carry over from the connection's previous transaction.
+func tagSeatAudit(ctx context.Context, tx *sql.Tx, audit SeatAudit) error {
+	var err error
+	if dbDriver == "postgres" {
+		_, err = tx.ExecContext(ctx, `
+			SELECT set_config('seat_audit.source', ?, true), set_config('seat_audit.strategy', ?, true),
+			       set_config('seat_audit.request_id', ?, true)
+		`, audit.Source, audit.Strategy, audit.RequestID)
+	} else {
+		_, err = tx.ExecContext(ctx, `SET @seat_audit_source = ?, @seat_audit_strategy = ?, @seat_audit_request_id = ?`,
+			nullString(audit.Source), nullString(audit.Strategy), nullString(audit.RequestID))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to tag transaction for the seat audit: %w", err)
+	}
+	return nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// handleSeatAudit lists audit entries, newest first, filtered by seat_id, show_id, user_id,
+// booking_id, source and since/until (RFC 3339).
+func handleSeatAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var where []string
+	var args []interface{}
+
+	for _, filter := range []string{"seat_id", "show_id", "user_id"} {
+		if v := query.Get(filter); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "Invalid "+filter, http.StatusBadRequest)
+				return
+			}
+			where = append(where, filter+" = ?")
+			args = append(args, id)
+		}
+	}
+	for _, filter := range []string{"booking_id", "source"} {
+		if v := query.Get(filter); v != "" {
+			where = append(where, filter+" = ?")
+			args = append(args, v)
+		}
+	}
+	for _, bound := range []struct{ param, op string }{{"since", ">="}, {"until", "<"}} {
+		if v := query.Get(bound.param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "Invalid "+bound.param+", expected RFC 3339", http.StatusBadRequest)
+				return
+			}
+			where = append(where, "changed_at "+bound.op+" ?")
+			args = append(args, t)
+		}
+	}
+
+	limit := 100
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSeatAuditQueryLimit)
+	}
+
+	sqlQuery := `
+		SELECT id, seat_id, show_id, user_id, booking_id, old_status, new_status, source, strategy,
+		       request_id, changed_at
+		FROM seat_audit`
+	if len(where) > 0 {
+		sqlQuery += " WHERE " + strings.Join(where, " AND ")
+	}
+	sqlQuery += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	entries, err := querySeatAudit(r.Context(), sqlQuery, args...)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to query seat audit", "component", "admin", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":   len(entries),
+		"entries": entries,
+	})
+}
+
+func querySeatAudit(ctx context.Context, query string, args ...interface{}) ([]SeatAuditEntry, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query seat audit: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []SeatAuditEntry{}
+	for rows.Next() {
+		var e SeatAuditEntry
+		var bookingID, source, strategy, requestID sql.NullString
+		if err := rows.Scan(&e.ID, &e.SeatID, &e.ShowID, &e.UserID, &bookingID, &e.OldStatus, &e.NewStatus,
+			&source, &strategy, &requestID, &e.ChangedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan seat audit entry: %w", err)
+		}
+		e.BookingID, e.Source, e.Strategy, e.RequestID = bookingID.String, source.String, strategy.String, requestID.String
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+)
+
+// One read of a seat set: availability and row version for every requested seat, taken in a
+// single statement so all of them come from the same snapshot. The strategies call it inside
+// their transaction, optionally locking the rows; the dry-run and quote endpoints call it
+// without locks.
+
+type seatLockMode int
+
+const (
+	seatLockNone seatLockMode = iota
+	seatLockForUpdate
+	seatLockForUpdateNoWait
+)
+
+type SeatAvailability struct {
+	SeatID    int  `json:"seat_id"`
+	ShowID    int  `json:"show_id"`
+	Available bool `json:"available"`
+	Version   int  `json:"version"`
+}
+
+// queryer is satisfied by *sql.DB, *sql.Conn and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// readSeatAvailability returns one entry per requested seat that exists; seats missing from
+// the map don't exist. Locked reads lock every requested row, available or not.
+func readSeatAvailability(ctx context.Context, q queryer, seatIDs []int, lock seatLockMode) (map[int]SeatAvailability, error) {
+	query := fmt.Sprintf(`
+		SELECT id, show_id, version,
+		       (is_reserved = 0 OR (is_reserved = 1 AND payment_status = 'FAILED')) AS available
+		FROM seats
+		WHERE id IN (%s)`, generatePlaceholders(len(seatIDs)))
+	switch lock {
+	case seatLockForUpdate:
+		query += " FOR UPDATE"
+	case seatLockForUpdateNoWait:
+		query += " FOR UPDATE NOWAIT"
+	}
+
+	rows, err := q.QueryContext(ctx, query, sliceToInterface(seatIDs)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seats := make(map[int]SeatAvailability, len(seatIDs))
+	for rows.Next() {
+		var seat SeatAvailability
+		if err := rows.Scan(&seat.SeatID, &seat.ShowID, &seat.Version, &seat.Available); err != nil {
+			return nil, fmt.Errorf("failed to scan seat availability: %w", err)
+		}
+		seats[seat.SeatID] = seat
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating seat availability rows: %w", err)
+	}
+	return seats, nil
+}
+
+// unavailableSeats lists, in order, the requested seats that are missing or taken.
+func unavailableSeats(seatIDs []int, seats map[int]SeatAvailability) []int {
+	unavailable := []int{}
+	for _, seatID := range seatIDs {
+		if seat, ok := seats[seatID]; !ok || !seat.Available {
+			unavailable = append(unavailable, seatID)
+		}
+	}
+	sort.Ints(unavailable)
+	return unavailable
+}
+
+type DryRunResponse struct {
+	WouldSucceed       bool               `json:"would_succeed"`
+	Seats              []SeatAvailability `json:"seats"`
+	UnavailableSeatIDs []int              `json:"unavailable_seat_ids"`
+}
+
+// handleBookingDryRun serves POST /api/book/dry-run: the same body as /api/book, answered with
+// whether the seats are free right now. Nothing is locked or written.
+func handleBookingDryRun(w http.ResponseWriter, r *http.Request) {
+	var req BookingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.SeatIDs) == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	seats, err := readSeatAvailability(r.Context(), db, req.SeatIDs, seatLockNone)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read seat availability", "component", "api", "user_id", req.UserID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := DryRunResponse{Seats: []SeatAvailability{}, UnavailableSeatIDs: unavailableSeats(req.SeatIDs, seats)}
+	for _, seatID := range req.SeatIDs {
+		if seat, ok := seats[seatID]; ok {
+			resp.Seats = append(resp.Seats, seat)
+		}
+	}
+	resp.WouldSucceed = len(resp.UnavailableSeatIDs) == 0
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+type QuoteRequest struct {
+	ShowID  int   `json:"show_id"`
+	SeatIDs []int `json:"seat_ids"`
+}
+
+type QuoteResponse struct {
+	ShowID             int    `json:"show_id"`
+	SeatIDs            []int  `json:"seat_ids"`
+	Available          bool   `json:"available"`
+	UnavailableSeatIDs []int  `json:"unavailable_seat_ids"`
+	UnitPriceCents     int    `json:"unit_price_cents"`
+	TotalCents         int    `json:"total_cents"`
+	Currency           string `json:"currency"`
+}
+
+// handleQuote serves POST /api/quote with the price of a seat set and whether it can still
+// be booked. Seats from another show count as unavailable.
+func handleQuote(w http.ResponseWriter, r *http.Request) {
+	var req QuoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ShowID == 0 || len(req.SeatIDs) == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	resp := QuoteResponse{ShowID: req.ShowID, SeatIDs: req.SeatIDs}
+	err := db.QueryRowContext(r.Context(), "SELECT price_cents, currency FROM shows WHERE id = ?", req.ShowID).
+		Scan(&resp.UnitPriceCents, &resp.Currency)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load show price", "component", "api", "show_id", req.ShowID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	seats, err := readSeatAvailability(r.Context(), db, req.SeatIDs, seatLockNone)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read seat availability", "component", "api", "show_id", req.ShowID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	for seatID, seat := range seats {
+		if seat.ShowID != req.ShowID {
+			delete(seats, seatID)
+		}
+	}
+
+	resp.UnavailableSeatIDs = unavailableSeats(req.SeatIDs, seats)
+	resp.Available = len(resp.UnavailableSeatIDs) == 0
+
+	// Premium seats carry their own price, the rest cost the show's.
+	prices, _, err := seatPrices(r.Context(), db, req.SeatIDs)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load seat prices", "component", "api", "show_id", req.ShowID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	for _, seatID := range req.SeatIDs {
+		if price, ok := prices[seatID]; ok && seats[seatID].ShowID == req.ShowID {
+			resp.TotalCents += price
+		} else {
+			resp.TotalCents += resp.UnitPriceCents
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
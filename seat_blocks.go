@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Blocked seats. House seats, broken seats and seats kept empty for distancing are taken off
+// sale with POST /admin/shows/{id}/seats/block, by seat id or by row, and put back with
+// POST /admin/shows/{id}/seats/unblock. A blocked seat is reserved with payment_status
+// BLOCKED and no holder, so the availability predicate every strategy shares (is_reserved = 0
+// or FAILED) already leaves it out, and the reaper, which only expires PENDING seats, never
+// frees it. The event store records it as SeatBlocked and SeatUnblocked. Only free seats can
+// be blocked: a held or sold seat has to be released (force_release.go) or refunded first.
+// Blocking is all or nothing; seats already blocked keep their reason. The seat map and the
+// live feed show blocked seats as "blocked", and a show whose seats are all sold or blocked is
+// sold out.
+
+var (
+	errSeatBlockNotFound    = errors.New("seats not found")
+	errSeatBlockUnavailable = errors.New("seats are held or sold")
+)
+
+type SeatBlockRequest struct {
+	SeatIDs []int    `json:"seat_ids"`
+	Rows    []string `json:"rows"`
+	Reason  string   `json:"reason"`
+}
+
+type SeatBlockResponse struct {
+	ShowID int `json:"show_id"`
+	// SeatIDs are the seats named, by id or row; ChangedSeatIDs those this call blocked or
+	// unblocked.
+	SeatIDs        []int `json:"seat_ids"`
+	ChangedSeatIDs []int `json:"changed_seat_ids"`
+}
+
+type BlockedSeat struct {
+	SeatID    int        `json:"seat_id"`
+	Label     string     `json:"label"`
+	Row       *string    `json:"row"`
+	Reason    string     `json:"reason,omitempty"`
+	BlockedAt *time.Time `json:"blocked_at,omitempty"`
+}
+
+// blockTarget is a seat named by a block or unblock request, as locked.
+type blockTarget struct {
+	id            int
+	row           sql.NullString
+	reserved      bool
+	paymentStatus string
+}
+
+func (t blockTarget) blocked() bool {
+	return t.reserved && t.paymentStatus == "BLOCKED"
+}
+
+func (t blockTarget) free() bool {
+	return !t.reserved || t.paymentStatus == "FAILED"
+}
+
+func handleBlockSeats(w http.ResponseWriter, r *http.Request) {
+	handleSeatBlocks(w, r, true)
+}
+
+func handleUnblockSeats(w http.ResponseWriter, r *http.Request) {
+	handleSeatBlocks(w, r, false)
+}
+
+func handleSeatBlocks(w http.ResponseWriter, r *http.Request, block bool) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+	var req SeatBlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (len(req.SeatIDs) == 0 && len(req.Rows) == 0) {
+		http.Error(w, "Invalid request body, seat_ids or rows are required", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if block && req.Reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := setSeatsBlocked(r.Context(), showID, req, block)
+	switch {
+	case errors.Is(err, errSeatBlockNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errSeatBlockUnavailable):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Failed to change seat blocks", "component", "admin", "show_id", showID, "block", block, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	action := "Unblocked seats"
+	if block {
+		action = "Blocked seats"
+	}
+	slog.InfoContext(r.Context(), action, "component", "admin", "show_id", showID, "seat_ids", resp.ChangedSeatIDs, "reason", req.Reason)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// setSeatsBlocked blocks or unblocks the named seats of the show in one transaction.
+func setSeatsBlocked(ctx context.Context, showID int, req SeatBlockRequest, block bool) (SeatBlockResponse, error) {
+	resp := SeatBlockResponse{ShowID: showID}
+	err := runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		resp.SeatIDs, resp.ChangedSeatIDs = []int{}, []int{}
+		targets, err := lockBlockTargets(ctx, tx, showID, req)
+		if err != nil {
+			return err
+		}
+
+		var unavailable []int
+		for _, t := range targets {
+			resp.SeatIDs = append(resp.SeatIDs, t.id)
+			switch {
+			case block && t.blocked(), !block && !t.blocked():
+			case block && !t.free():
+				unavailable = append(unavailable, t.id)
+			default:
+				resp.ChangedSeatIDs = append(resp.ChangedSeatIDs, t.id)
+			}
+		}
+		if len(unavailable) > 0 {
+			return fmt.Errorf("%w: %v", errSeatBlockUnavailable, unavailable)
+		}
+		if len(resp.ChangedSeatIDs) == 0 {
+			return nil
+		}
+
+		if block {
+			if err := appendSeatEvents(ctx, tx, SeatBlocked, resp.ChangedSeatIDs); err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+				UPDATE seats
+				SET is_reserved = 1,
+				    payment_status = 'BLOCKED',
+				    user_id = NULL,
+				    reserved_until = NULL,
+				    payment_timeout = NULL,
+				    payment_session_id = NULL,
+				    block_reason = ?,
+				    blocked_at = ?,
+				    version = version + 1
+				WHERE id IN (%s)
+			`, generatePlaceholders(len(resp.ChangedSeatIDs))),
+				append([]interface{}{truncate(req.Reason, 255), time.Now()}, sliceToInterface(resp.ChangedSeatIDs)...)...)
+		} else {
+			if err := appendSeatEvents(ctx, tx, SeatUnblocked, resp.ChangedSeatIDs); err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+				UPDATE seats
+				SET is_reserved = 0,
+				    payment_status = 'FAILED',
+				    block_reason = NULL,
+				    blocked_at = NULL,
+				    version = version + 1
+				WHERE id IN (%s)
+			`, generatePlaceholders(len(resp.ChangedSeatIDs))), sliceToInterface(resp.ChangedSeatIDs)...)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update seats: %w", err)
+		}
+		return nil
+	})
+	return resp, err
+}
+
+// lockBlockTargets locks the show's seats named by id or row, failing with
+// errSeatBlockNotFound when a seat id isn't the show's or a row has no seats.
+func lockBlockTargets(ctx context.Context, tx *sql.Tx, showID int, req SeatBlockRequest) ([]blockTarget, error) {
+	var conditions []string
+	args := []interface{}{showID}
+	if len(req.SeatIDs) > 0 {
+		conditions = append(conditions, fmt.Sprintf("id IN (%s)", generatePlaceholders(len(req.SeatIDs))))
+		args = append(args, sliceToInterface(req.SeatIDs)...)
+	}
+	if len(req.Rows) > 0 {
+		conditions = append(conditions, fmt.Sprintf("seat_row IN (%s)", generatePlaceholders(len(req.Rows))))
+		for _, row := range req.Rows {
+			args = append(args, row)
+		}
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, seat_row, is_reserved, COALESCE(payment_status, '') FROM seats
+		WHERE show_id = ? AND (`+strings.Join(conditions, " OR ")+`)
+		ORDER BY id
+		FOR UPDATE
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock seats: %w", err)
+	}
+	var targets []blockTarget
+	for rows.Next() {
+		var t blockTarget
+		if err := rows.Scan(&t.id, &t.row, &t.reserved, &t.paymentStatus); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan seat: %w", err)
+		}
+		targets = append(targets, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating seats: %w", err)
+	}
+
+	foundSeats := make(map[int]bool, len(targets))
+	foundRows := make(map[string]bool)
+	for _, t := range targets {
+		foundSeats[t.id] = true
+		foundRows[t.row.String] = true
+	}
+	var missing []string
+	for _, seatID := range req.SeatIDs {
+		if !foundSeats[seatID] {
+			missing = append(missing, "seat "+strconv.Itoa(seatID))
+		}
+	}
+	for _, row := range req.Rows {
+		if !foundRows[row] {
+			missing = append(missing, "row "+row)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%w in show %d: %s", errSeatBlockNotFound, showID, strings.Join(missing, ", "))
+	}
+	return targets, nil
+}
+
+// handleBlockedSeats serves GET /admin/shows/{id}/seats/blocked.
+func handleBlockedSeats(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, seat_number, seat_row, block_reason, blocked_at FROM seats
+		WHERE show_id = ? AND is_reserved = 1 AND payment_status = 'BLOCKED'
+		ORDER BY id
+	`, showID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load blocked seats", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	seats := []BlockedSeat{}
+	for rows.Next() {
+		var seat BlockedSeat
+		var row, reason sql.NullString
+		var blockedAt sql.NullTime
+		if err := rows.Scan(&seat.SeatID, &seat.Label, &row, &reason, &blockedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to scan blocked seat", "component", "admin", "show_id", showID, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if row.Valid {
+			seat.Row = &row.String
+		}
+		if blockedAt.Valid {
+			seat.BlockedAt = &blockedAt.Time
+		}
+		seat.Reason = reason.String
+		seats = append(seats, seat)
+	}
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read blocked seats", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"show_id": showID, "seats": seats})
+}
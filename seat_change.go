@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Seat changes. A user whose booking is still waiting for payment (HELD or PENDING_PAYMENT)
+// can change its seats with POST /api/bookings/{id}/seats, naming the seats it should have.
+// In one transaction, with the booking's seats and the new ones locked, the seats dropped go
+// back to inventory and the new ones are held under the same booking until the hold ends, as
+// the old ones were; nobody can take the new seats in between or end up with the old ones
+// while the booking still has them. Unlike a seat upgrade (seat_upgrade.go), nothing is paid
+// in between. Like a booking it needs bookings:write from a partner key, and the seats it adds
+// beyond those it releases count against the partner's daily seat quota (partner_keys.go).
+//
+// The booking keeps its checkout when its price doesn't change. When it does, the amount the
+// payment has to match is updated in the transaction, so a payment through the old checkout
+// goes to review, and after it the old checkout is closed at the gateway and a new one opened.
+// If the gateway won't close the old one no new one is opened, so the booking can't be paid
+// twice; if opening the new one fails the booking is left without one and asking for the same
+// seats again opens it.
+
+var (
+	errPendingBookingNotFound = errors.New("no booking waiting for payment found for this user")
+	errSeatChangeInvalidSeats = errors.New("seat change must name seats of the booking's show")
+	errSeatChangeUnavailable  = errors.New("requested seats are not available")
+)
+
+type SeatChangeRequest struct {
+	UserID  int   `json:"user_id"`
+	SeatIDs []int `json:"seat_ids"`
+}
+
+type SeatChangeResponse struct {
+	BookingID       string       `json:"booking_id"`
+	State           BookingState `json:"state"`
+	SeatIDs         []int        `json:"seat_ids"`
+	ReleasedSeatIDs []int        `json:"released_seat_ids"`
+	AddedSeatIDs    []int        `json:"added_seat_ids"`
+	AmountCents     int64        `json:"amount_cents"`
+	Currency        string       `json:"currency"`
+	// CheckoutReopened is set when the price changed and a new checkout was opened.
+	CheckoutReopened bool       `json:"checkout_reopened"`
+	RedirectURL      string     `json:"redirect_url,omitempty"`
+	HoldExpiresAt    *time.Time `json:"hold_expires_at,omitempty"`
+}
+
+// handleChangeBookingSeats serves POST /api/bookings/{id}/seats.
+func handleChangeBookingSeats(w http.ResponseWriter, r *http.Request) {
+	bookingID := r.PathValue("id")
+
+	var req SeatChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 || len(req.SeatIDs) == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.SeatIDs) > strategyConfig.Bulk.MaxSeatsPerRequest {
+		http.Error(w, fmt.Sprintf("at most %d seats", strategyConfig.Bulk.MaxSeatsPerRequest), http.StatusBadRequest)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Seat change requested", "component", "api", "booking_id", bookingID, "user_id", req.UserID, "seat_ids", req.SeatIDs)
+
+	resp, err := changeBookingSeats(r.Context(), bookingID, req.UserID, req.SeatIDs)
+	switch {
+	case errors.Is(err, errPendingBookingNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errSeatChangeInvalidSeats):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errSeatChangeUnavailable), errors.Is(err, ErrSeatLimitExceeded):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errCheckoutNotClosed):
+		// The seats changed, the old checkout may still take the old price.
+		slog.WarnContext(r.Context(), "Gateway refused to close checkout", "component", "api", "booking_id", bookingID, "provider", paymentProvider.Name(), "error", err)
+		http.Error(w, "Seats changed but the old checkout couldn't be closed at the payment gateway; it may have been paid", http.StatusBadGateway)
+		return
+	case err != nil && resp != nil:
+		// The seats changed, the new checkout didn't open.
+		slog.ErrorContext(r.Context(), "Failed to reopen checkout", "component", "api", "booking_id", bookingID, "error", err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Seats changed but the checkout couldn't be reopened, ask for the same seats again", http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Failed to change seats", "component", "api", "booking_id", bookingID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Seats changed", "component", "api", "booking_id", bookingID, "released", resp.ReleasedSeatIDs, "added", resp.AddedSeatIDs, "checkout_reopened", resp.CheckoutReopened)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// seatChangeSeats counts for the partner quota the seats a seat change adds to its booking,
+// less the ones it releases.
+func seatChangeSeats(r *http.Request, body []byte) (int, int, error) {
+	var req SeatChangeRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return 0, 0, errInvalidRequestBody
+	}
+	var held, showID int
+	err := db.QueryRowContext(r.Context(), `
+		SELECT COUNT(*), COALESCE(MAX(s.show_id), 0) FROM booking_seats bs
+		JOIN seats s ON s.id = bs.seat_id
+		WHERE bs.booking_id = ?
+	`, r.PathValue("id")).Scan(&held, &showID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to count booking seats: %w", err)
+	}
+	// Added less released is simply the seats it ends up with less the ones it has.
+	want := slices.Compact(slices.Sorted(slices.Values(req.SeatIDs)))
+	return showID, max(len(want)-held, 0), nil
+}
+
+// changeBookingSeats moves the booking onto seatIDs. It returns the change made along with the
+// error when only closing the old checkout or opening the new one failed.
+func changeBookingSeats(ctx context.Context, bookingID string, userID int, seatIDs []int) (*SeatChangeResponse, error) {
+	want := slices.Compact(slices.Sorted(slices.Values(seatIDs)))
+
+	var resp *SeatChangeResponse
+	var reopen bool
+	var oldCheckout sql.NullString
+	var showID int
+	err := runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		resp, reopen, oldCheckout = nil, false, sql.NullString{}
+		held, show, holdUntil, err := lockPendingSeats(ctx, tx, bookingID, userID)
+		if err != nil {
+			return err
+		}
+		showID = show
+		state, err := lockBookingState(ctx, tx, bookingID)
+		if err != nil {
+			return err
+		}
+		if state != BookingHeld && state != BookingPendingPayment {
+			return errPendingBookingNotFound
+		}
+
+		change := &SeatChangeResponse{BookingID: bookingID, State: state, SeatIDs: want, ReleasedSeatIDs: []int{}, AddedSeatIDs: []int{}, HoldExpiresAt: &holdUntil}
+		for _, seatID := range held {
+			if !slices.Contains(want, seatID) {
+				change.ReleasedSeatIDs = append(change.ReleasedSeatIDs, seatID)
+			}
+		}
+		for _, seatID := range want {
+			if !slices.Contains(held, seatID) {
+				change.AddedSeatIDs = append(change.AddedSeatIDs, seatID)
+			}
+		}
+
+		if len(change.AddedSeatIDs) > 0 {
+			seats, err := readSeatAvailability(ctx, tx, change.AddedSeatIDs, seatLockForUpdate)
+			if err != nil {
+				return fmt.Errorf("failed to lock new seats: %w", err)
+			}
+			if len(seats) != len(change.AddedSeatIDs) {
+				return errSeatChangeInvalidSeats
+			}
+			for _, seat := range seats {
+				if seat.ShowID != showID {
+					return errSeatChangeInvalidSeats
+				}
+			}
+			if unavailable := unavailableSeats(change.AddedSeatIDs, seats); len(unavailable) > 0 {
+				return fmt.Errorf("%w: %v", errSeatChangeUnavailable, unavailable)
+			}
+		}
+
+		prices, currency, err := seatPrices(ctx, tx, want)
+		if err != nil {
+			return err
+		}
+		for _, seatID := range want {
+			change.AmountCents += int64(prices[seatID])
+		}
+		change.Currency = currency
+		checkout, err := loadBookingCheckout(ctx, tx, bookingID)
+		if err != nil {
+			return err
+		}
+		change.RedirectURL = checkout.RedirectURL.String
+
+		if len(change.AddedSeatIDs) > 0 {
+			_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+				UPDATE seats
+				SET is_reserved = 1,
+				    payment_status = 'PENDING',
+				    user_id = ?,
+				    payment_session_id = ?,
+				    payment_timeout = ?
+				WHERE id IN (%s)`, generatePlaceholders(len(change.AddedSeatIDs))),
+				append([]interface{}{userID, bookingID, holdUntil}, sliceToInterface(change.AddedSeatIDs)...)...)
+			if err != nil {
+				return fmt.Errorf("failed to hold new seats: %w", err)
+			}
+		}
+		if len(change.ReleasedSeatIDs) > 0 {
+			if err := releaseSeatRows(ctx, tx, change.ReleasedSeatIDs, HoldReleased); err != nil {
+				return fmt.Errorf("failed to release old seats: %w", err)
+			}
+		}
+		if err := moveBookingSeats(ctx, tx, bookingID, change.ReleasedSeatIDs, change.AddedSeatIDs); err != nil {
+			return err
+		}
+		if len(change.AddedSeatIDs) > len(change.ReleasedSeatIDs) {
+			if err := checkSeatLimit(ctx, tx, userID, showID); err != nil {
+				return err
+			}
+		}
+
+		if state == BookingPendingPayment {
+			priced := checkout.AmountCents.Valid && checkout.AmountCents.Int64 == change.AmountCents
+			if !priced || !checkout.ProviderSessionID.Valid {
+				// The open checkout asks for the old price: payments through it must not match.
+				_, err := tx.ExecContext(ctx, `
+					UPDATE bookings SET provider_session_id = NULL, payment_amount_cents = ?, payment_currency = ?, updated_at = ?
+					WHERE id = ?
+				`, change.AmountCents, currency, time.Now(), bookingID)
+				if err != nil {
+					return fmt.Errorf("failed to reprice booking: %w", err)
+				}
+				reopen, oldCheckout = true, checkout.ProviderSessionID
+			}
+		}
+		resp = change
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.ReleasedSeatIDs) > 0 {
+		lockKeys := make([]string, 0, len(resp.ReleasedSeatIDs))
+		for _, seatID := range resp.ReleasedSeatIDs {
+			lockKeys = append(lockKeys, seatLockKey(showID, seatID))
+		}
+		lockProvider.Release(ctx, lockKeys, seatLockOwner(int64(userID)))
+		redlock.Unlock(ctx, redlockSeatKeys(resp.ReleasedSeatIDs), bookingID)
+	}
+
+	if oldCheckout.Valid {
+		if err := paymentProvider.CancelSession(ctx, oldCheckout.String); err != nil {
+			return resp, fmt.Errorf("%w: %v", errCheckoutNotClosed, err)
+		}
+	}
+	if reopen {
+		session, err := attachPaymentSession(ctx, bookingID)
+		if err != nil {
+			return resp, err
+		}
+		resp.CheckoutReopened = true
+		resp.RedirectURL = session.RedirectURL
+	}
+	return resp, nil
+}
+
+// lockPendingSeats locks the seats a booking holds waiting for payment and returns them with
+// their show and when the hold ends.
+func lockPendingSeats(ctx context.Context, tx *sql.Tx, bookingID string, userID int) ([]int, int, time.Time, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, show_id, payment_timeout FROM seats
+		WHERE payment_session_id = ? AND user_id = ? AND payment_status = 'PENDING' AND is_reserved = 1
+		ORDER BY id
+		FOR UPDATE
+	`, bookingID, userID)
+	if err != nil {
+		return nil, 0, time.Time{}, fmt.Errorf("failed to lock booking seats: %w", err)
+	}
+	defer rows.Close()
+
+	var seatIDs []int
+	var showID int
+	var holdUntil time.Time
+	for rows.Next() {
+		var seatID int
+		var timeout sql.NullTime
+		if err := rows.Scan(&seatID, &showID, &timeout); err != nil {
+			return nil, 0, time.Time{}, fmt.Errorf("failed to scan booking seat: %w", err)
+		}
+		if timeout.Valid && (holdUntil.IsZero() || timeout.Time.Before(holdUntil)) {
+			holdUntil = timeout.Time
+		}
+		seatIDs = append(seatIDs, seatID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, time.Time{}, fmt.Errorf("error iterating booking seats: %w", err)
+	}
+	if len(seatIDs) == 0 || holdUntil.IsZero() {
+		return nil, 0, time.Time{}, errPendingBookingNotFound
+	}
+	sort.Ints(seatIDs)
+	return seatIDs, showID, holdUntil, nil
+}
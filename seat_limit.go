@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Seat limit per user and show. With seat_limit.per_user_per_show set, a user may hold at most
+// that many seats of one show across all their bookings, held, waiting for payment or paid
+// (PENDING, REVIEW and COMPLETED seats; seats being refunded don't count). The check runs in
+// the booking's own transaction, after its seats are held, from recordBookingHold, which every
+// database strategy and the waitlist go through, and from seat changes that add seats. An
+// upgrade holds its new seats while the booking still has the old ones, so it leaves those out
+// of the count. Before counting it locks the user's row for the show in seat_limit_locks, so
+// two bookings of the same user for the same show count one after the other: the second sees
+// the first's seats once it commits, or none if it rolled back. Parallel requests can't each
+// see room for themselves. A booking over the limit fails as a whole with
+// ErrSeatLimitExceeded, 409 SEAT_LIMIT_EXCEEDED, and a request for more seats than the limit
+// is turned down before it starts. The memory strategy counts its own store the same way, one
+// booking per user at a time (memory_store.go).
+
+// SeatLimitConfig caps the seats a user may hold per show, see seat_limit.go.
+type SeatLimitConfig struct {
+	PerUserPerShow int `json:"per_user_per_show"` // SEAT_LIMIT_PER_USER_PER_SHOW, 0 for no limit
+}
+
+var ErrSeatLimitExceeded = errors.New("seat limit per user and show exceeded")
+
+// seatLimit is the configured limit, 0 when there is none.
+func seatLimit() int {
+	return strategyConfig.SeatLimit.PerUserPerShow
+}
+
+// checkSeatLimit fails with ErrSeatLimitExceeded when the user holds more seats of the show
+// than the limit, counting the seats tx holds itself.
+func checkSeatLimit(ctx context.Context, tx *sql.Tx, userID, showID int) error {
+	limit := seatLimit()
+	if limit <= 0 {
+		return nil
+	}
+	if err := lockUserShow(ctx, tx, userID, showID); err != nil {
+		return err
+	}
+	held, err := userShowSeats(ctx, tx, userID, showID)
+	if err != nil {
+		return err
+	}
+	held -= seatLimitReleasingFromContext(ctx)
+	if held > limit {
+		return fmt.Errorf("%w: user %d would hold %d seats of show %d, the limit is %d", ErrSeatLimitExceeded, userID, held, showID, limit)
+	}
+	return nil
+}
+
+type seatLimitReleasingContextKey struct{}
+
+// withSeatLimitReleasing makes the seat limit check under ctx leave out n paid seats the
+// booking gives back, an upgrade's original seats: until the upgrade completes or fails the
+// user holds both sets, but only ever keeps one.
+func withSeatLimitReleasing(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, seatLimitReleasingContextKey{}, n)
+}
+
+func seatLimitReleasingFromContext(ctx context.Context) int {
+	n, _ := ctx.Value(seatLimitReleasingContextKey{}).(int)
+	return n
+}
+
+// lockUserShow locks the user's seat_limit_locks row for the show for the rest of tx,
+// creating it the first time.
+func lockUserShow(ctx context.Context, tx *sql.Tx, userID, showID int) error {
+	query := `INSERT INTO seat_limit_locks (user_id, show_id) VALUES (?, ?) ON DUPLICATE KEY UPDATE user_id = user_id`
+	if dbDriver == "postgres" {
+		query = `INSERT INTO seat_limit_locks (user_id, show_id) VALUES (?, ?) ON CONFLICT (user_id, show_id) DO UPDATE SET user_id = EXCLUDED.user_id`
+	}
+	if _, err := tx.ExecContext(ctx, query, userID, showID); err != nil {
+		return fmt.Errorf("failed to lock user %d for show %d: %w", userID, showID, err)
+	}
+	return nil
+}
+
+// userShowSeats counts the seats of the show the user holds or has paid for.
+func userShowSeats(ctx context.Context, q rowQueryer, userID, showID int) (int, error) {
+	var held int
+	err := q.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM seats
+		WHERE show_id = ? AND user_id = ? AND is_reserved = 1 AND payment_status IN ('PENDING', 'REVIEW', 'COMPLETED')
+	`, showID, userID).Scan(&held)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count seats of user %d for show %d: %w", userID, showID, err)
+	}
+	return held, nil
+}
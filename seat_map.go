@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// Seat map. GET /api/shows/{id}/seats lists every seat of a show as a seat picker draws it:
+// its label, row and column (migrations/mysql/026_seat_layout.sql), price tier and price, and
+// status, with the same available, held, sold and blocked as the live feed
+// (seat_status_feed.go), seats handed to a sales channel (channel_allocations.go) being
+// blocked too, as they aren't on sale here. Seats without a layout come with no row or column,
+// and without a tier in "standard".
+
+const seatMapBlocked = "blocked"
+
+type SeatMap struct {
+	ShowID   int           `json:"show_id"`
+	Currency string        `json:"currency"`
+	Seats    []SeatMapSeat `json:"seats"`
+}
+
+type SeatMapSeat struct {
+	SeatID     int     `json:"seat_id"`
+	Label      string  `json:"label"`
+	Row        *string `json:"row"`
+	Column     *int    `json:"column"`
+	PriceTier  string  `json:"price_tier"`
+	PriceCents int     `json:"price_cents"`
+	Status     string  `json:"status"` // available, held, sold or blocked
+}
+
+// handleSeatMap serves GET /api/shows/{id}/seats.
+func handleSeatMap(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT s.id, s.seat_number, s.seat_row, s.seat_column, COALESCE(s.price_tier, 'standard'),
+		       COALESCE(s.price_cents, sh.price_cents), sh.currency,
+		       s.is_reserved, s.payment_status, s.allocation_id IS NOT NULL
+		FROM seats s JOIN shows sh ON sh.id = s.show_id
+		WHERE s.show_id = ?
+		ORDER BY s.id
+	`, showID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load seat map", "component", "seat_map", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	seatMap := SeatMap{ShowID: showID, Seats: []SeatMapSeat{}}
+	for rows.Next() {
+		var seat SeatMapSeat
+		var row sql.NullString
+		var column sql.NullInt64
+		var reserved, allocated bool
+		var paymentStatus sql.NullString
+		err := rows.Scan(&seat.SeatID, &seat.Label, &row, &column, &seat.PriceTier,
+			&seat.PriceCents, &seatMap.Currency, &reserved, &paymentStatus, &allocated)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to scan seat", "component", "seat_map", "show_id", showID, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if row.Valid {
+			seat.Row = &row.String
+		}
+		if column.Valid {
+			c := int(column.Int64)
+			seat.Column = &c
+		}
+		seat.Status = seatMapStatus(reserved, paymentStatus.String, allocated)
+		seatMap.Seats = append(seatMap.Seats, seat)
+	}
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load seat map", "component", "seat_map", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(seatMap.Seats) == 0 {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(seatMap)
+}
+
+// seatMapStatus is a seat's status on the map. A channel's seats are blocked until it sells
+// them, sold after.
+func seatMapStatus(reserved bool, paymentStatus string, allocated bool) string {
+	if !reserved || paymentStatus == "FAILED" {
+		return seatFeedAvailable
+	}
+	if allocated && paymentStatus == "PENDING" {
+		return seatMapBlocked
+	}
+	return seatFeedStatus(paymentStatus)
+}
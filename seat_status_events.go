@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Seat availability as Server-Sent Events, for clients that can't use the WebSocket
+// (seat_status_feed.go). GET /sse/shows/{id}/seats streams the same snapshot and change
+// messages from the same feed, as "snapshot" and "change" events whose id is the seat_audit
+// version. A client that reconnects with Last-Event-ID, which browsers' EventSource send on
+// their own, gets the changes since then instead of a new snapshot, unless there are more than
+// maxSnapshotDelta of them.
+
+const (
+	seatEventsHeartbeat = 15 * time.Second
+	// seatEventsRetry is the reconnection delay clients are asked to use, in ms.
+	seatEventsRetry = 2000
+)
+
+// handleSeatStatusEvents serves /sse/shows/{id}/seats.
+func handleSeatStatusEvents(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+	var lastEventID int64
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if lastEventID, err = strconv.ParseInt(v, 10, 64); err != nil || lastEventID < 0 {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribed before the catch-up is read, so no change falls between the two.
+	sub := seatFeed.subscribe(showID)
+	defer seatFeed.unsubscribe(showID, sub)
+
+	var changes []SeatStatusChange
+	if lastEventID > 0 {
+		changes, err = seatStatusChangesSince(r.Context(), showID, lastEventID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to load seat changes", "component", "seat_feed", "show_id", showID, "since", lastEventID, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	var snapshot *SeatStatusSnapshot
+	if lastEventID == 0 || len(changes) > maxSnapshotDelta {
+		s, err := showSeatStatuses(r.Context(), showID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to load seat statuses", "component", "seat_feed", "show_id", showID, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if len(s.Seats) == 0 {
+			http.Error(w, "Show not found", http.StatusNotFound)
+			return
+		}
+		snapshot, changes = &s, nil
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Proxies that buffer responses would hold the events back.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	fmt.Fprintf(w, "retry: %d\n\n", seatEventsRetry)
+
+	sent := lastEventID
+	if snapshot != nil {
+		if err := writeSeatEvent(w, "snapshot", snapshot.Version, snapshot); err != nil {
+			return
+		}
+		sent = snapshot.Version
+	}
+	for _, change := range changes {
+		if err := writeSeatEvent(w, "change", change.Version, change); err != nil {
+			return
+		}
+		sent = change.Version
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(seatEventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case message := <-sub.messages:
+			change, ok := message.(SeatStatusChange)
+			if !ok || change.Version <= sent {
+				continue
+			}
+			if err := writeSeatEvent(w, "change", change.Version, change); err != nil {
+				return
+			}
+			sent = change.Version
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-sub.dropped:
+			// The client reconnects with Last-Event-ID and picks up where it fell behind.
+			slog.InfoContext(r.Context(), "Dropping seat event stream", "component", "seat_feed", "show_id", showID)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeSeatEvent(w http.ResponseWriter, event string, id int64, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", event, id, payload)
+	return err
+}
+
+// seatStatusChangesSince returns the show's seat changes after version, up to one more than
+// maxSnapshotDelta.
+func seatStatusChangesSince(ctx context.Context, showID int, version int64) ([]SeatStatusChange, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, seat_id, new_status FROM seat_audit
+		WHERE show_id = ? AND id > ?
+		ORDER BY id
+		LIMIT ?
+	`, showID, version, maxSnapshotDelta+1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seat changes: %w", err)
+	}
+	defer rows.Close()
+
+	var changes []SeatStatusChange
+	for rows.Next() {
+		var status string
+		change := SeatStatusChange{Type: "change"}
+		if err := rows.Scan(&change.Version, &change.SeatID, &status); err != nil {
+			return nil, fmt.Errorf("failed to scan seat change: %w", err)
+		}
+		change.Status = seatFeedStatus(status)
+		change.Event = seatFeedEvent(change.Status)
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Live seat status. /ws/shows/{id}/seats is a WebSocket that pushes every seat of the show
+// that is held, released, sold or blocked (seat_blocks.go), for seat maps that have to stay
+// right during a rush. It is fed by the seat audit log (seat_audit.go), which every strategy,
+// the reaper and the other jobs write to through the trigger on seats, so nothing that moves a
+// seat is missed. The maintenance leader relays the log to every instance over Redis pub/sub
+// (seat_status_relay.go), and each instance fans the changes out to its own sockets.
+//
+// A socket first gets a snapshot of the show's seats, then a change per seat move. Changes the
+// snapshot already shows may be sent again; applying one twice does nothing. A client that
+// can't keep up is disconnected and should reconnect for a new snapshot. seat_audit ids, the
+// changes' version, are assigned at insert time like seat_changes ids (show_snapshot.go), so a
+// change committed late arrives after changes with a higher version: the relay sends it once
+// it commits (seat_status_relay.go). Clients apply changes in the order they arrive and don't
+// drop one for being older than the last version seen.
+
+const (
+	// seatFeedBuffer is how many messages a socket may fall behind before it is dropped.
+	seatFeedBuffer     = 256
+	seatFeedPingPeriod = 30 * time.Second
+	seatFeedWriteWait  = 10 * time.Second
+)
+
+// Seat statuses on the feed.
+const (
+	seatFeedAvailable = "available"
+	seatFeedHeld      = "held"
+	seatFeedSold      = "sold"
+)
+
+type SeatStatusSnapshot struct {
+	Type    string             `json:"type"` // "snapshot"
+	ShowID  int                `json:"show_id"`
+	Version int64              `json:"version"`
+	Seats   []SeatStatusChange `json:"seats"`
+}
+
+type SeatStatusChange struct {
+	Type    string `json:"type,omitempty"` // "change", empty inside a snapshot
+	SeatID  int    `json:"seat_id"`
+	Status  string `json:"status"`          // available, held, sold or blocked
+	Event   string `json:"event,omitempty"` // held, released, sold or blocked
+	Version int64  `json:"version,omitempty"`
+}
+
+// seatFeedStatus maps a seat's audit status to its status on the feed.
+func seatFeedStatus(auditStatus string) string {
+	switch auditStatus {
+	case "AVAILABLE":
+		return seatFeedAvailable
+	case "COMPLETED", "REFUND_PENDING":
+		return seatFeedSold
+	case "BLOCKED":
+		return seatMapBlocked
+	default:
+		return seatFeedHeld
+	}
+}
+
+func seatFeedEvent(status string) string {
+	if status == seatFeedAvailable {
+		return "released"
+	}
+	return status
+}
+
+type seatFeedSubscriber struct {
+	messages chan interface{}
+	// dropped is closed when the feed gives up on the subscriber.
+	dropped   chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *seatFeedSubscriber) drop() {
+	s.closeOnce.Do(func() { close(s.dropped) })
+}
+
+// SeatFeed fans seat changes out to the sockets watching each show.
+type SeatFeed struct {
+	mu          sync.Mutex
+	subscribers map[int]map[*seatFeedSubscriber]struct{}
+}
+
+var seatFeed = &SeatFeed{subscribers: make(map[int]map[*seatFeedSubscriber]struct{})}
+
+func (f *SeatFeed) subscribe(showID int) *seatFeedSubscriber {
+	sub := &seatFeedSubscriber{messages: make(chan interface{}, seatFeedBuffer), dropped: make(chan struct{})}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subscribers[showID] == nil {
+		f.subscribers[showID] = make(map[*seatFeedSubscriber]struct{})
+	}
+	f.subscribers[showID][sub] = struct{}{}
+	return sub
+}
+
+func (f *SeatFeed) unsubscribe(showID int, sub *seatFeedSubscriber) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subscribers[showID], sub)
+	if len(f.subscribers[showID]) == 0 {
+		delete(f.subscribers, showID)
+	}
+}
+
+// publish hands a change to the show's subscribers, dropping those whose buffer is full.
+func (f *SeatFeed) publish(showID int, change SeatStatusChange) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subscribers[showID] {
+		select {
+		case sub.messages <- change:
+		default:
+			sub.drop()
+		}
+	}
+}
+
+// closeAll drops every subscriber, their sockets close.
+func (f *SeatFeed) closeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, subs := range f.subscribers {
+		for sub := range subs {
+			sub.drop()
+		}
+	}
+}
+
+// showSeatStatuses is the snapshot a new socket starts from.
+func showSeatStatuses(ctx context.Context, showID int) (SeatStatusSnapshot, error) {
+	snapshot := SeatStatusSnapshot{Type: "snapshot", ShowID: showID, Seats: []SeatStatusChange{}}
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM seat_audit WHERE show_id = ?`, showID).Scan(&snapshot.Version)
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to read latest seat change: %w", err)
+	}
+	rows, err := db.QueryContext(ctx, `SELECT id, is_reserved, payment_status FROM seats WHERE show_id = ? ORDER BY id`, showID)
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to load seats: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var seatID int
+		var reserved bool
+		var paymentStatus sql.NullString
+		if err := rows.Scan(&seatID, &reserved, &paymentStatus); err != nil {
+			return snapshot, fmt.Errorf("failed to scan seat: %w", err)
+		}
+		auditStatus := "AVAILABLE"
+		if reserved && paymentStatus.String != "FAILED" {
+			auditStatus = strings.ToUpper(paymentStatus.String)
+		}
+		snapshot.Seats = append(snapshot.Seats, SeatStatusChange{SeatID: seatID, Status: seatFeedStatus(auditStatus)})
+	}
+	return snapshot, rows.Err()
+}
+
+// The feed is public, like the snapshot and changes endpoints, so any page may open it.
+var seatFeedUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// handleSeatStatusSocket serves /ws/shows/{id}/seats.
+func handleSeatStatusSocket(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+
+	// Subscribed before the snapshot is read, so no change falls between the two.
+	sub := seatFeed.subscribe(showID)
+	defer seatFeed.unsubscribe(showID, sub)
+	snapshot, err := showSeatStatuses(r.Context(), showID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load seat statuses", "component", "seat_feed", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(snapshot.Seats) == 0 {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+
+	conn, err := seatFeedUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has answered the client already.
+		slog.WarnContext(r.Context(), "Failed to open seat socket", "component", "seat_feed", "show_id", showID, "error", err)
+		return
+	}
+	defer conn.Close()
+	slog.DebugContext(r.Context(), "Seat socket opened", "component", "seat_feed", "show_id", showID)
+
+	// Nothing is read from clients; reading notices when they go away.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := writeSeatFeedMessage(conn, snapshot); err != nil {
+		return
+	}
+	ping := time.NewTicker(seatFeedPingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case message := <-sub.messages:
+			if err := writeSeatFeedMessage(conn, message); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(seatFeedWriteWait)); err != nil {
+				return
+			}
+		case <-sub.dropped:
+			slog.InfoContext(r.Context(), "Dropping seat socket", "component", "seat_feed", "show_id", showID)
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "reconnect for a new snapshot"), time.Now().Add(seatFeedWriteWait))
+			return
+		case <-gone:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeSeatFeedMessage(conn *websocket.Conn, message interface{}) error {
+	conn.SetWriteDeadline(time.Now().Add(seatFeedWriteWait))
+	return conn.WriteJSON(message)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Cross-instance fan-out of seat changes. A booking changes seats on whichever instance took
+// it, and the reaper and the other jobs on the leader, but the sockets and event streams
+// watching a show are spread over every instance. The maintenance leader reads the seat audit
+// log every seatRelayInterval and publishes what is new, a batch per message, on the Redis
+// channel seatStatusChannel; every instance subscribes to it and hands the changes to its
+// SeatFeed. Anything else an instance keeps per show can listen on the same channel. The relay
+// also keeps the cached availability counts (show_availability.go) and the sold-out flags
+// (sold_out.go) in step, and offers seats back on sale to the show's waitlist (waitlist.go).
+//
+// Audit ids are assigned at insert but rows become visible at commit, so a change can turn up
+// below one already relayed. The relay's cursor is therefore a low-water mark: every id up to
+// it has been relayed, or was missing for longer than seatRelayLag after a later row was
+// logged and is taken to be rolled back. Each pass reads from the cursor and skips the rows
+// above it it already relayed, so a late commit is relayed when it shows up. The cursor is
+// kept in Redis, so a new leader carries on where the old one stopped; the rows above it are
+// remembered in memory only, and a new leader relays them again (the feed and the counts take
+// repeats). Pub/sub delivers to whoever is subscribed at the time only: when an instance's
+// subscription drops and comes back, it disconnects its clients so they resync.
+
+const (
+	seatStatusChannel  = "seat_status_changes"
+	seatRelayCursorKey = "seat_status_relay:cursor"
+	seatRelayInterval  = 250 * time.Millisecond
+	seatRelayBatchSize = 1000
+	// seatRelayLag is how long a gap in the audit ids is waited on before the cursor passes it.
+	seatRelayLag        = 30 * time.Second
+	seatRelayPingPeriod = 30 * time.Second
+	// seatRelayRetryPause keeps the subscriber from spinning while Redis is unreachable.
+	seatRelayRetryPause = 1 * time.Second
+)
+
+// seatRelaySeen holds the ids above the cursor that were already relayed. Only the relay
+// touches it.
+var seatRelaySeen = make(map[int64]bool)
+
+type seatStatusMessage struct {
+	ShowID int              `json:"show_id"`
+	Change SeatStatusChange `json:"change"`
+}
+
+func runSeatStatusRelay() error {
+	ticker := time.NewTicker(seatRelayInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !runsMaintenance() {
+			continue
+		}
+		if err := relaySeatChanges(); err != nil {
+			slog.Error("Failed to relay seat changes", "component", "seat_feed", "error", err)
+		}
+	}
+	return errors.New("ending seat status relay")
+}
+
+// relaySeatChanges publishes the seat changes logged since the relay's cursor.
+func relaySeatChanges() error {
+	cursor, err := rdb.Get(ctx, seatRelayCursorKey).Int64()
+	if errors.Is(err, redis.Nil) {
+		// First run: start from now, sockets get the past from their snapshot.
+		if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM seat_audit`).Scan(&cursor); err != nil {
+			return fmt.Errorf("failed to read latest seat change: %w", err)
+		}
+		return rdb.Set(ctx, seatRelayCursorKey, cursor, 0).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read relay cursor: %w", err)
+	}
+
+	for runsMaintenance() {
+		// Room for a full batch of new rows next to the ones already relayed.
+		limit := seatRelayBatchSize + len(seatRelaySeen)
+		rows, err := db.QueryContext(ctx, `
+			SELECT id, seat_id, show_id, old_status, new_status, changed_at FROM seat_audit
+			WHERE id > ?
+			ORDER BY id
+			LIMIT ?
+		`, cursor, limit)
+		if err != nil {
+			return fmt.Errorf("failed to read seat changes: %w", err)
+		}
+		var batch []seatStatusMessage
+		availability := make(map[int][]availabilityChange)
+		soldOut := make(map[int]bool)
+		freed := make(map[int]bool)
+		settled, gap := cursor, false
+		lagged := time.Now().Add(-seatRelayLag)
+		read := 0
+		for rows.Next() {
+			var message seatStatusMessage
+			var oldStatus, status string
+			var changedAt time.Time
+			message.Change.Type = "change"
+			if err := rows.Scan(&message.Change.Version, &message.Change.SeatID, &message.ShowID, &oldStatus, &status, &changedAt); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan seat change: %w", err)
+			}
+			read++
+			// The cursor moves over consecutive ids, and over a gap once the row after it is
+			// old enough that whatever was missing isn't coming.
+			id := message.Change.Version
+			if !gap && (id == settled+1 || changedAt.Before(lagged)) {
+				settled = id
+			} else {
+				gap = true
+			}
+			if seatRelaySeen[id] {
+				continue
+			}
+			message.Change.Status = seatFeedStatus(status)
+			message.Change.Event = seatFeedEvent(message.Change.Status)
+			batch = append(batch, message)
+			if delta := availabilityDelta(oldStatus, status); delta != 0 {
+				availability[message.ShowID] = append(availability[message.ShowID], availabilityChange{delta, message.Change.Version})
+			}
+			// Only a payment or a block can sell a show out, and only a seat back on sale can end it.
+			if availabilityDelta(oldStatus, status) > 0 {
+				freed[message.ShowID] = true
+				soldOut[message.ShowID] = true
+			} else if status == "COMPLETED" || status == "BLOCKED" {
+				soldOut[message.ShowID] = true
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to read seat changes: %w", err)
+		}
+		if len(batch) == 0 && settled == cursor {
+			return nil
+		}
+		if err := relaySeatBatch(batch, availability, freed, soldOut); err != nil {
+			return err
+		}
+		for _, message := range batch {
+			seatRelaySeen[message.Change.Version] = true
+		}
+		for id := range seatRelaySeen {
+			if id <= settled {
+				delete(seatRelaySeen, id)
+			}
+		}
+		cursor = settled
+		if err := rdb.Set(ctx, seatRelayCursorKey, cursor, 0).Err(); err != nil {
+			return fmt.Errorf("failed to save relay cursor: %w", err)
+		}
+		if read < limit {
+			return nil
+		}
+	}
+	return nil
+}
+
+// relaySeatBatch applies a batch of seat changes to the availability counts, the waitlists and
+// the sold-out flags of their shows, and publishes it.
+func relaySeatBatch(batch []seatStatusMessage, availability map[int][]availabilityChange, freed, soldOut map[int]bool) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	// Counted before the cursor moves; a batch sent again is skipped by version.
+	if err := applyAvailabilityChanges(availability); err != nil {
+		return err
+	}
+	// The waitlist gets freed seats before the sold-out flag lets anyone else at them.
+	for showID := range freed {
+		if err := offerWaitlistSeats(showID); err != nil {
+			return err
+		}
+	}
+	for showID := range soldOut {
+		if err := syncShowSoldOut(showID); err != nil {
+			return err
+		}
+	}
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to encode seat changes: %w", err)
+	}
+	if err := rdb.Publish(ctx, seatStatusChannel, payload).Err(); err != nil {
+		return fmt.Errorf("failed to publish seat changes: %w", err)
+	}
+	return nil
+}
+
+// runSeatStatusSubscriber feeds the changes the leader publishes to this instance's sockets.
+func runSeatStatusSubscriber() error {
+	pubsub := rdb.Subscribe(ctx, seatStatusChannel)
+	defer pubsub.Close()
+
+	subscribed := false
+	for {
+		received, err := pubsub.ReceiveTimeout(ctx, seatRelayPingPeriod)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// Quiet channel: make sure the connection is still there.
+			if err := pubsub.Ping(ctx); err != nil {
+				slog.Warn("Seat change subscription ping failed", "component", "seat_feed", "error", err)
+			}
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to receive seat changes", "component", "seat_feed", "error", err)
+			time.Sleep(seatRelayRetryPause)
+			continue
+		}
+
+		switch m := received.(type) {
+		case *redis.Subscription:
+			if subscribed {
+				// Whatever was published while the subscription was down is lost.
+				slog.Warn("Seat change subscription restored, resyncing clients", "component", "seat_feed")
+				seatFeed.closeAll()
+			}
+			subscribed = true
+		case *redis.Message:
+			var batch []seatStatusMessage
+			if err := json.Unmarshal([]byte(m.Payload), &batch); err != nil {
+				slog.Error("Invalid seat change message", "component", "seat_feed", "error", err)
+				continue
+			}
+			for _, message := range batch {
+				seatFeed.publish(message.ShowID, message.Change)
+			}
+		}
+	}
+}
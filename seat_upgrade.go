@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Seat upgrades. A user with a paid booking can move it to other seats of the same show. The
+// new seats are locked and held in the same transaction that checks the booking, so nobody
+// can take them in between. If the new seats cost more, they stay PENDING under their own
+// payment session until the gateway webhook for the difference arrives: on success the
+// booking is moved onto them and the original seats go back to inventory, on failure the
+// hold is dropped and the booking keeps its seats. If they cost the same or less the swap
+// happens straight away and the difference is recorded as owed back to the user.
+
+var (
+	errConfirmedBookingNotFound = errors.New("no confirmed booking found for this user")
+	errUpgradeInvalidSeats      = errors.New("upgrade must name the same number of different seats of the same show")
+	errUpgradeSeatsUnavailable  = errors.New("requested seats are not available")
+	errUpgradeInProgress        = errors.New("an upgrade is already waiting for payment")
+)
+
+type UpgradeRequest struct {
+	UserID  int   `json:"user_id"`
+	SeatIDs []int `json:"seat_ids"`
+}
+
+type UpgradeResponse struct {
+	UpgradeID        int64  `json:"upgrade_id"`
+	BookingID        string `json:"booking_id"`
+	Status           string `json:"status"`
+	FromSeatIDs      []int  `json:"from_seat_ids"`
+	ToSeatIDs        []int  `json:"to_seat_ids"`
+	PriceDiffCents   int    `json:"price_diff_cents"`
+	RefundCents      int    `json:"refund_cents"`
+	Currency         string `json:"currency"`
+	PaymentSessionID string `json:"payment_session_id,omitempty"`
+	RedirectURL      string `json:"redirect_url,omitempty"`
+}
+
+type seatUpgrade struct {
+	ID        int64
+	BookingID string
+	SessionID string
+	From      []int
+	To        []int
+}
+
+// handleSeatUpgrade serves POST /api/bookings/{id}/upgrade.
+func handleSeatUpgrade(w http.ResponseWriter, r *http.Request) {
+	bookingID := r.PathValue("id")
+
+	var req UpgradeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 || len(req.SeatIDs) == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Upgrade requested", "component", "api", "booking_id", bookingID, "user_id", req.UserID, "seat_ids", req.SeatIDs)
+
+	resp, err := startSeatUpgrade(r.Context(), bookingID, req.UserID, req.SeatIDs)
+	switch {
+	case errors.Is(err, errConfirmedBookingNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errUpgradeInvalidSeats):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errUpgradeSeatsUnavailable), errors.Is(err, errUpgradeInProgress), errors.Is(err, ErrSeatLimitExceeded):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Failed to upgrade booking", "component", "api", "booking_id", bookingID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Upgrade processed", "component", "api", "status", resp.Status, "booking_id", bookingID, "upgrade_id", resp.UpgradeID, "price_diff_cents", resp.PriceDiffCents)
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status == "PENDING" {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func startSeatUpgrade(ctx context.Context, bookingID string, userID int, toSeatIDs []int) (*UpgradeResponse, error) {
+	to := append([]int(nil), toSeatIDs...)
+	sort.Ints(to)
+	sessionID := fmt.Sprintf("upg_%s_%d", bookingID, time.Now().UnixNano())
+	redirectURL := mockPaymentRedirectURL(sessionID)
+
+	var resp *UpgradeResponse
+	err := runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		from, showID, err := lockConfirmedSeats(ctx, tx, bookingID, userID)
+		if err != nil {
+			return err
+		}
+
+		if err := checkNoUpgradeInProgress(ctx, tx, bookingID); err != nil {
+			return err
+		}
+
+		if len(to) != len(from) {
+			return errUpgradeInvalidSeats
+		}
+		for _, seatID := range to {
+			if slices.Contains(from, seatID) {
+				return errUpgradeInvalidSeats
+			}
+		}
+
+		seats, err := readSeatAvailability(ctx, tx, to, seatLockForUpdate)
+		if err != nil {
+			return fmt.Errorf("failed to lock upgrade seats: %w", err)
+		}
+		for _, seat := range seats {
+			if seat.ShowID != showID {
+				return errUpgradeInvalidSeats
+			}
+		}
+		if unavailable := unavailableSeats(to, seats); len(unavailable) > 0 {
+			return fmt.Errorf("%w: %v", errUpgradeSeatsUnavailable, unavailable)
+		}
+
+		prices, currency, err := seatPrices(ctx, tx, append(append([]int{}, from...), to...))
+		if err != nil {
+			return err
+		}
+		diff := 0
+		for _, seatID := range to {
+			diff += prices[seatID]
+		}
+		for _, seatID := range from {
+			diff -= prices[seatID]
+		}
+
+		if err := markSeatsReserved(withSeatLimitReleasing(ctx, len(from)), tx, userID, to, sessionID, redirectURL); err != nil {
+			return fmt.Errorf("failed to hold upgrade seats: %w", err)
+		}
+		upgradeID, err := insertReturningID(ctx, tx, `
+			INSERT INTO seat_upgrades (booking_id, user_id, payment_session_id, from_seat_ids, to_seat_ids, price_diff_cents, currency)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, bookingID, userID, sessionID, joinInts(from), joinInts(to), diff, currency)
+		if err != nil {
+			return fmt.Errorf("failed to record upgrade: %w", err)
+		}
+
+		resp = &UpgradeResponse{
+			UpgradeID:      int64(upgradeID),
+			BookingID:      bookingID,
+			Status:         "PENDING",
+			FromSeatIDs:    from,
+			ToSeatIDs:      to,
+			PriceDiffCents: diff,
+			Currency:       currency,
+		}
+		if diff > 0 {
+			resp.PaymentSessionID = sessionID
+			resp.RedirectURL = redirectURL
+			return nil
+		}
+
+		// Nothing to charge: confirm the new seats and swap now.
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+			UPDATE seats SET payment_status = 'COMPLETED', version = version + 1 WHERE id IN (%s)
+		`, generatePlaceholders(len(to))), sliceToInterface(to)...)
+		if err != nil {
+			return fmt.Errorf("failed to confirm upgrade seats: %w", err)
+		}
+		if err := transitionBooking(ctx, tx, sessionID, BookingConfirmed, "nothing to pay"); err != nil {
+			return err
+		}
+		if err := swapUpgradeSeats(ctx, tx, seatUpgrade{ID: int64(upgradeID), BookingID: bookingID, SessionID: sessionID, From: from, To: to}); err != nil {
+			return err
+		}
+		resp.Status = "COMPLETED"
+		resp.RefundCents = -diff
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Status == "PENDING" {
+		// The checkout stays open as long as the new seats are held.
+		until := time.Now().Add(time.Duration(strategyConfig.Payment.HoldTimeout))
+		if expiresAt, err := bookingHoldExpiry(ctx, db, sessionID); err == nil && expiresAt != nil {
+			until = *expiresAt
+		}
+		session, err := openPaymentSession(ctx, sessionID, int64(resp.PriceDiffCents), resp.Currency,
+			until, fmt.Sprintf("Seat upgrade, booking %s", bookingID))
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to open payment session, cancelling", "component", "upgrade", "booking_id", bookingID, "upgrade_id", resp.UpgradeID, "error", err)
+			if cancelErr := cancelSeatUpgrade(ctx, resp.UpgradeID, sessionID, to); cancelErr != nil {
+				slog.ErrorContext(ctx, "Failed to cancel upgrade", "component", "upgrade", "upgrade_id", resp.UpgradeID, "error", cancelErr)
+			}
+			return nil, err
+		}
+		resp.RedirectURL = session.RedirectURL
+	}
+
+	if resp.RefundCents > 0 {
+		slog.InfoContext(ctx, "Refund due", "component", "upgrade", "booking_id", bookingID, "upgrade_id", resp.UpgradeID, "amount", fmt.Sprintf("%d %s", resp.RefundCents, resp.Currency))
+	}
+	return resp, nil
+}
+
+// cancelSeatUpgrade releases the seats held for an upgrade that can't be paid for.
+func cancelSeatUpgrade(ctx context.Context, upgradeID int64, sessionID string, seatIDs []int) error {
+	return runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		if err := releaseSeatRows(ctx, tx, seatIDs, HoldReleased); err != nil {
+			return fmt.Errorf("failed to release upgrade seats: %w", err)
+		}
+		if err := transitionBooking(ctx, tx, sessionID, BookingCancelled, "upgrade cancelled"); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `UPDATE seat_upgrades SET status = 'FAILED', completed_at = ? WHERE id = ?`, time.Now(), upgradeID)
+		if err != nil {
+			return fmt.Errorf("failed to fail upgrade: %w", err)
+		}
+		return nil
+	})
+}
+
+// checkNoUpgradeInProgress fails with errUpgradeInProgress while an upgrade of the booking
+// still holds seats waiting for payment.
+func checkNoUpgradeInProgress(ctx context.Context, tx *sql.Tx, bookingID string) error {
+	var pending int
+	err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM seat_upgrades u
+		WHERE u.booking_id = ? AND u.status = 'PENDING'
+		AND EXISTS (SELECT 1 FROM seats s WHERE s.payment_session_id = u.payment_session_id AND s.payment_status = 'PENDING')
+	`, bookingID).Scan(&pending)
+	if err != nil {
+		return fmt.Errorf("failed to check pending upgrades: %w", err)
+	}
+	if pending > 0 {
+		return errUpgradeInProgress
+	}
+	return nil
+}
+
+// lockConfirmedSeats locks the paid seats of a booking and returns them with their show.
+func lockConfirmedSeats(ctx context.Context, tx *sql.Tx, bookingID string, userID int) ([]int, int, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, show_id FROM seats
+		WHERE payment_session_id = ? AND user_id = ? AND payment_status = 'COMPLETED' AND is_reserved = 1
+		ORDER BY id
+		FOR UPDATE
+	`, bookingID, userID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to lock booking seats: %w", err)
+	}
+	defer rows.Close()
+
+	var seatIDs []int
+	var showID int
+	for rows.Next() {
+		var seatID int
+		if err := rows.Scan(&seatID, &showID); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan booking seat: %w", err)
+		}
+		seatIDs = append(seatIDs, seatID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating booking seats: %w", err)
+	}
+	if len(seatIDs) == 0 {
+		return nil, 0, errConfirmedBookingNotFound
+	}
+	return seatIDs, showID, nil
+}
+
+// seatPrices returns each seat's price, its own or else the show's, and the show currency.
+func seatPrices(ctx context.Context, q queryer, seatIDs []int) (map[int]int, string, error) {
+	rows, err := q.QueryContext(ctx, fmt.Sprintf(`
+		SELECT s.id, COALESCE(s.price_cents, sh.price_cents), sh.currency
+		FROM seats s JOIN shows sh ON sh.id = s.show_id
+		WHERE s.id IN (%s)
+	`, generatePlaceholders(len(seatIDs))), sliceToInterface(seatIDs)...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load seat prices: %w", err)
+	}
+	defer rows.Close()
+
+	prices := make(map[int]int, len(seatIDs))
+	currency := ""
+	for rows.Next() {
+		var seatID, price int
+		if err := rows.Scan(&seatID, &price, &currency); err != nil {
+			return nil, "", fmt.Errorf("failed to scan seat price: %w", err)
+		}
+		prices[seatID] = price
+	}
+	return prices, currency, rows.Err()
+}
+
+// swapUpgradeSeats moves the booking onto the upgrade's confirmed seats and releases the
+// original ones.
+func swapUpgradeSeats(ctx context.Context, tx *sql.Tx, up seatUpgrade) error {
+	args := append([]interface{}{up.BookingID, up.SessionID}, sliceToInterface(up.To)...)
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		UPDATE seats SET payment_session_id = ?
+		WHERE payment_session_id = ? AND id IN (%s)
+	`, generatePlaceholders(len(up.To))), args...)
+	if err != nil {
+		return fmt.Errorf("failed to move booking to upgrade seats: %w", err)
+	}
+	if err := moveBookingSeats(ctx, tx, up.BookingID, up.From, up.To); err != nil {
+		return err
+	}
+	if err := releaseSeatRows(ctx, tx, up.From, HoldReleased); err != nil {
+		return fmt.Errorf("failed to release original seats: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE seat_upgrades SET status = 'COMPLETED', completed_at = ? WHERE id = ?`, time.Now(), up.ID)
+	if err != nil {
+		return fmt.Errorf("failed to complete upgrade: %w", err)
+	}
+	return nil
+}
+
+// applyUpgradePayment finishes the upgrade paid for by sessionID, if it is one, inside the
+// webhook's transaction after the webhook has set the new seats' payment_status.
+func applyUpgradePayment(ctx context.Context, tx *sql.Tx, sessionID, status string) error {
+	var up seatUpgrade
+	var from, to string
+	err := tx.QueryRowContext(ctx, `
+		SELECT id, booking_id, from_seat_ids, to_seat_ids FROM seat_upgrades
+		WHERE payment_session_id = ? AND status = 'PENDING'
+		FOR UPDATE
+	`, sessionID).Scan(&up.ID, &up.BookingID, &from, &to)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load upgrade: %w", err)
+	}
+	up.SessionID, up.From, up.To = sessionID, splitInts(from), splitInts(to)
+
+	if status == "REVIEW" {
+		// Paid, but not what was asked; the upgrade waits on the review with its seats held.
+		slog.InfoContext(ctx, "Payment flagged for review, upgrade on hold", "component", "upgrade", "booking_id", up.BookingID, "upgrade_id", up.ID)
+		return nil
+	}
+	if status != "COMPLETED" {
+		// The webhook already marked the new seats FAILED, which frees them.
+		_, err = tx.ExecContext(ctx, `UPDATE seat_upgrades SET status = 'FAILED', completed_at = ? WHERE id = ?`, time.Now(), up.ID)
+		if err != nil {
+			return fmt.Errorf("failed to fail upgrade: %w", err)
+		}
+		slog.ErrorContext(ctx, "Payment failed, booking keeps its seats", "component", "upgrade", "booking_id", up.BookingID, "upgrade_id", up.ID)
+		return nil
+	}
+
+	if err := swapUpgradeSeats(ctx, tx, up); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Completed", "component", "upgrade", "booking_id", up.BookingID, "upgrade_id", up.ID, "from", up.From, "to", up.To)
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Seed data for load tests and demos: `go run . seed -shows 20 -seats 500` adds shows with
+// their seats (and users to book them with) on top of whatever the database holds. Seats are
+// numbered by row, A1..A<row size>, B1..., like the first migration's. There are no venues in
+// the schema yet, so every show gets a fresh block of seats of its own.
+
+type SeedConfig struct {
+	Shows        int
+	SeatsPerShow int
+	RowSize      int
+	Users        int
+	PriceCents   int
+	Currency     string
+	FirstShowAt  time.Time
+	ShowLength   time.Duration
+}
+
+// seedBatchSize is how many rows go into one INSERT.
+const seedBatchSize = 500
+
+type seedResult struct {
+	ShowIDs []int
+	Seats   int
+	Users   int
+}
+
+// seedDatabase adds the users, then each show with its seats in a transaction of its own, so
+// a big seed doesn't hold one huge transaction open.
+func seedDatabase(ctx context.Context, db *sql.DB, cfg SeedConfig) (seedResult, error) {
+	var result seedResult
+	runID := time.Now().Unix()
+
+	err := seedInTx(ctx, db, func(tx *sql.Tx) error {
+		for i := 0; i < cfg.Users; i++ {
+			// Emails are unique, so every run gets its own.
+			_, err := tx.ExecContext(ctx, `INSERT INTO users (name, email) VALUES (?, ?)`,
+				fmt.Sprintf("Seed User %d", i+1), fmt.Sprintf("seed-%d-%d@example.com", runID, i+1))
+			if err != nil {
+				return fmt.Errorf("failed to insert user: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	result.Users = cfg.Users
+
+	for i := 0; i < cfg.Shows; i++ {
+		start := cfg.FirstShowAt.Add(time.Duration(i) * 24 * time.Hour)
+		var showID int
+		err := seedInTx(ctx, db, func(tx *sql.Tx) error {
+			var err error
+			showID, err = insertReturningID(ctx, tx, `
+				INSERT INTO shows (name, start_time, end_time, price_cents, currency)
+				VALUES (?, ?, ?, ?, ?)
+			`, fmt.Sprintf("Seed Show %d-%d", runID, i+1), start, start.Add(cfg.ShowLength), cfg.PriceCents, cfg.Currency)
+			if err != nil {
+				return fmt.Errorf("failed to insert show: %w", err)
+			}
+			return seedShowSeats(ctx, tx, showID, cfg.SeatsPerShow, cfg.RowSize)
+		})
+		if err != nil {
+			return result, err
+		}
+		result.ShowIDs = append(result.ShowIDs, showID)
+		result.Seats += cfg.SeatsPerShow
+		slog.InfoContext(ctx, "Seeded show", "component", "seed", "show_id", showID, "seats", cfg.SeatsPerShow)
+	}
+	return result, nil
+}
+
+func seedInTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func seedShowSeats(ctx context.Context, tx *sql.Tx, showID, seats, rowSize int) error {
+	for from := 0; from < seats; from += seedBatchSize {
+		to := min(from+seedBatchSize, seats)
+		values := make([]interface{}, 0, 4*(to-from))
+		placeholders := make([]string, 0, to-from)
+		for n := from; n < to; n++ {
+			row, column := seatRowLabel(n/rowSize), n%rowSize+1
+			placeholders = append(placeholders, "(?, ?, ?, ?)")
+			values = append(values, showID, fmt.Sprintf("%s%d", row, column), row, column)
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO seats (show_id, seat_number, seat_row, seat_column) VALUES `+strings.Join(placeholders, ", "), values...)
+		if err != nil {
+			return fmt.Errorf("failed to insert seats for show %d: %w", showID, err)
+		}
+	}
+	return nil
+}
+
+// seatRowLabel names rows A..Z, then AA, AB, ...
+func seatRowLabel(row int) string {
+	label := ""
+	for row >= 0 {
+		label = string(rune('A'+row%26)) + label
+		row = row/26 - 1
+	}
+	return label
+}
+
+// insertReturningID runs an INSERT and returns the new row's id. Postgres has no
+// LastInsertId, so it gets the id back with RETURNING.
+func insertReturningID(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (int, error) {
+	if dbDriver == "postgres" {
+		var id int
+		err := tx.QueryRowContext(ctx, query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (c SeedConfig) Validate() error {
+	switch {
+	case c.Shows < 0, c.Users < 0:
+		return fmt.Errorf("shows and users can't be negative")
+	case c.SeatsPerShow <= 0:
+		return fmt.Errorf("seats must be > 0")
+	case c.RowSize <= 0:
+		return fmt.Errorf("row size must be > 0")
+	case c.PriceCents < 0:
+		return fmt.Errorf("price can't be negative")
+	case len(c.Currency) != 3:
+		return fmt.Errorf("currency must be a 3 letter code")
+	case c.ShowLength <= 0:
+		return fmt.Errorf("show length must be > 0")
+	}
+	return nil
+}
+
+// runSeedCommand is `seed`: seed the database (migrating it first, like serve does) and exit.
+func runSeedCommand(args []string) {
+	cfg := SeedConfig{}
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	flags.IntVar(&cfg.Shows, "shows", 2, "shows to create")
+	flags.IntVar(&cfg.SeatsPerShow, "seats", 100, "seats per show")
+	flags.IntVar(&cfg.RowSize, "row-size", 20, "seats per row")
+	flags.IntVar(&cfg.Users, "users", 10, "users to create")
+	flags.IntVar(&cfg.PriceCents, "price-cents", 25000, "ticket price of each show, in minor units")
+	flags.StringVar(&cfg.Currency, "currency", "INR", "currency of the price")
+	flags.DurationVar(&cfg.ShowLength, "show-length", 3*time.Hour, "how long each show runs")
+	configFile := configFlag(flags)
+	firstShow := flags.String("first-show", "", "start of the first show, RFC 3339 (default tomorrow 18:00); the rest follow a day apart")
+	flags.Parse(args)
+
+	if *firstShow == "" {
+		tomorrow := time.Now().AddDate(0, 0, 1)
+		cfg.FirstShowAt = time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 18, 0, 0, 0, time.Local)
+	} else {
+		at, err := time.Parse(time.RFC3339, *firstShow)
+		if err != nil {
+			log.Fatalf("Invalid -first-show: %v", err)
+		}
+		cfg.FirstShowAt = at
+	}
+	cfg.Currency = strings.ToUpper(cfg.Currency)
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid seed config: %v", err)
+	}
+
+	loadConfig(*configFile)
+	if !connectDatabase() {
+		log.Fatalf("Nothing to seed for DB_DRIVER=%s, the in-memory store seeds itself", dbDriver)
+	}
+	defer db.Close()
+
+	started := time.Now()
+	result, err := seedDatabase(ctx, db, cfg)
+	if err != nil {
+		log.Fatalf("Seeding failed: %v", err)
+	}
+	slog.Info("Seeded database", "component", "seed", "shows", result.ShowIDs, "seats", result.Seats, "users", result.Users, "duration", time.Since(started))
+}
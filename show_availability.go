@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Cached availability counts. GET /api/shows/{id}/availability answers how many of a show's
+// seats are on sale from a Redis hash, show_availability:<id>, so browsing doesn't reach the
+// database. A show missing from Redis is counted once, in one snapshot with the show's latest
+// seat_audit id, and the seat status relay (seat_status_relay.go), which reads every seat
+// change from the audit log, moves the count on from there with HINCRBY. Each change is
+// applied only past the version the count was taken at, so a change is never counted twice,
+// whether the relay repeats a batch or the count was taken after it.
+//
+// A change committed under an id lower than one already applied (ids are assigned at insert
+// time) is missed; counts expire after showAvailabilityTTL and are taken again, which bounds
+// the drift.
+
+const showAvailabilityTTL = 5 * time.Minute
+
+type ShowAvailability struct {
+	ShowID    int `json:"show_id"`
+	Available int `json:"available"`
+	Total     int `json:"total"`
+}
+
+func showAvailabilityKey(showID int) string {
+	return "show_availability:" + strconv.Itoa(showID)
+}
+
+// initAvailabilityScript stores the counts ARGV[1] available of ARGV[2] at version ARGV[3],
+// for ARGV[4] ms, unless KEYS[1] is already there.
+var initAvailabilityScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+redis.call("HSET", KEYS[1], "available", ARGV[1], "total", ARGV[2], "version", ARGV[3])
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+return 1
+`)
+
+// applyAvailabilityScript applies the changes ARGV holds as delta, version pairs, in version
+// order, to the count in KEYS[1], skipping those it is already past. Shows not in Redis are left
+// to be counted when they are next asked for.
+var applyAvailabilityScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+local version = tonumber(redis.call("HGET", KEYS[1], "version"))
+local applied = 0
+for i = 1, #ARGV, 2 do
+	local v = tonumber(ARGV[i + 1])
+	if v > version then
+		redis.call("HINCRBY", KEYS[1], "available", ARGV[i])
+		version = v
+		applied = applied + 1
+	end
+end
+redis.call("HSET", KEYS[1], "version", version)
+return applied
+`)
+
+// availabilityDelta is how a seat moving from one audit status to another changes its show's
+// available count.
+func availabilityDelta(oldStatus, newStatus string) int {
+	switch {
+	case oldStatus == "AVAILABLE" && newStatus != "AVAILABLE":
+		return -1
+	case oldStatus != "AVAILABLE" && newStatus == "AVAILABLE":
+		return 1
+	default:
+		return 0
+	}
+}
+
+// availabilityChange is one seat change's effect on its show's count.
+type availabilityChange struct {
+	delta   int
+	version int64
+}
+
+// applyAvailabilityChanges moves the cached counts on by changes, per show, in version order.
+func applyAvailabilityChanges(changes map[int][]availabilityChange) error {
+	for showID, showChanges := range changes {
+		args := make([]interface{}, 0, 2*len(showChanges))
+		for _, c := range showChanges {
+			args = append(args, c.delta, c.version)
+		}
+		if err := applyAvailabilityScript.Run(ctx, rdb, []string{showAvailabilityKey(showID)}, args...).Err(); err != nil {
+			return fmt.Errorf("failed to update availability of show %d: %w", showID, err)
+		}
+	}
+	return nil
+}
+
+// showAvailability returns the show's counts from Redis, counting them in the database when
+// they aren't there. Total is 0 for a show that doesn't exist.
+func showAvailability(ctx context.Context, showID int) (ShowAvailability, error) {
+	availability := ShowAvailability{ShowID: showID}
+	values, err := rdb.HMGet(ctx, showAvailabilityKey(showID), "available", "total").Result()
+	if err != nil {
+		return availability, fmt.Errorf("failed to read availability: %w", err)
+	}
+	if values[0] != nil && values[1] != nil {
+		availability.Available, _ = strconv.Atoi(values[0].(string))
+		availability.Total, _ = strconv.Atoi(values[1].(string))
+		return availability, nil
+	}
+
+	// One read-only snapshot so the version matches the counts exactly.
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return availability, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	var version int64
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM seat_audit WHERE show_id = ?`, showID).Scan(&version)
+	if err != nil {
+		return availability, fmt.Errorf("failed to read latest seat change: %w", err)
+	}
+	err = tx.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(CASE WHEN is_reserved = 0 OR payment_status = 'FAILED' THEN 1 ELSE 0 END), 0)
+		FROM seats WHERE show_id = ?
+	`, showID).Scan(&availability.Total, &availability.Available)
+	if err != nil {
+		return availability, fmt.Errorf("failed to count seats: %w", err)
+	}
+	if availability.Total == 0 {
+		return availability, nil
+	}
+
+	err = initAvailabilityScript.Run(ctx, rdb, []string{showAvailabilityKey(showID)},
+		availability.Available, availability.Total, version, showAvailabilityTTL.Milliseconds()).Err()
+	if err != nil {
+		// The count is right, it just isn't cached.
+		slog.WarnContext(ctx, "Failed to cache availability", "component", "availability", "show_id", showID, "error", err)
+	}
+	return availability, nil
+}
+
+// handleShowAvailability serves GET /api/shows/{id}/availability.
+func handleShowAvailability(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+
+	availability, err := showAvailability(r.Context(), showID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load availability", "component", "availability", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if availability.Total == 0 {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(availability)
+}
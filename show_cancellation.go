@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Show cancellation. POST /admin/shows/{id}/cancel sets shows.cancelled_at and the Redis key
+// show_cancelled:<id>, and from then on /api/book (holds and best available too) and the
+// waitlist turn the show away with 410 SHOW_CANCELLED before anything else. The rest is done
+// by the maintenance leader every showCancellationInterval, until nothing of the show is left:
+//   - WAITING waitlist entries become CANCELLED;
+//   - unpaid bookings have their checkout closed at the gateway and their seats released, and
+//     become CANCELLED (reason "show cancelled"); one the gateway won't close is tried again
+//     next pass, and if it was paid meanwhile it is refunded like the others;
+//   - paid bookings have their seats put REFUND_PENDING and a refund queued for the whole of
+//     them (refunds.go), in one transaction with a booking.show_cancelled outbox event
+//     (outbox.go) and, when the booking has a callback_url, a SHOW_CANCELLED callback;
+//   - queued refunds are sent to the gateway, a failed call tried again after
+//     show_cancellation.refund_backoff, doubling up to maxRefundBackoff, for up to
+//     show_cancellation.refund_max_attempts calls. The gateway's verdict then comes on
+//     /webhook/refund as for any refund, REFUNDED releasing the seats and, once all are, making
+//     the booking REFUNDED.
+//
+// A refund the gateway kept failing is left queued without a next attempt, its seats off sale;
+// cancelling the show again queues those once more. A refund the gateway declined on the
+// webhook (FAILED) confirms its seats again and is not retried; GET
+// /admin/shows/{id}/cancellation lists them, with the progress of the rest, for support to
+// refund by hand. A refund call that reached the gateway but whose id couldn't be stored is
+// sent again; the gateway refuses it, the payment being refunded already.
+//
+// Bookings that slipped in before every instance saw the cancellation are caught by the next
+// pass like the others.
+
+const (
+	showCancellationInterval  = 5 * time.Second
+	showCancellationBatchSize = 100
+	// showRefundConcurrency bounds the gateway refund calls in flight.
+	showRefundConcurrency = 8
+	maxRefundBackoff      = 1 * time.Hour
+	maxCancelReasonLength = 255
+	showCancelledReason   = "show cancelled"
+)
+
+// Conditions on a booking b of a cancelled show sh, for the ones the cancellation still has
+// to cancel and to refund.
+const (
+	openHoldCondition = `b.state IN ('HELD', 'PENDING_PAYMENT')
+		AND EXISTS (SELECT 1 FROM seats s WHERE s.payment_session_id = b.id AND s.payment_status = 'PENDING')`
+	toRefundCondition = `b.state = 'CONFIRMED'
+		AND EXISTS (SELECT 1 FROM seats s WHERE s.payment_session_id = b.id AND s.payment_status = 'COMPLETED')
+		AND NOT EXISTS (SELECT 1 FROM refunds r WHERE r.booking_id = b.id AND r.status = 'FAILED' AND r.created_at >= sh.cancelled_at)`
+)
+
+// ShowCancellationConfig tunes the refunds of cancelled shows, see show_cancellation.go.
+type ShowCancellationConfig struct {
+	RefundMaxAttempts int      `json:"refund_max_attempts"` // SHOW_CANCELLATION_REFUND_MAX_ATTEMPTS, gateway calls per refund
+	RefundBackoff     Duration `json:"refund_backoff"`      // SHOW_CANCELLATION_REFUND_BACKOFF, before the second call, doubling after
+}
+
+func showCancelledKey(showID int) string {
+	return "show_cancelled:" + strconv.Itoa(showID)
+}
+
+// showCancelled reports whether the show was cancelled.
+func showCancelled(ctx context.Context, showID int) bool {
+	n, err := rdb.Exists(ctx, showCancelledKey(showID)).Result()
+	if err == nil {
+		return n > 0
+	}
+	slog.WarnContext(ctx, "Failed to read cancellation flag, using cached settings", "component", "show_cancellation", "show_id", showID, "error", err)
+	showSettings.RLock()
+	defer showSettings.RUnlock()
+	return showSettings.cancelled[showID]
+}
+
+// writeShowCancelled answers a booking for a cancelled show.
+func writeShowCancelled(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGone)
+	json.NewEncoder(w).Encode(AsyncBookingResponse{
+		Status:    "SHOW_CANCELLED",
+		RequestID: requestIDFromContext(r.Context()),
+	})
+}
+
+type ShowCancellationRequest struct {
+	Reason string `json:"reason"`
+}
+
+// ShowCancellation is how far the cancellation of a show has got.
+type ShowCancellation struct {
+	ShowID      int       `json:"show_id"`
+	CancelledAt time.Time `json:"cancelled_at"`
+	Reason      string    `json:"reason,omitempty"`
+	// OpenHolds are unpaid bookings still to be cancelled, ToRefund paid ones still to get a
+	// refund queued.
+	OpenHolds int `json:"open_holds"`
+	ToRefund  int `json:"to_refund"`
+	// Refunds since the cancellation: Queued waiting for the gateway call, Requested waiting
+	// for its webhook, Stuck given up on after refund_max_attempts calls, Declined refused on
+	// the webhook.
+	Refunds       map[string]int `json:"refunds"`
+	RefundedCents int            `json:"refunded_cents"`
+	Declined      []string       `json:"declined_booking_ids"`
+}
+
+// handleCancelShow serves POST /admin/shows/{id}/cancel. Cancelling a cancelled show again
+// keeps its time and reason and queues its stuck refunds once more.
+func handleCancelShow(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+	var req ShowCancellationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Reason) > maxCancelReasonLength {
+		http.Error(w, fmt.Sprintf("reason is up to %d characters", maxCancelReasonLength), http.StatusBadRequest)
+		return
+	}
+
+	var cancelledAt time.Time
+	var requeued int64
+	err = seedInTx(r.Context(), db, func(tx *sql.Tx) error {
+		var at sql.NullTime
+		if err := tx.QueryRowContext(r.Context(), `SELECT cancelled_at FROM shows WHERE id = ? FOR UPDATE`, showID).Scan(&at); err != nil {
+			return err
+		}
+		if at.Valid {
+			cancelledAt = at.Time
+			result, err := tx.ExecContext(r.Context(), `
+				UPDATE refunds SET attempts = 0, next_attempt_at = ?
+				WHERE status = 'REFUND_PENDING' AND provider_refund_id IS NULL AND next_attempt_at IS NULL AND attempts > 0
+				AND booking_id IN (SELECT id FROM bookings WHERE show_id = ?)
+			`, time.Now(), showID)
+			if err != nil {
+				return fmt.Errorf("failed to queue stuck refunds: %w", err)
+			}
+			requeued, _ = result.RowsAffected()
+			return nil
+		}
+		cancelledAt = time.Now()
+		_, err := tx.ExecContext(r.Context(), `
+			UPDATE shows SET cancelled_at = ?, cancel_reason = ? WHERE id = ?
+		`, cancelledAt, nullString(req.Reason), showID)
+		if err != nil {
+			return fmt.Errorf("failed to cancel show: %w", err)
+		}
+		return nil
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to cancel show", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Without the key instances go by their settings, refreshed within showSettingsRefresh.
+	if err := rdb.Set(r.Context(), showCancelledKey(showID), cancelledAt.Unix(), 0).Err(); err != nil {
+		slog.WarnContext(r.Context(), "Failed to set cancellation flag", "component", "admin", "show_id", showID, "error", err)
+	}
+	if err := refreshShowSettings(); err != nil {
+		slog.WarnContext(r.Context(), "Failed to refresh show settings", "component", "admin", "error", err)
+	}
+	slog.InfoContext(r.Context(), "Show cancelled", "component", "admin", "show_id", showID, "reason", req.Reason, "requeued_refunds", requeued)
+
+	cancellation, err := loadShowCancellation(r.Context(), showID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load show cancellation", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(cancellation)
+}
+
+// handleShowCancellation serves GET /admin/shows/{id}/cancellation.
+func handleShowCancellation(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+	cancellation, err := loadShowCancellation(r.Context(), showID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Show not found or not cancelled", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load show cancellation", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(cancellation)
+}
+
+func loadShowCancellation(ctx context.Context, showID int) (*ShowCancellation, error) {
+	c := &ShowCancellation{ShowID: showID, Declined: []string{}, Refunds: map[string]int{
+		"queued": 0, "requested": 0, "refunded": 0, "stuck": 0, "declined": 0,
+	}}
+	var reason sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT cancelled_at, cancel_reason,
+		       (SELECT COUNT(*) FROM bookings b WHERE b.show_id = sh.id AND `+openHoldCondition+`),
+		       (SELECT COUNT(*) FROM bookings b WHERE b.show_id = sh.id AND `+toRefundCondition+`)
+		FROM shows sh WHERE sh.id = ? AND sh.cancelled_at IS NOT NULL
+	`, showID).Scan(&c.CancelledAt, &reason, &c.OpenHolds, &c.ToRefund)
+	if err != nil {
+		return nil, err
+	}
+	c.Reason = reason.String
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT r.booking_id, r.status, r.provider_refund_id IS NOT NULL, r.next_attempt_at IS NOT NULL, r.amount_cents
+		FROM refunds r JOIN bookings b ON b.id = r.booking_id
+		WHERE b.show_id = ? AND r.created_at >= ?
+		ORDER BY r.id
+	`, showID, c.CancelledAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load refunds: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bookingID, status string
+		var requested, due bool
+		var amount int
+		if err := rows.Scan(&bookingID, &status, &requested, &due, &amount); err != nil {
+			return nil, fmt.Errorf("failed to scan refund: %w", err)
+		}
+		switch {
+		case status == "REFUNDED":
+			c.Refunds["refunded"]++
+			c.RefundedCents += amount
+		case status == "FAILED":
+			c.Refunds["declined"]++
+			c.Declined = append(c.Declined, bookingID)
+		case requested:
+			c.Refunds["requested"]++
+		case due:
+			c.Refunds["queued"]++
+		default:
+			c.Refunds["stuck"]++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load refunds: %w", err)
+	}
+	return c, nil
+}
+
+func runShowCancellations() error {
+	ticker := time.NewTicker(showCancellationInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !runsMaintenance() {
+			continue
+		}
+		sweepCancelledShows()
+		sendQueuedRefunds()
+	}
+	return errors.New("ending show cancellations")
+}
+
+// sweepCancelledShows winds down the cancelled shows that still have waitlist entries,
+// unpaid bookings or paid ones to refund.
+func sweepCancelledShows() {
+	defer func() { reportPanic(ctx, "show_cancellation", recover()) }()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT sh.id FROM shows sh
+		WHERE sh.cancelled_at IS NOT NULL
+		AND (
+			EXISTS (SELECT 1 FROM waitlist_entries w WHERE w.show_id = sh.id AND w.status = ?)
+			OR EXISTS (SELECT 1 FROM bookings b WHERE b.show_id = sh.id AND (`+openHoldCondition+`))
+			OR EXISTS (SELECT 1 FROM bookings b WHERE b.show_id = sh.id AND `+toRefundCondition+`)
+		)
+	`, WaitlistWaiting)
+	if err != nil {
+		slog.Error("Failed to load cancelled shows", "component", "show_cancellation", "error", err)
+		return
+	}
+	var showIDs []int
+	for rows.Next() {
+		var showID int
+		if err := rows.Scan(&showID); err != nil {
+			slog.Error("Failed to scan cancelled show", "component", "show_cancellation", "error", err)
+			continue
+		}
+		showIDs = append(showIDs, showID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		slog.Error("Failed to load cancelled shows", "component", "show_cancellation", "error", err)
+		return
+	}
+
+	for _, showID := range showIDs {
+		if err := sweepCancelledShow(showID); err != nil {
+			slog.Error("Failed to wind down cancelled show", "component", "show_cancellation", "show_id", showID, "error", err)
+			reportError(ctx, "show_cancellation", err, "show_id", showID)
+		}
+	}
+}
+
+type showBooking struct {
+	id     string
+	userID int
+	state  BookingState
+}
+
+// showBookings returns up to showCancellationBatchSize of the show's bookings that meet
+// condition.
+func showBookings(showID int, condition string) ([]showBooking, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT b.id, b.user_id, b.state
+		FROM bookings b JOIN shows sh ON sh.id = b.show_id
+		WHERE b.show_id = ? AND `+condition+`
+		ORDER BY b.created_at, b.id
+		LIMIT ?
+	`, showID, showCancellationBatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bookings: %w", err)
+	}
+	defer rows.Close()
+
+	var bookings []showBooking
+	for rows.Next() {
+		var b showBooking
+		if err := rows.Scan(&b.id, &b.userID, &b.state); err != nil {
+			return nil, fmt.Errorf("failed to scan booking: %w", err)
+		}
+		bookings = append(bookings, b)
+	}
+	return bookings, rows.Err()
+}
+
+// sweepCancelledShow does one batch of each step for the show.
+func sweepCancelledShow(showID int) error {
+	sweepCtx := withSeatAudit(ctx, SeatAuditShowCancellation)
+
+	result, err := db.ExecContext(sweepCtx, `
+		UPDATE waitlist_entries SET status = ? WHERE show_id = ? AND status = ?
+	`, WaitlistCancelled, showID, WaitlistWaiting)
+	if err != nil {
+		return fmt.Errorf("failed to cancel waitlist: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		slog.Info("Cancelled waitlist entries", "component", "show_cancellation", "show_id", showID, "entries", n)
+	}
+
+	holds, err := showBookings(showID, openHoldCondition)
+	if err != nil {
+		return err
+	}
+	for _, b := range holds {
+		released, err := releaseBookingHoldFor(sweepCtx, b.id, b.userID, showCancelledReason)
+		if errors.Is(err, errCheckoutNotClosed) {
+			slog.Warn("Gateway refused to close checkout, trying next pass", "component", "show_cancellation", "show_id", showID, "booking_id", b.id, "error", err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to cancel booking %s: %w", b.id, err)
+		}
+		slog.Info("Cancelled booking of cancelled show", "component", "show_cancellation", "show_id", showID, "booking_id", b.id, "seats", released)
+	}
+
+	paid, err := showBookings(showID, toRefundCondition)
+	if err != nil {
+		return err
+	}
+	for _, b := range paid {
+		refund, err := queueShowCancellationRefund(sweepCtx, b)
+		switch {
+		case errors.Is(err, errConfirmedBookingNotFound):
+			// Its seats moved on since it was read.
+			continue
+		case errors.Is(err, errUpgradeInProgress):
+			slog.Info("Booking has an upgrade in progress, refunding it next pass", "component", "show_cancellation", "show_id", showID, "booking_id", b.id)
+			continue
+		case err != nil:
+			return fmt.Errorf("failed to queue refund of booking %s: %w", b.id, err)
+		}
+		slog.Info("Queued refund of cancelled show", "component", "show_cancellation", "show_id", showID, "booking_id", b.id, "refund_id", refund.RefundID, "amount", fmt.Sprintf("%d %s", refund.AmountCents, refund.Currency))
+	}
+	return nil
+}
+
+// queueShowCancellationRefund queues the refund of all of the booking's paid seats and tells
+// its listeners the show was cancelled.
+func queueShowCancellationRefund(ctx context.Context, b showBooking) (*RefundResponse, error) {
+	var refund *RefundResponse
+	err := runInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		seatIDs, _, err := lockConfirmedSeats(ctx, tx, b.id, b.userID)
+		if err != nil {
+			return err
+		}
+		if err := checkNoUpgradeInProgress(ctx, tx, b.id); err != nil {
+			return err
+		}
+		// A refund declined since it was read is left to support, like the others.
+		var declined bool
+		err = tx.QueryRowContext(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM refunds r
+				JOIN bookings b ON b.id = r.booking_id JOIN shows sh ON sh.id = b.show_id
+				WHERE r.booking_id = ? AND r.status = 'FAILED' AND r.created_at >= sh.cancelled_at
+			)
+		`, b.id).Scan(&declined)
+		if err != nil {
+			return fmt.Errorf("failed to check declined refunds: %w", err)
+		}
+		if declined {
+			return errConfirmedBookingNotFound
+		}
+
+		refund, _, err = recordRefund(ctx, tx, b.id, b.userID, seatIDs)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE refunds SET next_attempt_at = ? WHERE id = ?`, time.Now(), refund.RefundID); err != nil {
+			return fmt.Errorf("failed to queue refund: %w", err)
+		}
+
+		if err := writeOutboxEventOfType(ctx, tx, b.id, "booking.show_cancelled", BookingConfirmed, showCancelledReason); err != nil {
+			return err
+		}
+		var callbackURL sql.NullString
+		if err := tx.QueryRowContext(ctx, `SELECT callback_url FROM bookings WHERE id = ?`, b.id).Scan(&callbackURL); err != nil {
+			return fmt.Errorf("failed to load booking callback: %w", err)
+		}
+		if !callbackURL.Valid {
+			return nil
+		}
+		return insertBookingCallback(ctx, tx, callbackURL.String, BookingCallback{
+			BookingID: b.id, Status: "SHOW_CANCELLED", State: BookingConfirmed, Reason: showCancelledReason,
+			SeatIDs: seatIDs, OccurredAt: time.Now().UTC(),
+		})
+	})
+	return refund, err
+}
+
+type queuedRefund struct {
+	id                int64
+	bookingID         string
+	providerSessionID string
+	amountCents       int
+	attempts          int
+}
+
+// sendQueuedRefunds asks the gateway for the queued refunds that are due.
+func sendQueuedRefunds() {
+	defer func() { reportPanic(ctx, "show_cancellation", recover()) }()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, booking_id, provider_session_id, amount_cents, attempts FROM refunds
+		WHERE status = 'REFUND_PENDING' AND provider_refund_id IS NULL AND next_attempt_at <= ?
+		ORDER BY next_attempt_at
+		LIMIT ?
+	`, time.Now(), showCancellationBatchSize)
+	if err != nil {
+		slog.Error("Failed to load queued refunds", "component", "show_cancellation", "error", err)
+		return
+	}
+	var due []queuedRefund
+	for rows.Next() {
+		var r queuedRefund
+		if err := rows.Scan(&r.id, &r.bookingID, &r.providerSessionID, &r.amountCents, &r.attempts); err != nil {
+			slog.Error("Failed to scan queued refund", "component", "show_cancellation", "error", err)
+			continue
+		}
+		due = append(due, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		slog.Error("Failed to load queued refunds", "component", "show_cancellation", "error", err)
+		return
+	}
+
+	sem := make(chan struct{}, showRefundConcurrency)
+	var wg sync.WaitGroup
+	for _, r := range due {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			sendQueuedRefund(r)
+		}()
+	}
+	wg.Wait()
+}
+
+func sendQueuedRefund(r queuedRefund) {
+	defer func() { reportPanic(ctx, "show_cancellation", recover()) }()
+
+	// The attempt is taken before the call, so one cut short by a restart waits out the backoff
+	// instead of going out again at once.
+	attempts := r.attempts + 1
+	backoff := min(time.Duration(strategyConfig.Cancellation.RefundBackoff)<<(attempts-1), maxRefundBackoff)
+	if backoff <= 0 {
+		// Shifted past the int64 range.
+		backoff = maxRefundBackoff
+	}
+	result, err := db.ExecContext(ctx, `
+		UPDATE refunds SET attempts = ?, next_attempt_at = ?
+		WHERE id = ? AND attempts = ? AND status = 'REFUND_PENDING' AND provider_refund_id IS NULL
+	`, attempts, time.Now().Add(backoff), r.id, r.attempts)
+	if err != nil {
+		slog.Error("Failed to take refund attempt", "component", "show_cancellation", "refund_id", r.id, "error", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return
+	}
+
+	providerRefundID, err := paymentProvider.Refund(ctx, r.providerSessionID, int64(r.amountCents))
+	if err == nil {
+		_, err = db.ExecContext(ctx, `
+			UPDATE refunds SET provider_refund_id = ?, next_attempt_at = NULL, last_error = NULL WHERE id = ?
+		`, providerRefundID, r.id)
+		if err != nil {
+			slog.Error("Failed to store provider refund id", "component", "show_cancellation", "refund_id", r.id, "provider_refund_id", providerRefundID, "error", err)
+			return
+		}
+		slog.Info("Refund requested", "component", "show_cancellation", "booking_id", r.bookingID, "refund_id", r.id, "provider", paymentProvider.Name(), "provider_refund_id", providerRefundID, "attempt", attempts)
+		return
+	}
+
+	if attempts >= strategyConfig.Cancellation.RefundMaxAttempts {
+		_, dbErr := db.ExecContext(ctx, `UPDATE refunds SET next_attempt_at = NULL, last_error = ? WHERE id = ?`, truncate(err.Error(), 255), r.id)
+		if dbErr != nil {
+			slog.Error("Failed to record refund attempt", "component", "show_cancellation", "refund_id", r.id, "error", dbErr)
+		}
+		slog.Error("Giving up on refund", "component", "show_cancellation", "booking_id", r.bookingID, "refund_id", r.id, "attempts", attempts, "error", err)
+		reportError(ctx, "show_cancellation", err, "refund_id", r.id, "booking_id", r.bookingID)
+		return
+	}
+	if _, dbErr := db.ExecContext(ctx, `UPDATE refunds SET last_error = ? WHERE id = ?`, truncate(err.Error(), 255), r.id); dbErr != nil {
+		slog.Error("Failed to record refund attempt", "component", "show_cancellation", "refund_id", r.id, "error", dbErr)
+	}
+	slog.Warn("Refund call failed, retrying", "component", "show_cancellation", "booking_id", r.bookingID, "refund_id", r.id, "attempt", attempts, "backoff", backoff, "error", err)
+}
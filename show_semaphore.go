@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Per-show booking semaphore. When a show goes on sale, thousands of requests for the same
+// seats arrive at once and every one of them opens a transaction that ends up waiting on the
+// same rows. With strategyConfig.Semaphore.Limit set, at most that many bookings per show run
+// their strategy at the same time; the rest are turned away with a "try again" response
+// before touching the database. Slots live in a Redis sorted set scored by expiry, so a slot
+// held by a crashed instance frees itself after the TTL.
+
+var ErrShowBusy = errors.New("too many bookings in progress for this show, try again")
+
+// acquireSemaphoreScript drops expired holders of KEYS[1] and adds ARGV[1] if fewer than
+// ARGV[2] remain. ARGV[3] is the slot TTL in milliseconds.
+var acquireSemaphoreScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = t[1] * 1000 + math.floor(t[2] / 1000)
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now)
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], now + tonumber(ARGV[3]), ARGV[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 1
+`)
+
+func showSemaphoreKey(showID int) string {
+	return fmt.Sprintf("show_semaphore:%d", showID)
+}
+
+// acquireShowSlot takes a slot for the booking and returns the func that gives it back. It
+// fails open: if Redis can't be reached the booking goes ahead without a slot.
+func acquireShowSlot(ctx context.Context, showID int, bookingID string) (func(), error) {
+	cfg := strategyConfig.Semaphore
+	if cfg.Limit <= 0 || showID == 0 {
+		return func() {}, nil
+	}
+
+	key := showSemaphoreKey(showID)
+	ok, err := acquireSemaphoreScript.Run(ctx, rdb, []string{key}, bookingID, cfg.Limit, time.Duration(cfg.TTL).Milliseconds()).Int()
+	if err != nil {
+		slog.WarnContext(ctx, "Show semaphore unavailable, continuing without it", "component", "booking", "show_id", showID, "error", err)
+		return func() {}, nil
+	}
+	if ok != 1 {
+		slog.InfoContext(ctx, "Show semaphore full", "component", "booking", "show_id", showID, "limit", cfg.Limit, "booking_id", bookingID)
+		return nil, ErrShowBusy
+	}
+	return func() {
+		rdb.ZRem(context.Background(), key, bookingID)
+	}, nil
+}
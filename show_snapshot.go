@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Kiosk sync. A snapshot is the availability bitmap of every seat in a show (bit i is the i-th
+// seat by id, set when available) stamped with the show's latest seat_changes id. Kiosks then
+// poll for changes since that version and apply them to their local bitmap.
+//
+// seat_changes ids are assigned at insert time, not commit time, so a long transaction can
+// commit a change with a lower id than one a kiosk has already seen. Kiosks should refetch the
+// snapshot periodically rather than rely on deltas forever.
+//
+// Snapshots carry an ETag built from the version; a request with a matching If-None-Match is
+// answered 304 Not Modified without reading the seats.
+
+const maxSnapshotDelta = 1000
+
+type ShowSnapshot struct {
+	ShowID      int    `json:"show_id"`
+	Version     int64  `json:"version"`
+	FirstSeatID int    `json:"first_seat_id"`
+	SeatCount   int    `json:"seat_count"`
+	SeatIDs     []int  `json:"seat_ids,omitempty"` // only when seat ids are not contiguous
+	Bitmap      string `json:"bitmap"`
+}
+
+type SeatChange struct {
+	Version   int64 `json:"version"`
+	SeatID    int   `json:"seat_id"`
+	Available bool  `json:"available"`
+}
+
+type ShowDelta struct {
+	ShowID  int          `json:"show_id"`
+	Version int64        `json:"version"`
+	Changes []SeatChange `json:"changes"`
+}
+
+// handleShowSnapshot serves GET /api/shows/{id}/snapshot.
+func handleShowSnapshot(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+
+	// One read-only snapshot so the version matches the seat rows exactly.
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to begin transaction", "component", "snapshot", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	snapshot := ShowSnapshot{ShowID: showID}
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM seat_changes WHERE show_id = ?`, showID).Scan(&snapshot.Version)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read version", "component", "snapshot", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Seat pickers refetch the map every second or so; while nothing moved they get a 304 and
+	// the seats are neither read nor encoded.
+	etag := showSnapshotETag(showID, snapshot.Version)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, (is_reserved = 0 OR payment_status = 'FAILED') AS available
+		FROM seats WHERE show_id = ? ORDER BY id
+	`, showID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read seats", "component", "snapshot", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var seatIDs []int
+	var bitmap []byte
+	for rows.Next() {
+		var seatID int
+		var available bool
+		if err := rows.Scan(&seatID, &available); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to scan seat", "component", "snapshot", "show_id", showID, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		i := len(seatIDs)
+		if i%8 == 0 {
+			bitmap = append(bitmap, 0)
+		}
+		if available {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+		seatIDs = append(seatIDs, seatID)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(seatIDs) == 0 {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+
+	snapshot.FirstSeatID = seatIDs[0]
+	snapshot.SeatCount = len(seatIDs)
+	if seatIDs[len(seatIDs)-1]-seatIDs[0] != len(seatIDs)-1 {
+		snapshot.SeatIDs = seatIDs
+	}
+	snapshot.Bitmap = base64.StdEncoding.EncodeToString(bitmap)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// showSnapshotETag is the validator of a show's snapshot, which only changes with its version.
+// A change committed late under a lower id (see above) is missed until the show's next one.
+func showSnapshotETag(showID int, version int64) string {
+	return fmt.Sprintf(`"%d.%d"`, showID, version)
+}
+
+// etagMatches reports whether an If-None-Match header names etag, weak or not, or is "*".
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// handleShowChanges serves GET /api/shows/{id}/changes?since=N. It answers 410 when the kiosk
+// is too far behind and should take a fresh snapshot instead.
+func handleShowChanges(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		http.Error(w, "since version is required", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, seat_id, available FROM seat_changes
+		WHERE show_id = ? AND id > ?
+		ORDER BY id
+		LIMIT ?
+	`, showID, since, maxSnapshotDelta+1)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read changes", "component", "snapshot", "show_id", showID, "since", since, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	delta := ShowDelta{ShowID: showID, Version: since, Changes: []SeatChange{}}
+	for rows.Next() {
+		var change SeatChange
+		if err := rows.Scan(&change.Version, &change.SeatID, &change.Available); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to scan change", "component", "snapshot", "show_id", showID, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		delta.Changes = append(delta.Changes, change)
+		delta.Version = change.Version
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if len(delta.Changes) > maxSnapshotDelta {
+		slog.InfoContext(r.Context(), "Delta too large, snapshot required", "component", "snapshot", "show_id", showID, "since", since)
+		http.Error(w, "Too many changes, fetch a new snapshot", http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(delta)
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Show management. Admins create, list, change and delete shows under /admin/shows; a new
+// show can come with its seats, numbered by row like the seed data's or generated from a
+// venue's layout (venues.go). A show may set when its seats are on sale (sale_start and
+// sale_end, see sale_window.go, and presale_start, see presale.go), its own hold
+// (hold_timeout, as PUT /admin/shows/{id}/hold-timeout sets it) and the strategy all its
+// bookings use whatever the request asks for. Price and waiting room keep their own endpoints.
+//
+// The booking path reads the sale window and strategy from showSettings, which every instance
+// reloads every showSettingsRefresh, and at once after a change made through it, so a change
+// made on another instance takes up to that long to apply here.
+
+const (
+	showSettingsRefresh = 5 * time.Second
+	maxShowSeats        = 10000
+	maxShowsLimit       = 1000
+)
+
+// showStrategies are the strategies a show may force: not skip_locked, which picks seats
+// itself and would ignore the ones asked for, nor the ones chosen by configuration.
+var showStrategies = map[string]bool{
+	"pessimistic": true, "optimistic": true, "current": true, "redlock": true,
+	"advisory": true, "named": true, "auto": true,
+}
+
+var ErrShowInUse = errors.New("show has bookings or allocations")
+
+type Show struct {
+	ID           int        `json:"id"`
+	Title        string     `json:"title"`
+	Venue        *string    `json:"venue"`
+	VenueID      *int       `json:"venue_id"`
+	StartTime    time.Time  `json:"start_time"`
+	EndTime      time.Time  `json:"end_time"`
+	PresaleStart *time.Time `json:"presale_start"`
+	SaleStart    *time.Time `json:"sale_start"`
+	SaleEnd      *time.Time `json:"sale_end"`
+	HoldTimeout  *Duration  `json:"hold_timeout"`
+	Strategy     *string    `json:"strategy"`
+	PriceCents   int        `json:"price_cents"`
+	Currency     string     `json:"currency"`
+	WaitingRoom  bool       `json:"waiting_room"`
+	Seats        int        `json:"seats"`
+	// SoldOutAt is set while every seat is paid for, see sold_out.go.
+	SoldOutAt *time.Time `json:"sold_out_at"`
+	// CancelledAt is set once the show is cancelled, see show_cancellation.go.
+	CancelledAt  *time.Time `json:"cancelled_at,omitempty"`
+	CancelReason *string    `json:"cancel_reason,omitempty"`
+}
+
+// ShowRequest creates a show, or replaces one on PUT; fields left out are cleared. Price,
+// currency and the seats, seats and row_size or a venue_id to lay them out as the venue, are
+// only read on create.
+type ShowRequest struct {
+	Title        string     `json:"title"`
+	Venue        *string    `json:"venue"`
+	StartTime    time.Time  `json:"start_time"`
+	EndTime      time.Time  `json:"end_time"`
+	PresaleStart *time.Time `json:"presale_start"`
+	SaleStart    *time.Time `json:"sale_start"`
+	SaleEnd      *time.Time `json:"sale_end"`
+	HoldTimeout  *Duration  `json:"hold_timeout"`
+	Strategy     *string    `json:"strategy"`
+	PriceCents   int        `json:"price_cents"`
+	Currency     string     `json:"currency"`
+	Seats        int        `json:"seats"`
+	RowSize      int        `json:"row_size"`
+	VenueID      *int       `json:"venue_id"`
+}
+
+func (req *ShowRequest) Validate(create bool) error {
+	switch {
+	case req.Title == "" || len(req.Title) > 100:
+		return errors.New("title is required, up to 100 characters")
+	case req.Venue != nil && len(*req.Venue) > 100:
+		return errors.New("venue is up to 100 characters")
+	case req.StartTime.IsZero() || !req.EndTime.After(req.StartTime):
+		return errors.New("start_time is required and end_time must be after it")
+	case req.SaleStart != nil && !req.SaleStart.Before(req.EndTime):
+		return errors.New("sale_start must be before end_time")
+	case req.SaleStart != nil && req.SaleEnd != nil && !req.SaleEnd.After(*req.SaleStart):
+		return errors.New("sale_end must be after sale_start")
+	case req.PresaleStart != nil && (req.SaleStart == nil || !req.PresaleStart.Before(*req.SaleStart)):
+		return errors.New("presale_start needs a sale_start after it")
+	case req.HoldTimeout != nil && time.Duration(*req.HoldTimeout) < 10*time.Second:
+		return errors.New("hold_timeout must be at least 10s")
+	case req.Strategy != nil && !showStrategies[*req.Strategy]:
+		return fmt.Errorf("unknown strategy %q", *req.Strategy)
+	}
+	if !create {
+		return nil
+	}
+	if req.Currency == "" {
+		req.Currency = "INR"
+	}
+	if req.RowSize == 0 {
+		req.RowSize = 20
+	}
+	req.Currency = strings.ToUpper(req.Currency)
+	switch {
+	case req.PriceCents < 0 || len(req.Currency) != 3:
+		return errors.New("price_cents can't be negative and currency must be a 3 letter code")
+	case req.Seats < 0 || req.Seats > maxShowSeats:
+		return fmt.Errorf("seats must be between 0 and %d", maxShowSeats)
+	case req.RowSize <= 0:
+		return errors.New("row_size must be > 0")
+	case req.VenueID != nil && req.Seats > 0:
+		return errors.New("seats come from either the venue_id's layout or seats, not both")
+	}
+	return nil
+}
+
+// holdTimeoutSeconds is the request's hold as stored in shows.hold_timeout_seconds.
+func (req *ShowRequest) holdTimeoutSeconds() sql.NullInt64 {
+	if req.HoldTimeout == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(time.Duration(*req.HoldTimeout) / time.Second), Valid: true}
+}
+
+// showSettings caches what the booking path needs of each show, for shows that need anything:
+// a strategy, a sale start still to come, a sale end, a sold-out flag or a cancellation.
+var showSettings struct {
+	sync.RWMutex
+	saleWindow map[int]saleWindow
+	strategy   map[int]string
+	soldOut    map[int]bool
+	cancelled  map[int]bool
+}
+
+// showSaleWindow is the show's sale window, zero sides for open ones.
+func showSaleWindow(showID int) saleWindow {
+	showSettings.RLock()
+	defer showSettings.RUnlock()
+	return showSettings.saleWindow[showID]
+}
+
+// showStrategy is the strategy the show forces, "" for none.
+func showStrategy(showID int) string {
+	showSettings.RLock()
+	defer showSettings.RUnlock()
+	return showSettings.strategy[showID]
+}
+
+func refreshShowSettings() error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, presale_start, sale_start, sale_end, strategy, sold_out_at IS NOT NULL, cancelled_at IS NOT NULL FROM shows
+		WHERE strategy IS NOT NULL OR sale_start > ? OR sale_end IS NOT NULL OR sold_out_at IS NOT NULL OR cancelled_at IS NOT NULL
+	`, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to query show settings: %w", err)
+	}
+	defer rows.Close()
+
+	windows := make(map[int]saleWindow)
+	strategy := make(map[int]string)
+	soldOut := make(map[int]bool)
+	cancelled := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		var presaleStart, start, end sql.NullTime
+		var method sql.NullString
+		var isSoldOut, isCancelled bool
+		if err := rows.Scan(&id, &presaleStart, &start, &end, &method, &isSoldOut, &isCancelled); err != nil {
+			return fmt.Errorf("failed to scan show: %w", err)
+		}
+		if start.Valid || end.Valid {
+			windows[id] = saleWindow{presaleStart: presaleStart.Time, start: start.Time, end: end.Time}
+		}
+		if method.Valid {
+			strategy[id] = method.String
+		}
+		if isSoldOut {
+			soldOut[id] = true
+		}
+		if isCancelled {
+			cancelled[id] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating show settings: %w", err)
+	}
+
+	showSettings.Lock()
+	showSettings.saleWindow = windows
+	showSettings.strategy = strategy
+	showSettings.soldOut = soldOut
+	showSettings.cancelled = cancelled
+	showSettings.Unlock()
+	return nil
+}
+
+func runShowSettingsRefresher() error {
+	ticker := time.NewTicker(showSettingsRefresh)
+	defer ticker.Stop()
+
+	for {
+		if err := refreshShowSettings(); err != nil {
+			slog.Error("Failed to refresh show settings", "component", "shows", "error", err)
+		}
+		<-ticker.C
+	}
+}
+
+const showColumns = `
+	sh.id, sh.name, sh.venue, sh.venue_id, sh.start_time, sh.end_time, sh.presale_start, sh.sale_start, sh.sale_end,
+	sh.hold_timeout_seconds,
+	sh.strategy, sh.price_cents, sh.currency, sh.waiting_room, sh.sold_out_at, sh.cancelled_at, sh.cancel_reason,
+	(SELECT COUNT(*) FROM seats s WHERE s.show_id = sh.id)`
+
+func scanShow(row interface{ Scan(...interface{}) error }) (Show, error) {
+	var show Show
+	var venue, strategy, cancelReason sql.NullString
+	var presaleStart, saleStart, saleEnd, soldOutAt, cancelledAt sql.NullTime
+	var holdSeconds, venueID sql.NullInt64
+	err := row.Scan(&show.ID, &show.Title, &venue, &venueID, &show.StartTime, &show.EndTime, &presaleStart, &saleStart, &saleEnd, &holdSeconds,
+		&strategy, &show.PriceCents, &show.Currency, &show.WaitingRoom, &soldOutAt, &cancelledAt, &cancelReason, &show.Seats)
+	if err != nil {
+		return show, err
+	}
+	if venue.Valid {
+		show.Venue = &venue.String
+	}
+	if venueID.Valid {
+		id := int(venueID.Int64)
+		show.VenueID = &id
+	}
+	if presaleStart.Valid {
+		show.PresaleStart = &presaleStart.Time
+	}
+	if saleStart.Valid {
+		show.SaleStart = &saleStart.Time
+	}
+	if saleEnd.Valid {
+		show.SaleEnd = &saleEnd.Time
+	}
+	if holdSeconds.Valid {
+		hold := Duration(time.Duration(holdSeconds.Int64) * time.Second)
+		show.HoldTimeout = &hold
+	}
+	if strategy.Valid {
+		show.Strategy = &strategy.String
+	}
+	if soldOutAt.Valid {
+		show.SoldOutAt = &soldOutAt.Time
+	}
+	if cancelledAt.Valid {
+		show.CancelledAt = &cancelledAt.Time
+	}
+	if cancelReason.Valid {
+		show.CancelReason = &cancelReason.String
+	}
+	return show, nil
+}
+
+func loadShow(ctx context.Context, showID int) (Show, error) {
+	return scanShow(db.QueryRowContext(ctx, `SELECT `+showColumns+` FROM shows sh WHERE sh.id = ?`, showID))
+}
+
+func writeShow(w http.ResponseWriter, status int, show Show) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(show)
+}
+
+// handleListShows serves GET /admin/shows, by start time, from ?from= (RFC 3339) on when set.
+func handleListShows(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxShowsLimit)
+	}
+	var from time.Time
+	if v := r.URL.Query().Get("from"); v != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid from, expected RFC 3339", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT `+showColumns+` FROM shows sh
+		WHERE sh.start_time >= ?
+		ORDER BY sh.start_time, sh.id
+		LIMIT ?
+	`, from, limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list shows", "component", "admin", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	shows := []Show{}
+	for rows.Next() {
+		show, err := scanShow(rows)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to scan show", "component", "admin", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		shows = append(shows, show)
+	}
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list shows", "component", "admin", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count": len(shows),
+		"shows": shows,
+	})
+}
+
+// handleGetShow serves GET /admin/shows/{id}.
+func handleGetShow(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+	show, err := loadShow(r.Context(), showID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load show", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeShow(w, http.StatusOK, show)
+}
+
+// handleCreateShow serves POST /admin/shows.
+func handleCreateShow(w http.ResponseWriter, r *http.Request) {
+	var req ShowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(true); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var showID int
+	err := seedInTx(r.Context(), db, func(tx *sql.Tx) error {
+		var err error
+		showID, err = insertReturningID(r.Context(), tx, `
+			INSERT INTO shows (name, venue, start_time, end_time, presale_start, sale_start, sale_end, hold_timeout_seconds, strategy, price_cents, currency)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, req.Title, req.Venue, req.StartTime, req.EndTime, req.PresaleStart, req.SaleStart, req.SaleEnd, req.holdTimeoutSeconds(), req.Strategy, req.PriceCents, req.Currency)
+		if err != nil {
+			return fmt.Errorf("failed to insert show: %w", err)
+		}
+		if req.VenueID != nil {
+			req.Seats, err = generateShowSeats(r.Context(), tx, showID, *req.VenueID)
+			if err != nil {
+				return err
+			}
+			// The venue's name unless the show names it otherwise.
+			_, err = tx.ExecContext(r.Context(), `
+				UPDATE shows SET venue = COALESCE(venue, (SELECT name FROM venues WHERE id = ?)) WHERE id = ?
+			`, *req.VenueID, showID)
+			return err
+		}
+		if req.Seats == 0 {
+			return nil
+		}
+		return seedShowSeats(r.Context(), tx, showID, req.Seats, req.RowSize)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Venue not found", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create show", "component", "admin", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := refreshShowSettings(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to refresh show settings", "component", "admin", "error", err)
+	}
+
+	slog.InfoContext(r.Context(), "Created show", "component", "admin", "show_id", showID, "title", req.Title, "seats", req.Seats)
+	show, err := loadShow(r.Context(), showID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load show", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeShow(w, http.StatusCreated, show)
+}
+
+// handleUpdateShow serves PUT /admin/shows/{id}.
+func handleUpdateShow(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+	var req ShowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `
+		UPDATE shows
+		SET name = ?, venue = ?, start_time = ?, end_time = ?, presale_start = ?, sale_start = ?, sale_end = ?,
+		    hold_timeout_seconds = ?, strategy = ?
+		WHERE id = ?
+	`, req.Title, req.Venue, req.StartTime, req.EndTime, req.PresaleStart, req.SaleStart, req.SaleEnd, req.holdTimeoutSeconds(), req.Strategy, showID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update show", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// MySQL counts changed rows only: tell a show saved as it was from a missing one.
+		if _, err := loadShow(r.Context(), showID); errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Show not found", http.StatusNotFound)
+			return
+		}
+	}
+	if err := refreshShowSettings(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to refresh show settings", "component", "admin", "error", err)
+	}
+
+	slog.InfoContext(r.Context(), "Updated show", "component", "admin", "show_id", showID)
+	show, err := loadShow(r.Context(), showID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load show", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeShow(w, http.StatusOK, show)
+}
+
+// handleDeleteShow serves DELETE /admin/shows/{id}. Only a show nobody booked or was allocated
+// seats of can go, with its seats.
+func handleDeleteShow(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+
+	found := true
+	err = seedInTx(r.Context(), db, func(tx *sql.Tx) error {
+		var inUse bool
+		err := tx.QueryRowContext(r.Context(), `
+			SELECT EXISTS (SELECT 1 FROM bookings WHERE show_id = ?)
+			    OR EXISTS (SELECT 1 FROM channel_allocations WHERE show_id = ?)
+			    OR EXISTS (SELECT 1 FROM seats WHERE show_id = ? AND is_reserved = 1)
+		`, showID, showID, showID).Scan(&inUse)
+		if err != nil {
+			return fmt.Errorf("failed to check show use: %w", err)
+		}
+		if inUse {
+			return ErrShowInUse
+		}
+		if _, err := tx.ExecContext(r.Context(), `DELETE FROM waitlist_entries WHERE show_id = ?`, showID); err != nil {
+			return fmt.Errorf("failed to delete waitlist: %w", err)
+		}
+		if _, err := tx.ExecContext(r.Context(), `DELETE FROM presale_codes WHERE show_id = ?`, showID); err != nil {
+			return fmt.Errorf("failed to delete presale codes: %w", err)
+		}
+		if _, err := tx.ExecContext(r.Context(), `DELETE FROM seats WHERE show_id = ?`, showID); err != nil {
+			return fmt.Errorf("failed to delete seats: %w", err)
+		}
+		result, err := tx.ExecContext(r.Context(), `DELETE FROM shows WHERE id = ?`, showID)
+		if err != nil {
+			return fmt.Errorf("failed to delete show: %w", err)
+		}
+		n, _ := result.RowsAffected()
+		found = n > 0
+		return nil
+	})
+	switch {
+	case errors.Is(err, ErrShowInUse):
+		http.Error(w, "Show has bookings or allocations", http.StatusConflict)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Failed to delete show", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	case !found:
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+	if err := refreshShowSettings(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to refresh show settings", "component", "admin", "error", err)
+	}
+
+	slog.InfoContext(r.Context(), "Deleted show", "component", "admin", "show_id", showID)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
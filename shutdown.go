@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Graceful shutdown. On SIGINT/SIGTERM the server stops accepting connections and waits up to
+// server.shutdown_timeout for the requests it is serving to finish, so a booking in the middle
+// of its transaction commits or rolls back instead of being cut off. Requests still running
+// after that are cancelled through their context. Their bookings roll back, and the locks they
+// had taken are released here rather than left to block the seats until they expire. Locks
+// backing a booking that did get its hold stay: the hold outlives this process, and the
+// watchdog of the instances still running keeps them alive until it is paid or reaped.
+
+// shutdownCancelGrace is how long cancelled bookings get to roll back before their locks are
+// released.
+const shutdownCancelGrace = 5 * time.Second
+
+var (
+	// serverCtx is the base of every request's context; cancelRequests cancels the requests
+	// still running when the shutdown timeout runs out.
+	serverCtx, cancelRequests = context.WithCancel(context.Background())
+
+	// apiMux routes the API. It isn't http.DefaultServeMux, where net/http/pprof registers
+	// itself: the profiles are served on the debug listener only, see diagnostics.go.
+	apiMux = http.NewServeMux()
+
+	httpServer = &http.Server{
+		Handler:     withRequestID(recoverPanics(auditRequestSource(apiMux))),
+		BaseContext: func(net.Listener) context.Context { return serverCtx },
+	}
+)
+
+// serveHTTP serves the registered handlers until shutdownServer stops the server.
+func serveHTTP() error {
+	listener, err := net.Listen("tcp", strategyConfig.Server.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", strategyConfig.Server.ListenAddr, err)
+	}
+	slog.Info("Listening", "component", "api", "addr", listener.Addr())
+
+	if err := httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("server stopped: %w", err)
+	}
+	return nil
+}
+
+// shutdownServer drains the server, then cancels whatever is left and releases its locks.
+func shutdownServer() {
+	leader.resign()
+
+	timeout := time.Duration(strategyConfig.Server.ShutdownTimeout)
+	slog.Info("Draining requests", "component", "shutdown", "in_flight_bookings", inFlight.count(), "timeout", timeout)
+
+	// WebSockets outlive Shutdown and event streams would hold it up until the timeout: tell
+	// their clients to reconnect elsewhere.
+	seatFeed.closeAll()
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := httpServer.Shutdown(drainCtx)
+	if err == nil {
+		slog.Info("All requests finished", "component", "shutdown")
+		return
+	}
+
+	// Taken before cancelling: a booking drops out of the registry as soon as it returns.
+	abandoned := inFlight.locksByBooking()
+	slog.Warn("Cancelling requests still running", "component", "shutdown", "in_flight_bookings", inFlight.count(), "holding_locks", len(abandoned), "error", err)
+	cancelRequests()
+
+	deadline := time.Now().Add(shutdownCancelGrace)
+	for inFlight.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := inFlight.count(); n > 0 {
+		slog.Warn("Bookings still running after cancellation", "component", "shutdown", "in_flight_bookings", n)
+	}
+
+	releaseAbandonedLocks(abandoned)
+}
+
+// lockReleaser is anything that can release locks it handed out: a LockProvider or the
+// Redlock node set.
+type lockReleaser interface {
+	Release(ctx context.Context, keys []string, owner string) error
+}
+
+// releaseAbandonedLocks releases the locks of cancelled bookings that didn't get a hold. A
+// booking whose state can't be read keeps its locks; they expire on their own.
+func releaseAbandonedLocks(abandoned map[string][]heldLock) {
+	for bookingID, locks := range abandoned {
+		releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		state, err := bookingState(releaseCtx, db, bookingID)
+		if err != nil {
+			slog.Error("Failed to read booking state, leaving its locks to expire", "component", "shutdown", "booking_id", bookingID, "error", err)
+			cancel()
+			continue
+		}
+		if state == BookingHeld || state == BookingPendingPayment {
+			slog.Info("Keeping locks of held booking", "component", "shutdown", "booking_id", bookingID, "state", state)
+			cancel()
+			continue
+		}
+
+		for _, lock := range locks {
+			releaser, ok := lock.extender.(lockReleaser)
+			if !ok {
+				continue
+			}
+			if err := releaser.Release(releaseCtx, lock.keys, lock.owner); err != nil {
+				slog.Error("Failed to release locks", "component", "shutdown", "booking_id", bookingID, "keys", lock.keys, "error", err)
+				continue
+			}
+			slog.Info("Released locks", "component", "shutdown", "booking_id", bookingID, "keys", lock.keys)
+		}
+		cancel()
+	}
+}
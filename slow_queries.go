@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// Slow query and transaction logging. The service's pool is opened through timedDriver, which
+// wraps the real driver and times every statement and every transaction from BEGIN to COMMIT or
+// ROLLBACK. One over log.slow_query or log.slow_transaction is logged as a warning on the
+// context that issued it, so the line carries the booking's strategy and booking_id, and is
+// counted per strategy in /debug/vars. A query's time is until its first rows come back, not
+// until they are all read. Arguments are not logged, they hold user ids and payment data.
+
+const (
+	timedMySQLDriverName    = "mysql-timed"
+	timedPostgresDriverName = "postgres-timed"
+)
+
+func init() {
+	sql.Register(timedMySQLDriverName, timedDriver{&mysql.MySQLDriver{}})
+	sql.Register(timedPostgresDriverName, timedDriver{postgresRebindDriver{&pq.Driver{}}})
+}
+
+// maxLoggedQueryLength is where logged statements are cut off.
+const maxLoggedQueryLength = 300
+
+// SlowCounts is how many slow queries and transactions each strategy issued, "" for work
+// outside of a booking (reaper, webhooks...).
+type SlowCounts struct {
+	Queries      map[string]int64 `json:"queries"`
+	Transactions map[string]int64 `json:"transactions"`
+}
+
+var slowCounts = struct {
+	sync.Mutex
+	SlowCounts
+}{SlowCounts: SlowCounts{Queries: map[string]int64{}, Transactions: map[string]int64{}}}
+
+// slowCountsSnapshot copies the counts for /debug/vars.
+func slowCountsSnapshot() SlowCounts {
+	slowCounts.Lock()
+	defer slowCounts.Unlock()
+	snapshot := SlowCounts{Queries: map[string]int64{}, Transactions: map[string]int64{}}
+	for strategy, n := range slowCounts.Queries {
+		snapshot.Queries[strategy] = n
+	}
+	for strategy, n := range slowCounts.Transactions {
+		snapshot.Transactions[strategy] = n
+	}
+	return snapshot
+}
+
+// contextStrategy is the booking strategy BookSeats put on ctx's log fields.
+func contextStrategy(ctx context.Context) string {
+	for _, field := range contextLogFields(ctx) {
+		if field.Key == "strategy" {
+			return field.Value.String()
+		}
+	}
+	return ""
+}
+
+func observeQuery(ctx context.Context, query string, started time.Time, err error) {
+	threshold := time.Duration(strategyConfig.Log.SlowQuery)
+	took := time.Since(started)
+	if threshold <= 0 || took < threshold {
+		return
+	}
+	slowCounts.Lock()
+	slowCounts.Queries[contextStrategy(ctx)]++
+	slowCounts.Unlock()
+	slog.WarnContext(ctx, "Slow query", "component", "db", "took", took, "query", loggedQuery(query), "error", err)
+}
+
+func observeTransaction(ctx context.Context, started time.Time, outcome string) {
+	threshold := time.Duration(strategyConfig.Log.SlowTransaction)
+	took := time.Since(started)
+	if threshold <= 0 || took < threshold {
+		return
+	}
+	slowCounts.Lock()
+	slowCounts.Transactions[contextStrategy(ctx)]++
+	slowCounts.Unlock()
+	slog.WarnContext(ctx, "Slow transaction", "component", "db", "took", took, "outcome", outcome)
+}
+
+// loggedQuery puts query on one line and cuts it short.
+func loggedQuery(query string) string {
+	query = strings.Join(strings.Fields(query), " ")
+	if len(query) > maxLoggedQueryLength {
+		query = query[:maxLoggedQueryLength] + "..."
+	}
+	return query
+}
+
+type timedDriver struct {
+	driver.Driver
+}
+
+func (d timedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{conn}, nil
+}
+
+type timedConn struct {
+	driver.Conn
+}
+
+func (c *timedConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &timedStmt{stmt, query}, nil
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	p, ok := c.Conn.(driver.ConnPrepareContext)
+	if !ok {
+		return c.Prepare(query)
+	}
+	stmt, err := p.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &timedStmt{stmt, query}, nil
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	started := time.Now()
+	var tx driver.Tx
+	var err error
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = b.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &timedTx{Tx: tx, ctx: ctx, started: started}, nil
+}
+
+// QueryContext and ExecContext answer driver.ErrSkip when the driver wants the statement
+// prepared instead (MySQL with arguments); database/sql then goes through PrepareContext and
+// the statement is timed there.
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	started := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		observeQuery(ctx, query, started, err)
+	}
+	return rows, err
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	started := time.Now()
+	result, err := e.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		observeQuery(ctx, query, started, err)
+	}
+	return result, err
+}
+
+func (c *timedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *timedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *timedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *timedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+type timedStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s *timedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	started := time.Now()
+	var result driver.Result
+	var err error
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = e.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err == nil {
+			result, err = s.Stmt.Exec(values)
+		}
+	}
+	observeQuery(ctx, s.query, started, err)
+	return result, err
+}
+
+func (s *timedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	started := time.Now()
+	var rows driver.Rows
+	var err error
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err == nil {
+			rows, err = s.Stmt.Query(values)
+		}
+	}
+	observeQuery(ctx, s.query, started, err)
+	return rows, err
+}
+
+func (s *timedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("named arguments are not supported")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+// timedTx keeps the context the transaction began on: Commit and Rollback don't get one, and
+// it carries the strategy to tag the transaction with.
+type timedTx struct {
+	driver.Tx
+	ctx     context.Context
+	started time.Time
+}
+
+func (t *timedTx) Commit() error {
+	err := t.Tx.Commit()
+	outcome := "commit"
+	if err != nil {
+		outcome = "commit_failed"
+	}
+	observeTransaction(t.ctx, t.started, outcome)
+	return err
+}
+
+func (t *timedTx) Rollback() error {
+	err := t.Tx.Rollback()
+	observeTransaction(t.ctx, t.started, "rollback")
+	return err
+}
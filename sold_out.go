@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Sold-out shows. Once every seat of a show is paid for or blocked, shows.sold_out_at is set
+// and the Redis key show_sold_out:<id> with it, and /api/book turns bookings for the show away
+// with 409 SOLD_OUT before the waiting room, any lock or any transaction. The seat status
+// relay (seat_status_relay.go) keeps the flag: after a batch paying for or blocking a show's
+// seats it sets it if nothing is left, after one putting seats back on sale (a refund) it
+// clears it, both going by the seats as committed, so payments finishing together can't leave
+// it unset. The flag trails the last payment by up to seatRelayInterval; bookings in between
+// fail on the seats as before. A seat freed by a change the relay never saw would leave the
+// show flagged with seats on sale, so the leader also re-syncs every flagged show that hasn't
+// ended every soldOutResyncInterval, and the Redis key lapses after soldOutKeyTTL unless that
+// keeps it.
+//
+// Redis answers for every instance; when it can't, showSettings' copy of the flag (shows.go),
+// up to showSettingsRefresh old, does.
+
+const (
+	soldOutResyncInterval = 1 * time.Minute
+	soldOutKeyTTL         = 10 * time.Minute
+)
+
+func showSoldOutKey(showID int) string {
+	return "show_sold_out:" + strconv.Itoa(showID)
+}
+
+// showSoldOut reports whether the show is flagged sold out.
+func showSoldOut(ctx context.Context, showID int) bool {
+	n, err := rdb.Exists(ctx, showSoldOutKey(showID)).Result()
+	if err == nil {
+		return n > 0
+	}
+	slog.WarnContext(ctx, "Failed to read sold-out flag, using cached settings", "component", "sold_out", "show_id", showID, "error", err)
+	showSettings.RLock()
+	defer showSettings.RUnlock()
+	return showSettings.soldOut[showID]
+}
+
+// syncShowSoldOut sets or clears the show's flag to match its seats, in the database and then
+// in Redis.
+func syncShowSoldOut(showID int) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE shows SET sold_out_at = CASE
+			WHEN NOT EXISTS (
+				SELECT 1 FROM seats
+				WHERE show_id = ? AND (is_reserved = 0 OR COALESCE(payment_status, '') NOT IN ('COMPLETED', 'REFUND_PENDING', 'BLOCKED'))
+			) THEN COALESCE(sold_out_at, ?)
+			ELSE NULL
+		END
+		WHERE id = ?
+	`, showID, time.Now(), showID)
+	if err != nil {
+		return fmt.Errorf("failed to update sold-out flag of show %d: %w", showID, err)
+	}
+	var soldOutAt sql.NullTime
+	if err := db.QueryRowContext(ctx, `SELECT sold_out_at FROM shows WHERE id = ?`, showID).Scan(&soldOutAt); err != nil {
+		return fmt.Errorf("failed to read sold-out flag of show %d: %w", showID, err)
+	}
+
+	if soldOutAt.Valid {
+		err = rdb.Set(ctx, showSoldOutKey(showID), soldOutAt.Time.Unix(), soldOutKeyTTL).Err()
+	} else {
+		err = rdb.Del(ctx, showSoldOutKey(showID)).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to cache sold-out flag of show %d: %w", showID, err)
+	}
+	return nil
+}
+
+func runSoldOutResync() error {
+	ticker := time.NewTicker(soldOutResyncInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !runsMaintenance() {
+			continue
+		}
+		resyncSoldOutShows()
+	}
+	return errors.New("ending sold-out resync")
+}
+
+// resyncSoldOutShows checks the flag of every flagged show that hasn't ended against its seats.
+func resyncSoldOutShows() {
+	defer func() { reportPanic(ctx, "sold_out", recover()) }()
+
+	rows, err := db.QueryContext(ctx, `SELECT id FROM shows WHERE sold_out_at IS NOT NULL AND end_time > ?`, time.Now())
+	if err != nil {
+		slog.Error("Failed to load sold-out shows", "component", "sold_out", "error", err)
+		return
+	}
+	var showIDs []int
+	for rows.Next() {
+		var showID int
+		if err := rows.Scan(&showID); err != nil {
+			slog.Error("Failed to scan sold-out show", "component", "sold_out", "error", err)
+			continue
+		}
+		showIDs = append(showIDs, showID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		slog.Error("Failed to load sold-out shows", "component", "sold_out", "error", err)
+		return
+	}
+
+	for _, showID := range showIDs {
+		if err := syncShowSoldOut(showID); err != nil {
+			slog.Error("Failed to re-sync sold-out flag", "component", "sold_out", "show_id", showID, "error", err)
+		}
+	}
+}
+
+// writeSoldOut answers a booking for a sold-out show.
+func writeSoldOut(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(AsyncBookingResponse{
+		Status:    "SOLD_OUT",
+		RequestID: requestIDFromContext(r.Context()),
+	})
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Service config: where it listens and connects, and the tuning for the booking strategies.
+// Every knob has a default matching the old hard-coded value. A YAML file (-config, or
+// CONFIG_FILE) can override any of them, using the same keys /admin/config/strategies prints,
+// and the environment variable named next to each overrides the file. The config is loaded
+// and validated once at startup; a bad value stops the service rather than being silently
+// replaced by the default. Secrets (gateway keys, tokens) stay in the environment only.
+
+// Duration is a time.Duration that reads and prints as "250ms", "1m" etc.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// ServerConfig is where the service listens and what it connects to.
+type ServerConfig struct {
+	ListenAddr string `json:"listen_addr"` // LISTEN_ADDR
+	RedisAddr  string `json:"redis_addr"`  // REDIS_ADDR, also the redlock node when REDLOCK_ADDRS is unset
+	// REDIS_SENTINEL_MASTER and REDIS_SENTINEL_ADDRS (comma separated): when the master name is
+	// set Redis is found through these sentinels and redis_addr is not used
+	RedisSentinelMaster string   `json:"redis_sentinel_master"`
+	RedisSentinelAddrs  []string `json:"redis_sentinel_addrs"`
+	// REDIS_CLUSTER_ADDRS (comma separated): seed nodes of a Redis Cluster, used instead of
+	// redis_addr; seat lock keys are then hash tagged by show
+	RedisClusterAddrs []string `json:"redis_cluster_addrs"`
+	DBDriver          string   `json:"db_driver"`    // DB_DRIVER, "mysql", "postgres" or "memory"
+	DBDSN             string   `json:"db_dsn"`       // DB_DSN, the local default database of DBDriver when unset
+	AutoMigrate       bool     `json:"auto_migrate"` // DB_AUTO_MIGRATE, apply missing migrations at startup
+	// REQUEST_TIMEOUT, deadline for booking, status and webhook requests; keep it above
+	// pessimistic.lock_wait_timeout or waits for row locks get cut short
+	RequestTimeout Duration `json:"request_timeout"`
+	// SHUTDOWN_TIMEOUT, how long a stopping server waits for in-flight requests before it
+	// cancels them
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// CONNECT_ATTEMPTS and CONNECT_BACKOFF, how often the database and Redis are tried at
+	// startup and the first wait between tries, doubling after each
+	ConnectAttempts     int      `json:"connect_attempts"`
+	ConnectBackoff      Duration `json:"connect_backoff"`
+	HealthCheckInterval Duration `json:"health_check_interval"` // HEALTH_CHECK_INTERVAL, how often the dependencies are pinged
+	DebugAddr           string   `json:"debug_addr"`            // DEBUG_ADDR, where pprof and /debug/vars are served, "" for nowhere
+	// DEV_ENDPOINTS, serve the /dev/ tools (webhook_replay.go) outside production; they need
+	// the admin token and the mock payment provider
+	DevEndpoints bool `json:"dev_endpoints"`
+}
+
+// PaymentHoldConfig is how long booked seats are held for payment.
+type PaymentHoldConfig struct {
+	HoldTimeout Duration `json:"hold_timeout"` // PAYMENT_HOLD_TIMEOUT, bulk bookings have their own
+}
+
+type OptimisticConfig struct {
+	MaxRetries int      `json:"max_retries"` // OPTIMISTIC_MAX_RETRIES, retries after a version conflict
+	Backoff    Duration `json:"backoff"`     // OPTIMISTIC_BACKOFF, multiplied by the retry number
+}
+
+type PessimisticConfig struct {
+	LockWaitTimeout Duration `json:"lock_wait_timeout"` // PESSIMISTIC_LOCK_WAIT_TIMEOUT, ignored with NoWait
+}
+
+// RedisLockConfig is for the "current" strategy's single-node lock.
+type RedisLockConfig struct {
+	TTL             Duration `json:"ttl"`              // REDIS_LOCK_TTL
+	RenewalInterval Duration `json:"renewal_interval"` // REDIS_LOCK_RENEWAL_INTERVAL, how often the watchdog extends held locks
+	StripeBucket    int      `json:"stripe_bucket"`    // REDIS_LOCK_STRIPE_BUCKET, seats per hash tag, 0 turns striping off
+	ExpiryEvents    bool     `json:"expiry_events"`    // REDIS_LOCK_EXPIRY_EVENTS, release a hold as soon as its seat_lock expires, see lock_expiry.go
+}
+
+type RedlockConfig struct {
+	TTL         Duration `json:"ttl"`          // REDLOCK_TTL
+	NodeTimeout Duration `json:"node_timeout"` // REDLOCK_NODE_TIMEOUT
+	DriftFactor float64  `json:"drift_factor"` // REDLOCK_DRIFT_FACTOR
+	RetryCount  int      `json:"retry_count"`  // REDLOCK_RETRY_COUNT
+	RetryDelay  Duration `json:"retry_delay"`  // REDLOCK_RETRY_DELAY
+}
+
+type NamedLockConfig struct {
+	LockTimeout Duration `json:"lock_timeout"` // NAMED_LOCK_TIMEOUT, whole seconds
+}
+
+// TxRetryConfig drives runInTx's deadlock and lock wait timeout retries.
+type TxRetryConfig struct {
+	MaxAttempts int      `json:"max_attempts"` // TX_MAX_ATTEMPTS
+	BaseDelay   Duration `json:"base_delay"`   // TX_RETRY_BASE_DELAY
+}
+
+type AutoConfig struct {
+	OptimisticMaxConflictRate  float64  `json:"optimistic_max_conflict_rate"`  // AUTO_OPTIMISTIC_MAX_CONFLICT_RATE
+	PessimisticMaxConflictRate float64  `json:"pessimistic_max_conflict_rate"` // AUTO_PESSIMISTIC_MAX_CONFLICT_RATE
+	HalfLife                   Duration `json:"half_life"`                     // AUTO_CONTENTION_HALF_LIFE
+}
+
+// BulkConfig covers requests above the per-request seat cap, see bulk_booking.go.
+type BulkConfig struct {
+	MaxSeatsPerRequest int      `json:"max_seats_per_request"` // MAX_SEATS_PER_REQUEST, larger requests are booked in bulk
+	ChunkSize          int      `json:"chunk_size"`            // BULK_CHUNK_SIZE, seats per sub-transaction
+	HoldTimeout        Duration `json:"hold_timeout"`          // BULK_HOLD_TIMEOUT, payment hold for bulk bookings
+}
+
+// SemaphoreConfig caps concurrent bookings per show, see show_semaphore.go.
+type SemaphoreConfig struct {
+	Limit int      `json:"limit"` // SHOW_SEMAPHORE_LIMIT, bookings in flight per show, 0 turns it off
+	TTL   Duration `json:"ttl"`   // SHOW_SEMAPHORE_TTL, how long a slot outlives a crashed holder
+}
+
+// WaitingRoomConfig paces admissions for waiting room shows, see waiting_room.go.
+type WaitingRoomConfig struct {
+	AdmitPerSecond int      `json:"admit_per_second"` // WAITING_ROOM_ADMIT_PER_SECOND, per show
+	AdmissionTTL   Duration `json:"admission_ttl"`    // WAITING_ROOM_ADMISSION_TTL, how long an admitted token can be used
+	QueueTTL       Duration `json:"queue_ttl"`        // WAITING_ROOM_QUEUE_TTL, how long a token stays in the queue
+	PriorityShare  float64  `json:"priority_share"`   // WAITING_ROOM_PRIORITY_SHARE, fraction of admissions reserved for the priority lane
+}
+
+// BackpressureConfig bounds the bookings /api/book runs at once, see backpressure.go.
+type BackpressureConfig struct {
+	MaxInFlight  int      `json:"max_in_flight"` // BOOKING_MAX_IN_FLIGHT, 0 turns the limit off
+	MaxQueue     int      `json:"max_queue"`     // BOOKING_MAX_QUEUE, requests allowed to wait for a slot
+	QueueTimeout Duration `json:"queue_timeout"` // BOOKING_QUEUE_TIMEOUT, longest wait for a slot, also the Retry-After
+}
+
+// PaymentReconcileConfig drives the payment reconciler, see payment_reconciler.go.
+type PaymentReconcileConfig struct {
+	Interval  Duration `json:"interval"`   // PAYMENT_RECONCILE_INTERVAL, how often the gateway is polled
+	After     Duration `json:"after"`      // PAYMENT_RECONCILE_AFTER, how long a checkout stays PENDING before it is polled
+	BatchSize int      `json:"batch_size"` // PAYMENT_RECONCILE_BATCH_SIZE, sessions polled per run
+}
+
+// MemoryConfig sizes the in-process seat store behind the "memory" strategy.
+type MemoryConfig struct {
+	Shows        int `json:"shows"`          // MEMORY_SHOWS
+	SeatsPerShow int `json:"seats_per_show"` // MEMORY_SEATS_PER_SHOW
+}
+
+// LockProviderConfig picks the backend behind the "current" strategy's lock.
+type LockProviderConfig struct {
+	Provider            string   `json:"provider"`              // LOCK_PROVIDER, "redis", "etcd", "zookeeper" or "consul"
+	EtcdEndpoints       []string `json:"etcd_endpoints"`        // ETCD_ENDPOINTS, comma separated
+	ZookeeperServers    []string `json:"zookeeper_servers"`     // ZOOKEEPER_SERVERS, comma separated
+	ConsulAddr          string   `json:"consul_addr"`           // CONSUL_ADDR
+	ConsulSessionChecks []string `json:"consul_session_checks"` // CONSUL_SESSION_CHECKS, node checks that release the locks when critical
+}
+
+type StrategyConfig struct {
+	Server       ServerConfig           `json:"server"`
+	Log          LogConfig              `json:"log"`
+	Payment      PaymentHoldConfig      `json:"payment"`
+	Optimistic   OptimisticConfig       `json:"optimistic"`
+	Pessimistic  PessimisticConfig      `json:"pessimistic"`
+	Redis        RedisLockConfig        `json:"redis"`
+	Redlock      RedlockConfig          `json:"redlock"`
+	Named        NamedLockConfig        `json:"named"`
+	Transactions TxRetryConfig          `json:"transactions"`
+	Auto         AutoConfig             `json:"auto"`
+	Locks        LockProviderConfig     `json:"locks"`
+	Bulk         BulkConfig             `json:"bulk"`
+	Memory       MemoryConfig           `json:"memory"`
+	Semaphore    SemaphoreConfig        `json:"semaphore"`
+	WaitingRoom  WaitingRoomConfig      `json:"waiting_room"`
+	Backpressure BackpressureConfig     `json:"backpressure"`
+	Reconcile    PaymentReconcileConfig `json:"payment_reconcile"`
+	DBBreaker    DBBreakerConfig        `json:"db_breaker"`
+	Leader       LeaderConfig           `json:"leader"`
+	Reaper       ReaperConfig           `json:"reaper"`
+	EventStore   EventStoreConfig       `json:"event_store"`
+	Outbox       OutboxConfig           `json:"outbox"`
+	AsyncBooking AsyncBookingConfig     `json:"async_booking"`
+	Callbacks    BookingCallbackConfig  `json:"callbacks"`
+	Waitlist     WaitlistConfig         `json:"waitlist"`
+	Cancellation ShowCancellationConfig `json:"show_cancellation"`
+	SeatLimit    SeatLimitConfig        `json:"seat_limit"`
+	Partner      PartnerConfig          `json:"partner"`
+}
+
+func defaultStrategyConfig() StrategyConfig {
+	return StrategyConfig{
+		Server: ServerConfig{
+			ListenAddr:          ":8081",
+			RedisAddr:           "localhost:6379",
+			DBDriver:            "mysql",
+			AutoMigrate:         true,
+			RequestTimeout:      Duration(1 * time.Minute),
+			ShutdownTimeout:     Duration(30 * time.Second),
+			ConnectAttempts:     8,
+			ConnectBackoff:      Duration(500 * time.Millisecond),
+			HealthCheckInterval: Duration(5 * time.Second),
+			DebugAddr:           "localhost:6060",
+		},
+		Log:         LogConfig{Level: "info", Format: "auto", SlowQuery: Duration(250 * time.Millisecond), SlowTransaction: Duration(1 * time.Second)},
+		Payment:     PaymentHoldConfig{HoldTimeout: Duration(1 * time.Minute)},
+		Optimistic:  OptimisticConfig{MaxRetries: 2, Backoff: Duration(20 * time.Millisecond)},
+		Pessimistic: PessimisticConfig{LockWaitTimeout: Duration(50 * time.Second)},
+		Redis:       RedisLockConfig{TTL: Duration(1 * time.Minute), RenewalInterval: Duration(10 * time.Second)},
+		Redlock: RedlockConfig{
+			TTL:         Duration(1 * time.Minute),
+			NodeTimeout: Duration(50 * time.Millisecond),
+			DriftFactor: 0.01,
+			RetryCount:  3,
+			RetryDelay:  Duration(200 * time.Millisecond),
+		},
+		Named:        NamedLockConfig{LockTimeout: Duration(5 * time.Second)},
+		Transactions: TxRetryConfig{MaxAttempts: 3, BaseDelay: Duration(50 * time.Millisecond)},
+		Auto: AutoConfig{
+			OptimisticMaxConflictRate:  0.05,
+			PessimisticMaxConflictRate: 0.30,
+			HalfLife:                   Duration(1 * time.Minute),
+		},
+		Locks: LockProviderConfig{
+			Provider:            "redis",
+			EtcdEndpoints:       []string{"localhost:2379"},
+			ZookeeperServers:    []string{"localhost:2181"},
+			ConsulAddr:          "localhost:8500",
+			ConsulSessionChecks: []string{"serfHealth"},
+		},
+		Bulk:      BulkConfig{MaxSeatsPerRequest: 10, ChunkSize: 10, HoldTimeout: Duration(10 * time.Minute)},
+		Memory:    MemoryConfig{Shows: 2, SeatsPerShow: 100},
+		Semaphore: SemaphoreConfig{Limit: 0, TTL: Duration(30 * time.Second)},
+		WaitingRoom: WaitingRoomConfig{
+			AdmitPerSecond: 50,
+			AdmissionTTL:   Duration(2 * time.Minute),
+			QueueTTL:       Duration(1 * time.Hour),
+			PriorityShare:  0.8,
+		},
+		Backpressure: BackpressureConfig{MaxInFlight: 64, MaxQueue: 128, QueueTimeout: Duration(2 * time.Second)},
+		Reconcile:    PaymentReconcileConfig{Interval: Duration(15 * time.Second), After: Duration(30 * time.Second), BatchSize: 100},
+		DBBreaker:    DBBreakerConfig{FailureThreshold: 10, OpenFor: Duration(5 * time.Second)},
+		Leader:       LeaderConfig{LeaseTTL: Duration(15 * time.Second)},
+		Reaper:       ReaperConfig{BatchSize: 200, BatchPause: Duration(20 * time.Millisecond), MaxBatchesPerPass: 10},
+		Outbox: OutboxConfig{
+			Broker:       "redis",
+			KafkaBrokers: []string{"localhost:9092"},
+			KafkaTopic:   "booking_events",
+			NatsURL:      "nats://localhost:4222",
+			NatsStream:   "BOOKING_EVENTS",
+			NatsSubject:  "booking_events",
+			Stream:       "booking_events",
+			Interval:     Duration(1 * time.Second),
+			BatchSize:    100,
+		},
+		AsyncBooking: AsyncBookingConfig{
+			Stream:        "booking_requests",
+			Workers:       8,
+			ResultTTL:     Duration(1 * time.Hour),
+			MaxAttempts:   3,
+			RetryBackoff:  Duration(200 * time.Millisecond),
+			MaxDeliveries: 3,
+		},
+		Callbacks:    BookingCallbackConfig{MaxAttempts: 8, Backoff: Duration(5 * time.Second), Timeout: Duration(5 * time.Second)},
+		Waitlist:     WaitlistConfig{OfferHold: Duration(2 * time.Minute), MaxQuantity: 10},
+		Cancellation: ShowCancellationConfig{RefundMaxAttempts: 8, RefundBackoff: Duration(30 * time.Second)},
+		Partner:      PartnerConfig{AnonymousDailySeats: 20},
+	}
+}
+
+var strategyConfig = defaultStrategyConfig()
+
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) duration(name string, dst *Duration) {
+	if v := os.Getenv(name); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		*dst = Duration(d)
+	}
+}
+
+func (e *envReader) int(name string, dst *int) {
+	if v := os.Getenv(name); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		*dst = n
+	}
+}
+
+func (e *envReader) float(name string, dst *float64) {
+	if v := os.Getenv(name); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		*dst = f
+	}
+}
+
+func (e *envReader) string(name string, dst *string) {
+	if v := os.Getenv(name); v != "" {
+		*dst = v
+	}
+}
+
+func (e *envReader) bool(name string, dst *bool) {
+	if v := os.Getenv(name); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		*dst = b
+	}
+}
+
+func (e *envReader) list(name string, dst *[]string) {
+	if v := os.Getenv(name); v != "" {
+		*dst = strings.Split(v, ",")
+	}
+}
+
+// loadStrategyConfig reads the config file at path, if any, then the environment.
+func loadStrategyConfig(path string) (StrategyConfig, error) {
+	cfg := defaultStrategyConfig()
+	if path != "" {
+		if err := loadConfigFile(path, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+	env := &envReader{}
+
+	env.string("LISTEN_ADDR", &cfg.Server.ListenAddr)
+	env.string("REDIS_ADDR", &cfg.Server.RedisAddr)
+	env.string("REDIS_SENTINEL_MASTER", &cfg.Server.RedisSentinelMaster)
+	env.list("REDIS_SENTINEL_ADDRS", &cfg.Server.RedisSentinelAddrs)
+	env.list("REDIS_CLUSTER_ADDRS", &cfg.Server.RedisClusterAddrs)
+	env.string("DB_DRIVER", &cfg.Server.DBDriver)
+	env.string("DB_DSN", &cfg.Server.DBDSN)
+	env.bool("DB_AUTO_MIGRATE", &cfg.Server.AutoMigrate)
+	env.duration("REQUEST_TIMEOUT", &cfg.Server.RequestTimeout)
+	env.duration("SHUTDOWN_TIMEOUT", &cfg.Server.ShutdownTimeout)
+	env.int("CONNECT_ATTEMPTS", &cfg.Server.ConnectAttempts)
+	env.duration("CONNECT_BACKOFF", &cfg.Server.ConnectBackoff)
+	env.duration("HEALTH_CHECK_INTERVAL", &cfg.Server.HealthCheckInterval)
+	env.string("DEBUG_ADDR", &cfg.Server.DebugAddr)
+	env.bool("DEV_ENDPOINTS", &cfg.Server.DevEndpoints)
+	env.string("LOG_LEVEL", &cfg.Log.Level)
+	env.string("LOG_FORMAT", &cfg.Log.Format)
+	env.duration("LOG_SLOW_QUERY", &cfg.Log.SlowQuery)
+	env.duration("LOG_SLOW_TRANSACTION", &cfg.Log.SlowTransaction)
+	env.duration("PAYMENT_HOLD_TIMEOUT", &cfg.Payment.HoldTimeout)
+	env.int("OPTIMISTIC_MAX_RETRIES", &cfg.Optimistic.MaxRetries)
+	env.duration("OPTIMISTIC_BACKOFF", &cfg.Optimistic.Backoff)
+	env.duration("PESSIMISTIC_LOCK_WAIT_TIMEOUT", &cfg.Pessimistic.LockWaitTimeout)
+	env.duration("REDIS_LOCK_TTL", &cfg.Redis.TTL)
+	env.duration("REDIS_LOCK_RENEWAL_INTERVAL", &cfg.Redis.RenewalInterval)
+	env.int("REDIS_LOCK_STRIPE_BUCKET", &cfg.Redis.StripeBucket)
+	env.bool("REDIS_LOCK_EXPIRY_EVENTS", &cfg.Redis.ExpiryEvents)
+	env.duration("REDLOCK_TTL", &cfg.Redlock.TTL)
+	env.duration("REDLOCK_NODE_TIMEOUT", &cfg.Redlock.NodeTimeout)
+	env.float("REDLOCK_DRIFT_FACTOR", &cfg.Redlock.DriftFactor)
+	env.int("REDLOCK_RETRY_COUNT", &cfg.Redlock.RetryCount)
+	env.duration("REDLOCK_RETRY_DELAY", &cfg.Redlock.RetryDelay)
+	env.duration("NAMED_LOCK_TIMEOUT", &cfg.Named.LockTimeout)
+	env.int("TX_MAX_ATTEMPTS", &cfg.Transactions.MaxAttempts)
+	env.duration("TX_RETRY_BASE_DELAY", &cfg.Transactions.BaseDelay)
+	env.float("AUTO_OPTIMISTIC_MAX_CONFLICT_RATE", &cfg.Auto.OptimisticMaxConflictRate)
+	env.float("AUTO_PESSIMISTIC_MAX_CONFLICT_RATE", &cfg.Auto.PessimisticMaxConflictRate)
+	env.duration("AUTO_CONTENTION_HALF_LIFE", &cfg.Auto.HalfLife)
+	env.string("LOCK_PROVIDER", &cfg.Locks.Provider)
+	env.list("ETCD_ENDPOINTS", &cfg.Locks.EtcdEndpoints)
+	env.list("ZOOKEEPER_SERVERS", &cfg.Locks.ZookeeperServers)
+	env.string("CONSUL_ADDR", &cfg.Locks.ConsulAddr)
+	env.list("CONSUL_SESSION_CHECKS", &cfg.Locks.ConsulSessionChecks)
+	env.int("MAX_SEATS_PER_REQUEST", &cfg.Bulk.MaxSeatsPerRequest)
+	env.int("BULK_CHUNK_SIZE", &cfg.Bulk.ChunkSize)
+	env.duration("BULK_HOLD_TIMEOUT", &cfg.Bulk.HoldTimeout)
+	env.bool("EVENT_STORE_ENABLED", &cfg.EventStore.Enabled)
+	env.string("OUTBOX_BROKER", &cfg.Outbox.Broker)
+	env.list("KAFKA_BROKERS", &cfg.Outbox.KafkaBrokers)
+	env.string("KAFKA_TOPIC", &cfg.Outbox.KafkaTopic)
+	env.bool("KAFKA_TOPIC_PER_TYPE", &cfg.Outbox.KafkaTopicPerType)
+	env.string("NATS_URL", &cfg.Outbox.NatsURL)
+	env.string("NATS_STREAM", &cfg.Outbox.NatsStream)
+	env.string("NATS_SUBJECT", &cfg.Outbox.NatsSubject)
+	env.list("NATS_CONSUMERS", &cfg.Outbox.NatsConsumers)
+	env.string("OUTBOX_STREAM", &cfg.Outbox.Stream)
+	env.duration("OUTBOX_RELAY_INTERVAL", &cfg.Outbox.Interval)
+	env.int("OUTBOX_BATCH_SIZE", &cfg.Outbox.BatchSize)
+	env.bool("ASYNC_BOOKING_ENABLED", &cfg.AsyncBooking.Enabled)
+	env.string("ASYNC_BOOKING_STREAM", &cfg.AsyncBooking.Stream)
+	env.int("ASYNC_BOOKING_WORKERS", &cfg.AsyncBooking.Workers)
+	env.duration("ASYNC_BOOKING_RESULT_TTL", &cfg.AsyncBooking.ResultTTL)
+	env.int("ASYNC_BOOKING_MAX_ATTEMPTS", &cfg.AsyncBooking.MaxAttempts)
+	env.duration("ASYNC_BOOKING_RETRY_BACKOFF", &cfg.AsyncBooking.RetryBackoff)
+	env.int("ASYNC_BOOKING_MAX_DELIVERIES", &cfg.AsyncBooking.MaxDeliveries)
+	env.int("BOOKING_CALLBACK_MAX_ATTEMPTS", &cfg.Callbacks.MaxAttempts)
+	env.duration("BOOKING_CALLBACK_BACKOFF", &cfg.Callbacks.Backoff)
+	env.duration("BOOKING_CALLBACK_TIMEOUT", &cfg.Callbacks.Timeout)
+	env.duration("WAITLIST_OFFER_HOLD", &cfg.Waitlist.OfferHold)
+	env.int("WAITLIST_MAX_QUANTITY", &cfg.Waitlist.MaxQuantity)
+	env.int("SHOW_CANCELLATION_REFUND_MAX_ATTEMPTS", &cfg.Cancellation.RefundMaxAttempts)
+	env.duration("SHOW_CANCELLATION_REFUND_BACKOFF", &cfg.Cancellation.RefundBackoff)
+	env.int("SEAT_LIMIT_PER_USER_PER_SHOW", &cfg.SeatLimit.PerUserPerShow)
+	env.int("PARTNER_ANONYMOUS_DAILY_SEATS", &cfg.Partner.AnonymousDailySeats)
+	env.list("PARTNER_TRUSTED_PROXIES", &cfg.Partner.TrustedProxies)
+	env.int("MEMORY_SHOWS", &cfg.Memory.Shows)
+	env.int("MEMORY_SEATS_PER_SHOW", &cfg.Memory.SeatsPerShow)
+	env.int("SHOW_SEMAPHORE_LIMIT", &cfg.Semaphore.Limit)
+	env.duration("SHOW_SEMAPHORE_TTL", &cfg.Semaphore.TTL)
+	env.int("WAITING_ROOM_ADMIT_PER_SECOND", &cfg.WaitingRoom.AdmitPerSecond)
+	env.duration("WAITING_ROOM_ADMISSION_TTL", &cfg.WaitingRoom.AdmissionTTL)
+	env.duration("WAITING_ROOM_QUEUE_TTL", &cfg.WaitingRoom.QueueTTL)
+	env.float("WAITING_ROOM_PRIORITY_SHARE", &cfg.WaitingRoom.PriorityShare)
+	env.int("BOOKING_MAX_IN_FLIGHT", &cfg.Backpressure.MaxInFlight)
+	env.int("BOOKING_MAX_QUEUE", &cfg.Backpressure.MaxQueue)
+	env.duration("BOOKING_QUEUE_TIMEOUT", &cfg.Backpressure.QueueTimeout)
+	env.duration("PAYMENT_RECONCILE_INTERVAL", &cfg.Reconcile.Interval)
+	env.duration("PAYMENT_RECONCILE_AFTER", &cfg.Reconcile.After)
+	env.int("PAYMENT_RECONCILE_BATCH_SIZE", &cfg.Reconcile.BatchSize)
+	env.int("DB_BREAKER_FAILURE_THRESHOLD", &cfg.DBBreaker.FailureThreshold)
+	env.duration("DB_BREAKER_OPEN_FOR", &cfg.DBBreaker.OpenFor)
+	env.duration("LEADER_LEASE_TTL", &cfg.Leader.LeaseTTL)
+	env.int("REAPER_BATCH_SIZE", &cfg.Reaper.BatchSize)
+	env.duration("REAPER_BATCH_PAUSE", &cfg.Reaper.BatchPause)
+	env.int("REAPER_MAX_BATCHES_PER_PASS", &cfg.Reaper.MaxBatchesPerPass)
+
+	if len(env.errs) > 0 {
+		return cfg, errors.Join(env.errs...)
+	}
+	if cfg.Server.DBDSN == "" {
+		cfg.Server.DBDSN = defaultDatabaseDSN(cfg.Server.DBDriver)
+	}
+	return cfg, cfg.Validate()
+}
+
+// loadConfigFile overlays the YAML file at path on cfg. Keys left out keep their value;
+// unknown keys are an error, so a typo doesn't silently fall back to the default.
+func loadConfigFile(path string, cfg *StrategyConfig) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	// Through JSON, so the file uses the json keys and Duration's parsing.
+	var doc interface{}
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if doc == nil {
+		return nil
+	}
+	asJSON, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(asJSON))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports every invalid value at once.
+func (c StrategyConfig) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.ListenAddr != "", "server.listen_addr is required")
+	check(c.Server.RedisAddr != "" || c.Server.RedisSentinelMaster != "" || len(c.Server.RedisClusterAddrs) > 0,
+		"server.redis_addr is required")
+	check(c.Server.RedisSentinelMaster == "" || len(c.Server.RedisClusterAddrs) == 0,
+		"server.redis_sentinel_master and server.redis_cluster_addrs can't both be set")
+	check((c.Server.RedisSentinelMaster == "") == (len(c.Server.RedisSentinelAddrs) == 0),
+		"server.redis_sentinel_master and server.redis_sentinel_addrs must be set together")
+	check(c.Server.RequestTimeout > 0, "server.request_timeout must be positive")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.Server.ConnectAttempts >= 1, "server.connect_attempts must be at least 1")
+	check(c.Server.ConnectBackoff > 0, "server.connect_backoff must be positive")
+	check(c.Server.HealthCheckInterval > 0, "server.health_check_interval must be positive")
+	switch c.Server.DBDriver {
+	case "mysql", "postgres":
+		check(c.Server.DBDSN != "", "server.db_dsn is required")
+	case "memory":
+	default:
+		check(false, "server.db_driver must be mysql, postgres or memory")
+	}
+	_, knownLevel := logLevels[strings.ToLower(c.Log.Level)]
+	check(knownLevel, "log.level must be debug, info, warn or error")
+	check(c.Log.Format == "auto" || c.Log.Format == "json" || c.Log.Format == "text", "log.format must be auto, json or text")
+	check(c.Log.SlowQuery >= 0, "log.slow_query must not be negative")
+	check(c.Log.SlowTransaction >= 0, "log.slow_transaction must not be negative")
+	check(time.Duration(c.Payment.HoldTimeout) >= 10*time.Second, "payment.hold_timeout must be at least 10s")
+	check(c.Optimistic.MaxRetries >= 0, "optimistic.max_retries must not be negative")
+	check(c.Optimistic.Backoff >= 0, "optimistic.backoff must not be negative")
+	check(time.Duration(c.Pessimistic.LockWaitTimeout) >= time.Second,
+		"pessimistic.lock_wait_timeout must be at least 1s")
+	check(c.Redis.TTL > 0, "redis.ttl must be positive")
+	check(c.Redis.RenewalInterval > 0 && c.Redis.RenewalInterval < c.Redis.TTL && c.Redis.RenewalInterval < c.Redlock.TTL,
+		"redis.renewal_interval must be positive and below redis.ttl and redlock.ttl")
+	check(c.Redis.StripeBucket >= 0, "redis.stripe_bucket must not be negative")
+	check(c.Redlock.TTL > 0, "redlock.ttl must be positive")
+	check(c.Redlock.NodeTimeout > 0 && c.Redlock.NodeTimeout < c.Redlock.TTL,
+		"redlock.node_timeout must be positive and below redlock.ttl")
+	check(c.Redlock.DriftFactor >= 0 && c.Redlock.DriftFactor < 1, "redlock.drift_factor must be in [0, 1)")
+	check(c.Redlock.RetryCount >= 1, "redlock.retry_count must be at least 1")
+	check(c.Redlock.RetryDelay > 0, "redlock.retry_delay must be positive")
+	check(time.Duration(c.Named.LockTimeout) >= time.Second && time.Duration(c.Named.LockTimeout)%time.Second == 0,
+		"named.lock_timeout must be a whole number of seconds, at least 1s")
+	check(c.Transactions.MaxAttempts >= 1, "transactions.max_attempts must be at least 1")
+	check(c.Transactions.BaseDelay > 0, "transactions.base_delay must be positive")
+	check(c.Auto.OptimisticMaxConflictRate >= 0 && c.Auto.OptimisticMaxConflictRate <= c.Auto.PessimisticMaxConflictRate,
+		"auto.optimistic_max_conflict_rate must be between 0 and auto.pessimistic_max_conflict_rate")
+	check(c.Auto.PessimisticMaxConflictRate <= 1, "auto.pessimistic_max_conflict_rate must be at most 1")
+	check(c.Auto.HalfLife > 0, "auto.half_life must be positive")
+	check(c.Bulk.MaxSeatsPerRequest >= 1, "bulk.max_seats_per_request must be at least 1")
+	check(c.Bulk.ChunkSize >= 1, "bulk.chunk_size must be at least 1")
+	check(time.Duration(c.Bulk.HoldTimeout) >= time.Minute, "bulk.hold_timeout must be at least 1m")
+	check(c.Semaphore.Limit >= 0, "semaphore.limit must not be negative")
+	check(c.Semaphore.TTL > 0, "semaphore.ttl must be positive")
+	check(c.WaitingRoom.AdmitPerSecond >= 1, "waiting_room.admit_per_second must be at least 1")
+	check(c.WaitingRoom.AdmissionTTL > 0, "waiting_room.admission_ttl must be positive")
+	check(c.WaitingRoom.QueueTTL > 0, "waiting_room.queue_ttl must be positive")
+	check(c.Backpressure.MaxInFlight >= 0 && c.Backpressure.MaxQueue >= 0,
+		"backpressure.max_in_flight and backpressure.max_queue must not be negative")
+	check(c.Backpressure.QueueTimeout > 0, "backpressure.queue_timeout must be positive")
+	check(c.WaitingRoom.PriorityShare >= 0 && c.WaitingRoom.PriorityShare <= 1, "waiting_room.priority_share must be in [0, 1]")
+	check(c.Reconcile.Interval > 0, "payment_reconcile.interval must be positive")
+	check(c.Reconcile.After >= 0 && c.Reconcile.After < c.Payment.HoldTimeout,
+		"payment_reconcile.after must not be negative and below payment.hold_timeout")
+	check(c.Reconcile.BatchSize >= 1, "payment_reconcile.batch_size must be at least 1")
+	check(c.DBBreaker.FailureThreshold >= 0, "db_breaker.failure_threshold must not be negative")
+	check(c.DBBreaker.OpenFor > 0, "db_breaker.open_for must be positive")
+	check(time.Duration(c.Leader.LeaseTTL) >= 3*time.Second, "leader.lease_ttl must be at least 3s")
+	check(c.Reaper.BatchSize >= 1, "reaper.batch_size must be at least 1")
+	check(c.Reaper.BatchPause >= 0, "reaper.batch_pause must not be negative")
+	check(c.Reaper.MaxBatchesPerPass >= 1, "reaper.max_batches_per_pass must be at least 1")
+	switch c.Outbox.Broker {
+	case "redis":
+		check(c.Outbox.Stream != "", "outbox.stream is required for the redis broker")
+	case "kafka":
+		check(len(c.Outbox.KafkaBrokers) > 0 && c.Outbox.KafkaTopic != "", "outbox.kafka_brokers and outbox.kafka_topic are required for the kafka broker")
+	case "nats":
+		check(c.Outbox.NatsURL != "" && c.Outbox.NatsStream != "" && c.Outbox.NatsSubject != "", "outbox.nats_url, outbox.nats_stream and outbox.nats_subject are required for the nats broker")
+	default:
+		check(false, "outbox.broker must be redis, kafka or nats")
+	}
+	check(c.Outbox.Interval > 0, "outbox.interval must be positive")
+	check(c.Outbox.BatchSize >= 1, "outbox.batch_size must be at least 1")
+	check(c.AsyncBooking.Stream != "", "async_booking.stream is required")
+	check(c.AsyncBooking.Workers >= 1, "async_booking.workers must be at least 1")
+	check(c.AsyncBooking.ResultTTL > 0, "async_booking.result_ttl must be positive")
+	check(c.AsyncBooking.MaxAttempts >= 1, "async_booking.max_attempts must be at least 1")
+	check(c.AsyncBooking.RetryBackoff > 0, "async_booking.retry_backoff must be positive")
+	check(c.AsyncBooking.MaxDeliveries >= 1, "async_booking.max_deliveries must be at least 1")
+	check(c.Callbacks.MaxAttempts >= 1, "callbacks.max_attempts must be at least 1")
+	check(c.Callbacks.Backoff > 0, "callbacks.backoff must be positive")
+	check(c.Callbacks.Timeout > 0, "callbacks.timeout must be positive")
+	check(c.Waitlist.OfferHold > 0, "waitlist.offer_hold must be positive")
+	check(c.Waitlist.MaxQuantity >= 1, "waitlist.max_quantity must be at least 1")
+	check(c.Cancellation.RefundMaxAttempts >= 1, "show_cancellation.refund_max_attempts must be at least 1")
+	check(c.Cancellation.RefundBackoff > 0, "show_cancellation.refund_backoff must be positive")
+	check(c.SeatLimit.PerUserPerShow >= 0, "seat_limit.per_user_per_show must not be negative")
+	check(c.Partner.AnonymousDailySeats >= 0, "partner.anonymous_daily_seats must not be negative")
+	for _, proxy := range c.Partner.TrustedProxies {
+		_, err := parseTrustedProxy(proxy)
+		check(err == nil, "partner.trusted_proxies: %q is not an address or CIDR", proxy)
+	}
+	check(!c.AsyncBooking.Enabled || c.Server.DBDriver != "memory", "async_booking.enabled needs Redis, not db_driver memory")
+	check(!c.EventStore.Enabled || c.Server.DBDriver != "memory", "event_store.enabled needs a database, not db_driver memory")
+	check(c.Memory.Shows >= 0 && c.Memory.SeatsPerShow >= 0, "memory.shows and memory.seats_per_show must not be negative")
+	switch c.Locks.Provider {
+	case "redis":
+	case "etcd":
+		check(len(c.Locks.EtcdEndpoints) > 0, "locks.etcd_endpoints is required for the etcd provider")
+	case "zookeeper":
+		check(len(c.Locks.ZookeeperServers) > 0, "locks.zookeeper_servers is required for the zookeeper provider")
+	case "consul":
+		check(c.Locks.ConsulAddr != "", "locks.consul_addr is required for the consul provider")
+	default:
+		check(false, "locks.provider must be redis, etcd, zookeeper or consul")
+	}
+
+	return errors.Join(errs...)
+}
+
+// handleStrategyConfig serves GET /admin/config/strategies with the config in effect, the
+// database password masked.
+func handleStrategyConfig(w http.ResponseWriter, r *http.Request) {
+	cfg := strategyConfig
+	cfg.Server.DBDSN = redactDSN(cfg.Server.DBDSN)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(cfg)
+}
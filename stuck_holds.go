@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Stuck hold detection. The reaper only frees seats whose payment_timeout has passed, so a
+// reserved PENDING seat that lost its timeout or its booking (a manual fix gone wrong, a bug in
+// some older release) would block inventory forever. Every stuckHoldInterval the leader looks
+// for three kinds:
+//   - no payment_timeout, but a live booking: the timeout is set to now, and the reaper's next
+//     pass expires the booking and frees the seats the usual way
+//   - no booking, or one that is already over (no payment_session_id, no bookings row, or a
+//     state other than HELD and PENDING_PAYMENT): the seat is released here, there is nothing
+//     left to expire
+//   - a payment_timeout further out than any configured hold: flagged, not touched, since an
+//     operator may have extended it on purpose
+// Seats handed to a sales channel (allocation_id) have no timeout by design and are skipped.
+
+const (
+	stuckHoldInterval = 5 * time.Minute
+	// stuckHoldSlack is how far past the longest configured hold a timeout may be before it is
+	// flagged.
+	stuckHoldSlack = 1 * time.Hour
+)
+
+func runStuckHoldDetector() error {
+	ticker := time.NewTicker(stuckHoldInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !runsMaintenance() {
+			continue
+		}
+		detectStuckHolds()
+	}
+	return errors.New("ending stuck hold detector")
+}
+
+func detectStuckHolds() {
+	defer func() { reportPanic(ctx, "stuck_holds", recover()) }()
+
+	expired, err := expireUntimedHolds()
+	if err != nil {
+		slog.Error("Failed to expire holds without timeout", "component", "stuck_holds", "error", err)
+		reportError(ctx, "stuck_holds", err)
+	} else if expired > 0 {
+		slog.Warn("Expired holds without timeout", "component", "stuck_holds", "seats", expired)
+	}
+
+	released, err := releaseOrphanedHolds()
+	if err != nil {
+		slog.Error("Failed to release orphaned holds", "component", "stuck_holds", "error", err)
+		reportError(ctx, "stuck_holds", err)
+	} else if len(released) > 0 {
+		slog.Warn("Released orphaned holds", "component", "stuck_holds", "seat_ids", released)
+	}
+
+	flagged, err := farFutureHolds()
+	if err != nil {
+		slog.Error("Failed to check hold timeouts", "component", "stuck_holds", "error", err)
+		reportError(ctx, "stuck_holds", err)
+	} else if len(flagged) > 0 {
+		slog.Warn("Holds with a timeout beyond any configured hold", "component", "stuck_holds", "seat_ids", flagged)
+		reportError(ctx, "stuck_holds", fmt.Errorf("%d seat(s) held beyond any configured hold", len(flagged)), "seat_ids", flagged)
+	}
+}
+
+// expireUntimedHolds hands live bookings' seats without a payment_timeout to the reaper.
+func expireUntimedHolds() (int64, error) {
+	result, err := db.ExecContext(ctx, `
+		UPDATE seats SET payment_timeout = ?
+		WHERE is_reserved = 1 AND payment_status = 'PENDING' AND allocation_id IS NULL
+		AND payment_timeout IS NULL
+		AND payment_session_id IN (SELECT id FROM bookings WHERE state IN ('HELD', 'PENDING_PAYMENT'))
+	`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// releaseOrphanedHolds frees up to a reaper batch of held seats no live booking owns, along
+// with their seat locks.
+func releaseOrphanedHolds() ([]int, error) {
+	type orphan struct {
+		id     int
+		showID int
+		userID sql.NullInt64
+	}
+	var orphans []orphan
+
+	err := runInTx(withSeatAudit(ctx, SeatAuditStuckHolds), db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		orphans = nil
+		rows, err := tx.QueryContext(ctx, `
+			SELECT s.id, s.show_id, s.user_id
+			FROM seats s LEFT JOIN bookings b ON b.id = s.payment_session_id
+			WHERE s.is_reserved = 1 AND s.payment_status = 'PENDING' AND s.allocation_id IS NULL
+			AND (b.id IS NULL OR b.state NOT IN ('HELD', 'PENDING_PAYMENT'))
+			LIMIT ?
+			FOR UPDATE OF s SKIP LOCKED
+		`, strategyConfig.Reaper.BatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to find orphaned holds: %w", err)
+		}
+		defer rows.Close()
+		var seatIDs []int
+		for rows.Next() {
+			var o orphan
+			if err := rows.Scan(&o.id, &o.showID, &o.userID); err != nil {
+				return fmt.Errorf("failed to scan orphaned hold: %w", err)
+			}
+			orphans = append(orphans, o)
+			seatIDs = append(seatIDs, o.id)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating orphaned holds: %w", err)
+		}
+		if len(seatIDs) == 0 {
+			return nil
+		}
+		return releaseSeatRows(ctx, tx, seatIDs, HoldReleased)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seatIDs := make([]int, 0, len(orphans))
+	lockKeys := make(map[string][]string)
+	for _, o := range orphans {
+		seatIDs = append(seatIDs, o.id)
+		if o.userID.Valid {
+			owner := seatLockOwner(o.userID.Int64)
+			lockKeys[owner] = append(lockKeys[owner], seatLockKey(o.showID, o.id))
+		}
+	}
+	releaseSeatLocks(ctx, "stuck_holds", lockKeys)
+	return seatIDs, nil
+}
+
+// farFutureHolds lists held seats whose timeout lies beyond the longest hold any booking
+// could have been given.
+func farFutureHolds() ([]int, error) {
+	var longestShowHold sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT MAX(hold_timeout_seconds) FROM shows").Scan(&longestShowHold); err != nil {
+		return nil, fmt.Errorf("failed to read show holds: %w", err)
+	}
+	longest := max(time.Duration(strategyConfig.Payment.HoldTimeout), time.Duration(strategyConfig.Bulk.HoldTimeout),
+		time.Duration(longestShowHold.Int64)*time.Second)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id FROM seats
+		WHERE is_reserved = 1 AND payment_status = 'PENDING' AND payment_timeout > ?
+		ORDER BY id
+		LIMIT ?
+	`, time.Now().Add(longest+stuckHoldSlack), strategyConfig.Reaper.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var seatIDs []int
+	for rows.Next() {
+		var seatID int
+		if err := rows.Scan(&seatID); err != nil {
+			return nil, err
+		}
+		seatIDs = append(seatIDs, seatID)
+	}
+	return seatIDs, rows.Err()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+// Deadlocks (MySQL 1213, Postgres 40P01), lock wait timeouts (1205) and serialization
+// failures (40001) are expected under load and say nothing about whether the booking can
+// succeed, so the whole transaction is retried a few times (strategyConfig.Transactions)
+// before giving up. Each attempt goes through the database circuit breaker, see db_breaker.go.
+
+// txBeginner is satisfied by both *sql.DB and *sql.Conn.
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// runInTx runs fn inside a transaction and commits it. fn may be invoked more than once, so it
+// must not have side effects outside the transaction.
+func runInTx(ctx context.Context, db txBeginner, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	cfg := strategyConfig.Transactions
+	baseDelay := time.Duration(cfg.BaseDelay)
+
+	var err error
+	for attempt := 1; attempt <= cfg.MaxAttempts; attempt++ {
+		if err = dbBreaker.Allow(); err != nil {
+			return err
+		}
+		err = runTxOnce(ctx, db, opts, fn)
+		dbBreaker.Record(err)
+		if err == nil || !isLockContention(err) || attempt == cfg.MaxAttempts {
+			return err
+		}
+
+		delay := baseDelay<<(attempt-1) + time.Duration(rand.Int63n(int64(baseDelay)))
+		slog.InfoContext(ctx, "Lock contention, retrying transaction", "component", "tx", "attempt", attempt, "delay", delay, "error", err)
+		setBookingPhase(ctx, "retry_backoff")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	return err
+}
+
+func runTxOnce(ctx context.Context, db txBeginner, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	setBookingPhase(ctx, "begin_tx")
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if opts == nil || !opts.ReadOnly {
+		if err := tagSeatAudit(ctx, tx, seatAuditFromContext(ctx)); err != nil {
+			return err
+		}
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	setBookingPhase(ctx, "committing")
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
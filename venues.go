@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Venues and seating layouts. A venue is laid out as sections, each a price tier (and
+// optionally a price of its own), of rows of seats: POST /admin/venues takes the whole layout
+// at once. A show created with a venue_id (shows.go), or an existing show without seats through
+// POST /admin/shows/{id}/seats, gets its seats generated from the layout: row label and number
+// as the seat number (row B, seat 12 is B12), row and column as on the seat map (seat_map.go),
+// and the section's tier and price. The seats are the show's own from then on; changing a
+// venue would not move the seats of its shows, which is why layouts can't be changed.
+
+const (
+	maxVenueSeats   = 100000
+	maxVenuesLimit  = 1000
+	maxRowLabelSize = 5
+	maxRowSeats     = 9999
+)
+
+var ErrShowHasSeats = errors.New("show already has seats")
+
+type Venue struct {
+	ID       int            `json:"id"`
+	Name     string         `json:"name"`
+	City     *string        `json:"city"`
+	Seats    int            `json:"seats"`
+	Sections []VenueSection `json:"sections,omitempty"`
+}
+
+type VenueSection struct {
+	Name       string     `json:"name"`
+	PriceTier  *string    `json:"price_tier"`
+	PriceCents *int       `json:"price_cents"`
+	Rows       []VenueRow `json:"rows"`
+}
+
+type VenueRow struct {
+	Label string `json:"label"`
+	Seats int    `json:"seats"`
+}
+
+func (v *Venue) Validate() error {
+	if v.Name == "" || len(v.Name) > 100 || v.City != nil && len(*v.City) > 100 {
+		return errors.New("name is required, name and city are up to 100 characters")
+	}
+	if len(v.Sections) == 0 {
+		return errors.New("a venue needs at least one section")
+	}
+	labels := make(map[string]bool)
+	seats := 0
+	for _, section := range v.Sections {
+		switch {
+		case section.Name == "" || len(section.Name) > 100:
+			return errors.New("section name is required, up to 100 characters")
+		case section.PriceTier != nil && (*section.PriceTier == "" || len(*section.PriceTier) > 30):
+			return errors.New("price_tier is up to 30 characters")
+		case section.PriceCents != nil && *section.PriceCents < 0:
+			return errors.New("price_cents can't be negative")
+		case len(section.Rows) == 0:
+			return fmt.Errorf("section %q has no rows", section.Name)
+		}
+		for _, row := range section.Rows {
+			switch {
+			case row.Label == "" || len(row.Label) > maxRowLabelSize:
+				return fmt.Errorf("row labels are 1 to %d characters", maxRowLabelSize)
+			case labels[row.Label]:
+				return fmt.Errorf("row %q appears twice", row.Label)
+			case row.Seats <= 0 || row.Seats > maxRowSeats:
+				return fmt.Errorf("row %q must have 1 to %d seats", row.Label, maxRowSeats)
+			}
+			labels[row.Label] = true
+			seats += row.Seats
+		}
+	}
+	if seats > maxVenueSeats {
+		return fmt.Errorf("a venue has at most %d seats", maxVenueSeats)
+	}
+	v.Seats = seats
+	return nil
+}
+
+type venueQueryer interface {
+	queryer
+	rowQueryer
+}
+
+// loadVenue returns the venue with its layout, sql.ErrNoRows when there is none.
+func loadVenue(ctx context.Context, q venueQueryer, venueID int) (Venue, error) {
+	venue := Venue{ID: venueID}
+	var city sql.NullString
+	err := q.QueryRowContext(ctx, `SELECT name, city FROM venues WHERE id = ?`, venueID).Scan(&venue.Name, &city)
+	if err != nil {
+		return venue, err
+	}
+	if city.Valid {
+		venue.City = &city.String
+	}
+
+	rows, err := q.QueryContext(ctx, `
+		SELECT vs.id, vs.name, vs.price_tier, vs.price_cents, vr.label, vr.seat_count
+		FROM venue_sections vs JOIN venue_rows vr ON vr.section_id = vs.id
+		WHERE vs.venue_id = ?
+		ORDER BY vs.position, vr.position
+	`, venueID)
+	if err != nil {
+		return venue, fmt.Errorf("failed to load venue layout: %w", err)
+	}
+	defer rows.Close()
+
+	lastSection := 0
+	for rows.Next() {
+		var sectionID int
+		var section VenueSection
+		var tier sql.NullString
+		var price sql.NullInt64
+		var row VenueRow
+		if err := rows.Scan(&sectionID, &section.Name, &tier, &price, &row.Label, &row.Seats); err != nil {
+			return venue, fmt.Errorf("failed to scan venue row: %w", err)
+		}
+		if sectionID != lastSection {
+			if tier.Valid {
+				section.PriceTier = &tier.String
+			}
+			if price.Valid {
+				p := int(price.Int64)
+				section.PriceCents = &p
+			}
+			venue.Sections = append(venue.Sections, section)
+			lastSection = sectionID
+		}
+		last := &venue.Sections[len(venue.Sections)-1]
+		last.Rows = append(last.Rows, row)
+		venue.Seats += row.Seats
+	}
+	return venue, rows.Err()
+}
+
+// generateShowSeats adds the seats of the venue's layout to the show, which must have none.
+// It returns how many it added.
+func generateShowSeats(ctx context.Context, tx *sql.Tx, showID, venueID int) (int, error) {
+	var existing int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM seats WHERE show_id = ?`, showID).Scan(&existing); err != nil {
+		return 0, fmt.Errorf("failed to count seats: %w", err)
+	}
+	if existing > 0 {
+		return 0, ErrShowHasSeats
+	}
+	venue, err := loadVenue(ctx, tx, venueID)
+	if err != nil {
+		return 0, err
+	}
+
+	const columns = 6
+	values := make([]interface{}, 0, columns*seedBatchSize)
+	placeholders := make([]string, 0, seedBatchSize)
+	flush := func() error {
+		if len(placeholders) == 0 {
+			return nil
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO seats (show_id, seat_number, seat_row, seat_column, price_tier, price_cents)
+			VALUES `+strings.Join(placeholders, ", "), values...)
+		if err != nil {
+			return fmt.Errorf("failed to insert seats for show %d: %w", showID, err)
+		}
+		values, placeholders = values[:0], placeholders[:0]
+		return nil
+	}
+	for _, section := range venue.Sections {
+		for _, row := range section.Rows {
+			for column := 1; column <= row.Seats; column++ {
+				placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?)")
+				values = append(values, showID, fmt.Sprintf("%s%d", row.Label, column), row.Label, column, section.PriceTier, section.PriceCents)
+				if len(placeholders) == seedBatchSize {
+					if err := flush(); err != nil {
+						return 0, err
+					}
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE shows SET venue_id = ? WHERE id = ?`, venueID, showID); err != nil {
+		return 0, fmt.Errorf("failed to set show venue: %w", err)
+	}
+	return venue.Seats, nil
+}
+
+// handleCreateVenue serves POST /admin/venues.
+func handleCreateVenue(w http.ResponseWriter, r *http.Request) {
+	var venue Venue
+	if err := json.NewDecoder(r.Body).Decode(&venue); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := venue.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := seedInTx(r.Context(), db, func(tx *sql.Tx) error {
+		var err error
+		venue.ID, err = insertReturningID(r.Context(), tx, `INSERT INTO venues (name, city) VALUES (?, ?)`, venue.Name, venue.City)
+		if err != nil {
+			return fmt.Errorf("failed to insert venue: %w", err)
+		}
+		rowPosition := 0
+		for i, section := range venue.Sections {
+			sectionID, err := insertReturningID(r.Context(), tx, `
+				INSERT INTO venue_sections (venue_id, name, price_tier, price_cents, position) VALUES (?, ?, ?, ?, ?)
+			`, venue.ID, section.Name, section.PriceTier, section.PriceCents, i)
+			if err != nil {
+				return fmt.Errorf("failed to insert section: %w", err)
+			}
+			for _, row := range section.Rows {
+				_, err := tx.ExecContext(r.Context(), `
+					INSERT INTO venue_rows (venue_id, section_id, label, seat_count, position) VALUES (?, ?, ?, ?, ?)
+				`, venue.ID, sectionID, row.Label, row.Seats, rowPosition)
+				if err != nil {
+					return fmt.Errorf("failed to insert row: %w", err)
+				}
+				rowPosition++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create venue", "component", "admin", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Created venue", "component", "admin", "venue_id", venue.ID, "name", venue.Name, "seats", venue.Seats)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(venue)
+}
+
+// handleListVenues serves GET /admin/venues, without their layouts.
+func handleListVenues(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxVenuesLimit)
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT v.id, v.name, v.city, COALESCE((SELECT SUM(seat_count) FROM venue_rows vr WHERE vr.venue_id = v.id), 0)
+		FROM venues v
+		ORDER BY v.name, v.id
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list venues", "component", "admin", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	venues := []Venue{}
+	for rows.Next() {
+		var venue Venue
+		var city sql.NullString
+		if err := rows.Scan(&venue.ID, &venue.Name, &city, &venue.Seats); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to scan venue", "component", "admin", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if city.Valid {
+			venue.City = &city.String
+		}
+		venues = append(venues, venue)
+	}
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list venues", "component", "admin", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":  len(venues),
+		"venues": venues,
+	})
+}
+
+// handleGetVenue serves GET /admin/venues/{id}, with its layout.
+func handleGetVenue(w http.ResponseWriter, r *http.Request) {
+	venueID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid venue ID", http.StatusBadRequest)
+		return
+	}
+	venue, err := loadVenue(r.Context(), db, venueID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Venue not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load venue", "component", "admin", "venue_id", venueID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(venue)
+}
+
+// GenerateSeatsRequest names the venue whose layout a show's seats are generated from.
+type GenerateSeatsRequest struct {
+	VenueID int `json:"venue_id"`
+}
+
+// handleGenerateShowSeats serves POST /admin/shows/{id}/seats.
+func handleGenerateShowSeats(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+	var req GenerateSeatsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.VenueID <= 0 {
+		http.Error(w, "Invalid request body, venue_id is required", http.StatusBadRequest)
+		return
+	}
+
+	var seats int
+	err = seedInTx(r.Context(), db, func(tx *sql.Tx) error {
+		// Locks the show, so two requests can't both find it without seats.
+		var id int
+		if err := tx.QueryRowContext(r.Context(), `SELECT id FROM shows WHERE id = ? FOR UPDATE`, showID).Scan(&id); err != nil {
+			return err
+		}
+		var err error
+		seats, err = generateShowSeats(r.Context(), tx, showID, req.VenueID)
+		return err
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Show or venue not found", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrShowHasSeats):
+		http.Error(w, "Show already has seats", http.StatusConflict)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Failed to generate seats", "component", "admin", "show_id", showID, "venue_id", req.VenueID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Generated show seats", "component", "admin", "show_id", showID, "venue_id", req.VenueID, "seats", seats)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]int{
+		"show_id":  showID,
+		"venue_id": req.VenueID,
+		"seats":    seats,
+	})
+}
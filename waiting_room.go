@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Virtual waiting room for on-sales that would otherwise flood the booking path. For shows
+// flagged with shows.waiting_room, /api/book doesn't book: it answers 202 QUEUED with a queue
+// token and appends the token to the show's Redis list. Every second the dispatcher admits
+// the next WaitingRoom.AdmitPerSecond tokens of each show in arrival order and issues each an
+// admission token. The client polls /api/queue-status with its queue token, or simply sends
+// the same request again with QueueToken set; either way an admission is good for one booking
+// within WaitingRoom.AdmissionTTL, and a token that isn't admitted yet gets QUEUED again.
+//
+// Users flagged with users.priority queue in a lane of their own. Each tick the priority lane
+// gets WaitingRoom.PriorityShare of the show's admissions and the standard lane the rest, so a
+// busy priority lane can't starve everyone else; a lane's unused places go to the other one.
+
+const waitingRoomDispatchInterval = time.Second
+
+var ErrAdmissionUsed = errors.New("waiting room admission was already used")
+
+const (
+	laneStandard = "standard"
+	lanePriority = "priority"
+)
+
+func waitingRoomQueueKey(showID int, lane string) string {
+	if lane == lanePriority {
+		return fmt.Sprintf("waiting_room:queue:%d:priority", showID)
+	}
+	return fmt.Sprintf("waiting_room:queue:%d", showID)
+}
+
+// waitingRoomTokenKey marks a token as queued. It holds "<show>:<lane>".
+func waitingRoomTokenKey(token string) string {
+	return "waiting_room:token:" + token
+}
+
+// waitingRoomAdmittedKey maps an admitted queue token to its admission token.
+func waitingRoomAdmittedKey(token string) string {
+	return "waiting_room:admitted:" + token
+}
+
+// waitingRoomAdmissionKey marks an admission token as usable for the show it holds.
+func waitingRoomAdmissionKey(token string) string {
+	return "waiting_room:admission:" + token
+}
+
+// waitingRoomDispatchKey lets one instance per second dispatch a show, so running several
+// instances doesn't multiply the admission rate.
+func waitingRoomDispatchKey(showID int, second int64) string {
+	return fmt.Sprintf("waiting_room:dispatch:%d:%d", showID, second)
+}
+
+// waitingRoomShows caches which shows are flagged. The dispatcher refreshes it every tick,
+// so the booking path doesn't read the shows table.
+var waitingRoomShows struct {
+	sync.RWMutex
+	ids map[int]bool
+}
+
+func waitingRoomEnabled(showID int) bool {
+	waitingRoomShows.RLock()
+	defer waitingRoomShows.RUnlock()
+	return waitingRoomShows.ids[showID]
+}
+
+func anyWaitingRoomEnabled() bool {
+	waitingRoomShows.RLock()
+	defer waitingRoomShows.RUnlock()
+	return len(waitingRoomShows.ids) > 0
+}
+
+func newWaitingRoomToken(prefix string) (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(raw), nil
+}
+
+// laneQuotas splits a tick's admissions between the lanes. With a non-zero share and more
+// than one admission per tick, each lane keeps at least one place.
+func laneQuotas(rate int, share float64) (priority, standard int) {
+	priority = int(math.Round(float64(rate) * share))
+	if share > 0 && rate > 1 {
+		priority = min(max(priority, 1), rate-1)
+	}
+	return priority, rate - priority
+}
+
+func userLane(ctx context.Context, userID int) (string, error) {
+	var priority bool
+	err := db.QueryRowContext(ctx, "SELECT priority FROM users WHERE id = ?", userID).Scan(&priority)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("failed to read priority of user %d: %w", userID, err)
+	}
+	if priority {
+		return lanePriority, nil
+	}
+	return laneStandard, nil
+}
+
+// useAdmission spends an admission token on a booking for show.
+func useAdmission(ctx context.Context, admissionToken, show string) (bool, error) {
+	admitted, err := rdb.Get(ctx, waitingRoomAdmissionKey(admissionToken)).Result()
+	if err == redis.Nil || (err == nil && admitted != show) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check admission: %w", err)
+	}
+	// One booking per admission.
+	if n, err := rdb.Del(ctx, waitingRoomAdmissionKey(admissionToken)).Result(); err != nil || n == 0 {
+		return false, fmt.Errorf("%w: admission token %s", ErrAdmissionUsed, admissionToken)
+	}
+	return true, nil
+}
+
+// enterWaitingRoom decides whether req may book now. When it has to wait, the queue token to
+// hand back is returned instead. Requests without a ShowID are placed by their first seat so
+// leaving it out doesn't skip the queue.
+func enterWaitingRoom(ctx context.Context, req BookingRequest) (string, error) {
+	if !anyWaitingRoomEnabled() {
+		return "", nil
+	}
+	showID := req.ShowID
+	if showID == 0 && len(req.SeatIDs) > 0 {
+		err := db.QueryRowContext(ctx, "SELECT show_id FROM seats WHERE id = ?", req.SeatIDs[0]).Scan(&showID)
+		if err != nil && err != sql.ErrNoRows {
+			return "", fmt.Errorf("failed to read show of seat %d: %w", req.SeatIDs[0], err)
+		}
+	}
+	if !waitingRoomEnabled(showID) {
+		return "", nil
+	}
+	show := strconv.Itoa(showID)
+
+	admissionToken := req.AdmissionToken
+	if admissionToken == "" && req.QueueToken != "" {
+		var err error
+		admissionToken, err = rdb.Get(ctx, waitingRoomAdmittedKey(req.QueueToken)).Result()
+		if err != nil && err != redis.Nil {
+			return "", fmt.Errorf("failed to check admission: %w", err)
+		}
+	}
+	if admissionToken != "" {
+		ok, err := useAdmission(ctx, admissionToken, show)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			slog.InfoContext(ctx, "Admitted booking", "component", "queue", "show_id", showID, "user_id", req.UserID, "admission_token", admissionToken)
+			return "", nil
+		}
+	}
+
+	if req.QueueToken != "" {
+		queued, err := rdb.Get(ctx, waitingRoomTokenKey(req.QueueToken)).Result()
+		if err != nil && err != redis.Nil {
+			return "", fmt.Errorf("failed to check queue token: %w", err)
+		}
+		if queuedShow, _, _ := strings.Cut(queued, ":"); queuedShow == show {
+			return req.QueueToken, nil
+		}
+		// Unknown or expired tokens join the back of the queue like a new request.
+	}
+
+	lane, err := userLane(ctx, req.UserID)
+	if err != nil {
+		return "", err
+	}
+	token, err := newWaitingRoomToken("q_")
+	if err != nil {
+		return "", fmt.Errorf("failed to generate queue token: %w", err)
+	}
+	cfg := strategyConfig.WaitingRoom
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, waitingRoomTokenKey(token), show+":"+lane, time.Duration(cfg.QueueTTL))
+		pipe.RPush(ctx, waitingRoomQueueKey(showID, lane), token)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to join waiting room: %w", err)
+	}
+	slog.InfoContext(ctx, "Queued booking", "component", "queue", "show_id", showID, "user_id", req.UserID, "lane", lane, "token", token)
+	return token, nil
+}
+
+// refreshWaitingRoomShows reloads the flagged shows.
+func refreshWaitingRoomShows() error {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM shows WHERE waiting_room")
+	if err != nil {
+		return fmt.Errorf("failed to query waiting room shows: %w", err)
+	}
+	defer rows.Close()
+
+	ids := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("failed to scan show: %w", err)
+		}
+		ids[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating waiting room shows: %w", err)
+	}
+
+	waitingRoomShows.Lock()
+	waitingRoomShows.ids = ids
+	waitingRoomShows.Unlock()
+	return nil
+}
+
+// admitFromQueue admits up to AdmitPerSecond tokens of the show, split between the lanes by
+// laneQuotas. Places a lane can't fill go to the other lane.
+func admitFromQueue(showID int, now time.Time) (int, error) {
+	cfg := strategyConfig.WaitingRoom
+	ok, err := rdb.SetNX(ctx, waitingRoomDispatchKey(showID, now.Unix()), 1, 2*waitingRoomDispatchInterval).Result()
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	priorityQuota, standardQuota := laneQuotas(cfg.AdmitPerSecond, cfg.PriorityShare)
+	priority, err := admitFromLane(showID, lanePriority, priorityQuota)
+	if err != nil {
+		return priority, err
+	}
+	standard, err := admitFromLane(showID, laneStandard, standardQuota+priorityQuota-priority)
+	if err != nil {
+		return priority + standard, err
+	}
+	if spare := standardQuota - standard; spare > 0 {
+		more, err := admitFromLane(showID, lanePriority, spare)
+		return priority + standard + more, err
+	}
+	return priority + standard, nil
+}
+
+// admitFromLane moves up to limit tokens from the front of one lane to admitted. Tokens whose
+// queue entry expired are dropped without using up a place.
+func admitFromLane(showID int, lane string, limit int) (int, error) {
+	cfg := strategyConfig.WaitingRoom
+	queueKey := waitingRoomQueueKey(showID, lane)
+	show := strconv.Itoa(showID)
+	admitted := 0
+	for admitted < limit {
+		var tokens *redis.StringSliceCmd
+		_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			tokens = pipe.LRange(ctx, queueKey, 0, int64(limit-admitted-1))
+			pipe.LTrim(ctx, queueKey, int64(limit-admitted), -1)
+			return nil
+		})
+		if err != nil {
+			return admitted, fmt.Errorf("failed to pop waiting room queue: %w", err)
+		}
+		if len(tokens.Val()) == 0 {
+			return admitted, nil
+		}
+
+		for _, token := range tokens.Val() {
+			// Admit before dropping the queue entry, so a resubmit in between never finds
+			// the token in neither state.
+			n, err := rdb.Exists(ctx, waitingRoomTokenKey(token)).Result()
+			if err != nil {
+				return admitted, fmt.Errorf("failed to check token %s: %w", token, err)
+			}
+			if n == 0 {
+				continue
+			}
+			admissionToken, err := newWaitingRoomToken("a_")
+			if err != nil {
+				return admitted, fmt.Errorf("failed to generate admission token: %w", err)
+			}
+			_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, waitingRoomAdmissionKey(admissionToken), show, time.Duration(cfg.AdmissionTTL))
+				pipe.Set(ctx, waitingRoomAdmittedKey(token), admissionToken, time.Duration(cfg.AdmissionTTL))
+				return nil
+			})
+			if err != nil {
+				return admitted, fmt.Errorf("failed to admit token %s: %w", token, err)
+			}
+			rdb.Del(ctx, waitingRoomTokenKey(token))
+			admitted++
+		}
+	}
+	return admitted, nil
+}
+
+func runWaitingRoomDispatcher() error {
+	ticker := time.NewTicker(waitingRoomDispatchInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if !isPrimaryRegion() {
+			continue
+		}
+		if err := refreshWaitingRoomShows(); err != nil {
+			slog.Error("Failed to refresh waiting room shows", "component", "queue", "error", err)
+			continue
+		}
+
+		waitingRoomShows.RLock()
+		showIDs := make([]int, 0, len(waitingRoomShows.ids))
+		for id := range waitingRoomShows.ids {
+			showIDs = append(showIDs, id)
+		}
+		waitingRoomShows.RUnlock()
+
+		for _, showID := range showIDs {
+			admitted, err := admitFromQueue(showID, now)
+			if err != nil {
+				slog.Error("Dispatch failed", "component", "queue", "show_id", showID, "error", err)
+			}
+			if admitted > 0 {
+				slog.Info("Admitted from waiting room", "component", "queue", "show_id", showID, "admitted", admitted)
+			}
+		}
+	}
+	return errors.New("ending waiting room dispatcher")
+}
+
+type QueueStatusResponse struct {
+	QueueToken           string     `json:"queue_token"`
+	ShowID               int        `json:"show_id,omitempty"`
+	Status               string     `json:"status"`
+	Lane                 string     `json:"lane,omitempty"`
+	Position             int64      `json:"position,omitempty"`
+	EstimatedAdmissionAt *time.Time `json:"estimated_admission_at,omitempty"`
+	AdmissionToken       string     `json:"admission_token,omitempty"`
+	AdmissionExpiresAt   *time.Time `json:"admission_expires_at,omitempty"`
+}
+
+// handleQueueStatus serves GET /api/queue-status?token=<queue token>. A queued token gets its
+// 1-based place in its lane and when the dispatcher should reach it at the lane's quota; the
+// estimate counts queue entries that may expire before their turn and ignores places the
+// other lane leaves over, so it errs late. An admitted token gets the admission token to book
+// with.
+func handleQueueStatus(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Queue token is required", http.StatusBadRequest)
+		return
+	}
+	resp := QueueStatusResponse{QueueToken: token}
+
+	admissionToken, err := rdb.Get(ctx, waitingRoomAdmittedKey(token)).Result()
+	if err != nil && err != redis.Nil {
+		slog.ErrorContext(r.Context(), "Failed to read admission", "component", "queue", "token", token, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		// The admission key goes away once it is used for a booking.
+		resp.Status = "USED"
+		if show, err := rdb.Get(ctx, waitingRoomAdmissionKey(admissionToken)).Result(); err == nil {
+			resp.Status = "ADMITTED"
+			resp.ShowID, _ = strconv.Atoi(show)
+			resp.AdmissionToken = admissionToken
+			if ttl, err := rdb.PTTL(ctx, waitingRoomAdmissionKey(admissionToken)).Result(); err == nil && ttl > 0 {
+				expiresAt := time.Now().Add(ttl)
+				resp.AdmissionExpiresAt = &expiresAt
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	queued, err := rdb.Get(ctx, waitingRoomTokenKey(token)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Queue token not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read queue token", "component", "queue", "token", token, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	show, lane, _ := strings.Cut(queued, ":")
+	resp.ShowID, _ = strconv.Atoi(show)
+	resp.Status = "QUEUED"
+	resp.Lane = lane
+
+	index, err := rdb.LPos(ctx, waitingRoomQueueKey(resp.ShowID, lane), token, redis.LPosArgs{}).Result()
+	if err != nil && err != redis.Nil {
+		slog.ErrorContext(r.Context(), "Failed to find queue position", "component", "queue", "token", token, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		resp.Position = index + 1
+		// The dispatcher admits a batch per tick, position n goes out in tick ceil(n/quota).
+		// A lane without a quota only gets leftovers, so there is no estimate for it.
+		priorityQuota, standardQuota := laneQuotas(strategyConfig.WaitingRoom.AdmitPerSecond, strategyConfig.WaitingRoom.PriorityShare)
+		quota := int64(standardQuota)
+		if lane == lanePriority {
+			quota = int64(priorityQuota)
+		}
+		if quota > 0 {
+			ticks := (resp.Position + quota - 1) / quota
+			estimate := time.Now().Add(time.Duration(ticks) * waitingRoomDispatchInterval)
+			resp.EstimatedAdmissionAt = &estimate
+		}
+	}
+	// Not in the list but not admitted either: the dispatcher is between popping and
+	// admitting it, the next poll will see it admitted.
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type WaitingRoomRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// handleUpdateWaitingRoom serves PUT /admin/shows/{id}/waiting-room. Turning it off lets
+// everyone still queued book straight away.
+func handleUpdateWaitingRoom(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+
+	var req WaitingRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.ExecContext(ctx, "UPDATE shows SET waiting_room = ? WHERE id = ?", req.Enabled, showID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update waiting room", "component", "admin", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+	if !req.Enabled {
+		// One key per DEL: on a cluster the two lanes can live in different slots.
+		rdb.Del(ctx, waitingRoomQueueKey(showID, laneStandard))
+		rdb.Del(ctx, waitingRoomQueueKey(showID, lanePriority))
+	}
+	if err := refreshWaitingRoomShows(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to refresh waiting room shows", "component", "admin", "error", err)
+	}
+
+	slog.InfoContext(r.Context(), "Updated waiting room", "component", "admin", "show_id", showID, "enabled", req.Enabled)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
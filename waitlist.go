@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Waitlists. Users can join the waitlist of a show with no seats on sale, sold out
+// (sold_out.go) or all held, for a number of seats with POST /api/shows/{id}/waitlist. When
+// seats of the show come back on sale, a hold the reaper lets go of, a booking abandoned or
+// refunded, the seat status relay (seat_status_relay.go) offers them before it lifts the
+// sold-out flag: the earliest WAITING entry the free seats are enough for gets a booking
+// holding them for waitlist.offer_hold, with its checkout open, and, with a callback_url, a
+// WAITLIST_OFFERED callback (booking_callbacks.go) carrying the booking and where to pay. The
+// offer is a booking like any other: paying confirms it, and when it lapses the reaper frees
+// the seats for the next entry. An entry gets one offer; GET /api/waitlist/{id} shows where it
+// stands. With a seat limit (seat_limit.go) a user can't wait for more than the limit leaves
+// them, and an entry whose offer would take them over it by then is skipped as OVER_LIMIT.
+
+const (
+	WaitlistWaiting = "WAITING"
+	WaitlistOffered = "OFFERED"
+	WaitlistLeft    = "LEFT"
+	// WaitlistCancelled entries were waiting when their show was cancelled.
+	WaitlistCancelled = "CANCELLED"
+	// WaitlistOverLimit entries came up when their seats would have taken the user over the
+	// seat limit (seat_limit.go).
+	WaitlistOverLimit = "OVER_LIMIT"
+)
+
+// WaitlistConfig tunes waitlist offers, see waitlist.go.
+type WaitlistConfig struct {
+	OfferHold   Duration `json:"offer_hold"`   // WAITLIST_OFFER_HOLD, how long an offer's seats are held
+	MaxQuantity int      `json:"max_quantity"` // WAITLIST_MAX_QUANTITY, seats one entry may wait for
+}
+
+var (
+	ErrShowNotSoldOut  = errors.New("show has seats on sale")
+	ErrAlreadyWaiting  = errors.New("user is already on the show's waitlist")
+	ErrNotOnWaitlist   = errors.New("no waiting entry for the user")
+	errNoWaitlistOffer = errors.New("no entry to offer seats to")
+)
+
+type WaitlistRequest struct {
+	UserID      int    `json:"user_id"`
+	Quantity    int    `json:"quantity"`
+	CallbackURL string `json:"callback_url"`
+}
+
+type WaitlistEntry struct {
+	ID       int64  `json:"waitlist_id"`
+	ShowID   int    `json:"show_id"`
+	UserID   int    `json:"user_id"`
+	Quantity int    `json:"quantity"`
+	Status   string `json:"status"`
+	// Position counts the entries waiting ahead, from 1, while WAITING.
+	Position       int          `json:"position,omitempty"`
+	BookingID      string       `json:"booking_id,omitempty"`
+	BookingState   BookingState `json:"booking_state,omitempty"`
+	OfferExpiresAt *time.Time   `json:"offer_expires_at,omitempty"`
+	CreatedAt      time.Time    `json:"created_at"`
+}
+
+// offerWaitlistSeats offers the show's free seats to its waitlist until they run out or no
+// entry fits.
+func offerWaitlistSeats(showID int) error {
+	// Most shows have nobody waiting; don't lock their free seats to find out.
+	var waiting bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM waitlist_entries WHERE show_id = ? AND status = ?)
+	`, showID, WaitlistWaiting).Scan(&waiting)
+	if err != nil {
+		return fmt.Errorf("failed to check waitlist of show %d: %w", showID, err)
+	}
+	if !waiting {
+		return nil
+	}
+	for {
+		err := offerNextWaitlistEntry(showID)
+		if errors.Is(err, errNoWaitlistOffer) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// offerNextWaitlistEntry holds free seats of the show for the first waiting entry they are
+// enough for.
+func offerNextWaitlistEntry(showID int) error {
+	offerCtx := withSeatAudit(ctx, SeatAuditWaitlist)
+	var entryID int64
+	var userID int
+	var callbackURL sql.NullString
+	var seatIDs []int
+	var expiresAt time.Time
+	var bookingID string
+	err := runInTx(offerCtx, db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(offerCtx, `
+			SELECT id FROM seats
+			WHERE show_id = ?
+			AND (is_reserved = 0 OR (is_reserved = 1 AND payment_status = 'FAILED'))
+			ORDER BY id
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		`, showID, strategyConfig.Waitlist.MaxQuantity)
+		if err != nil {
+			return fmt.Errorf("failed to select free seats: %w", err)
+		}
+		defer rows.Close()
+		seatIDs = nil
+		for rows.Next() {
+			var seatID int
+			if err := rows.Scan(&seatID); err != nil {
+				return fmt.Errorf("failed to scan seat: %w", err)
+			}
+			seatIDs = append(seatIDs, seatID)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating free seats: %w", err)
+		}
+		if len(seatIDs) == 0 {
+			return errNoWaitlistOffer
+		}
+
+		var quantity int
+		err = tx.QueryRowContext(offerCtx, `
+			SELECT id, user_id, quantity, callback_url FROM waitlist_entries
+			WHERE show_id = ? AND status = ? AND quantity <= ?
+			ORDER BY id
+			LIMIT 1
+			FOR UPDATE
+		`, showID, WaitlistWaiting, len(seatIDs)).Scan(&entryID, &userID, &quantity, &callbackURL)
+		if err == sql.ErrNoRows {
+			return errNoWaitlistOffer
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load waitlist entry: %w", err)
+		}
+		seatIDs = seatIDs[:quantity]
+
+		bookingID = fmt.Sprintf("book_%d_%d", userID, time.Now().UnixNano())
+		expiresAt = time.Now().Add(time.Duration(strategyConfig.Waitlist.OfferHold))
+		_, err = tx.ExecContext(offerCtx, fmt.Sprintf(`
+			UPDATE seats
+			SET is_reserved = 1,
+			    payment_status = 'PENDING',
+			    user_id = ?,
+			    payment_session_id = ?,
+			    payment_timeout = ?
+			WHERE id IN (%s)`, generatePlaceholders(len(seatIDs))),
+			append([]interface{}{userID, bookingID, expiresAt}, sliceToInterface(seatIDs)...)...)
+		if err != nil {
+			return fmt.Errorf("failed to hold seats: %w", err)
+		}
+		holdCtx := withBookingCallback(offerCtx, callbackURL.String)
+		if err := recordBookingHold(holdCtx, tx, bookingID, userID, seatIDs, mockPaymentRedirectURL(bookingID)); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(offerCtx, `
+			UPDATE waitlist_entries SET status = ?, booking_id = ?, offer_expires_at = ? WHERE id = ?
+		`, WaitlistOffered, bookingID, expiresAt, entryID)
+		if err != nil {
+			return fmt.Errorf("failed to record offer: %w", err)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrSeatLimitExceeded) {
+		// The user bought elsewhere since joining; skip the entry rather than retry it forever.
+		_, err = db.ExecContext(offerCtx, `
+			UPDATE waitlist_entries SET status = ? WHERE id = ? AND status = ?
+		`, WaitlistOverLimit, entryID, WaitlistWaiting)
+		if err != nil {
+			return fmt.Errorf("failed to skip waitlist entry %d: %w", entryID, err)
+		}
+		slog.Info("Skipped waitlist entry over the seat limit", "component", "waitlist", "show_id", showID, "waitlist_id", entryID, "user_id", userID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	session, err := attachPaymentSession(offerCtx, bookingID)
+	if err != nil {
+		// Put the entry back first, so the seats released go to it again.
+		_, resetErr := db.ExecContext(offerCtx, `
+			UPDATE waitlist_entries SET status = ?, booking_id = NULL, offer_expires_at = NULL WHERE id = ?
+		`, WaitlistWaiting, entryID)
+		if resetErr != nil {
+			slog.Error("Failed to put waitlist entry back", "component", "waitlist", "waitlist_id", entryID, "error", resetErr)
+		}
+		if _, releaseErr := releaseBookingHold(offerCtx, bookingID, userID); releaseErr != nil {
+			slog.Error("Failed to release offer", "component", "waitlist", "booking_id", bookingID, "error", releaseErr)
+		}
+		return fmt.Errorf("failed to open checkout for waitlist entry %d: %w", entryID, err)
+	}
+
+	if callbackURL.Valid {
+		err := insertBookingCallback(offerCtx, db, callbackURL.String, BookingCallback{
+			BookingID:   bookingID,
+			Status:      "WAITLIST_OFFERED",
+			State:       BookingHeld,
+			Reason:      "seats offered from the waitlist",
+			WaitlistID:  entryID,
+			SeatIDs:     seatIDs,
+			RedirectURL: session.RedirectURL,
+			ExpiresAt:   &expiresAt,
+			OccurredAt:  time.Now().UTC(),
+		})
+		if err != nil {
+			// The offer stands, the entry's status shows it.
+			slog.Error("Failed to queue waitlist offer callback", "component", "waitlist", "waitlist_id", entryID, "error", err)
+		}
+	}
+	slog.Info("Offered seats from waitlist", "component", "waitlist", "show_id", showID, "waitlist_id", entryID, "user_id", userID, "booking_id", bookingID, "seat_ids", seatIDs, "expires_at", expiresAt)
+	return nil
+}
+
+// loadWaitlistEntry reads the entry with its position and its offer's booking state.
+func loadWaitlistEntry(ctx context.Context, entryID int64) (WaitlistEntry, error) {
+	var entry WaitlistEntry
+	var bookingID sql.NullString
+	var expiresAt sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		SELECT id, show_id, user_id, quantity, status, booking_id, offer_expires_at, created_at
+		FROM waitlist_entries WHERE id = ?
+	`, entryID).Scan(&entry.ID, &entry.ShowID, &entry.UserID, &entry.Quantity, &entry.Status, &bookingID, &expiresAt, &entry.CreatedAt)
+	if err != nil {
+		return entry, err
+	}
+	if expiresAt.Valid {
+		entry.OfferExpiresAt = &expiresAt.Time
+	}
+	switch {
+	case entry.Status == WaitlistWaiting:
+		err = db.QueryRowContext(ctx, `
+			SELECT COUNT(*) FROM waitlist_entries WHERE show_id = ? AND status = ? AND id <= ?
+		`, entry.ShowID, WaitlistWaiting, entry.ID).Scan(&entry.Position)
+		if err != nil {
+			return entry, fmt.Errorf("failed to count waitlist position: %w", err)
+		}
+	case bookingID.Valid:
+		entry.BookingID = bookingID.String
+		if entry.BookingState, err = bookingState(ctx, db, bookingID.String); err != nil {
+			return entry, err
+		}
+	}
+	return entry, nil
+}
+
+// handleJoinWaitlist serves POST /api/shows/{id}/waitlist.
+func handleJoinWaitlist(w http.ResponseWriter, r *http.Request) {
+	showID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid show ID", http.StatusBadRequest)
+		return
+	}
+	var req WaitlistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID <= 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Quantity <= 0 || req.Quantity > strategyConfig.Waitlist.MaxQuantity {
+		http.Error(w, fmt.Sprintf("quantity must be between 1 and %d", strategyConfig.Waitlist.MaxQuantity), http.StatusBadRequest)
+		return
+	}
+	if err := checkCallbackURL(req.CallbackURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if showCancelled(r.Context(), showID) {
+		writeShowCancelled(w, r)
+		return
+	}
+	availability, err := showAvailability(r.Context(), showID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load availability", "component", "waitlist", "show_id", showID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if availability.Total == 0 {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+	if availability.Available > 0 {
+		http.Error(w, ErrShowNotSoldOut.Error(), http.StatusConflict)
+		return
+	}
+
+	var entryID int
+	err = seedInTx(r.Context(), db, func(tx *sql.Tx) error {
+		// The show's row serializes joins, so a user can't be waiting twice.
+		var id int
+		if err := tx.QueryRowContext(r.Context(), `SELECT id FROM shows WHERE id = ? FOR UPDATE`, showID).Scan(&id); err != nil {
+			return err
+		}
+		var waiting bool
+		err := tx.QueryRowContext(r.Context(), `
+			SELECT EXISTS (SELECT 1 FROM waitlist_entries WHERE show_id = ? AND user_id = ? AND status = ?)
+		`, showID, req.UserID, WaitlistWaiting).Scan(&waiting)
+		if err != nil {
+			return fmt.Errorf("failed to check waitlist: %w", err)
+		}
+		if waiting {
+			return ErrAlreadyWaiting
+		}
+		if limit := seatLimit(); limit > 0 {
+			held, err := userShowSeats(r.Context(), tx, req.UserID, showID)
+			if err != nil {
+				return err
+			}
+			if held+req.Quantity > limit {
+				return fmt.Errorf("%w: user %d holds %d seats of show %d, the limit is %d", ErrSeatLimitExceeded, req.UserID, held, showID, limit)
+			}
+		}
+		entryID, err = insertReturningID(r.Context(), tx, `
+			INSERT INTO waitlist_entries (show_id, user_id, quantity, status, callback_url) VALUES (?, ?, ?, ?, ?)
+		`, showID, req.UserID, req.Quantity, WaitlistWaiting, nullString(req.CallbackURL))
+		return err
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrAlreadyWaiting), errors.Is(err, ErrSeatLimitExceeded):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Failed to join waitlist", "component", "waitlist", "show_id", showID, "user_id", req.UserID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	entry, err := loadWaitlistEntry(r.Context(), int64(entryID))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load waitlist entry", "component", "waitlist", "waitlist_id", entryID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Joined waitlist", "component", "waitlist", "show_id", showID, "user_id", req.UserID, "waitlist_id", entryID, "quantity", req.Quantity, "position", entry.Position)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// handleWaitlistEntry serves GET /api/waitlist/{id}.
+func handleWaitlistEntry(w http.ResponseWriter, r *http.Request) {
+	entryID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid waitlist ID", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := loadWaitlistEntry(r.Context(), entryID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Waitlist entry not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load waitlist entry", "component", "waitlist", "waitlist_id", entryID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// handleLeaveWaitlist serves POST /api/waitlist/{id}/leave. Like abandoning a booking, the
+// caller names the entry's user. An entry already offered seats keeps its booking, which is
+// abandoned like any other.
+func handleLeaveWaitlist(w http.ResponseWriter, r *http.Request) {
+	entryID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid waitlist ID", http.StatusBadRequest)
+		return
+	}
+	var req AbandonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `
+		UPDATE waitlist_entries SET status = ? WHERE id = ? AND user_id = ? AND status = ?
+	`, WaitlistLeft, entryID, req.UserID, WaitlistWaiting)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to leave waitlist", "component", "waitlist", "waitlist_id", entryID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, ErrNotOnWaitlist.Error(), http.StatusNotFound)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Left waitlist", "component", "waitlist", "waitlist_id", entryID, "user_id", req.UserID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"waitlist_id": entryID, "status": WaitlistLeft})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Webhook idempotency. Every processed delivery is recorded as (session_id, status, event_id)
+// in the same transaction as its seat updates, so a gateway retry of a delivery we already
+// applied is answered 200 without touching the seats, and a delivery that failed half way
+// leaves no record and is applied when retried. Deliveries without an event_id are keyed on
+// session and status alone.
+
+// recordWebhookEvent claims the delivery for this transaction. It reports true when the
+// delivery was already processed. A concurrent duplicate blocks on the unique key until the
+// first one commits or rolls back.
+func recordWebhookEvent(ctx context.Context, tx *sql.Tx, sessionID, status, eventID string) (bool, error) {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_webhook_events (session_id, status, event_id)
+		VALUES (?, ?, ?)
+	`, sessionID, status, eventID)
+	if isDuplicateKey(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to record webhook event: %w", err)
+	}
+	return false, nil
+}
+
+// sessionSettled reports whether an earlier delivery for the session was processed, meaning
+// a later one that finds no PENDING seats is stale rather than unknown.
+func sessionSettled(ctx context.Context, tx *sql.Tx, sessionID string) (bool, error) {
+	var events int
+	err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM payment_webhook_events WHERE session_id = ?
+	`, sessionID).Scan(&events)
+	if err != nil {
+		return false, fmt.Errorf("failed to count webhook events: %w", err)
+	}
+	// The current delivery is already recorded.
+	return events > 1, nil
+}
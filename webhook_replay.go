@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Developer tool for exercising webhook edge cases without the real gateway. It signs its
+// payloads with the real webhook secret, so it can settle any booking: it is only registered
+// with server.dev_endpoints on and APP_ENV not "production", needs the admin token, and
+// refuses to run unless payments go to the mock gateway, where nobody is charged.
+
+type ReplayStep struct {
+	Status  string `json:"status"`
+	DelayMs int    `json:"delay_ms"`
+	// What the gateway says was paid; defaults to the amount the checkout was opened for.
+	AmountCents *int64 `json:"amount_cents,omitempty"`
+	Currency    string `json:"currency,omitempty"`
+}
+
+type ReplayRequest struct {
+	BookingID string       `json:"booking_id"`
+	Scenario  string       `json:"scenario"`
+	Steps     []ReplayStep `json:"steps"` // used when scenario is "custom"
+}
+
+type ReplayStepResult struct {
+	Step       int    `json:"step"`
+	Status     string `json:"status"`
+	SentAt     string `json:"sent_at"`
+	HTTPStatus int    `json:"http_status"`
+	Body       string `json:"body"`
+}
+
+// replayScenarios are the gateway delivery patterns we have seen in practice.
+var replayScenarios = map[string][]ReplayStep{
+	"success": {{Status: "COMPLETED"}},
+	"failure": {{Status: "FAILED"}},
+	// Gateway retries a delivery it thinks timed out.
+	"duplicate": {{Status: "COMPLETED"}, {Status: "COMPLETED", DelayMs: 500}},
+	// A failed first attempt is delivered after the successful retry; the webhook refuses
+	// to move the session out of COMPLETED.
+	"out_of_order": {{Status: "COMPLETED"}, {Status: "FAILED", DelayMs: 200}},
+	// Delivered after the 1 minute hold has been reclaimed.
+	"late_delivery": {{Status: "COMPLETED", DelayMs: 65000}},
+}
+
+func isProduction() bool {
+	return strings.EqualFold(os.Getenv("APP_ENV"), "production")
+}
+
+// handleWebhookReplay serves POST /dev/webhook-replay. Steps run synchronously, so a
+// late_delivery replay holds the request open for over a minute.
+func handleWebhookReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if paymentProvider.Name() != "mock" {
+		http.Error(w, "Webhook replay needs PAYMENT_PROVIDER=mock", http.StatusForbidden)
+		return
+	}
+
+	var req ReplayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.BookingID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	steps := req.Steps
+	if req.Scenario != "custom" {
+		var ok bool
+		steps, ok = replayScenarios[req.Scenario]
+		if !ok {
+			http.Error(w, "Unknown scenario", http.StatusBadRequest)
+			return
+		}
+	}
+
+	slog.InfoContext(r.Context(), "Replaying webhook scenario", "component", "replay", "booking_id", req.BookingID, "scenario", req.Scenario, "steps", len(steps))
+
+	results := make([]ReplayStepResult, 0, len(steps))
+	for i, step := range steps {
+		select {
+		case <-r.Context().Done():
+			slog.InfoContext(r.Context(), "Client went away", "component", "replay", "booking_id", req.BookingID, "step", i)
+			return
+		case <-time.After(time.Duration(step.DelayMs) * time.Millisecond):
+		}
+
+		results = append(results, replayWebhookStep(i, req.BookingID, step))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(results)
+}
+
+// replayWebhookStep pushes one payload through the real webhook handler in-process, signed
+// like the gateway would sign it.
+func replayWebhookStep(i int, bookingID string, step ReplayStep) ReplayStepResult {
+	if step.AmountCents == nil {
+		checkout, err := loadBookingCheckout(ctx, db, bookingID)
+		if err != nil {
+			slog.Error("Failed to look up checkout amount", "component", "replay", "booking_id", bookingID, "error", err)
+		}
+		if checkout.AmountCents.Valid {
+			step.AmountCents = &checkout.AmountCents.Int64
+		}
+		if step.Currency == "" {
+			step.Currency = checkout.Currency.String
+		}
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"session_id":   bookingID,
+		"status":       step.Status,
+		"amount_cents": step.AmountCents,
+		"currency":     step.Currency,
+	})
+
+	webhookReq := httptest.NewRequest(http.MethodPost, "/webhook/payment", bytes.NewReader(payload))
+	webhookReq.RemoteAddr = "replay"
+	sentAt := time.Now()
+	if secret := os.Getenv("PAYMENT_WEBHOOK_SECRET"); secret != "" {
+		timestamp := strconv.FormatInt(sentAt.Unix(), 10)
+		webhookReq.Header.Set(webhookTimestampHeader, timestamp)
+		webhookReq.Header.Set(webhookSignatureHeader, signWebhookPayload(secret, timestamp, payload))
+	}
+	recorder := httptest.NewRecorder()
+	requireWebhookSignature(handlePaymentWebhook)(recorder, webhookReq)
+
+	slog.Info("Step delivered", "component", "replay", "booking_id", bookingID, "step", i, "status", step.Status, "response", recorder.Code)
+	return ReplayStepResult{
+		Step:       i,
+		Status:     step.Status,
+		SentAt:     sentAt.Format(time.RFC3339Nano),
+		HTTPStatus: recorder.Code,
+		Body:       strings.TrimSpace(recorder.Body.String()),
+	}
+}
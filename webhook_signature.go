@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Payment webhook signatures. The gateway signs every delivery with the secret in
+// PAYMENT_WEBHOOK_SECRET: X-Webhook-Timestamp carries the unix time it was sent and
+// X-Webhook-Signature is "sha256=" followed by the hex HMAC-SHA256 of "<timestamp>.<body>".
+// Deliveries that are unsigned, signed with another secret or older than
+// PAYMENT_WEBHOOK_TOLERANCE_SECONDS (default 300) in either direction are rejected, so a
+// captured delivery can't be replayed later. Without a secret the check is skipped outside
+// production and every delivery is refused in production.
+
+const (
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+	maxWebhookBodyBytes    = 1 << 20
+)
+
+func webhookTolerance() time.Duration {
+	if secs, err := strconv.Atoi(os.Getenv("PAYMENT_WEBHOOK_TOLERANCE_SECONDS")); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+// signWebhookPayload returns the X-Webhook-Signature value for body sent at timestamp.
+func signWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// requireWebhookSignature verifies the delivery before handing it, body intact, to next.
+func requireWebhookSignature(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+		if secret == "" {
+			if isProduction() {
+				slog.WarnContext(r.Context(), "Rejected delivery, PAYMENT_WEBHOOK_SECRET is not set", "component", "webhook", "ip", r.RemoteAddr)
+				http.Error(w, "Webhook signing not configured", http.StatusServiceUnavailable)
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBodyBytes))
+		if err != nil {
+			http.Error(w, "Invalid payload", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		timestamp := r.Header.Get(webhookTimestampHeader)
+		signature := r.Header.Get(webhookSignatureHeader)
+		if timestamp == "" || !strings.HasPrefix(signature, "sha256=") {
+			slog.WarnContext(r.Context(), "Rejected unsigned delivery", "component", "webhook", "ip", r.RemoteAddr)
+			http.Error(w, "Missing signature", http.StatusUnauthorized)
+			return
+		}
+
+		sentAt, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid timestamp", http.StatusUnauthorized)
+			return
+		}
+		if age := time.Since(time.Unix(sentAt, 0)); age > webhookTolerance() || age < -webhookTolerance() {
+			slog.WarnContext(r.Context(), "Rejected stale delivery", "component", "webhook", "ip", r.RemoteAddr, "age", age.Round(time.Second))
+			http.Error(w, "Stale timestamp", http.StatusUnauthorized)
+			return
+		}
+
+		expected := signWebhookPayload(secret, timestamp, body)
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			slog.WarnContext(r.Context(), "Rejected delivery with bad signature", "component", "webhook", "ip", r.RemoteAddr)
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}